@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -10,7 +11,10 @@ import (
 	"github.com/ncolesummers/mindgateway/internal/auth"
 	"github.com/ncolesummers/mindgateway/internal/shared/config"
 	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	"github.com/redis/go-redis/v9"
 	"google.golang.org/grpc"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
 )
 
 func main() {
@@ -23,11 +27,35 @@ func main() {
 	// Initialize logger
 	logger := logging.NewLogger(cfg.LogLevel)
 
-	// Create service
-	svc, err := auth.NewService(
+	// Connect to the database API keys are stored in
+	opts := []auth.Option{
 		auth.WithConfig(cfg),
 		auth.WithLogger(logger),
-	)
+	}
+	if cfg.Auth.APIKeys {
+		dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+			cfg.Database.Host, cfg.Database.Port, cfg.Database.Username,
+			cfg.Database.Password, cfg.Database.Name, cfg.Database.SSLMode)
+		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err != nil {
+			logger.Fatalf("Failed to connect to database: %v", err)
+		}
+		opts = append(opts, auth.WithDatabase(db))
+	}
+
+	// Connect to Redis when revocations are announced to gateway replicas
+	if cfg.Auth.Revocations.Backend == "redis" {
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		defer redisClient.Close()
+		opts = append(opts, auth.WithRedis(redisClient))
+	}
+
+	// Create service
+	svc, err := auth.NewService(opts...)
 	if err != nil {
 		logger.Fatalf("Failed to create auth service: %v", err)
 	}
@@ -2,14 +2,28 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/batch"
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/gateway/queue"
+	"github.com/ncolesummers/mindgateway/internal/gateway/registry"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
 	"github.com/ncolesummers/mindgateway/internal/gateway/server"
+	"github.com/ncolesummers/mindgateway/internal/gateway/shadow"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
 	"github.com/ncolesummers/mindgateway/internal/shared/config"
 	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	"github.com/ncolesummers/mindgateway/internal/shared/revocation"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
@@ -22,14 +36,143 @@ func main() {
 	// Initialize logger
 	logger := logging.NewLogger(cfg.LogLevel)
 
+	// Connect to the worker registry
+	registryConn, err := grpc.Dial(cfg.Registry.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		logger.Fatalf("Failed to connect to worker registry: %v", err)
+	}
+	defer registryConn.Close()
+	registryClient := registry.NewClient(registryConn, cfg.Registry.RefreshInterval)
+
+	// Create routing engine
+	router, err := routing.New(
+		routing.WithConfig(cfg),
+		routing.WithLogger(logger),
+		routing.WithWorkerSource(registryClient),
+	)
+	if err != nil {
+		logger.Fatalf("Failed to create routing engine: %v", err)
+	}
+
+	// Connect to Redis when the queue or jobs are shared between replicas,
+	// or revocations are announced through it
+	revocations := cfg.Auth.Enabled && cfg.Auth.Revocations.Backend == "redis"
+	var redisClient *redis.Client
+	if cfg.Queue.Backend == "redis" || cfg.Jobs.Backend == "redis" || revocations {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		defer redisClient.Close()
+	}
+
+	// Create request queue, shared between replicas through Redis when
+	// configured
+	queueOpts := []queue.Option{
+		queue.WithConfig(cfg),
+		queue.WithLogger(logger),
+		queue.WithRouter(router),
+	}
+	if cfg.Queue.Backend == "redis" {
+		store, err := queue.NewRedisStore(redisClient, cfg)
+		if err != nil {
+			logger.Fatalf("Failed to create shared request queue: %v", err)
+		}
+		queueOpts = append(queueOpts, queue.WithStore(store))
+	}
+	queueManager, err := queue.New(queueOpts...)
+	if err != nil {
+		logger.Fatalf("Failed to create request queue: %v", err)
+	}
+	queueManager.Start()
+
+	// Create shadow traffic mirror
+	mirror, err := shadow.New(
+		shadow.WithConfig(cfg),
+		shadow.WithLogger(logger),
+	)
+	if err != nil {
+		logger.Fatalf("Failed to create shadow mirror: %v", err)
+	}
+
 	// Create server with modular components
-	srv, err := server.New(
+	serverOpts := []server.Option{
 		server.WithConfig(cfg),
 		server.WithLogger(logger),
-	)
+		server.WithRegistryClient(registryClient),
+		server.WithRoutingEngine(router),
+		server.WithWorkerClient(worker.NewClient(cfg.Worker.RequestTimeout)),
+		server.WithQueueManager(queueManager),
+		server.WithShadowMirror(mirror),
+	}
+
+	// Connect to the auth service when callers must authenticate, caching
+	// what it answers until the credentials are revoked
+	subCtx, stopSubscriptions := context.WithCancel(context.Background())
+	defer stopSubscriptions()
+	if cfg.Auth.Enabled {
+		authConn, err := grpc.Dial(cfg.Auth.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			logger.Fatalf("Failed to connect to auth service: %v", err)
+		}
+		defer authConn.Close()
+		var authClient server.AuthClient = auth.NewClient(authConn, auth.WithServiceToken(cfg.Auth.ServiceToken))
+		if cfg.Auth.Cache.Enabled {
+			cache := auth.NewCache(authClient, cfg)
+			if revocations {
+				go revocation.Subscribe(subCtx, redisClient, cfg.Auth.Revocations.Channel, cache.Revoke, cache.Flush)
+			}
+			authClient = cache
+		}
+		serverOpts = append(serverOpts, server.WithAuthClient(authClient))
+	}
+
+	// Create the embedding batcher
+	if cfg.Batching.Enabled {
+		batcher, err := batch.New(
+			batch.WithConfig(cfg),
+			batch.WithLogger(logger),
+		)
+		if err != nil {
+			logger.Fatalf("Failed to create embedding batcher: %v", err)
+		}
+		serverOpts = append(serverOpts, server.WithEmbeddingBatcher(batcher))
+	}
+
+	// Create the job manager, which serves jobs through the server's own
+	// routes once the server exists
+	var srv *server.Server
+	var jobManager *jobs.Manager
+	if cfg.Jobs.Enabled {
+		jobOpts := []jobs.Option{
+			jobs.WithConfig(cfg),
+			jobs.WithLogger(logger),
+			jobs.WithHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				srv.ServeHTTP(w, r)
+			})),
+		}
+		if cfg.Jobs.Backend == "redis" {
+			store, err := jobs.NewRedisStore(redisClient, cfg)
+			if err != nil {
+				logger.Fatalf("Failed to create shared job store: %v", err)
+			}
+			jobOpts = append(jobOpts, jobs.WithStore(store))
+		}
+		jobManager, err = jobs.New(jobOpts...)
+		if err != nil {
+			logger.Fatalf("Failed to create job manager: %v", err)
+		}
+		serverOpts = append(serverOpts, server.WithJobManager(jobManager))
+	}
+
+	srv, err = server.New(serverOpts...)
 	if err != nil {
 		logger.Fatalf("Failed to create server: %v", err)
 	}
+	if jobManager != nil {
+		jobManager.Start()
+	}
 
 	// Start server
 	go func() {
@@ -52,6 +195,17 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Errorf("Server forced to shutdown: %v", err)
 	}
+	if jobManager != nil {
+		if err := jobManager.Stop(ctx); err != nil {
+			logger.Errorf("Failed to stop job manager: %v", err)
+		}
+	}
+	if err := queueManager.Stop(ctx); err != nil {
+		logger.Errorf("Failed to stop request queue: %v", err)
+	}
+	if err := mirror.Close(ctx); err != nil {
+		logger.Errorf("Failed to flush shadow requests: %v", err)
+	}
 	
 	logger.Info("Server exited")
 }
\ No newline at end of file
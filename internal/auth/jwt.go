@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Token validation errors
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token has expired")
+	ErrTokenRevoked = errors.New("token has been revoked")
+)
+
+// Claims are the claims of a token signed by the auth service
+type Claims struct {
+	Issuer    string            `json:"iss,omitempty"`
+	Subject   string            `json:"sub"`
+	ID        string            `json:"jti,omitempty"`
+	IssuedAt  int64             `json:"iat,omitempty"`
+	NotBefore int64             `json:"nbf,omitempty"`
+	ExpiresAt int64             `json:"exp,omitempty"`
+	Roles     []string          `json:"roles,omitempty"`
+	Extra     map[string]string `json:"claims,omitempty"`
+}
+
+// header is the JOSE header of a token
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// rawToken is a compact serialized token split into its parts
+type rawToken struct {
+	header    header
+	payload   []byte
+	signed    string
+	signature []byte
+}
+
+var encoding = base64.RawURLEncoding
+
+// splitToken decodes the parts of a compact serialized token without
+// verifying it
+func splitToken(token string) (*rawToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts, got %d", ErrInvalidToken, len(parts))
+	}
+
+	raw := &rawToken{signed: parts[0] + "." + parts[1]}
+	h, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(h, &raw.header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+	if raw.payload, err = encoding.DecodeString(parts[1]); err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+	if raw.signature, err = encoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+	return raw, nil
+}
+
+// signer signs and verifies HS256 tokens with the auth service's secret
+type signer struct {
+	key    []byte
+	issuer string
+	now    func() time.Time
+}
+
+// sign returns the compact serialization of a token carrying claims
+func (s *signer) sign(claims *Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	return signed + "." + encoding.EncodeToString(s.mac(signed)), nil
+}
+
+// parse verifies a token's signature and issuer and returns its claims,
+// leaving the time checks to the caller
+func (s *signer) parse(token string) (*Claims, error) {
+	raw, err := splitToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if raw.header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unexpected signing algorithm %q", ErrInvalidToken, raw.header.Alg)
+	}
+	if !hmac.Equal(raw.signature, s.mac(raw.signed)) {
+		return nil, fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(raw.payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	if claims.Issuer != s.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	return &claims, nil
+}
+
+// verify parses a token and checks that it is valid now
+func (s *signer) verify(token string) (*Claims, error) {
+	claims, err := s.parse(token)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+func (s *signer) mac(signed string) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(signed))
+	return m.Sum(nil)
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Auth metrics
+var (
+	validationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_auth_validations_total",
+			Help: "Total number of token validations by result",
+		},
+		[]string{"result"},
+	)
+
+	tokensIssued = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mindgateway_auth_tokens_issued_total",
+			Help: "Total number of tokens issued",
+		},
+	)
+
+	keysIssued = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mindgateway_auth_api_keys_issued_total",
+			Help: "Total number of API keys issued",
+		},
+	)
+
+	permissionChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_auth_permission_checks_total",
+			Help: "Total number of permission checks by decision",
+		},
+		[]string{"decision"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(validationsTotal, tokensIssued, keysIssued, permissionChecks)
+}
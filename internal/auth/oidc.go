@@ -0,0 +1,465 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// maxKeyRefetch bounds how often a token signed with an unknown key makes an
+// issuer's keys be fetched again, which is how rotated keys are picked up
+const maxKeyRefetch = 5 * time.Second
+
+// oidcTimeout bounds the discovery and JWKS requests to an issuer
+const oidcTimeout = 10 * time.Second
+
+// oidcIssuer validates the tokens of an external OpenID Connect provider. It
+// discovers the provider's signing keys and caches them.
+type oidcIssuer struct {
+	cfg      config.OIDCIssuer
+	client   *http.Client
+	skew     time.Duration
+	refresh  time.Duration
+	lifetime time.Duration
+	now      func() time.Time
+
+	// roles lists the roles granted to each group
+	roles map[string][]string
+
+	mu          sync.Mutex
+	jwksURI     string
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// fetching is closed when the fetch in progress ends, and is nil when
+	// none is. fetchErr is why the last fetch failed, if it did.
+	fetching chan struct{}
+	fetchErr error
+}
+
+// newOIDCIssuers creates the validators of the configured issuers, keyed by
+// issuer
+func newOIDCIssuers(cfg *config.Config, client *http.Client, now func() time.Time) (map[string]*oidcIssuer, error) {
+	oc := cfg.Auth.OIDC
+	issuers := make(map[string]*oidcIssuer, len(oc.Issuers))
+	if len(oc.Issuers) > 0 && (oc.JWKSRefresh <= 0 || oc.MaxTokenTTL <= 0 || oc.ClockSkew < 0) {
+		return nil, fmt.Errorf("OIDC requires a positive JWKS refresh interval and maximum token TTL, and a clock skew of at least zero")
+	}
+	for _, ic := range oc.Issuers {
+		if ic.Issuer == "" {
+			return nil, fmt.Errorf("OIDC issuer requires an issuer URL")
+		}
+		if ic.Issuer == cfg.Auth.Issuer {
+			return nil, fmt.Errorf("OIDC issuer %q is the auth service's own issuer", ic.Issuer)
+		}
+		if _, ok := issuers[ic.Issuer]; ok {
+			return nil, fmt.Errorf("duplicate OIDC issuer %q", ic.Issuer)
+		}
+		if len(ic.Audiences) == 0 {
+			return nil, fmt.Errorf("OIDC issuer %q requires an audience", ic.Issuer)
+		}
+		if ic.UserClaim == "" {
+			ic.UserClaim = "sub"
+		}
+		if ic.GroupsClaim == "" {
+			ic.GroupsClaim = "groups"
+		}
+
+		i := &oidcIssuer{
+			cfg:      ic,
+			client:   client,
+			skew:     oc.ClockSkew,
+			refresh:  oc.JWKSRefresh,
+			lifetime: oc.MaxTokenTTL,
+			now:      now,
+			roles:    make(map[string][]string, len(ic.GroupRoles)),
+		}
+		for _, gr := range ic.GroupRoles {
+			i.roles[gr.Group] = append(i.roles[gr.Group], gr.Roles...)
+		}
+		issuers[ic.Issuer] = i
+	}
+	return issuers, nil
+}
+
+// oidcIdentity is the caller a provider's token identifies
+type oidcIdentity struct {
+	userID  string
+	tenant  string
+	issued  time.Time
+	expires time.Time
+	roles   []string
+	groups  []string
+	claims  map[string]string
+}
+
+// verify checks a token's signature, issuer, audience and lifetime and maps
+// its groups to roles
+func (i *oidcIssuer) verify(ctx context.Context, raw *rawToken) (*oidcIdentity, error) {
+	key, err := i.key(ctx, raw.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(raw.header.Alg, key, raw.signed, raw.signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(raw.payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	if iss, _ := claims["iss"].(string); iss != i.cfg.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+	if !i.audienceAllowed(claims["aud"]) {
+		return nil, fmt.Errorf("%w: token is not meant for this service", ErrInvalidToken)
+	}
+
+	now := i.now()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing expiry", ErrInvalidToken)
+	}
+	if !now.Before(exp.Add(i.skew)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(i.skew).Before(nbf) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	// The issue time bounds a token's lifetime, and so how long revocations
+	// must be kept to cover it
+	issued, ok := numericClaim(claims, "iat")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing issue time", ErrInvalidToken)
+	}
+	if exp.Sub(issued) > i.lifetime {
+		return nil, fmt.Errorf("%w: token lifetime exceeds %s", ErrInvalidToken, i.lifetime)
+	}
+
+	user, _ := claims[i.cfg.UserClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("%w: missing %s claim", ErrInvalidToken, i.cfg.UserClaim)
+	}
+
+	id := &oidcIdentity{userID: user, issued: issued, expires: exp, claims: make(map[string]string)}
+	for name, value := range claims {
+		if s, ok := value.(string); ok {
+			id.claims[name] = s
+		}
+	}
+	if i.cfg.TenantClaim != "" {
+		id.tenant, _ = claims[i.cfg.TenantClaim].(string)
+	}
+	id.groups = stringList(claims[i.cfg.GroupsClaim])
+	id.roles = i.rolesOf(id.groups)
+	return id, nil
+}
+
+// audienceAllowed reports whether a token's audience, a string or a list,
+// names one of the issuer's audiences
+func (i *oidcIssuer) audienceAllowed(aud interface{}) bool {
+	var auds []string
+	switch v := aud.(type) {
+	case string:
+		auds = []string{v}
+	case []interface{}:
+		auds = stringList(v)
+	}
+	for _, a := range auds {
+		for _, allowed := range i.cfg.Audiences {
+			if a == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rolesOf returns the default roles and those mapped from a caller's groups,
+// without duplicates
+func (i *oidcIssuer) rolesOf(groups []string) []string {
+	seen := make(map[string]bool)
+	var roles []string
+	add := func(rs []string) {
+		for _, r := range rs {
+			if !seen[r] {
+				seen[r] = true
+				roles = append(roles, r)
+			}
+		}
+	}
+
+	add(i.cfg.DefaultRoles)
+	for _, g := range groups {
+		add(i.roles[g])
+	}
+	return roles
+}
+
+// stringList returns the strings of a list claim
+func stringList(claim interface{}) []string {
+	list, _ := claim.([]interface{})
+	var out []string
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// key returns the signing key with an ID. Keys are fetched again once they
+// are older than the refresh interval, or sooner when the ID is unknown,
+// which is how a rotated key is first seen. Fetches are at most
+// maxKeyRefetch apart, and cached keys stay in use while the provider is
+// unreachable. One fetch runs at a time, without holding i.mu: callers whose
+// key is cached are served meanwhile, and the others wait for it.
+func (i *oidcIssuer) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	i.mu.Lock()
+	for {
+		now := i.now()
+		key, ok := i.keys[kid]
+		if ok && now.Sub(i.fetchedAt) < i.refresh {
+			i.mu.Unlock()
+			return key, nil
+		}
+		if i.fetching != nil {
+			if ok {
+				i.mu.Unlock()
+				return key, nil
+			}
+			done := i.fetching
+			i.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			i.mu.Lock()
+			continue
+		}
+		if now.Sub(i.attemptedAt) < min(i.refresh, maxKeyRefetch) {
+			key, err := i.cached(kid)
+			i.mu.Unlock()
+			return key, err
+		}
+
+		i.attemptedAt = now
+		done := make(chan struct{})
+		i.fetching = done
+		i.mu.Unlock()
+
+		// The fetch serves every caller waiting for it, so it does not end
+		// when this caller gives up
+		keys, err := i.fetchKeys(context.WithoutCancel(ctx))
+
+		i.mu.Lock()
+		if err == nil {
+			i.keys = keys
+			i.fetchedAt = i.now()
+		}
+		i.fetchErr = err
+		i.fetching = nil
+		close(done)
+		key, cachedErr := i.cached(kid)
+		i.mu.Unlock()
+		if err != nil && cachedErr != nil {
+			return nil, err
+		}
+		return key, cachedErr
+	}
+}
+
+// cached returns the signing key with an ID from the keys last fetched, or
+// why it is not available. The caller must hold i.mu.
+func (i *oidcIssuer) cached(kid string) (crypto.PublicKey, error) {
+	if key, ok := i.keys[kid]; ok {
+		return key, nil
+	}
+	if i.keys == nil {
+		if i.fetchErr != nil {
+			return nil, i.fetchErr
+		}
+		return nil, fmt.Errorf("signing keys of %s are not available", i.cfg.Issuer)
+	}
+	return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+}
+
+// fetchKeys discovers the provider's JWKS document and returns its keys.
+// Only one fetch runs at a time, which is what guards i.jwksURI.
+func (i *oidcIssuer) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, oidcTimeout)
+	defer cancel()
+
+	if i.jwksURI == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		url := strings.TrimSuffix(i.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := i.getJSON(ctx, url, &discovery); err != nil {
+			return nil, fmt.Errorf("failed to discover OIDC issuer %s: %w", i.cfg.Issuer, err)
+		}
+		if discovery.Issuer != i.cfg.Issuer || discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OIDC discovery document of %s does not match its issuer", i.cfg.Issuer)
+		}
+		i.jwksURI = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := i.getJSON(ctx, i.jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys of %s: %w", i.cfg.Issuer, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			// Skip keys of types this service does not verify
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+func (i *oidcIssuer) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jwk is a JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes an RSA or elliptic curve key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := encoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := encoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := encoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := encoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks an RS* or ES* signature over a token's signed
+// parts
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unexpected signing algorithm %q", ErrInvalidToken, alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported signing key", ErrInvalidToken)
+	}
+	return nil
+}
+
+// numericClaim reads a NumericDate claim
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// tokenIssuer reads the issuer of a token before it is verified, to choose
+// who verifies it
+func tokenIssuer(raw *rawToken) (string, error) {
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(raw.payload, &claims); err != nil {
+		return "", fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	return claims.Issuer, nil
+}
@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// Built-in roles
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleUser     = "user"
+	RoleViewer   = "viewer"
+)
+
+// Resources permissions apply to. A single model is the resource
+// "models/<name>", which permissions on ResourceModels cover.
+const (
+	ResourceModels = "models"
+	ResourceAdmin  = "admin"
+	ResourceQueues = "queues"
+	ResourceKeys   = "keys"
+	ResourceJobs   = "jobs"
+)
+
+// Actions on resources
+const (
+	ActionInvoke = "invoke"
+	ActionRead   = "read"
+	ActionWrite  = "write"
+	ActionCreate = "create"
+	ActionRevoke = "revoke"
+)
+
+// Permission allows an action on a resource. Either may be "*" to match any.
+type Permission struct {
+	Resource string
+	Action   string
+}
+
+// allows reports whether the permission covers an action on a resource or
+// one of its members
+func (p Permission) allows(resource, action string) bool {
+	if p.Action != "*" && p.Action != action {
+		return false
+	}
+	return p.Resource == "*" || p.Resource == resource || strings.HasPrefix(resource, p.Resource+"/")
+}
+
+// rolePermissions lists the permissions each built-in role grants
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		{Resource: "*", Action: "*"},
+	},
+	RoleOperator: {
+		{Resource: ResourceModels, Action: "*"},
+		{Resource: ResourceAdmin, Action: ActionRead},
+		{Resource: ResourceAdmin, Action: ActionWrite},
+		{Resource: ResourceQueues, Action: "*"},
+		{Resource: ResourceKeys, Action: ActionRead},
+		{Resource: ResourceJobs, Action: "*"},
+	},
+	RoleUser: {
+		{Resource: ResourceModels, Action: ActionRead},
+		{Resource: ResourceModels, Action: ActionInvoke},
+		{Resource: ResourceJobs, Action: ActionCreate},
+		{Resource: ResourceJobs, Action: ActionRead},
+		{Resource: ResourceKeys, Action: ActionCreate},
+	},
+	RoleViewer: {
+		{Resource: ResourceModels, Action: ActionRead},
+		{Resource: ResourceJobs, Action: ActionRead},
+		{Resource: ResourceQueues, Action: ActionRead},
+	},
+}
+
+// permissionsOf returns the permissions granted by a set of roles. Unknown
+// roles grant nothing.
+func permissionsOf(roles []string) []Permission {
+	var perms []Permission
+	for _, role := range roles {
+		perms = append(perms, rolePermissions[role]...)
+	}
+	return perms
+}
+
+// allowed reports whether any of a set of roles allows an action on a
+// resource
+func allowed(roles []string, resource, action string) bool {
+	for _, p := range permissionsOf(roles) {
+		if p.allows(resource, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScope reads a scope of an API key, which is a permission written as
+// "<resource>:<action>", such as "models:invoke" or
+// "models/llama3.1:8b:invoke"
+func parseScope(scope string) (Permission, error) {
+	i := strings.LastIndex(scope, ":")
+	if i <= 0 || i == len(scope)-1 {
+		return Permission{}, fmt.Errorf("scope %q must be of the form <resource>:<action>", scope)
+	}
+	return Permission{Resource: scope[:i], Action: scope[i+1:]}, nil
+}
+
+// scoped reports whether the scopes of a credential allow an action on a
+// resource. Credentials without scopes are limited by their roles alone.
+func scoped(scopes []string, resource, action string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		if p, err := parseScope(scope); err == nil && p.allows(resource, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// modelAccess restricts models to callers holding certain roles or
+// belonging to certain groups
+type modelAccess map[string]config.ModelAccess
+
+// newModelAccess validates the configured model restrictions
+func newModelAccess(rules []config.ModelAccess) (modelAccess, error) {
+	access := make(modelAccess, len(rules))
+	for _, rule := range rules {
+		if rule.Model == "" {
+			return nil, fmt.Errorf("model access rule requires a model")
+		}
+		if len(rule.Roles) == 0 && len(rule.Groups) == 0 {
+			return nil, fmt.Errorf("model access rule of %q requires roles or groups", rule.Model)
+		}
+		if _, ok := access[rule.Model]; ok {
+			return nil, fmt.Errorf("duplicate model access rule for %q", rule.Model)
+		}
+		access[rule.Model] = rule
+	}
+	return access, nil
+}
+
+// permits reports whether a caller may use the model a resource names.
+// Admins may use every model, and models without a rule are open to
+// everyone the roles allow.
+func (a modelAccess) permits(roles, groups []string, resource string) bool {
+	model, ok := strings.CutPrefix(resource, ResourceModels+"/")
+	if !ok {
+		return true
+	}
+	rule, ok := a[model]
+	if !ok || contains(roles, RoleAdmin) {
+		return true
+	}
+	for _, role := range rule.Roles {
+		if contains(roles, role) {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		if contains(groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// grant is what a user was last granted: their roles, and the identity
+// provider groups they belong to
+type grant struct {
+	roles  []string
+	groups []string
+}
+
+// UserGrant is the stored grant of a user
+type UserGrant struct {
+	UserID    string   `gorm:"primaryKey"`
+	Roles     []string `gorm:"serializer:json"`
+	Groups    []string `gorm:"serializer:json"`
+	UpdatedAt time.Time
+}
+
+// TableName names the table of user grants
+func (UserGrant) TableName() string {
+	return "user_grants"
+}
+
+// roleStore holds the grant of each user, which is that of the latest token
+// issued to them or presented by them from an identity provider. Given a
+// database it keeps them there, so that they survive restarts and every
+// replica of the service answers alike; otherwise it keeps them in memory.
+type roleStore struct {
+	db *gorm.DB
+
+	mu     sync.RWMutex
+	grants map[string]grant
+}
+
+// newRoleStore creates a role store, migrating its table when it has a
+// database
+func newRoleStore(db *gorm.DB) (*roleStore, error) {
+	if db != nil {
+		if err := db.AutoMigrate(&UserGrant{}); err != nil {
+			return nil, fmt.Errorf("failed to migrate user grants: %w", err)
+		}
+	}
+	return &roleStore{db: db, grants: make(map[string]grant)}, nil
+}
+
+// set records the roles and groups of a user
+func (s *roleStore) set(ctx context.Context, userID string, roles, groups []string) error {
+	roles = append([]string(nil), roles...)
+	sort.Strings(roles)
+	groups = append([]string(nil), groups...)
+	sort.Strings(groups)
+
+	if s.db != nil {
+		err := s.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).
+			Create(&UserGrant{UserID: userID, Roles: roles, Groups: groups}).Error
+		if err != nil {
+			return fmt.Errorf("failed to store user grant: %w", err)
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants[userID] = grant{roles: roles, groups: groups}
+	return nil
+}
+
+// get returns the roles and groups of a user, or none when the user is
+// unknown
+func (s *roleStore) get(ctx context.Context, userID string) (roles, groups []string, err error) {
+	if s.db != nil {
+		var g UserGrant
+		err := s.db.WithContext(ctx).Where("user_id = ?", userID).Take(&g).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to look up user grant: %w", err)
+		}
+		return g.Roles, g.Groups, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g := s.grants[userID]
+	return append([]string(nil), g.roles...), append([]string(nil), g.groups...), nil
+}
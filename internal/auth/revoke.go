@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// revocationStore records revoked tokens and API keys until they would have
+// expired anyway, and when every credential of a user or a tenant was last
+// revoked, for as long as credentials may live
+type revocationStore interface {
+	// revoke records a credential as revoked until its expiry
+	revoke(ctx context.Context, id string, expires, now time.Time) error
+	// revoked reports whether a credential has been revoked
+	revoked(ctx context.Context, id string) (bool, error)
+	// revokeAll records that the credentials of a subject issued until a
+	// time are revoked
+	revokeAll(ctx context.Context, subject string, at time.Time) error
+	// revokedUntil returns the latest time the credentials of any of the
+	// subjects were revoked until, zero if they never were
+	revokedUntil(ctx context.Context, subjects ...string) (time.Time, error)
+}
+
+// tokenRevocation names the revocation of a token by its ID
+func tokenRevocation(id string) string {
+	return "token:" + id
+}
+
+// keyRevocation names the revocation of an API key by its ID
+func keyRevocation(id string) string {
+	return "key:" + id
+}
+
+// userSubject names the subject of revocations of a user's credentials
+func userSubject(userID string) string {
+	return "user:" + userID
+}
+
+// tenantSubject names the subject of revocations of a tenant's credentials
+func tenantSubject(tenant string) string {
+	return "tenant:" + tenant
+}
+
+// subjectsOf returns the subjects a credential of a user, and of a tenant if
+// it has one, belongs to
+func subjectsOf(userID, tenant string) []string {
+	subjects := []string{userSubject(userID)}
+	if tenant != "" {
+		subjects = append(subjects, tenantSubject(tenant))
+	}
+	return subjects
+}
+
+// revocations holds revocations in memory, so that they last until the
+// service restarts. Subjects are forgotten once the retention has passed
+// since their revocation.
+type revocations struct {
+	retention time.Duration
+
+	mu       sync.Mutex
+	expires  map[string]time.Time
+	subjects map[string]time.Time
+}
+
+func newRevocations(retention time.Duration) *revocations {
+	return &revocations{
+		retention: retention,
+		expires:   make(map[string]time.Time),
+		subjects:  make(map[string]time.Time),
+	}
+}
+
+// revoke records a token ID as revoked until its expiry, dropping entries
+// that have lapsed
+func (r *revocations) revoke(ctx context.Context, id string, expires, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for other, exp := range r.expires {
+		if !now.Before(exp) {
+			delete(r.expires, other)
+		}
+	}
+	r.expires[id] = expires
+	return nil
+}
+
+func (r *revocations) revoked(ctx context.Context, id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.expires[id]
+	return ok, nil
+}
+
+// revokeAll records a subject's revocation, dropping those that have lapsed
+func (r *revocations) revokeAll(ctx context.Context, subject string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for other, until := range r.subjects {
+		if !at.Before(until.Add(r.retention)) {
+			delete(r.subjects, other)
+		}
+	}
+	if at.After(r.subjects[subject]) {
+		r.subjects[subject] = at
+	}
+	return nil
+}
+
+func (r *revocations) revokedUntil(ctx context.Context, subjects ...string) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var until time.Time
+	for _, subject := range subjects {
+		if at := r.subjects[subject]; at.After(until) {
+			until = at
+		}
+	}
+	return until, nil
+}
+
+// redisRevocations keeps revocations in Redis, so that they survive restarts
+// and are shared between replicas of the service. Each revoked credential is
+// a key that expires with the credential. Each revoked subject is a key
+// holding the Unix time its credentials were revoked until, which expires
+// after the retention, once every credential it revoked has expired.
+type redisRevocations struct {
+	client    redis.UniversalClient
+	prefix    string
+	retention time.Duration
+}
+
+func newRedisRevocations(client redis.UniversalClient, prefix string, retention time.Duration) *redisRevocations {
+	if prefix == "" {
+		prefix = "{mindgateway:auth:revoked}"
+	}
+	return &redisRevocations{client: client, prefix: prefix, retention: retention}
+}
+
+// key names the Redis key of a revoked credential or subject
+func (r *redisRevocations) key(name string) string {
+	return r.prefix + ":" + name
+}
+
+func (r *redisRevocations) revoke(ctx context.Context, id string, expires, now time.Time) error {
+	if err := r.client.Set(ctx, r.key(id), 1, expires.Sub(now)).Err(); err != nil {
+		return fmt.Errorf("failed to store revocation: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRevocations) revoked(ctx context.Context, id string) (bool, error) {
+	n, err := r.client.Exists(ctx, r.key(id)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check revocation: %w", err)
+	}
+	return n > 0, nil
+}
+
+// revokeUntilScript moves a subject's revocation time forward, never back,
+// keeping it for the retention from then
+var revokeUntilScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if tonumber(ARGV[1]) > current then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+end
+return 1
+`)
+
+func (r *redisRevocations) revokeAll(ctx context.Context, subject string, at time.Time) error {
+	err := revokeUntilScript.Run(ctx, r.client, []string{r.key(subject)}, at.Unix(), r.retention.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to store revocation: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRevocations) revokedUntil(ctx context.Context, subjects ...string) (time.Time, error) {
+	keys := make([]string, len(subjects))
+	for i, subject := range subjects {
+		keys[i] = r.key(subject)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to check revocation: %w", err)
+	}
+
+	var until time.Time
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		unix, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		if at := time.Unix(unix, 0); at.After(until) {
+			until = at
+		}
+	}
+	return until, nil
+}
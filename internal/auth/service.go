@@ -0,0 +1,883 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	"github.com/ncolesummers/mindgateway/internal/shared/revocation"
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+// minSecretLength is the shortest JWT secret the service accepts, the size
+// of an HS256 key
+const minSecretLength = 32
+
+// tokenIDBytes is the size of a token's random ID
+const tokenIDBytes = 16
+
+// TenantClaim is the claim of the tokens the service issues that names the
+// caller's tenant
+const TenantClaim = "tenant"
+
+// Service implements the AuthService gRPC API. It issues and verifies tokens
+// signed with the configured secret and, given a database, API keys. It also
+// accepts the tokens of configured OIDC providers, and answers role and
+// permission checks.
+type Service struct {
+	authpb.UnimplementedAuthServiceServer
+
+	config *config.Config
+	logger *logging.Logger
+	db     *gorm.DB
+	redis  redis.UniversalClient
+
+	signer  *signer
+	keys    *keyStore
+	oidc    map[string]*oidcIssuer
+	roles   *roleStore
+	access  modelAccess
+	revoked revocationStore
+	ttl     time.Duration
+	maxTTL  time.Duration
+
+	mu     sync.Mutex
+	server *grpc.Server
+}
+
+// Option configures a Service
+type Option func(*Service)
+
+// NewService creates a new auth service
+func NewService(opts ...Option) (*Service, error) {
+	s := &Service{}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.config == nil {
+		return nil, fmt.Errorf("auth: config is required")
+	}
+	cfg := s.config.Auth
+	if len(cfg.JWTSecret) < minSecretLength {
+		return nil, fmt.Errorf("auth: JWT secret must be at least %d bytes", minSecretLength)
+	}
+	if cfg.TokenTTL <= 0 {
+		return nil, fmt.Errorf("auth: token TTL must be positive")
+	}
+	maxTTL := cfg.MaxTokenTTL
+	if maxTTL == 0 {
+		maxTTL = cfg.TokenTTL
+	}
+	if maxTTL < cfg.TokenTTL {
+		return nil, fmt.Errorf("auth: max token TTL must not be shorter than the token TTL")
+	}
+	if cfg.BootstrapToken != "" && len(cfg.BootstrapToken) < minSecretLength {
+		return nil, fmt.Errorf("auth: bootstrap token must be at least %d bytes", minSecretLength)
+	}
+	if cfg.ServiceToken != "" && len(cfg.ServiceToken) < minSecretLength {
+		return nil, fmt.Errorf("auth: service token must be at least %d bytes", minSecretLength)
+	}
+	// Revocations of every credential of a subject are kept for as long as
+	// a token issued just before them may still be accepted
+	retention := maxTTL
+	if len(cfg.OIDC.Issuers) > 0 {
+		retention = max(retention, cfg.OIDC.MaxTokenTTL)
+	}
+	retention += cfg.OIDC.ClockSkew
+	switch cfg.Revocations.Backend {
+	case "", "memory":
+		s.revoked = newRevocations(retention)
+	case "redis":
+		if s.redis == nil {
+			return nil, fmt.Errorf("auth: redis client is required for redis revocations")
+		}
+		s.revoked = newRedisRevocations(s.redis, cfg.Revocations.KeyPrefix, retention)
+	default:
+		return nil, fmt.Errorf("auth: unknown revocations backend %q", cfg.Revocations.Backend)
+	}
+	if s.logger == nil {
+		s.logger = logging.NewLogger(s.config.LogLevel)
+	}
+
+	s.signer = &signer{key: []byte(cfg.JWTSecret), issuer: cfg.Issuer, now: time.Now}
+	s.ttl = cfg.TokenTTL
+	s.maxTTL = maxTTL
+
+	oidc, err := newOIDCIssuers(s.config, &http.Client{}, time.Now)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	s.oidc = oidc
+
+	access, err := newModelAccess(cfg.ModelAccess)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	s.access = access
+
+	roles, err := newRoleStore(s.db)
+	if err != nil {
+		return nil, err
+	}
+	s.roles = roles
+
+	if s.db != nil {
+		keys, err := newKeyStore(s.db, time.Now)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = keys
+	}
+
+	return s, nil
+}
+
+// WithConfig sets the service configuration
+func WithConfig(cfg *config.Config) Option {
+	return func(s *Service) {
+		s.config = cfg
+	}
+}
+
+// WithLogger sets the service logger
+func WithLogger(logger *logging.Logger) Option {
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// WithDatabase sets the database API keys and the roles of users are stored
+// in. Without one, the service does not issue or accept API keys, and keeps
+// roles in memory.
+func WithDatabase(db *gorm.DB) Option {
+	return func(s *Service) {
+		s.db = db
+	}
+}
+
+// WithRedis sets the Redis client revocations are announced through
+func WithRedis(client redis.UniversalClient) Option {
+	return func(s *Service) {
+		s.redis = client
+	}
+}
+
+// RegisterWithServer registers the service with a gRPC server
+func (s *Service) RegisterWithServer(server *grpc.Server) {
+	authpb.RegisterAuthServiceServer(server, s)
+}
+
+// Start serves the gRPC server on the configured address until it stops
+func (s *Service) Start(server *grpc.Server) error {
+	lis, err := net.Listen("tcp", s.config.Auth.Address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.Auth.Address, err)
+	}
+	return s.Serve(server, lis)
+}
+
+// Serve serves the gRPC server on a listener until it stops
+func (s *Service) Serve(server *grpc.Server, lis net.Listener) error {
+	s.mu.Lock()
+	s.server = server
+	s.mu.Unlock()
+
+	s.logger.WithComponent("auth").Infof("Auth service listening on %s", lis.Addr())
+	return server.Serve(lis)
+}
+
+// Shutdown stops the gRPC server, waiting for in-flight calls to finish
+// until ctx is done
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return ctx.Err()
+	}
+}
+
+// ValidateToken verifies a token or API key and returns its claims. Invalid
+// credentials are reported in the response rather than as an error.
+func (s *Service) ValidateToken(ctx context.Context, req *authpb.ValidateTokenRequest) (*authpb.ValidateTokenResponse, error) {
+	if strings.HasPrefix(req.GetToken(), APIKeyPrefix) {
+		return s.validateKey(ctx, req.GetToken())
+	}
+	if issuer, raw, ok := s.oidcIssuer(req.GetToken()); ok {
+		return s.validateOIDC(ctx, issuer, raw)
+	}
+
+	claims, err := s.validate(ctx, req.GetToken())
+	if err != nil {
+		if !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrTokenExpired) && !errors.Is(err, ErrTokenRevoked) {
+			s.logger.WithComponent("auth").WithError(err).Error("Failed to validate token")
+			return nil, status.Error(codes.Unavailable, "failed to validate token")
+		}
+		validationsTotal.WithLabelValues(validationResult(err)).Inc()
+		return &authpb.ValidateTokenResponse{Valid: false, Error: err.Error()}, nil
+	}
+	validationsTotal.WithLabelValues("valid").Inc()
+
+	return &authpb.ValidateTokenResponse{
+		Valid:     true,
+		UserId:    claims.Subject,
+		Tenant:    claims.Extra[TenantClaim],
+		Roles:     claims.Roles,
+		Claims:    claims.Extra,
+		TokenId:   claims.ID,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+	}, nil
+}
+
+// validateKey verifies an API key
+func (s *Service) validateKey(ctx context.Context, token string) (*authpb.ValidateTokenResponse, error) {
+	if s.keys == nil {
+		validationsTotal.WithLabelValues("invalid").Inc()
+		return &authpb.ValidateTokenResponse{Valid: false, Error: "API keys are not enabled"}, nil
+	}
+	key, err := s.keys.validate(ctx, token)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrTokenExpired) && !errors.Is(err, ErrTokenRevoked) {
+			s.logger.WithComponent("auth").WithError(err).Error("Failed to validate API key")
+			return nil, status.Error(codes.Unavailable, "failed to validate API key")
+		}
+		validationsTotal.WithLabelValues(validationResult(err)).Inc()
+		return &authpb.ValidateTokenResponse{Valid: false, Error: err.Error()}, nil
+	}
+	revoked, err := s.revoked.revoked(ctx, keyRevocation(key.ID))
+	if err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to check API key revocation")
+		return nil, status.Error(codes.Unavailable, "failed to validate API key")
+	}
+	if revoked {
+		validationsTotal.WithLabelValues(validationResult(ErrTokenRevoked)).Inc()
+		return &authpb.ValidateTokenResponse{Valid: false, Error: ErrTokenRevoked.Error()}, nil
+	}
+	validationsTotal.WithLabelValues("valid").Inc()
+
+	resp := &authpb.ValidateTokenResponse{
+		Valid:  true,
+		UserId: key.OwnerID,
+		Tenant: key.Tenant,
+		Roles:  key.Roles,
+		KeyId:  key.ID,
+		Scopes: key.Scopes,
+	}
+	if key.ExpiresAt != nil {
+		resp.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	return resp, nil
+}
+
+// oidcIssuer returns the OIDC provider that issued a token, if it is one of
+// the configured providers
+func (s *Service) oidcIssuer(token string) (*oidcIssuer, *rawToken, bool) {
+	if len(s.oidc) == 0 {
+		return nil, nil, false
+	}
+	raw, err := splitToken(token)
+	if err != nil {
+		return nil, nil, false
+	}
+	iss, err := tokenIssuer(raw)
+	if err != nil {
+		return nil, nil, false
+	}
+	issuer, ok := s.oidc[iss]
+	return issuer, raw, ok
+}
+
+// validateOIDC verifies a token of an OIDC provider, recording the roles its
+// groups map to as the user's roles
+func (s *Service) validateOIDC(ctx context.Context, issuer *oidcIssuer, raw *rawToken) (*authpb.ValidateTokenResponse, error) {
+	id, err := issuer.verify(ctx, raw)
+	if err == nil {
+		err = s.checkRevokedAll(ctx, id.userID, id.tenant, id.issued)
+	}
+	if err != nil {
+		if !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrTokenExpired) && !errors.Is(err, ErrTokenRevoked) {
+			s.logger.WithComponent("auth").WithError(err).Error("Failed to validate OIDC token")
+			return nil, status.Error(codes.Unavailable, "failed to validate OIDC token")
+		}
+		validationsTotal.WithLabelValues(validationResult(err)).Inc()
+		return &authpb.ValidateTokenResponse{Valid: false, Error: err.Error()}, nil
+	}
+	if err := s.roles.set(ctx, id.userID, id.roles, id.groups); err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to record OIDC roles")
+		return nil, status.Error(codes.Unavailable, "failed to validate OIDC token")
+	}
+	validationsTotal.WithLabelValues("valid").Inc()
+
+	return &authpb.ValidateTokenResponse{
+		Valid:     true,
+		UserId:    id.userID,
+		Tenant:    id.tenant,
+		Roles:     id.roles,
+		Groups:    id.groups,
+		Claims:    id.claims,
+		ExpiresAt: id.expires.Unix(),
+		IssuedAt:  id.issued.Unix(),
+	}, nil
+}
+
+// validate verifies a token and checks it has not been revoked, alone or
+// with every credential of its user or tenant
+func (s *Service) validate(ctx context.Context, token string) (*Claims, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: token is empty", ErrInvalidToken)
+	}
+	claims, err := s.signer.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID != "" {
+		revoked, err := s.revoked.revoked(ctx, tokenRevocation(claims.ID))
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	if err := s.checkRevokedAll(ctx, claims.Subject, claims.Extra[TenantClaim], time.Unix(claims.IssuedAt, 0)); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkRevokedAll returns ErrTokenRevoked if a credential issued at a time
+// was issued before every credential of its user or tenant was revoked.
+// Credentials issued in the same second as the revocation are revoked too.
+func (s *Service) checkRevokedAll(ctx context.Context, userID, tenant string, issued time.Time) error {
+	until, err := s.revoked.revokedUntil(ctx, subjectsOf(userID, tenant)...)
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() && !issued.After(until) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// checkCaller checks that the credential a caller identified earlier
+// presented has neither expired nor been revoked since, alone or with every
+// credential of its user or tenant
+func (s *Service) checkCaller(ctx context.Context, userID string, caller *authpb.Caller) error {
+	if caller.GetExpiresAt() != 0 && !time.Now().Before(time.Unix(caller.GetExpiresAt(), 0)) {
+		return ErrTokenExpired
+	}
+	if id := caller.GetKeyId(); id != "" {
+		if s.keys == nil {
+			return fmt.Errorf("%w: API keys are not enabled", ErrInvalidToken)
+		}
+		key, err := s.keys.get(ctx, id)
+		if errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		if err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return ErrTokenRevoked
+		}
+		revoked, err := s.revoked.revoked(ctx, keyRevocation(id))
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return ErrTokenRevoked
+		}
+		return nil
+	}
+	if id := caller.GetTokenId(); id != "" {
+		revoked, err := s.revoked.revoked(ctx, tokenRevocation(id))
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return ErrTokenRevoked
+		}
+	}
+	return s.checkRevokedAll(ctx, userID, caller.GetTenant(), time.Unix(caller.GetIssuedAt(), 0))
+}
+
+// caller identifies who presented the credential in the "authorization"
+// metadata of a request, as the RPCs that issue credentials require. The
+// configured bootstrap token identifies an admin, so that the first admin
+// credential can be issued.
+func (s *Service) caller(ctx context.Context) (*authpb.ValidateTokenResponse, error) {
+	token, err := bearer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if secretEqual(token, s.config.Auth.BootstrapToken) {
+		return &authpb.ValidateTokenResponse{Valid: true, Roles: []string{RoleAdmin}}, nil
+	}
+	id, err := s.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: token})
+	if err != nil {
+		return nil, err
+	}
+	if !id.GetValid() {
+		return nil, status.Error(codes.Unauthenticated, "invalid credential")
+	}
+	return id, nil
+}
+
+// vouch checks that the caller of a request may ask about a caller it names
+// rather than presents the credential of, which the gateway may, presenting
+// the configured service token, and so may admins
+func (s *Service) vouch(ctx context.Context) error {
+	if token, err := bearer(ctx); err == nil && secretEqual(token, s.config.Auth.ServiceToken) {
+		return nil
+	}
+	caller, err := s.caller(ctx)
+	if err != nil {
+		return err
+	}
+	if !contains(caller.GetRoles(), RoleAdmin) {
+		return status.Error(codes.PermissionDenied, "only the gateway and admins may check the permissions of other callers")
+	}
+	return nil
+}
+
+// bearer returns the credential in the "authorization" metadata of a request
+func bearer(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", status.Error(codes.Unauthenticated, "a credential is required")
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok || token == "" {
+		return "", status.Error(codes.Unauthenticated, "authorization must be a bearer credential")
+	}
+	return token, nil
+}
+
+// secretEqual reports whether a credential is a configured secret, which is
+// never the case for a secret that is not set
+func secretEqual(token, secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// GetUserRoles returns the roles of a user and the permissions they grant
+func (s *Service) GetUserRoles(ctx context.Context, req *authpb.GetUserRolesRequest) (*authpb.GetUserRolesResponse, error) {
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+
+	roles, _, err := s.roles.get(ctx, req.GetUserId())
+	if err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to get user roles")
+		return nil, status.Error(codes.Unavailable, "failed to get user roles")
+	}
+	resp := &authpb.GetUserRolesResponse{Roles: roles}
+	for _, p := range permissionsOf(roles) {
+		resp.Permissions = append(resp.Permissions, &authpb.Permission{Resource: p.Resource, Action: p.Action})
+	}
+	return resp, nil
+}
+
+// CreateToken signs a token for a user. Tokens last the configured TTL
+// unless the request sets an expiration, which may not exceed the maximum
+// token TTL. Only admins may issue tokens.
+func (s *Service) CreateToken(ctx context.Context, req *authpb.CreateTokenRequest) (*authpb.CreateTokenResponse, error) {
+	caller, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(caller.GetRoles(), RoleAdmin) || !scoped(caller.GetScopes(), ResourceKeys, ActionCreate) {
+		return nil, status.Error(codes.PermissionDenied, "only admins may issue tokens")
+	}
+	if req.GetUserId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if req.GetExpirationSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "expiration_seconds must not be negative")
+	}
+
+	ttl := s.ttl
+	if req.GetExpirationSeconds() > 0 {
+		ttl = time.Duration(req.GetExpirationSeconds()) * time.Second
+	}
+	if ttl > s.maxTTL {
+		return nil, status.Errorf(codes.InvalidArgument, "expiration_seconds must not exceed %d", int64(s.maxTTL/time.Second))
+	}
+	id, err := randomHex(tokenIDBytes)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create token ID: %v", err)
+	}
+
+	now := s.signer.now()
+	claims := &Claims{
+		Issuer:    s.signer.issuer,
+		Subject:   req.GetUserId(),
+		ID:        id,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Roles:     req.GetRoles(),
+		Extra:     req.GetClaims(),
+	}
+	token, err := s.signer.sign(claims)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sign token: %v", err)
+	}
+
+	if err := s.roles.set(ctx, req.GetUserId(), req.GetRoles(), nil); err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to record user roles")
+		return nil, status.Error(codes.Internal, "failed to record user roles")
+	}
+	tokensIssued.Inc()
+	s.logger.WithUser(req.GetUserId()).WithField("token_id", id).Info("Token issued")
+
+	return &authpb.CreateTokenResponse{Token: token, ExpiresAt: claims.ExpiresAt}, nil
+}
+
+// RevokeToken revokes a token for the rest of its lifetime. Revoking an
+// expired token succeeds without recording it.
+func (s *Service) RevokeToken(ctx context.Context, req *authpb.RevokeTokenRequest) (*authpb.RevokeTokenResponse, error) {
+	claims, err := s.signer.parse(req.GetToken())
+	if err != nil {
+		return &authpb.RevokeTokenResponse{Success: false, Error: err.Error()}, nil
+	}
+	if claims.ID == "" {
+		return &authpb.RevokeTokenResponse{Success: false, Error: "token has no ID to revoke"}, nil
+	}
+
+	now := s.signer.now()
+	if expires := time.Unix(claims.ExpiresAt, 0); now.Before(expires) {
+		if err := s.revoked.revoke(ctx, tokenRevocation(claims.ID), expires, now); err != nil {
+			s.logger.WithComponent("auth").WithError(err).Error("Failed to revoke token")
+			return nil, status.Error(codes.Unavailable, "failed to revoke token")
+		}
+		s.announce(ctx, revocation.Event{TokenID: claims.ID})
+		s.logger.WithUser(claims.Subject).WithField("token_id", claims.ID).Info("Token revoked")
+	}
+	return &authpb.RevokeTokenResponse{Success: true}, nil
+}
+
+// CheckPermission reports whether a caller's roles allow an action on a
+// resource, and for a model whether the caller may use it. The caller is
+// the one presenting the request's token, whose roles are those it carries,
+// or else the one the request describes or the user with the request's ID,
+// which only the gateway and admins may ask about. API keys are further
+// limited to their scopes. Invalid tokens are allowed nothing.
+func (s *Service) CheckPermission(ctx context.Context, req *authpb.CheckPermissionRequest) (*authpb.CheckPermissionResponse, error) {
+	if (req.GetUserId() == "" && req.GetToken() == "" && req.GetCaller() == nil) || req.GetResource() == "" || req.GetAction() == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id, token or caller, resource and action are required")
+	}
+	if req.GetToken() == "" {
+		if err := s.vouch(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var roles, groups, scopes []string
+	switch {
+	case req.GetToken() != "":
+		id, err := s.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: req.GetToken()})
+		if err != nil {
+			return nil, err
+		}
+		if !id.GetValid() {
+			permissionChecks.WithLabelValues("denied").Inc()
+			return &authpb.CheckPermissionResponse{Allowed: false}, nil
+		}
+		roles, groups, scopes = id.GetRoles(), id.GetGroups(), id.GetScopes()
+	case req.GetCaller() != nil:
+		caller := req.GetCaller()
+		if err := s.checkCaller(ctx, req.GetUserId(), caller); err != nil {
+			if !errors.Is(err, ErrInvalidToken) && !errors.Is(err, ErrTokenExpired) && !errors.Is(err, ErrTokenRevoked) {
+				s.logger.WithComponent("auth").WithError(err).Error("Failed to check caller's credential")
+				return nil, status.Error(codes.Unavailable, "failed to check permission")
+			}
+			permissionChecks.WithLabelValues("denied").Inc()
+			return &authpb.CheckPermissionResponse{Allowed: false}, nil
+		}
+		roles, groups, scopes = caller.GetRoles(), caller.GetGroups(), caller.GetScopes()
+	default:
+		var err error
+		roles, groups, err = s.roles.get(ctx, req.GetUserId())
+		if err != nil {
+			s.logger.WithComponent("auth").WithError(err).Error("Failed to get user roles")
+			return nil, status.Error(codes.Unavailable, "failed to check permission")
+		}
+	}
+
+	ok := allowed(roles, req.GetResource(), req.GetAction()) &&
+		scoped(scopes, req.GetResource(), req.GetAction()) &&
+		s.access.permits(roles, groups, req.GetResource())
+	if ok {
+		permissionChecks.WithLabelValues("allowed").Inc()
+	} else {
+		permissionChecks.WithLabelValues("denied").Inc()
+	}
+	return &authpb.CheckPermissionResponse{Allowed: ok}, nil
+}
+
+// CreateAPIKey issues an API key for an owner. Keys last until they are
+// revoked unless the request sets an expiration. Admins may issue any key,
+// and other callers allowed to create keys only their own.
+func (s *Service) CreateAPIKey(ctx context.Context, req *authpb.CreateAPIKeyRequest) (*authpb.CreateAPIKeyResponse, error) {
+	if s.keys == nil {
+		return nil, status.Error(codes.FailedPrecondition, "API keys are not enabled")
+	}
+	caller, err := s.keysCaller(ctx, ActionCreate)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetOwnerId() == "" || req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "owner_id and name are required")
+	}
+	// Callers other than admins issue keys for themselves, with no more than
+	// their own tenant and roles
+	if !contains(caller.GetRoles(), RoleAdmin) {
+		if req.GetOwnerId() != caller.GetUserId() || req.GetTenant() != caller.GetTenant() {
+			return nil, status.Error(codes.PermissionDenied, "API keys may only be issued to their caller")
+		}
+		for _, role := range req.GetRoles() {
+			if !contains(caller.GetRoles(), role) {
+				return nil, status.Errorf(codes.PermissionDenied, "caller may not grant role %q", role)
+			}
+		}
+	}
+	if req.GetExpirationSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "expiration_seconds must not be negative")
+	}
+	for _, scope := range req.GetScopes() {
+		if _, err := parseScope(scope); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	ttl := time.Duration(req.GetExpirationSeconds()) * time.Second
+	token, key, err := s.keys.create(ctx, &APIKey{
+		OwnerID: req.GetOwnerId(),
+		Tenant:  req.GetTenant(),
+		Name:    req.GetName(),
+		Scopes:  req.GetScopes(),
+		Roles:   req.GetRoles(),
+	}, ttl)
+	if err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to create API key")
+		return nil, status.Error(codes.Internal, "failed to create API key")
+	}
+	keysIssued.Inc()
+	s.logger.WithUser(key.OwnerID).WithField("key_id", key.ID).Info("API key issued")
+
+	return &authpb.CreateAPIKeyResponse{Key: token, ApiKey: keyToProto(key)}, nil
+}
+
+// ListAPIKeys lists an owner's API keys, newest first. Admins may list any
+// owner's keys, and other callers allowed to read keys only their own.
+func (s *Service) ListAPIKeys(ctx context.Context, req *authpb.ListAPIKeysRequest) (*authpb.ListAPIKeysResponse, error) {
+	if s.keys == nil {
+		return nil, status.Error(codes.FailedPrecondition, "API keys are not enabled")
+	}
+	caller, err := s.keysCaller(ctx, ActionRead)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetOwnerId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "owner_id is required")
+	}
+	if !owns(caller, req.GetOwnerId()) {
+		return nil, status.Error(codes.PermissionDenied, "callers may only list their own API keys")
+	}
+
+	keys, err := s.keys.list(ctx, req.GetOwnerId(), req.GetIncludeRevoked())
+	if err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to list API keys")
+		return nil, status.Error(codes.Internal, "failed to list API keys")
+	}
+	resp := &authpb.ListAPIKeysResponse{ApiKeys: make([]*authpb.APIKey, 0, len(keys))}
+	for i := range keys {
+		resp.ApiKeys = append(resp.ApiKeys, keyToProto(&keys[i]))
+	}
+	return resp, nil
+}
+
+// RevokeAPIKey revokes an API key. The database keeps the revocation for
+// good, and the revocation store until the key would have expired, or for
+// the maximum token TTL when it never does. Admins may revoke any key, and
+// other callers allowed to revoke keys only their own.
+func (s *Service) RevokeAPIKey(ctx context.Context, req *authpb.RevokeAPIKeyRequest) (*authpb.RevokeAPIKeyResponse, error) {
+	if s.keys == nil {
+		return nil, status.Error(codes.FailedPrecondition, "API keys are not enabled")
+	}
+	caller, err := s.keysCaller(ctx, ActionRevoke)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := s.keys.get(ctx, req.GetId())
+	if errors.Is(err, ErrKeyNotFound) {
+		return &authpb.RevokeAPIKeyResponse{Success: false, Error: err.Error()}, nil
+	}
+	if err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to revoke API key")
+		return nil, status.Error(codes.Internal, "failed to revoke API key")
+	}
+	if !owns(caller, key.OwnerID) {
+		return nil, status.Error(codes.PermissionDenied, "callers may only revoke their own API keys")
+	}
+	expires, err := s.keys.revoke(ctx, key.ID)
+	if errors.Is(err, ErrKeyNotFound) {
+		return &authpb.RevokeAPIKeyResponse{Success: false, Error: err.Error()}, nil
+	}
+	if err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to revoke API key")
+		return nil, status.Error(codes.Internal, "failed to revoke API key")
+	}
+	now := s.signer.now()
+	until := now.Add(s.maxTTL)
+	if expires != nil {
+		until = *expires
+	}
+	if now.Before(until) {
+		if err := s.revoked.revoke(ctx, keyRevocation(req.GetId()), until, now); err != nil {
+			s.logger.WithComponent("auth").WithError(err).Error("Failed to revoke API key")
+			return nil, status.Error(codes.Unavailable, "failed to revoke API key")
+		}
+	}
+	s.announce(ctx, revocation.Event{KeyID: req.GetId()})
+	s.logger.WithComponent("auth").WithField("key_id", req.GetId()).Info("API key revoked")
+	return &authpb.RevokeAPIKeyResponse{Success: true}, nil
+}
+
+// RevokeAll revokes every token and API key issued to a user or a tenant so
+// far. Tokens are revoked by when they were issued, so the tokens of an
+// identity provider are revoked as well. Only admins may revoke credentials
+// this way.
+func (s *Service) RevokeAll(ctx context.Context, req *authpb.RevokeAllRequest) (*authpb.RevokeAllResponse, error) {
+	caller, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(caller.GetRoles(), RoleAdmin) || !scoped(caller.GetScopes(), ResourceKeys, ActionRevoke) {
+		return nil, status.Error(codes.PermissionDenied, "only admins may revoke every credential of a user or tenant")
+	}
+	if (req.GetUserId() == "") == (req.GetTenant() == "") {
+		return nil, status.Error(codes.InvalidArgument, "exactly one of user_id and tenant is required")
+	}
+
+	subject := userSubject(req.GetUserId())
+	if req.GetTenant() != "" {
+		subject = tenantSubject(req.GetTenant())
+	}
+	logger := s.logger.WithComponent("auth").WithField("subject", subject)
+	if err := s.revoked.revokeAll(ctx, subject, s.signer.now()); err != nil {
+		logger.WithError(err).Error("Failed to revoke credentials")
+		return nil, status.Error(codes.Unavailable, "failed to revoke credentials")
+	}
+
+	var keys int64
+	if s.keys != nil {
+		var err error
+		keys, err = s.keys.revokeAll(ctx, req.GetUserId(), req.GetTenant())
+		if err != nil {
+			logger.WithError(err).Error("Failed to revoke API keys")
+			return nil, status.Error(codes.Internal, "failed to revoke API keys")
+		}
+	}
+
+	s.announce(ctx, revocation.Event{UserID: req.GetUserId(), Tenant: req.GetTenant()})
+	logger.WithField("revoked_keys", keys).Info("Credentials revoked")
+	return &authpb.RevokeAllResponse{Success: true, RevokedKeys: keys}, nil
+}
+
+// keysCaller returns the caller of an RPC managing API keys, if it may take
+// an action on them
+func (s *Service) keysCaller(ctx context.Context, action string) (*authpb.ValidateTokenResponse, error) {
+	caller, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed(caller.GetRoles(), ResourceKeys, action) || !scoped(caller.GetScopes(), ResourceKeys, action) {
+		return nil, status.Errorf(codes.PermissionDenied, "caller may not %s API keys", action)
+	}
+	return caller, nil
+}
+
+// owns reports whether a caller may manage the API keys of an owner, which
+// admins may for any owner and other callers for themselves
+func owns(caller *authpb.ValidateTokenResponse, owner string) bool {
+	return contains(caller.GetRoles(), RoleAdmin) || owner == caller.GetUserId()
+}
+
+// announce tells gateway replicas of a revocation so that they stop
+// accepting cached credentials, when revocations are shared through Redis
+func (s *Service) announce(ctx context.Context, e revocation.Event) {
+	if s.config.Auth.Revocations.Backend != "redis" {
+		return
+	}
+	if err := revocation.Publish(ctx, s.redis, s.config.Auth.Revocations.Channel, e); err != nil {
+		s.logger.WithComponent("auth").WithError(err).Error("Failed to announce revocation")
+	}
+}
+
+// keyToProto converts a stored API key to its description
+func keyToProto(key *APIKey) *authpb.APIKey {
+	out := &authpb.APIKey{
+		Id:        key.ID,
+		OwnerId:   key.OwnerID,
+		Tenant:    key.Tenant,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		Roles:     key.Roles,
+		CreatedAt: key.CreatedAt.Unix(),
+		Revoked:   key.RevokedAt != nil,
+	}
+	if key.ExpiresAt != nil {
+		out.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	if key.LastUsedAt != nil {
+		out.LastUsedAt = key.LastUsedAt.Unix()
+	}
+	return out
+}
+
+// validationResult labels the outcome of a failed validation
+func validationResult(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return "expired"
+	case errors.Is(err, ErrTokenRevoked):
+		return "revoked"
+	default:
+		return "invalid"
+	}
+}
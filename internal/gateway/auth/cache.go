@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/revocation"
+)
+
+// Backend validates, authorizes and revokes credentials, which the Client
+// does through the auth service
+type Backend interface {
+	ValidateToken(ctx context.Context, token string) (*Principal, error)
+	GetUserRoles(ctx context.Context, userID string) ([]string, error)
+	CheckPermission(ctx context.Context, token, resource, action string) (bool, error)
+	CheckPrincipalPermission(ctx context.Context, p *Principal, resource, action string) (bool, error)
+	RevokeAll(ctx context.Context, token, userID, tenant string) (int64, error)
+}
+
+// Cache holds the callers a backend identified and the permission decisions
+// it made, keyed by a hash of the token presented. Entries live for the
+// configured TTL but never past the credential's expiry, and invalid tokens
+// are remembered for the shorter negative TTL. Errors are not cached. When
+// the cache is full, the least recently used entry makes room for a new one.
+type Cache struct {
+	backend     Backend
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most to the least recently used
+	recent *list.List
+	// generation changes whenever entries are revoked, so that answers the
+	// backend gave before a revocation are not cached after it
+	generation uint64
+}
+
+// cacheEntry is what the cache knows of a token
+type cacheEntry struct {
+	key       string
+	principal *Principal // nil for invalid tokens
+	expires   time.Time
+	allowed   map[string]bool
+}
+
+// NewCache creates a cache in front of a backend
+func NewCache(backend Backend, cfg *config.Config) *Cache {
+	return &Cache{
+		backend:     backend,
+		ttl:         cfg.Auth.Cache.TTL,
+		negativeTTL: cfg.Auth.Cache.NegativeTTL,
+		maxEntries:  cfg.Auth.Cache.MaxEntries,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		recent:      list.New(),
+	}
+}
+
+// ValidateToken returns the caller a token identifies, or nil when it is
+// invalid, asking the backend only when the token is not cached
+func (c *Cache) ValidateToken(ctx context.Context, token string) (*Principal, error) {
+	key := hashToken(token)
+
+	c.mu.Lock()
+	e := c.lookup(key)
+	generation := c.generation
+	c.mu.Unlock()
+
+	if e != nil {
+		cacheRequests.WithLabelValues("hit").Inc()
+		return e.principal, nil
+	}
+	cacheRequests.WithLabelValues("miss").Inc()
+
+	p, err := c.backend.ValidateToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, generation, p)
+	return p, nil
+}
+
+// GetUserRoles returns the roles of a user, which are not cached
+func (c *Cache) GetUserRoles(ctx context.Context, userID string) ([]string, error) {
+	return c.backend.GetUserRoles(ctx, userID)
+}
+
+// CheckPermission reports whether the caller presenting a token may take an
+// action on a resource. Decisions are cached along with the token, so they
+// are only cached for tokens that were validated through the cache.
+func (c *Cache) CheckPermission(ctx context.Context, token, resource, action string) (bool, error) {
+	key := hashToken(token)
+	permission := resource + " " + action
+
+	c.mu.Lock()
+	e := c.lookup(key)
+	if e != nil {
+		allowed, ok := e.allowed[permission]
+		if e.principal == nil || ok {
+			c.mu.Unlock()
+			cacheRequests.WithLabelValues("hit").Inc()
+			return allowed, nil
+		}
+	}
+	generation := c.generation
+	c.mu.Unlock()
+	cacheRequests.WithLabelValues("miss").Inc()
+
+	allowed, err := c.backend.CheckPermission(ctx, token, resource, action)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok && generation == c.generation && el.Value == e {
+		e.allowed[permission] = allowed
+	}
+	return allowed, nil
+}
+
+// CheckPrincipalPermission reports whether a caller identified earlier may
+// take an action on a resource, which is not cached
+func (c *Cache) CheckPrincipalPermission(ctx context.Context, p *Principal, resource, action string) (bool, error) {
+	return c.backend.CheckPrincipalPermission(ctx, p, resource, action)
+}
+
+// RevokeAll revokes every credential of a user or a tenant on behalf of the
+// admin presenting a token, dropping the cached ones at once rather than
+// when the revocation is announced
+func (c *Cache) RevokeAll(ctx context.Context, token, userID, tenant string) (int64, error) {
+	keys, err := c.backend.RevokeAll(ctx, token, userID, tenant)
+	if err != nil {
+		return 0, err
+	}
+	c.Revoke(revocation.Event{UserID: userID, Tenant: tenant})
+	return keys, nil
+}
+
+// Revoke drops the cached credentials an event revokes
+func (c *Cache) Revoke(e revocation.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, el := range c.entries {
+		if p := el.Value.(*cacheEntry).principal; p != nil && e.Matches(revocation.Credential{
+			TokenID: p.TokenID, KeyID: p.KeyID, UserID: p.UserID, Tenant: p.Tenant,
+		}) {
+			c.remove(el)
+			cacheEvictions.WithLabelValues("revoked").Inc()
+		}
+	}
+}
+
+// Flush drops every cached token, for when revocations may have been missed
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	cacheEvictions.WithLabelValues("flushed").Add(float64(len(c.entries)))
+	c.entries = make(map[string]*list.Element)
+	c.recent.Init()
+}
+
+// lookup returns the live entry of a token, marking it the most recently
+// used, and drops it if it expired. The caller holds c.mu.
+func (c *Cache) lookup(key string) *cacheEntry {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return nil
+	}
+	c.recent.MoveToFront(el)
+	return e
+}
+
+// remove drops an entry. The caller holds c.mu.
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	c.recent.Remove(el)
+}
+
+// store caches what the backend said of a token, unless entries were revoked
+// since it was asked
+func (c *Cache) store(key string, generation uint64, p *Principal) {
+	now := c.now()
+	ttl := c.ttl
+	if p == nil {
+		ttl = c.negativeTTL
+	}
+	expires := now.Add(ttl)
+	if p != nil && !p.ExpiresAt.IsZero() && p.ExpiresAt.Before(expires) {
+		expires = p.ExpiresAt
+	}
+	if !now.Before(expires) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	e := &cacheEntry{key: key, principal: p, expires: expires, allowed: make(map[string]bool)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.recent.MoveToFront(el)
+		return
+	}
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = c.recent.PushFront(e)
+}
+
+// evict makes room for an entry by dropping the least recently used one,
+// unless it had already expired. The caller holds c.mu.
+func (c *Cache) evict(now time.Time) {
+	el := c.recent.Back()
+	if el == nil {
+		return
+	}
+	c.remove(el)
+	if now.Before(el.Value.(*cacheEntry).expires) {
+		cacheEvictions.WithLabelValues("capacity").Inc()
+	}
+}
+
+// hashToken keys the cache so that it holds no credentials
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+// APIKeyPrefix starts every MindGateway API key
+const APIKeyPrefix = "mg-"
+
+// KeyID returns the public ID of an API key, which keys are listed and
+// revoked by
+func KeyID(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, APIKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, "-")
+	return id, ok && id != ""
+}
+
+// Resources and actions the gateway checks permissions for
+const (
+	ResourceModels = "models"
+	ResourceAdmin  = "admin"
+	ResourceQueues = "queues"
+	ResourceJobs   = "jobs"
+	ResourceKeys   = "keys"
+
+	ActionInvoke = "invoke"
+	ActionRead   = "read"
+	ActionWrite  = "write"
+	ActionCreate = "create"
+	ActionRevoke = "revoke"
+)
+
+// ModelResource is the resource of a single model
+func ModelResource(model string) string {
+	return ResourceModels + "/" + model
+}
+
+// Client is a gRPC client for the auth service
+type Client struct {
+	client       authpb.AuthServiceClient
+	serviceToken string
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithServiceToken sets the token the client presents to check the
+// permissions of callers identified earlier
+func WithServiceToken(token string) ClientOption {
+	return func(c *Client) {
+		c.serviceToken = token
+	}
+}
+
+// NewClient creates an auth service client
+func NewClient(conn grpc.ClientConnInterface, opts ...ClientOption) *Client {
+	c := &Client{client: authpb.NewAuthServiceClient(conn)}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ValidateToken validates a JWT or API key, returning the caller it
+// identifies, or nil when it is invalid
+func (c *Client) ValidateToken(ctx context.Context, token string) (*Principal, error) {
+	resp, err := c.client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: token})
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate token: %w", err)
+	}
+	if !resp.GetValid() {
+		return nil, nil
+	}
+	p := &Principal{
+		UserID:  resp.GetUserId(),
+		Tenant:  resp.GetTenant(),
+		Roles:   resp.GetRoles(),
+		Groups:  resp.GetGroups(),
+		Scopes:  resp.GetScopes(),
+		KeyID:   resp.GetKeyId(),
+		TokenID: resp.GetTokenId(),
+	}
+	if resp.GetIssuedAt() != 0 {
+		p.IssuedAt = time.Unix(resp.GetIssuedAt(), 0)
+	}
+	if resp.GetExpiresAt() != 0 {
+		p.ExpiresAt = time.Unix(resp.GetExpiresAt(), 0)
+	}
+	return p, nil
+}
+
+// GetUserRoles returns the roles of a user
+func (c *Client) GetUserRoles(ctx context.Context, userID string) ([]string, error) {
+	resp, err := c.client.GetUserRoles(ctx, &authpb.GetUserRolesRequest{UserId: userID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user roles: %w", err)
+	}
+	return resp.GetRoles(), nil
+}
+
+// CheckPermission reports whether the caller presenting a token may take an
+// action on a resource
+func (c *Client) CheckPermission(ctx context.Context, token, resource, action string) (bool, error) {
+	resp, err := c.client.CheckPermission(ctx, &authpb.CheckPermissionRequest{Token: token, Resource: resource, Action: action})
+	if err != nil {
+		return false, fmt.Errorf("failed to check permission: %w", err)
+	}
+	return resp.GetAllowed(), nil
+}
+
+// CheckPrincipalPermission reports whether a caller identified earlier, such
+// as the one who submitted an asynchronous job, may take an action on a
+// resource. Callers whose credential has since expired or been revoked may
+// not. The auth service only answers this for the service token.
+func (c *Client) CheckPrincipalPermission(ctx context.Context, p *Principal, resource, action string) (bool, error) {
+	if c.serviceToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.serviceToken)
+	}
+	resp, err := c.client.CheckPermission(ctx, &authpb.CheckPermissionRequest{
+		UserId:   p.UserID,
+		Resource: resource,
+		Action:   action,
+		Caller:   caller(p),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to check permission: %w", err)
+	}
+	return resp.GetAllowed(), nil
+}
+
+// caller describes a principal to the auth service, which checks the
+// credential they presented is still valid
+func caller(p *Principal) *authpb.Caller {
+	c := &authpb.Caller{
+		Roles:   p.Roles,
+		Groups:  p.Groups,
+		Scopes:  p.Scopes,
+		Tenant:  p.Tenant,
+		TokenId: p.TokenID,
+		KeyId:   p.KeyID,
+	}
+	if !p.IssuedAt.IsZero() {
+		c.IssuedAt = p.IssuedAt.Unix()
+	}
+	if !p.ExpiresAt.IsZero() {
+		c.ExpiresAt = p.ExpiresAt.Unix()
+	}
+	return c
+}
+
+// RevokeAll revokes every token and API key issued to a user or a tenant so
+// far on behalf of the admin presenting a token, returning how many API keys
+// were revoked
+func (c *Client) RevokeAll(ctx context.Context, token, userID, tenant string) (int64, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	resp, err := c.client.RevokeAll(ctx, &authpb.RevokeAllRequest{UserId: userID, Tenant: tenant})
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke credentials: %w", err)
+	}
+	return resp.GetRevokedKeys(), nil
+}
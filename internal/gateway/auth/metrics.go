@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Credential cache metrics
+var (
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_auth_cache_requests_total",
+			Help: "Total number of token validations and permission checks by cache result",
+		},
+		[]string{"result"},
+	)
+
+	cacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_auth_cache_evictions_total",
+			Help: "Total number of cached tokens dropped before they expired by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests, cacheEvictions)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID string   `json:"user_id"`
+	Tenant string   `json:"tenant,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+
+	// KeyID is the ID of the API key the caller presented, if any
+	KeyID string `json:"key_id,omitempty"`
+
+	// TokenID is the ID of the token the caller presented, if the auth
+	// service issued it. IssuedAt is when their token was issued and
+	// ExpiresAt when their credential expires, so that the credential can be
+	// checked again when an asynchronous job is served as the caller.
+	TokenID   string    `json:"token_id,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type principalKey struct{}
+
+// NewContext returns a context carrying a principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal a context carries, if any
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
@@ -0,0 +1,246 @@
+package batch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+)
+
+// Result is the outcome of embedding a set of inputs. Model and QueueWait
+// describe the call that served them, which callers in one batch share.
+type Result struct {
+	Embeddings [][]float64
+	Model      string
+	QueueWait  time.Duration
+}
+
+// Func embeds a set of inputs, returning one embedding per input in order
+type Func func(ctx context.Context, inputs []string) (*Result, error)
+
+// Batcher merges concurrent embedding requests that share a key into one
+// call. A batch is sent once it holds the maximum number of inputs or has
+// lingered for the maximum time, and its result is split back out to each
+// caller.
+type Batcher struct {
+	config *config.Config
+	logger *logging.Logger
+
+	maxSize int
+	linger  time.Duration
+
+	mu   sync.Mutex
+	open map[string]*batch
+}
+
+// batch collects the requests merged into one call
+type batch struct {
+	key     string
+	fn      Func
+	inputs  []string
+	members []*member
+	timer   *time.Timer
+
+	// ctx carries the values of the request that opened the batch. It is
+	// cancelled once every member has given up.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiting int
+
+	// deadline is the latest of the members' deadlines, or zero when any
+	// member has none
+	deadline time.Time
+	bounded  bool
+}
+
+// member is one caller's share of a batch
+type member struct {
+	offset int
+	n      int
+	result chan result
+}
+
+type result struct {
+	res *Result
+	err error
+}
+
+// Option configures a Batcher
+type Option func(*Batcher)
+
+// New creates a new embedding batcher
+func New(opts ...Option) (*Batcher, error) {
+	b := &Batcher{
+		open: make(map[string]*batch),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.config == nil {
+		return nil, fmt.Errorf("batch: config is required")
+	}
+
+	cfg := b.config.Batching
+	if cfg.MaxBatchSize < 2 {
+		return nil, fmt.Errorf("batch: max batch size must be at least 2")
+	}
+	if cfg.MaxLinger <= 0 {
+		return nil, fmt.Errorf("batch: max linger must be positive")
+	}
+	b.maxSize = cfg.MaxBatchSize
+	b.linger = cfg.MaxLinger
+
+	return b, nil
+}
+
+// WithConfig sets the batcher configuration
+func WithConfig(cfg *config.Config) Option {
+	return func(b *Batcher) {
+		b.config = cfg
+	}
+}
+
+// WithLogger sets the batcher logger
+func WithLogger(logger *logging.Logger) Option {
+	return func(b *Batcher) {
+		b.logger = logger
+	}
+}
+
+// Embed embeds the inputs together with those of concurrent requests sharing
+// the key. Requests sharing a key must be interchangeable for fn, which is
+// taken from the request that opens each batch. Requests with as many inputs
+// as a full batch are sent on their own.
+func (b *Batcher) Embed(ctx context.Context, key string, inputs []string, fn Func) (*Result, error) {
+	if len(inputs) >= b.maxSize {
+		batchSize.Observe(float64(len(inputs)))
+		batchRequests.Observe(1)
+		return fn(ctx, inputs)
+	}
+
+	m := &member{n: len(inputs), result: make(chan result, 1)}
+
+	b.mu.Lock()
+	bt := b.open[key]
+	if bt != nil && len(bt.inputs)+len(inputs) > b.maxSize {
+		b.flushLocked(bt, flushFull)
+		bt = nil
+	}
+	if bt == nil {
+		bt = b.openLocked(ctx, key, fn)
+	}
+	m.offset = len(bt.inputs)
+	bt.inputs = append(bt.inputs, inputs...)
+	bt.members = append(bt.members, m)
+	bt.join(ctx)
+	if len(bt.inputs) >= b.maxSize {
+		b.flushLocked(bt, flushFull)
+	}
+	b.mu.Unlock()
+
+	select {
+	case r := <-m.result:
+		return r.res, r.err
+	case <-ctx.Done():
+		b.leave(bt)
+		return nil, ctx.Err()
+	}
+}
+
+// openLocked starts a batch for the key. The caller must hold b.mu.
+func (b *Batcher) openLocked(ctx context.Context, key string, fn Func) *batch {
+	bt := &batch{key: key, fn: fn, bounded: true}
+	bt.ctx, bt.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	bt.timer = time.AfterFunc(b.linger, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.open[key] == bt {
+			b.flushLocked(bt, flushLinger)
+		}
+	})
+	b.open[key] = bt
+	return bt
+}
+
+// flushLocked closes a batch to new requests and sends it. The caller must
+// hold b.mu.
+func (b *Batcher) flushLocked(bt *batch, reason string) {
+	if b.open[bt.key] == bt {
+		delete(b.open, bt.key)
+	}
+	bt.timer.Stop()
+	flushesTotal.WithLabelValues(reason).Inc()
+	go b.run(bt)
+}
+
+// run sends a batch and splits its result between the members
+func (b *Batcher) run(bt *batch) {
+	ctx, cancel := bt.ctx, bt.cancel
+	defer cancel()
+	if bt.bounded && !bt.deadline.IsZero() {
+		var stop context.CancelFunc
+		ctx, stop = context.WithDeadline(ctx, bt.deadline)
+		defer stop()
+	}
+
+	batchSize.Observe(float64(len(bt.inputs)))
+	batchRequests.Observe(float64(len(bt.members)))
+
+	res, err := bt.fn(ctx, bt.inputs)
+	if err == nil && len(res.Embeddings) != len(bt.inputs) {
+		err = fmt.Errorf("batch: expected %d embeddings, got %d", len(bt.inputs), len(res.Embeddings))
+	}
+	if err != nil && b.logger != nil && ctx.Err() == nil {
+		b.logger.WithComponent("batch").WithError(err).
+			WithField("inputs", len(bt.inputs)).
+			WithField("requests", len(bt.members)).
+			Debug("Embedding batch failed")
+	}
+
+	for _, m := range bt.members {
+		if err != nil {
+			m.result <- result{err: err}
+			continue
+		}
+		m.result <- result{res: &Result{
+			Embeddings: res.Embeddings[m.offset : m.offset+m.n : m.offset+m.n],
+			Model:      res.Model,
+			QueueWait:  res.QueueWait,
+		}}
+	}
+}
+
+// join records a member's deadline. The caller must hold b.mu.
+func (bt *batch) join(ctx context.Context) {
+	bt.waiting++
+	d, ok := ctx.Deadline()
+	if !ok {
+		bt.bounded = false
+		return
+	}
+	if d.After(bt.deadline) {
+		bt.deadline = d
+	}
+}
+
+// leave records a member that gave up, cancelling the batch once nobody is
+// waiting for it
+func (b *Batcher) leave(bt *batch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bt.waiting--
+	if bt.waiting > 0 {
+		return
+	}
+	if b.open[bt.key] == bt {
+		delete(b.open, bt.key)
+		bt.timer.Stop()
+	}
+	bt.cancel()
+}
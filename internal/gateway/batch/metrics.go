@@ -0,0 +1,42 @@
+package batch
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a batch is sent
+const (
+	flushFull   = "full"
+	flushLinger = "linger"
+)
+
+// Batching metrics
+var (
+	batchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mindgateway_embedding_batch_inputs",
+			Help:    "Number of inputs per batched embedding call",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 9),
+		},
+	)
+
+	batchRequests = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "mindgateway_embedding_batch_requests",
+			Help:    "Number of client requests merged into each batched embedding call",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 9),
+		},
+	)
+
+	flushesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_embedding_batch_flushes_total",
+			Help: "Total number of embedding batches sent by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(batchSize, batchRequests, flushesTotal)
+}
@@ -45,6 +45,38 @@ var (
 		},
 		[]string{"model", "type"},
 	)
+	
+	variantRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_model_variant_requests_total",
+			Help: "Total number of requests by logical model and the variant that served them",
+		},
+		[]string{"model", "variant", "endpoint", "status"},
+	)
+	
+	hedgedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_hedged_requests_total",
+			Help: "Total number of hedged requests by which attempt answered first",
+		},
+		[]string{"model", "endpoint", "winner"},
+	)
+	
+	tenantRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_tenant_requests_total",
+			Help: "Total number of requests by the caller's tenant",
+		},
+		[]string{"tenant", "endpoint", "status"},
+	)
+	
+	tenantTokens = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_tenant_tokens_total",
+			Help: "Total number of tokens processed by the caller's tenant",
+		},
+		[]string{"tenant", "type"},
+	)
 )
 
 func init() {
@@ -55,6 +87,10 @@ func init() {
 		workersActive,
 		queueDepth,
 		tokenCounter,
+		variantRequests,
+		hedgedRequests,
+		tenantRequests,
+		tenantTokens,
 	)
 }
 
@@ -70,6 +106,27 @@ func RecordRequestMetrics(model, endpoint string, status int, startTime time.Tim
 	tokenCounter.WithLabelValues(model, "output").Add(float64(outputTokens))
 }
 
+// RecordVariant records which model variant served a request for a logical model
+func RecordVariant(model, variant, endpoint string, status int) {
+	variantRequests.WithLabelValues(model, variant, endpoint, strconv.Itoa(status)).Inc()
+}
+
+// RecordHedge records which attempt of a hedged request answered first
+func RecordHedge(model, endpoint, winner string) {
+	hedgedRequests.WithLabelValues(model, endpoint, winner).Inc()
+}
+
+// RecordTenantUsage records a request and its tokens against the caller's
+// tenant. Requests without a tenant are not recorded.
+func RecordTenantUsage(tenant, endpoint string, status int, inputTokens, outputTokens int) {
+	if tenant == "" {
+		return
+	}
+	tenantRequests.WithLabelValues(tenant, endpoint, strconv.Itoa(status)).Inc()
+	tenantTokens.WithLabelValues(tenant, "input").Add(float64(inputTokens))
+	tenantTokens.WithLabelValues(tenant, "output").Add(float64(outputTokens))
+}
+
 // UpdateQueueMetrics updates queue-related metrics
 func UpdateQueueMetrics(queueSize int) {
 	queueDepth.Set(float64(queueSize))
@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+// Status is the state of a job
+type Status string
+
+// Job states. A job is queued until a replica takes it on, in progress while
+// its request is queued or served, and then completed or failed.
+const (
+	StatusQueued     Status = "queued"
+	StatusInProgress Status = "in_progress"
+	StatusCompleted  Status = "completed"
+	StatusFailed     Status = "failed"
+)
+
+// Finished reports whether the job has reached a final state
+func (s Status) Finished() bool {
+	return s == StatusCompleted || s == StatusFailed
+}
+
+// Endpoints are the inference endpoints a job may call
+var Endpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+}
+
+// Job is an inference request served in the background. Its result is kept
+// for polling and, when a webhook is registered, posted to the caller.
+type Job struct {
+	ID       string `json:"id"`
+	Object   string `json:"object"`
+	Endpoint string `json:"endpoint"`
+	Status   Status `json:"status"`
+
+	// Request is the body of the inference request and Header the gateway
+	// headers it was submitted with, which steer its routing
+	Request json.RawMessage   `json:"request"`
+	Header  map[string]string `json:"header,omitempty"`
+
+	// UserID is the caller who submitted the job, and Principal the rest of
+	// what is known of them, whose request it is served as. The principal is
+	// kept with the job but never shown.
+	UserID    string          `json:"user_id,omitempty"`
+	Principal *auth.Principal `json:"-"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	// ExpiresAt is when the job fails if it has not completed
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Attempts counts the times the request was sent, including those turned
+	// away by admission control
+	Attempts int `json:"attempts"`
+
+	// Queue is set while the request waits for capacity
+	Queue *QueueStatus `json:"queue,omitempty"`
+
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+
+	Webhook *Webhook `json:"webhook,omitempty"`
+}
+
+// QueueStatus describes a job's wait for capacity
+type QueueStatus struct {
+	Position int     `json:"position,omitempty"`
+	ETAMs    float64 `json:"eta_ms,omitempty"`
+	WaitedMs float64 `json:"waited_ms,omitempty"`
+
+	// RetryAt is set while the job backs off after the queue turned it away
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// Error describes why a job failed
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Webhook is the callback made when a job finishes, and how it went
+type Webhook struct {
+	URL         string     `json:"url"`
+	Attempts    int        `json:"attempts,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Job errors
+var (
+	ErrNotFound = &errors.Error{Code: http.StatusNotFound, Message: "Job not found"}
+
+	// ErrLeaseLost is returned when a replica saves a job that another
+	// replica has taken over
+	ErrLeaseLost = &errors.Error{Code: http.StatusConflict, Message: "Job is held by another replica"}
+)
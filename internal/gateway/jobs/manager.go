@@ -0,0 +1,577 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/queue"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+)
+
+// Manager runs jobs in the background. Each job's request is served by the
+// gateway's own handler, so it is routed and queued like any other request.
+// Jobs are leased to the replica serving them; when a replica goes away
+// without finishing a job, another takes it over once the lease lapses.
+type Manager struct {
+	config     *config.Config
+	logger     *logging.Logger
+	store      Store
+	handler    http.Handler
+	httpClient *http.Client
+
+	replica string
+	timeout time.Duration
+	lease   time.Duration
+
+	secret          string
+	allowedHosts    map[string]bool
+	webhookAttempts int
+	webhookTimeout  time.Duration
+
+	// slots limits the jobs served at once by this replica
+	slots chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	running map[string]bool
+}
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// New creates a new job manager
+func New(opts ...Option) (*Manager, error) {
+	m := &Manager{
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		running: make(map[string]bool),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.config == nil {
+		return nil, fmt.Errorf("jobs: config is required")
+	}
+	if m.handler == nil {
+		return nil, fmt.Errorf("jobs: handler is required")
+	}
+
+	cfg := m.config.Jobs
+	if m.store == nil {
+		m.store = NewMemoryStore(cfg.Retention)
+	}
+	if m.httpClient == nil {
+		m.httpClient = m.webhookClient()
+	}
+	m.replica = replicaID()
+	m.timeout = cfg.Timeout
+	if m.timeout <= 0 {
+		m.timeout = time.Hour
+	}
+	m.lease = cfg.Lease
+	if m.lease <= 0 {
+		m.lease = 30 * time.Second
+	}
+	maxRunning := cfg.MaxRunning
+	if maxRunning <= 0 {
+		maxRunning = 100
+	}
+	m.slots = make(chan struct{}, maxRunning)
+
+	m.secret = cfg.Webhook.Secret
+	m.allowedHosts = make(map[string]bool, len(cfg.Webhook.AllowedHosts))
+	for _, host := range cfg.Webhook.AllowedHosts {
+		m.allowedHosts[strings.ToLower(host)] = true
+	}
+	m.webhookAttempts = cfg.Webhook.MaxAttempts
+	if m.webhookAttempts <= 0 {
+		m.webhookAttempts = 1
+	}
+	m.webhookTimeout = cfg.Webhook.Timeout
+	if m.webhookTimeout <= 0 {
+		m.webhookTimeout = 10 * time.Second
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	return m, nil
+}
+
+// WithConfig sets the job configuration
+func WithConfig(cfg *config.Config) Option {
+	return func(m *Manager) {
+		m.config = cfg
+	}
+}
+
+// WithLogger sets the job logger
+func WithLogger(logger *logging.Logger) Option {
+	return func(m *Manager) {
+		m.logger = logger
+	}
+}
+
+// WithStore sets the store that keeps jobs, in memory by default
+func WithStore(store Store) Option {
+	return func(m *Manager) {
+		m.store = store
+	}
+}
+
+// WithHandler sets the handler that serves job requests, normally the
+// gateway's own router
+func WithHandler(handler http.Handler) Option {
+	return func(m *Manager) {
+		m.handler = handler
+	}
+}
+
+// WithHTTPClient sets the client used to call webhooks
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *Manager) {
+		m.httpClient = client
+	}
+}
+
+// Start looks for jobs to serve until Stop is called
+func (m *Manager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		return
+	}
+	m.started = true
+	go m.run()
+}
+
+// Stop stops taking on jobs and gives up the jobs being served, which
+// another replica resumes once this one has gone
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return nil
+	}
+	m.stopped = true
+	started := m.started
+	m.mu.Unlock()
+
+	m.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		if started {
+			<-m.done
+		}
+		m.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Submit validates and stores a new job, then starts it as soon as a slot is
+// free. The caller sets the endpoint, request, gateway headers and webhook.
+func (m *Manager) Submit(ctx context.Context, job *Job) error {
+	if !Endpoints[job.Endpoint] {
+		return errors.WithMessage(errors.ErrInvalidInput, fmt.Sprintf("Jobs cannot call %s", job.Endpoint))
+	}
+	var body struct {
+		Stream bool `json:"stream"`
+	}
+	if err := json.Unmarshal(job.Request, &body); err != nil {
+		return errors.WithMessage(errors.ErrMalformedInput, "Job request must be a JSON object")
+	}
+	if body.Stream {
+		return errors.WithMessage(errors.ErrInvalidInput, "Jobs cannot stream their responses")
+	}
+	if job.Webhook != nil {
+		if err := m.checkWebhook(job.Webhook.URL); err != nil {
+			return errors.WithMessage(errors.ErrInvalidInput, "Invalid webhook: "+err.Error())
+		}
+		job.Webhook = &Webhook{URL: job.Webhook.URL}
+	}
+
+	now := time.Now()
+	job.ID = newJobID()
+	job.Object = "job"
+	job.Status = StatusQueued
+	job.CreatedAt = now
+	job.ExpiresAt = now.Add(m.timeout)
+
+	if err := m.store.Create(ctx, job); err != nil {
+		m.warn(err, "Failed to store job")
+		return errors.ErrServiceUnavailable
+	}
+	m.launch(job.ID)
+	return nil
+}
+
+// Get returns a job
+func (m *Manager) Get(ctx context.Context, id string) (*Job, error) {
+	job, err := m.store.Get(ctx, id)
+	if err != nil && !stderrors.Is(err, ErrNotFound) {
+		m.warn(err, "Failed to read job")
+		return nil, errors.ErrServiceUnavailable
+	}
+	return job, err
+}
+
+// run starts the unclaimed jobs in the store as slots free up, and takes over
+// jobs whose replica has let their lease lapse
+func (m *Manager) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.lease / 2)
+	defer ticker.Stop()
+
+	for {
+		ids, err := m.store.Unclaimed(m.ctx, cap(m.slots))
+		if err != nil {
+			m.warn(err, "Failed to look for unclaimed jobs")
+		}
+		for _, id := range ids {
+			if !m.launch(id) {
+				break
+			}
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// launch starts serving a job if a slot is free, reporting false otherwise
+func (m *Manager) launch(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped || m.running[id] {
+		return true
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return false
+	}
+	m.running[id] = true
+	m.wg.Add(1)
+	go m.serve(id)
+	return true
+}
+
+// serve claims a job and runs it to completion
+func (m *Manager) serve(id string) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, id)
+		m.mu.Unlock()
+		<-m.slots
+		m.wg.Done()
+
+		// Let the next unclaimed job have the slot
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}()
+
+	job, err := m.store.Claim(m.ctx, id, m.replica, time.Now().Add(m.lease))
+	if err != nil {
+		m.warn(err, "Failed to claim job")
+		return
+	}
+	if job == nil {
+		return
+	}
+	if job.Status == StatusInProgress {
+		jobsResumed.Inc()
+	}
+	jobsRunning.Inc()
+	defer jobsRunning.Dec()
+
+	ctx, cancel := context.WithDeadline(m.ctx, job.ExpiresAt)
+	defer cancel()
+
+	// Renew the lease while the job runs, and abandon the job if another
+	// replica has taken it over
+	var lost atomic.Bool
+	holding, release := context.WithCancel(ctx)
+	defer release()
+	go m.hold(holding, id, &lost, cancel)
+
+	if time.Now().Before(job.ExpiresAt) {
+		now := time.Now()
+		job.Status = StatusInProgress
+		job.StartedAt = &now
+		if err := m.save(job); err != nil {
+			return
+		}
+		m.execute(ctx, job)
+	} else {
+		job.Status = StatusFailed
+		job.Error = &Error{Code: http.StatusGatewayTimeout, Message: "Job expired before it completed"}
+	}
+	release()
+
+	if m.ctx.Err() != nil {
+		// Shutting down; another replica resumes the job
+		if err := m.store.Release(context.Background(), id, m.replica); err != nil {
+			m.warn(err, "Failed to release job")
+		}
+		return
+	}
+	if lost.Load() {
+		return
+	}
+	m.finish(job)
+}
+
+// hold renews a job's lease until ctx ends
+func (m *Manager) hold(ctx context.Context, id string, lost *atomic.Bool, abandon context.CancelFunc) {
+	ticker := time.NewTicker(m.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := m.store.Renew(ctx, id, m.replica, time.Now().Add(m.lease))
+		if err != nil {
+			m.warn(err, "Failed to renew job lease")
+			continue
+		}
+		if !renewed {
+			lost.Store(true)
+			abandon()
+			return
+		}
+	}
+}
+
+// execute sends a job's request, backing off and trying again while the
+// queue turns it away, until it succeeds, fails or the job expires
+func (m *Manager) execute(ctx context.Context, job *Job) {
+	for {
+		job.Attempts++
+		status, header, body := m.call(ctx, job)
+		job.Queue = nil
+
+		if status == http.StatusTooManyRequests && ctx.Err() == nil {
+			retry := retryAfter(header)
+			if at := time.Now().Add(retry); at.Before(job.ExpiresAt) {
+				job.Queue = &QueueStatus{RetryAt: &at}
+				_ = m.save(job)
+
+				select {
+				case <-time.After(retry):
+					continue
+				case <-ctx.Done():
+					job.Queue = nil
+					job.Status = StatusFailed
+					job.Error = &Error{Code: http.StatusGatewayTimeout, Message: "Job expired before it completed"}
+					return
+				}
+			}
+		}
+
+		if status >= 200 && status < 300 {
+			job.Status = StatusCompleted
+			job.Result = json.RawMessage(body)
+			return
+		}
+		job.Status = StatusFailed
+		job.Error = responseError(status, body)
+		return
+	}
+}
+
+// call serves a job's request through the gateway's handler, reporting the
+// request's progress through the queue on the job
+func (m *Manager) call(ctx context.Context, job *Job) (int, http.Header, []byte) {
+	ctx = context.WithValue(ctx, jobKey{}, job.ID)
+	if job.Principal != nil {
+		ctx = auth.NewContext(ctx, job.Principal)
+	}
+	ctx = queue.WithMaxWait(ctx, time.Until(job.ExpiresAt))
+	ctx = queue.WithProgress(ctx, func(p queue.Progress) {
+		job.Queue = &QueueStatus{
+			Position: p.Position,
+			ETAMs:    float64(p.ETA) / float64(time.Millisecond),
+			WaitedMs: float64(p.Waited) / float64(time.Millisecond),
+		}
+		_ = m.save(job)
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.Endpoint, bytes.NewReader(job.Request))
+	if err != nil {
+		return http.StatusInternalServerError, nil, nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range job.Header {
+		req.Header.Set(k, v)
+	}
+
+	w := &responseBuffer{header: make(http.Header)}
+	m.handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.status, w.header, w.body.Bytes()
+}
+
+type jobKey struct{}
+
+// FromContext returns the ID of the job whose request is being served with
+// the context, if any
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(jobKey{}).(string)
+	return id, ok
+}
+
+// finish saves a finished job and calls its webhook
+func (m *Manager) finish(job *Job) {
+	now := time.Now()
+	job.CompletedAt = &now
+	if err := m.save(job); err != nil {
+		return
+	}
+	jobsTotal.WithLabelValues(job.Endpoint, string(job.Status)).Inc()
+
+	if job.Webhook != nil {
+		m.notify(job)
+		_ = m.save(job)
+	}
+}
+
+// save stores a job held by this replica
+func (m *Manager) save(job *Job) error {
+	err := m.store.Save(m.ctx, job, m.replica)
+	if err != nil && !stderrors.Is(err, ErrLeaseLost) {
+		m.warn(err, "Failed to save job")
+	}
+	return err
+}
+
+func (m *Manager) warn(err error, msg string) {
+	if m.logger != nil && !stderrors.Is(err, context.Canceled) {
+		m.logger.WithError(err).Warn(msg)
+	}
+}
+
+// responseBuffer captures the response to a job's request
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Flush() {}
+
+// responseError reads the error from a failed response, which is either the
+// gateway's own error body or an OpenAI error
+func responseError(status int, body []byte) *Error {
+	e := &Error{Code: status, Message: http.StatusText(status)}
+
+	var resp struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || len(resp.Error) == 0 {
+		return e
+	}
+	var message string
+	if json.Unmarshal(resp.Error, &message) == nil && message != "" {
+		e.Message = message
+		return e
+	}
+	var detail struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(resp.Error, &detail) == nil && detail.Message != "" {
+		e.Message = detail.Message
+	}
+	return e
+}
+
+// retryAfter reads the Retry-After header of a rejected request
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// newJobID returns a random job ID
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "job-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return "job-" + hex.EncodeToString(b)
+}
+
+// replicaID names this process in the job store
+func replicaID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gateway"
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return host + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return host + "-" + hex.EncodeToString(b)
+}
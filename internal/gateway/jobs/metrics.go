@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Job metrics
+var (
+	jobsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_jobs_total",
+			Help: "Total number of finished jobs by endpoint and status",
+		},
+		[]string{"endpoint", "status"},
+	)
+
+	jobsRunning = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mindgateway_jobs_running",
+			Help: "Number of jobs this replica is serving",
+		},
+	)
+
+	jobsResumed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mindgateway_jobs_resumed_total",
+			Help: "Total number of jobs taken over after the lease of their replica lapsed",
+		},
+	)
+
+	webhooksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_job_webhooks_total",
+			Help: "Total number of job webhook attempts by outcome",
+		},
+		[]string{"outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobsTotal, jobsRunning, jobsResumed, webhooksTotal)
+}
@@ -0,0 +1,211 @@
+package jobs
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// RedisStore keeps jobs in Redis so that every gateway replica can answer
+// for them. Each job is a key that expires once its result has been kept for
+// the retention period. Unfinished jobs are in a sorted set scored by the
+// time their lease runs out, zero while no replica holds them, with the
+// holder of each lease in a hash.
+type RedisStore struct {
+	client    redis.UniversalClient
+	prefix    string
+	retention time.Duration
+}
+
+// NewRedisStore creates a store that keeps jobs in Redis
+func NewRedisStore(client redis.UniversalClient, cfg *config.Config) (*RedisStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("jobs: redis client is required")
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("jobs: config is required")
+	}
+
+	s := &RedisStore{
+		client:    client,
+		prefix:    cfg.Jobs.KeyPrefix,
+		retention: cfg.Jobs.Retention,
+	}
+	if s.prefix == "" {
+		s.prefix = "{mindgateway:jobs}"
+	}
+	if s.retention <= 0 {
+		s.retention = 24 * time.Hour
+	}
+	return s, nil
+}
+
+func (s *RedisStore) jobKey(id string) string {
+	return s.prefix + ":job:" + id
+}
+
+func (s *RedisStore) pendingKey() string {
+	return s.prefix + ":pending"
+}
+
+func (s *RedisStore) ownersKey() string {
+	return s.prefix + ":owners"
+}
+
+// ttl returns how long a job's record is kept. Unfinished jobs are kept long
+// enough to fail and then be retained.
+func (s *RedisStore) ttl(job *Job) time.Duration {
+	if job.Status.Finished() {
+		return s.retention
+	}
+	ttl := time.Until(job.ExpiresAt) + s.retention
+	if ttl < s.retention {
+		ttl = s.retention
+	}
+	return ttl
+}
+
+func (s *RedisStore) Create(ctx context.Context, job *Job) error {
+	data, err := encodeJob(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.jobKey(job.ID), data, s.ttl(job))
+		pipe.ZAdd(ctx, s.pendingKey(), redis.Z{Score: 0, Member: job.ID})
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) Get(ctx context.Context, id string) (*Job, error) {
+	data, err := s.client.Get(ctx, s.jobKey(id)).Bytes()
+	if stderrors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeJob(data)
+}
+
+// claimScript leases an unfinished job whose lease has run out, forgetting
+// jobs whose record has expired
+var claimScript = redis.NewScript(`
+local lease = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not lease or tonumber(lease) > tonumber(ARGV[3]) then
+  return false
+end
+local data = redis.call('GET', KEYS[3])
+if not data then
+  redis.call('ZREM', KEYS[1], ARGV[1])
+  redis.call('HDEL', KEYS[2], ARGV[1])
+  return false
+end
+redis.call('ZADD', KEYS[1], ARGV[4], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return data
+`)
+
+func (s *RedisStore) Claim(ctx context.Context, id, owner string, until time.Time) (*Job, error) {
+	data, err := claimScript.Run(ctx, s.client,
+		[]string{s.pendingKey(), s.ownersKey(), s.jobKey(id)},
+		id, owner, time.Now().UnixMilli(), until.UnixMilli(),
+	).Text()
+	if stderrors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeJob([]byte(data))
+}
+
+// renewScript extends a lease held by the caller
+var renewScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+  return 0
+end
+redis.call('ZADD', KEYS[1], 'XX', ARGV[3], ARGV[1])
+return 1
+`)
+
+func (s *RedisStore) Renew(ctx context.Context, id, owner string, until time.Time) (bool, error) {
+	renewed, err := renewScript.Run(ctx, s.client,
+		[]string{s.pendingKey(), s.ownersKey()},
+		id, owner, until.UnixMilli(),
+	).Int()
+	return renewed == 1, err
+}
+
+// releaseScript gives up a lease held by the caller
+var releaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+  return 0
+end
+redis.call('ZADD', KEYS[1], 'XX', 0, ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`)
+
+func (s *RedisStore) Release(ctx context.Context, id, owner string) error {
+	return releaseScript.Run(ctx, s.client,
+		[]string{s.pendingKey(), s.ownersKey()},
+		id, owner,
+	).Err()
+}
+
+// saveScript writes a job held by the caller, or a finished job again, and
+// lets go of the job once it has finished
+var saveScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+  if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+    return 0
+  end
+elseif ARGV[5] ~= '1' or redis.call('EXISTS', KEYS[3]) == 0 then
+  return 0
+end
+redis.call('SET', KEYS[3], ARGV[3], 'PX', ARGV[4])
+if ARGV[5] == '1' then
+  redis.call('ZREM', KEYS[1], ARGV[1])
+  redis.call('HDEL', KEYS[2], ARGV[1])
+end
+return 1
+`)
+
+func (s *RedisStore) Save(ctx context.Context, job *Job, owner string) error {
+	data, err := encodeJob(job)
+	if err != nil {
+		return err
+	}
+	finished := "0"
+	if job.Status.Finished() {
+		finished = "1"
+	}
+
+	saved, err := saveScript.Run(ctx, s.client,
+		[]string{s.pendingKey(), s.ownersKey(), s.jobKey(job.ID)},
+		job.ID, owner, data, s.ttl(job).Milliseconds(), finished,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (s *RedisStore) Unclaimed(ctx context.Context, limit int) ([]string, error) {
+	return s.client.ZRangeByScore(ctx, s.pendingKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: int64(limit),
+	}).Result()
+}
@@ -0,0 +1,210 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+)
+
+// Store keeps jobs and the leases of the replicas serving them. The
+// in-memory store serves a single gateway; RedisStore lets every replica
+// answer for a job and take over jobs whose replica has gone.
+type Store interface {
+	// Create adds a new job that no replica holds yet
+	Create(ctx context.Context, job *Job) error
+
+	// Get returns a job, or ErrNotFound
+	Get(ctx context.Context, id string) (*Job, error)
+
+	// Claim takes an unfinished job that no replica holds, or whose lease
+	// has lapsed, for owner until the given time. It returns nil when the
+	// job cannot be claimed.
+	Claim(ctx context.Context, id, owner string, until time.Time) (*Job, error)
+
+	// Renew extends owner's lease on a job, reporting false once the job is
+	// no longer held by owner
+	Renew(ctx context.Context, id, owner string, until time.Time) (bool, error)
+
+	// Release gives up owner's lease so that another replica can take the
+	// job over straight away
+	Release(ctx context.Context, id, owner string) error
+
+	// Save stores a job held by owner, returning ErrLeaseLost if it is held
+	// by another replica. A finished job is no longer held by anyone, and
+	// can only be saved again as a finished job.
+	Save(ctx context.Context, job *Job, owner string) error
+
+	// Unclaimed returns up to limit unfinished jobs that no replica holds
+	Unclaimed(ctx context.Context, limit int) ([]string, error)
+}
+
+// memoryStore keeps jobs in the gateway's memory
+type memoryStore struct {
+	retention time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*memoryRecord
+}
+
+type memoryRecord struct {
+	data     []byte
+	created  time.Time
+	finished bool
+	owner    string
+	lease    time.Time
+
+	// expires is when a finished job is forgotten
+	expires time.Time
+}
+
+// NewMemoryStore returns a store that keeps jobs in memory, forgetting
+// finished jobs after the retention period
+func NewMemoryStore(retention time.Duration) Store {
+	return &memoryStore{
+		retention: retention,
+		jobs:      make(map[string]*memoryRecord),
+	}
+}
+
+func (s *memoryStore) Create(_ context.Context, job *Job) error {
+	data, err := encodeJob(job)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = &memoryRecord{data: data, created: job.CreatedAt}
+	return nil
+}
+
+func (s *memoryStore) Get(_ context.Context, id string) (*Job, error) {
+	s.mu.Lock()
+	rec, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return decodeJob(rec.data)
+}
+
+func (s *memoryStore) Claim(_ context.Context, id, owner string, until time.Time) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.jobs[id]
+	if !ok || rec.finished || rec.lease.After(time.Now()) {
+		return nil, nil
+	}
+	rec.owner = owner
+	rec.lease = until
+	return decodeJob(rec.data)
+}
+
+func (s *memoryStore) Renew(_ context.Context, id, owner string, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.jobs[id]
+	if !ok || rec.finished || rec.owner != owner {
+		return false, nil
+	}
+	rec.lease = until
+	return true, nil
+}
+
+func (s *memoryStore) Release(_ context.Context, id, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.jobs[id]; ok && !rec.finished && rec.owner == owner {
+		rec.owner = ""
+		rec.lease = time.Time{}
+	}
+	return nil
+}
+
+func (s *memoryStore) Save(_ context.Context, job *Job, owner string) error {
+	data, err := encodeJob(job)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.jobs[job.ID]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case rec.finished && !job.Status.Finished():
+		return ErrLeaseLost
+	case !rec.finished && rec.owner != owner:
+		return ErrLeaseLost
+	}
+
+	rec.data = data
+	if job.Status.Finished() && !rec.finished {
+		rec.finished = true
+		rec.owner = ""
+		rec.lease = time.Time{}
+		rec.expires = time.Now().Add(s.retention)
+	}
+	return nil
+}
+
+func (s *memoryStore) Unclaimed(_ context.Context, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var recs []*memoryRecord
+	ids := make(map[*memoryRecord]string)
+	for id, rec := range s.jobs {
+		if rec.finished {
+			if now.After(rec.expires) {
+				delete(s.jobs, id)
+			}
+			continue
+		}
+		if rec.lease.After(now) {
+			continue
+		}
+		recs = append(recs, rec)
+		ids[rec] = id
+	}
+
+	// Oldest jobs first
+	sort.Slice(recs, func(i, j int) bool { return recs[i].created.Before(recs[j].created) })
+	if limit > 0 && len(recs) > limit {
+		recs = recs[:limit]
+	}
+	out := make([]string, len(recs))
+	for i, rec := range recs {
+		out[i] = ids[rec]
+	}
+	return out, nil
+}
+
+// record is how a job is stored, along with the caller it is served as
+type record struct {
+	*Job
+	Principal *auth.Principal `json:"principal,omitempty"`
+}
+
+func encodeJob(job *Job) ([]byte, error) {
+	return json.Marshal(record{Job: job, Principal: job.Principal})
+}
+
+func decodeJob(data []byte) (*Job, error) {
+	rec := record{Job: &Job{}}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	rec.Job.Principal = rec.Principal
+	return rec.Job, nil
+}
@@ -0,0 +1,186 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Webhook headers. The signature is the hex HMAC-SHA256, under the
+// configured secret, of the timestamp, a dot and the request body.
+const (
+	HeaderJobID     = "X-MindGateway-Job-Id"
+	HeaderTimestamp = "X-MindGateway-Timestamp"
+	HeaderSignature = "X-MindGateway-Signature"
+)
+
+// Sign returns the signature header value for a webhook body sent at the
+// given Unix time
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a webhook's signature, rejecting webhooks sent more than
+// tolerance ago so that a captured callback cannot be replayed later
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return fmt.Errorf("webhook timestamp is outside the tolerance")
+	}
+	if !hmac.Equal([]byte(header.Get(HeaderSignature)), []byte(Sign(secret, timestamp, body))) {
+		return fmt.Errorf("invalid webhook signature")
+	}
+	return nil
+}
+
+// checkWebhook validates a webhook URL against the allowed hosts. Hosts
+// that are not listed may not be internal addresses, which is checked again
+// for the addresses their names resolve to when the webhook is called.
+func (m *Manager) checkWebhook(raw string) error {
+	if m.secret == "" {
+		return fmt.Errorf("webhooks are not enabled")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL must be an absolute http or https URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	if m.allowedHosts[host] {
+		return nil
+	}
+	if len(m.allowedHosts) > 0 {
+		return fmt.Errorf("webhook host %s is not allowed", u.Hostname())
+	}
+	if ip := net.ParseIP(host); ip != nil && internalAddress(ip) {
+		return fmt.Errorf("webhook host %s is an internal address", u.Hostname())
+	}
+	return nil
+}
+
+// cgnat is the shared address space, where some clouds serve instance
+// metadata
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// internalAddress reports whether an address is loopback, private,
+// link-local, which includes cloud metadata endpoints, or otherwise not a
+// public unicast address
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || cgnat.Contains(ip)
+}
+
+// webhookClient creates the client webhooks are called with. It dials hosts
+// that are not allowed explicitly only at public addresses, so that a name
+// resolving to an internal address, or a redirect to one, is refused, and it
+// ignores proxies, which would dial on its behalf.
+func (m *Manager) webhookClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !m.allowedHosts[strings.ToLower(host)] {
+			dialer.Control = dialPublic
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// dialPublic refuses to connect to internal addresses
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalAddress(ip) {
+		return fmt.Errorf("webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+// notify posts a finished job to its webhook, retrying with exponential
+// backoff until the receiver accepts it or the attempts run out
+func (m *Manager) notify(job *Job) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		m.warn(err, "Failed to encode job for its webhook")
+		return
+	}
+
+	backoff := time.Second
+	for job.Webhook.Attempts < m.webhookAttempts {
+		job.Webhook.Attempts++
+		err := m.post(job, body)
+		if err == nil {
+			now := time.Now()
+			job.Webhook.DeliveredAt = &now
+			job.Webhook.LastError = ""
+			webhooksTotal.WithLabelValues("delivered").Inc()
+			return
+		}
+		job.Webhook.LastError = err.Error()
+		webhooksTotal.WithLabelValues("error").Inc()
+
+		if job.Webhook.Attempts >= m.webhookAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-m.ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
+	m.warn(fmt.Errorf("%s", job.Webhook.LastError), "Failed to deliver job webhook")
+}
+
+// post sends one webhook request
+func (m *Manager) post(job *Job, body []byte) error {
+	ctx, cancel := context.WithTimeout(m.ctx, m.webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderJobID, job.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(m.secret, timestamp, body))
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+// Rejection is returned when admission control turns a request away. Clients
+// should retry after RetryAfter rather than wait for a request that would
+// time out.
+type Rejection struct {
+	Err        *errors.Error
+	RetryAfter time.Duration
+}
+
+func (r *Rejection) Error() string {
+	return r.Err.Error()
+}
+
+func (r *Rejection) Unwrap() error {
+	return r.Err
+}
+
+// admission holds the thresholds at which each priority class is turned away
+type admission struct {
+	enabled bool
+	maxSize int
+
+	// classes are ordered by their minimum priority
+	classes []config.AdmissionClass
+
+	defaultRetry time.Duration
+	maxRetry     time.Duration
+}
+
+func newAdmission(cfg *config.Config) (*admission, error) {
+	ac := cfg.Queue.Admission
+	a := &admission{
+		enabled:      ac.Enabled,
+		maxSize:      cfg.Queue.MaxSize,
+		classes:      append([]config.AdmissionClass(nil), ac.Classes...),
+		defaultRetry: ac.DefaultRetryAfter,
+		maxRetry:     ac.MaxRetryAfter,
+	}
+	if a.defaultRetry <= 0 {
+		a.defaultRetry = time.Second
+	}
+	if a.maxRetry < a.defaultRetry {
+		a.maxRetry = time.Minute
+	}
+
+	sort.SliceStable(a.classes, func(i, j int) bool { return a.classes[i].MinPriority < a.classes[j].MinPriority })
+	for i, class := range a.classes {
+		if class.MaxDepth < 0 || class.MaxWait < 0 {
+			return nil, fmt.Errorf("queue: admission class %q has a negative threshold", class.Name)
+		}
+		if i > 0 && class.MinPriority == a.classes[i-1].MinPriority {
+			return nil, fmt.Errorf("queue: admission classes %q and %q share minimum priority %d", a.classes[i-1].Name, class.Name, class.MinPriority)
+		}
+	}
+	return a, nil
+}
+
+// class returns the thresholds for a priority. Priorities below every class
+// are limited only by the queue's size and their deadlines.
+func (a *admission) class(priority int) config.AdmissionClass {
+	class := config.AdmissionClass{Name: "default"}
+	for _, c := range a.classes {
+		if priority < c.MinPriority {
+			break
+		}
+		class = c
+	}
+	return class
+}
+
+// depthLimited reports whether a class is turned away before the queue is
+// full, which the store enforces by itself
+func (a *admission) depthLimited(class config.AdmissionClass) bool {
+	return class.MaxDepth > 0 && (a.maxSize <= 0 || class.MaxDepth < a.maxSize)
+}
+
+// retryAfter rounds an estimate of when a request would be admitted up to
+// whole seconds, falling back to the default when there is no estimate
+func (a *admission) retryAfter(d time.Duration) time.Duration {
+	if d <= 0 {
+		d = a.defaultRetry
+	}
+	if d > a.maxRetry {
+		d = a.maxRetry
+	}
+	if rem := d % time.Second; rem != 0 {
+		d += time.Second - rem
+	}
+	return d
+}
@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// weights resolves a caller's share of a queue level from the configured
+// tenant and role weights
+type weights struct {
+	def     float64
+	tenants map[string]float64
+	roles   map[string]float64
+}
+
+func newWeights(def float64, rules []config.FairnessWeight) (*weights, error) {
+	if def <= 0 {
+		def = 1
+	}
+	w := &weights{
+		def:     def,
+		tenants: make(map[string]float64),
+		roles:   make(map[string]float64),
+	}
+
+	for _, rule := range rules {
+		var target map[string]float64
+		var name string
+		switch {
+		case rule.Tenant != "" && rule.Role != "":
+			return nil, fmt.Errorf("queue: fairness weight sets both tenant %q and role %q", rule.Tenant, rule.Role)
+		case rule.Tenant != "":
+			target, name = w.tenants, rule.Tenant
+		case rule.Role != "":
+			target, name = w.roles, rule.Role
+		default:
+			return nil, fmt.Errorf("queue: fairness weight must set a tenant or a role")
+		}
+		if rule.Weight <= 0 {
+			return nil, fmt.Errorf("queue: fairness weight for %q must be positive", name)
+		}
+		target[name] = rule.Weight
+	}
+	return w, nil
+}
+
+// weight returns the share of a caller. A tenant weight takes precedence,
+// then the largest weight among the caller's roles, then the default.
+func (w *weights) weight(tenant string, roles []string) float64 {
+	if w == nil {
+		return 1
+	}
+	if weight, ok := w.tenants[tenant]; ok {
+		return weight
+	}
+
+	best := 0.0
+	for _, role := range roles {
+		if weight := w.roles[role]; weight > best {
+			best = weight
+		}
+	}
+	if best > 0 {
+		return best
+	}
+	return w.def
+}
+
+// tenantLabel returns the metric label for a tenant. Only the tenants the
+// configuration names are labelled by name, so that callers cannot add
+// metric series without bound.
+func (m *Manager) tenantLabel(tenant string) string {
+	switch {
+	case tenant == "":
+		return "none"
+	case m.config.NamesTenant(tenant):
+		return tenant
+	default:
+		return "other"
+	}
+}
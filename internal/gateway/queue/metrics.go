@@ -0,0 +1,68 @@
+package queue
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Queue metrics
+var (
+	waitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mindgateway_queue_wait_seconds",
+			Help:    "Time requests spent queued before dispatch",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"priority"},
+	)
+
+	tenantWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mindgateway_queue_tenant_wait_seconds",
+			Help:    "Time each tenant's requests spent queued before dispatch or expiry",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"tenant"},
+	)
+
+	expiredTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_queue_expired_total",
+			Help: "Total number of requests whose deadline passed while queued",
+		},
+		[]string{"priority"},
+	)
+
+	redeliveredTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mindgateway_queue_redelivered_total",
+			Help: "Total number of claimed requests returned to the shared queue after their visibility timeout",
+		},
+	)
+
+	abandonedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mindgateway_queue_abandoned_total",
+			Help: "Total number of requests dropped from the shared queue because their gateway replica had gone",
+		},
+	)
+
+	rejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_queue_rejected_total",
+			Help: "Total number of requests rejected because the queue was full",
+		},
+		[]string{"priority"},
+	)
+
+	admissionRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_queue_admission_rejected_total",
+			Help: "Total number of requests turned away by admission control, by priority class and reason",
+		},
+		[]string{"class", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(waitSeconds, tenantWaitSeconds, expiredTotal, rejectedTotal, redeliveredTotal, abandonedTotal, admissionRejectedTotal)
+}
@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Progress describes a queued request's place in the queue
+type Progress struct {
+	// Position counts the request and the requests ahead of it that wait for
+	// the same workers, so the next one to be served is at position 1
+	Position int
+
+	// ETA estimates the remaining wait from the rate at which requests for
+	// the same workers have recently left the queue. It is zero until such a
+	// rate has been observed.
+	ETA time.Duration
+
+	// Waited is how long the request has been queued
+	Waited time.Duration
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context whose request reports its progress to fn
+// while it waits in the queue. fn is called from the goroutine that submitted
+// the request.
+func WithProgress(ctx context.Context, fn func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFunc(ctx context.Context) func(Progress) {
+	fn, _ := ctx.Value(progressKey{}).(func(Progress))
+	return fn
+}
+
+// rateSmoothing is the weight of the newest sample in each service interval
+const rateSmoothing = 0.3
+
+// serviceRates estimates how quickly the requests competing for each group
+// of workers leave the queue. It compares successive snapshots, so requests
+// dispatched or cancelled by other replicas count too. The dispatcher
+// updates it on every pass.
+type serviceRates struct {
+	mu sync.Mutex
+
+	// seen maps the IDs of the jobs in the last snapshot to their keys
+	seen  map[string]string
+	rates map[string]*serviceRate
+
+	// waiting counts the jobs in the last snapshot by key and priority
+	waiting map[string]map[int]int
+}
+
+type serviceRate struct {
+	// since is when the current sample started, and zero while nothing waits
+	// for the key's workers, so that idle time is not counted
+	since time.Time
+
+	// interval is the smoothed time between departures
+	interval time.Duration
+}
+
+func newServiceRates() *serviceRates {
+	return &serviceRates{
+		seen:    make(map[string]string),
+		rates:   make(map[string]*serviceRate),
+		waiting: make(map[string]map[int]int),
+	}
+}
+
+// observe updates the service intervals from the latest snapshot of the queue
+func (r *serviceRates) observe(now time.Time, jobs []*Job) {
+	current := make(map[string]string, len(jobs))
+	waiting := make(map[string]map[int]int)
+	for _, job := range jobs {
+		current[job.ID] = job.key
+		if waiting[job.key] == nil {
+			waiting[job.key] = make(map[int]int)
+		}
+		waiting[job.key][job.Priority]++
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waiting = waiting
+
+	departed := make(map[string]int)
+	for id, key := range r.seen {
+		if _, ok := current[id]; !ok {
+			departed[key]++
+		}
+	}
+	r.seen = current
+
+	for key, n := range departed {
+		rate := r.rates[key]
+		if rate == nil || rate.since.IsZero() {
+			continue
+		}
+		sample := now.Sub(rate.since) / time.Duration(n)
+		if rate.interval == 0 {
+			rate.interval = sample
+		} else {
+			rate.interval = time.Duration(rateSmoothing*float64(sample) + (1-rateSmoothing)*float64(rate.interval))
+		}
+		rate.since = now
+	}
+
+	backlog := make(map[string]bool, len(current))
+	for _, key := range current {
+		backlog[key] = true
+	}
+	for key, rate := range r.rates {
+		if !backlog[key] {
+			rate.since = time.Time{}
+		}
+	}
+	for key := range backlog {
+		rate := r.rates[key]
+		if rate == nil {
+			rate = &serviceRate{}
+			r.rates[key] = rate
+		}
+		if rate.since.IsZero() {
+			rate.since = now
+		}
+	}
+}
+
+// eta estimates the wait of the job at a position among those sharing a key
+func (r *serviceRates) eta(key string, position int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.etaLocked(key, position)
+}
+
+func (r *serviceRates) etaLocked(key string, position int) time.Duration {
+	rate := r.rates[key]
+	if rate == nil {
+		return 0
+	}
+	return time.Duration(position) * rate.interval
+}
+
+// predict estimates the wait of a job joining the queue behind the jobs of
+// equal or higher priority that compete for the same workers. It is zero
+// when there is no rate to go by.
+func (r *serviceRates) predict(key string, priority int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ahead := 0
+	for p, n := range r.waiting[key] {
+		if p >= priority {
+			ahead += n
+		}
+	}
+	return r.etaLocked(key, ahead+1)
+}
@@ -0,0 +1,362 @@
+package queue
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+// Job is a request waiting in the queue for worker capacity
+type Job struct {
+	ID         string
+	Request    *routing.Request
+	Priority   int
+	Deadline   time.Time
+	EnqueuedAt time.Time
+
+	// Tenant is the sub-queue the job waits in within its priority level and
+	// Weight the tenant's share of the level while the job is queued
+	Tenant string
+	Weight float64
+
+	// seq records arrival order, which breaks ties between tenants
+	seq uint64
+
+	// key groups the job with the jobs that compete for the same workers
+	key string
+
+	// progress is the job's place in the queue as of the last dispatch pass,
+	// guarded by the manager's lock
+	progress Progress
+
+	// result receives the worker the job was dispatched to, or the error
+	// that ended its wait
+	result chan result
+}
+
+type result struct {
+	worker worker.Worker
+	err    error
+}
+
+// expired reports whether the job's deadline has passed
+func (j *Job) expired(now time.Time) bool {
+	return !j.Deadline.IsZero() && !now.Before(j.Deadline)
+}
+
+// snapshotProgress returns the job's progress with its current wait
+func (j *Job) snapshotProgress() Progress {
+	p := j.progress
+	p.Waited = time.Since(j.EnqueuedAt)
+	return p
+}
+
+// cost returns the virtual time the job takes from its tenant's share
+func (j *Job) cost() float64 {
+	if j.Weight <= 0 {
+		return 1
+	}
+	return 1 / j.Weight
+}
+
+// level holds the jobs of one priority level in per-tenant sub-queues,
+// scheduled by weighted fair queuing. Each tenant's next job is tagged with
+// the virtual time at which it would finish if the tenant were served at its
+// weight, and the job with the earliest tag goes first. A tenant that has
+// been idle starts again from the level's current virtual time, so it cannot
+// bank a share it did not use.
+type level struct {
+	tenants map[string]*tenantQueue
+	size    int
+
+	// vtime is the virtual start time of the last job taken from the level
+	vtime float64
+}
+
+type tenantQueue struct {
+	jobs []*Job
+
+	// finish is the virtual finish time of the tenant's last dispatched job,
+	// and so the virtual start time of its next one
+	finish float64
+}
+
+func newLevel() *level {
+	return &level{tenants: make(map[string]*tenantQueue)}
+}
+
+// push adds a job to a tenant's sub-queue
+func (l *level) push(key string, job *Job) {
+	t := l.tenants[key]
+	if t == nil {
+		t = &tenantQueue{}
+		l.tenants[key] = t
+	}
+	if len(t.jobs) == 0 && t.finish < l.vtime {
+		t.finish = l.vtime
+	}
+	t.jobs = append(t.jobs, job)
+	l.size++
+}
+
+// next returns the tenant whose head job is served next
+func (l *level) next() *tenantQueue {
+	var best *tenantQueue
+	var bestTag float64
+	for _, t := range l.tenants {
+		if len(t.jobs) == 0 {
+			continue
+		}
+		tag := t.finish + t.jobs[0].cost()
+		if best == nil || tag < bestTag || (tag == bestTag && t.jobs[0].seq < best.jobs[0].seq) {
+			best, bestTag = t, tag
+		}
+	}
+	return best
+}
+
+// order returns the level's jobs in the order they would be served if every
+// one of them were dispatched, without charging any tenant
+func (l *level) order() []*Job {
+	type cursor struct {
+		t      *tenantQueue
+		pos    int
+		finish float64
+	}
+	cursors := make([]*cursor, 0, len(l.tenants))
+	for _, t := range l.tenants {
+		if len(t.jobs) > 0 {
+			cursors = append(cursors, &cursor{t: t, finish: t.finish})
+		}
+	}
+
+	jobs := make([]*Job, 0, l.size)
+	for len(jobs) < l.size {
+		var best *cursor
+		var bestTag float64
+		for _, c := range cursors {
+			if c.pos == len(c.t.jobs) {
+				continue
+			}
+			tag := c.finish + c.t.jobs[c.pos].cost()
+			if best == nil || tag < bestTag || (tag == bestTag && c.t.jobs[c.pos].seq < best.t.jobs[best.pos].seq) {
+				best, bestTag = c, tag
+			}
+		}
+		best.finish = bestTag
+		jobs = append(jobs, best.t.jobs[best.pos])
+		best.pos++
+	}
+	return jobs
+}
+
+// remove takes a job out of its sub-queue, charging the tenant for it when
+// the job was dispatched
+func (l *level) remove(key string, job *Job, charge bool) bool {
+	t := l.tenants[key]
+	if t == nil {
+		return false
+	}
+	for i, j := range t.jobs {
+		if j != job {
+			continue
+		}
+		if charge {
+			l.vtime = math.Max(l.vtime, t.finish)
+			t.finish += job.cost()
+		}
+		copy(t.jobs[i:], t.jobs[i+1:])
+		t.jobs[len(t.jobs)-1] = nil
+		t.jobs = t.jobs[:len(t.jobs)-1]
+		l.size--
+		l.prune()
+		return true
+	}
+	return false
+}
+
+// prune forgets idle tenants that have no share left to catch up on
+func (l *level) prune() {
+	for key, t := range l.tenants {
+		if len(t.jobs) == 0 && t.finish <= l.vtime {
+			delete(l.tenants, key)
+		}
+	}
+}
+
+// PriorityQueue is a bounded, concurrency-safe multi-level queue. Jobs are
+// ordered by priority level, highest first. Within a level a plain queue
+// serves jobs in arrival order while a fair queue shares the level between
+// tenants by weight.
+type PriorityQueue struct {
+	mu      sync.Mutex
+	levels  []*level
+	size    int
+	maxSize int
+	fair    bool
+	seq     uint64
+}
+
+// NewPriorityQueue creates a queue with priority levels 0 to levels-1
+func NewPriorityQueue(levels, maxSize int) *PriorityQueue {
+	if levels <= 0 {
+		levels = 1
+	}
+	q := &PriorityQueue{
+		levels:  make([]*level, levels),
+		maxSize: maxSize,
+	}
+	for p := range q.levels {
+		q.levels[p] = newLevel()
+	}
+	return q
+}
+
+// NewFairQueue creates a queue with priority levels 0 to levels-1 whose
+// levels are shared between tenants by weight
+func NewFairQueue(levels, maxSize int) *PriorityQueue {
+	q := NewPriorityQueue(levels, maxSize)
+	q.fair = true
+	return q
+}
+
+// Levels returns the number of priority levels
+func (q *PriorityQueue) Levels() int {
+	return len(q.levels)
+}
+
+// Clamp limits a priority to the queue's levels
+func (q *PriorityQueue) Clamp(priority int) int {
+	switch {
+	case priority < 0:
+		return 0
+	case priority >= len(q.levels):
+		return len(q.levels) - 1
+	default:
+		return priority
+	}
+}
+
+// key returns the sub-queue a job waits in
+func (q *PriorityQueue) key(job *Job) string {
+	if !q.fair {
+		return ""
+	}
+	return job.Tenant
+}
+
+// Enqueue adds a job at the back of its tenant's sub-queue in its priority
+// level
+func (q *PriorityQueue) Enqueue(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxSize > 0 && q.size >= q.maxSize {
+		return ErrQueueFull
+	}
+
+	job.Priority = q.Clamp(job.Priority)
+	q.seq++
+	job.seq = q.seq
+
+	q.levels[job.Priority].push(q.key(job), job)
+	q.size++
+	return nil
+}
+
+// Dequeue removes and returns the next job to serve, or nil when the queue
+// is empty
+func (q *PriorityQueue) Dequeue() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for p := len(q.levels) - 1; p >= 0; p-- {
+		l := q.levels[p]
+		if t := l.next(); t != nil {
+			job := t.jobs[0]
+			l.remove(q.key(job), job, true)
+			q.size--
+			return job
+		}
+	}
+	return nil
+}
+
+// Take removes a job that has been dispatched, charging it to its tenant's
+// share. It returns false when the job is no longer queued.
+func (q *PriorityQueue) Take(job *Job) bool {
+	return q.remove(job, true)
+}
+
+// Remove takes a job that was not dispatched, such as one whose caller gave
+// up, out of the queue. It returns false when the job is no longer queued.
+func (q *PriorityQueue) Remove(job *Job) bool {
+	return q.remove(job, false)
+}
+
+func (q *PriorityQueue) remove(job *Job, charge bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.levels[job.Priority].remove(q.key(job), job, charge) {
+		return false
+	}
+	q.size--
+	return true
+}
+
+// Snapshot returns the queued jobs in the order they would be served
+func (q *PriorityQueue) Snapshot() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]*Job, 0, q.size)
+	for p := len(q.levels) - 1; p >= 0; p-- {
+		jobs = append(jobs, q.levels[p].order()...)
+	}
+	return jobs
+}
+
+// Len returns the number of queued jobs
+func (q *PriorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Waiting returns the number of queued jobs at or above a priority
+func (q *PriorityQueue) Waiting(priority int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for p := q.Clamp(priority); p < len(q.levels); p++ {
+		n += q.levels[p].size
+	}
+	return n
+}
+
+// Depths returns the number of queued jobs at each priority level
+func (q *PriorityQueue) Depths() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	depths := make([]int, len(q.levels))
+	for p, l := range q.levels {
+		depths[p] = l.size
+	}
+	return depths
+}
+
+// Queue errors
+var (
+	ErrQueueFull   = &errors.Error{Code: errors.ErrRateLimited.Code, Message: "Request queue is full"}
+	ErrBacklogged  = &errors.Error{Code: errors.ErrRateLimited.Code, Message: "Request queue is too long to serve the request in time"}
+	ErrExpired     = &errors.Error{Code: errors.ErrTimeout.Code, Message: "Request deadline passed while queued"}
+	ErrStopped     = &errors.Error{Code: errors.ErrServiceUnavailable.Code, Message: "Request queue is shutting down"}
+	ErrUnavailable = &errors.Error{Code: errors.ErrServiceUnavailable.Code, Message: "Request queue is unavailable"}
+)
@@ -0,0 +1,571 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// RedisStore keeps queued jobs in Redis so that every gateway replica shares
+// one queue. Each priority level is a sorted set of job IDs scored by arrival,
+// with the fair queuing state of its tenants in a hash, and job records live
+// in a hash keyed by job ID.
+//
+// A claimed job moves to a processing set until it is acknowledged, and
+// returns to its place in the queue if its visibility timeout passes first.
+// Every replica renews a lease while it runs. Jobs queued by a replica whose
+// lease has lapsed are dropped, since their callers went with it.
+type RedisStore struct {
+	client     redis.UniversalClient
+	prefix     string
+	replica    string
+	levels     int
+	maxSize    int
+	fair       bool
+	visibility time.Duration
+	scanLimit  int
+
+	mu           sync.Mutex
+	renewedAt    time.Time
+	maintainedAt time.Time
+}
+
+// redisJob is the record kept for each queued job
+type redisJob struct {
+	ID         string  `json:"id"`
+	Replica    string  `json:"replica"`
+	Priority   int     `json:"priority"`
+	Tenant     string  `json:"tenant,omitempty"`
+	Weight     float64 `json:"weight"`
+	Key        string  `json:"key,omitempty"`
+	Seq        uint64  `json:"seq"`
+	Deadline   int64   `json:"deadline_ms,omitempty"`
+	EnqueuedAt int64   `json:"enqueued_at_ms"`
+}
+
+// NewRedisStore creates a store that keeps the queue in Redis
+func NewRedisStore(client redis.UniversalClient, cfg *config.Config) (*RedisStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("queue: redis client is required")
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("queue: config is required")
+	}
+
+	qc := cfg.Queue
+	s := &RedisStore{
+		client:     client,
+		prefix:     qc.Redis.KeyPrefix,
+		replica:    replicaID(),
+		levels:     qc.Levels,
+		maxSize:    qc.MaxSize,
+		fair:       qc.Fairness.Enabled,
+		visibility: qc.Redis.VisibilityTimeout,
+		scanLimit:  qc.Redis.ScanLimit,
+	}
+	if s.prefix == "" {
+		s.prefix = "{mindgateway:queue}"
+	}
+	if s.levels <= 0 {
+		s.levels = 1
+	}
+	if s.visibility <= 0 {
+		s.visibility = 30 * time.Second
+	}
+	if s.scanLimit <= 0 {
+		s.scanLimit = 500
+	}
+	return s, nil
+}
+
+// replicaID names this process in the shared queue. The random suffix keeps
+// a restarted gateway from claiming the jobs its previous process queued.
+func replicaID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gateway"
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return host + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// Replica returns the name this store's gateway holds its lease under
+func (s *RedisStore) Replica() string {
+	return s.replica
+}
+
+func (s *RedisStore) key(parts ...string) string {
+	k := s.prefix
+	for _, p := range parts {
+		k += ":" + p
+	}
+	return k
+}
+
+func (s *RedisStore) pendingKey(priority int) string {
+	return s.key("pending", strconv.Itoa(priority))
+}
+
+func (s *RedisStore) levelKey(priority int) string {
+	return s.key("level", strconv.Itoa(priority))
+}
+
+// tenantKey returns the sub-queue a job waits in
+func (s *RedisStore) tenantKey(tenant string) string {
+	if !s.fair {
+		return ""
+	}
+	return tenant
+}
+
+// pushScript adds a job ID to its tenant's sub-queue. A tenant that was idle
+// starts from the level's virtual time, as in the in-memory queue.
+const pushScript = `
+local n = redis.call('HINCRBY', KEYS[2], 'n:' .. ARGV[2], 1)
+if n == 1 then
+  local finish = tonumber(redis.call('HGET', KEYS[2], 'f:' .. ARGV[2]) or '0')
+  local vtime = tonumber(redis.call('HGET', KEYS[2], 'vtime') or '0')
+  if finish < vtime then
+    redis.call('HSET', KEYS[2], 'f:' .. ARGV[2], string.format('%.17g', vtime))
+  end
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+redis.call('INCR', KEYS[3])
+`
+
+// popScript drops a job ID from its tenant's sub-queue, forgetting tenants
+// that are idle and have no share left to catch up on
+const popScript = `
+local function pop(level, tenant)
+  local n = redis.call('HINCRBY', level, 'n:' .. tenant, -1)
+  if n > 0 then
+    return
+  end
+  redis.call('HDEL', level, 'n:' .. tenant)
+  local finish = tonumber(redis.call('HGET', level, 'f:' .. tenant) or '0')
+  local vtime = tonumber(redis.call('HGET', level, 'vtime') or '0')
+  if finish <= vtime then
+    redis.call('HDEL', level, 'f:' .. tenant)
+  end
+end
+`
+
+// KEYS: pending, level, size, jobs
+// ARGV: id, tenant, seq, record, max size
+var enqueueScript = redis.NewScript(`
+local max = tonumber(ARGV[5])
+if max > 0 and tonumber(redis.call('GET', KEYS[3]) or '0') >= max then
+  return 0
+end
+` + pushScript + `
+redis.call('HSET', KEYS[4], ARGV[1], ARGV[4])
+return 1
+`)
+
+// KEYS: pending, level, size, processing
+// ARGV: id, tenant, cost, lease deadline
+var takeScript = redis.NewScript(popScript + `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+  return 0
+end
+redis.call('DECR', KEYS[3])
+local fkey = 'f:' .. ARGV[2]
+local finish = tonumber(redis.call('HGET', KEYS[2], fkey) or '0')
+local vtime = tonumber(redis.call('HGET', KEYS[2], 'vtime') or '0')
+if finish > vtime then
+  redis.call('HSET', KEYS[2], 'vtime', string.format('%.17g', finish))
+end
+redis.call('HSET', KEYS[2], fkey, string.format('%.17g', finish + tonumber(ARGV[3])))
+pop(KEYS[2], ARGV[2])
+redis.call('ZADD', KEYS[4], ARGV[4], ARGV[1])
+return 1
+`)
+
+// KEYS: pending, level, size, jobs
+// ARGV: id, tenant
+var removeScript = redis.NewScript(popScript + `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+  return 0
+end
+redis.call('DECR', KEYS[3])
+redis.call('HDEL', KEYS[4], ARGV[1])
+pop(KEYS[2], ARGV[2])
+return 1
+`)
+
+// KEYS: pending, level, size, processing
+// ARGV: id, tenant, seq, now
+var redeliverScript = redis.NewScript(`
+local lease = redis.call('ZSCORE', KEYS[4], ARGV[1])
+if not lease or tonumber(lease) > tonumber(ARGV[4]) then
+  return 0
+end
+redis.call('ZREM', KEYS[4], ARGV[1])
+` + pushScript + `
+return 1
+`)
+
+// Enqueue adds a job at the back of its tenant's sub-queue
+func (s *RedisStore) Enqueue(ctx context.Context, job *Job) error {
+	if err := s.renew(ctx, false); err != nil {
+		return err
+	}
+
+	seq, err := s.client.Incr(ctx, s.key("seq")).Uint64()
+	if err != nil {
+		return err
+	}
+	job.seq = seq
+
+	rec := redisJob{
+		ID:         job.ID,
+		Replica:    s.replica,
+		Priority:   job.Priority,
+		Tenant:     job.Tenant,
+		Weight:     job.Weight,
+		Key:        job.key,
+		Seq:        seq,
+		EnqueuedAt: job.EnqueuedAt.UnixMilli(),
+	}
+	if !job.Deadline.IsZero() {
+		rec.Deadline = job.Deadline.UnixMilli()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	added, err := enqueueScript.Run(ctx, s.client,
+		[]string{s.pendingKey(job.Priority), s.levelKey(job.Priority), s.key("size"), s.key("jobs")},
+		job.ID, s.tenantKey(job.Tenant), seq, data, s.maxSize,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// Snapshot returns the jobs at the front of each level in the order they
+// would be served. At most the configured scan limit is read per level.
+func (s *RedisStore) Snapshot(ctx context.Context) ([]*Job, error) {
+	ids := make([]*redis.StringSliceCmd, s.levels)
+	states := make([]*redis.MapStringStringCmd, s.levels)
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for p := 0; p < s.levels; p++ {
+			ids[p] = pipe.ZRange(ctx, s.pendingKey(p), 0, int64(s.scanLimit-1))
+			states[p] = pipe.HGetAll(ctx, s.levelKey(p))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var all []string
+	for _, cmd := range ids {
+		all = append(all, cmd.Val()...)
+	}
+	if len(all) == 0 {
+		return nil, nil
+	}
+	records, err := s.records(ctx, all)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0, len(all))
+	for p := s.levels - 1; p >= 0; p-- {
+		state := states[p].Val()
+		l := newLevel()
+		l.vtime = parseFloat(state["vtime"])
+
+		for _, id := range ids[p].Val() {
+			rec, ok := records[id]
+			if !ok {
+				continue
+			}
+			key := s.tenantKey(rec.Tenant)
+			t := l.tenants[key]
+			if t == nil {
+				t = &tenantQueue{finish: parseFloat(state["f:"+key])}
+				l.tenants[key] = t
+			}
+			t.jobs = append(t.jobs, rec.job())
+			l.size++
+		}
+		jobs = append(jobs, l.order()...)
+	}
+	return jobs, nil
+}
+
+// records loads the job records for a set of job IDs, skipping jobs that
+// have already left the queue
+func (s *RedisStore) records(ctx context.Context, ids []string) (map[string]redisJob, error) {
+	vals, err := s.client.HMGet(ctx, s.key("jobs"), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]redisJob, len(ids))
+	for i, v := range vals {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var rec redisJob
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			continue
+		}
+		records[ids[i]] = rec
+	}
+	return records, nil
+}
+
+// job returns the queued job a record describes
+func (r redisJob) job() *Job {
+	j := &Job{
+		ID:         r.ID,
+		Priority:   r.Priority,
+		Tenant:     r.Tenant,
+		Weight:     r.Weight,
+		EnqueuedAt: time.UnixMilli(r.EnqueuedAt),
+		seq:        r.Seq,
+		key:        r.Key,
+	}
+	if r.Deadline != 0 {
+		j.Deadline = time.UnixMilli(r.Deadline)
+	}
+	return j
+}
+
+// Take claims a dispatched job for the visibility timeout
+func (s *RedisStore) Take(ctx context.Context, job *Job) (bool, error) {
+	lease := time.Now().Add(s.visibility).UnixMilli()
+	taken, err := takeScript.Run(ctx, s.client,
+		[]string{s.pendingKey(job.Priority), s.levelKey(job.Priority), s.key("size"), s.key("processing")},
+		job.ID, s.tenantKey(job.Tenant), strconv.FormatFloat(job.cost(), 'g', -1, 64), lease,
+	).Int()
+	return taken == 1, err
+}
+
+// Ack drops a claimed job once it has been delivered
+func (s *RedisStore) Ack(ctx context.Context, job *Job) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, s.key("processing"), job.ID)
+		pipe.HDel(ctx, s.key("jobs"), job.ID)
+		return nil
+	})
+	return err
+}
+
+// Remove takes a job that was not dispatched out of the queue
+func (s *RedisStore) Remove(ctx context.Context, job *Job) (bool, error) {
+	removed, err := removeScript.Run(ctx, s.client,
+		[]string{s.pendingKey(job.Priority), s.levelKey(job.Priority), s.key("size"), s.key("jobs")},
+		job.ID, s.tenantKey(job.Tenant),
+	).Int()
+	return removed == 1, err
+}
+
+// Waiting returns the number of queued jobs at or above a priority
+func (s *RedisStore) Waiting(ctx context.Context, priority int) (int, error) {
+	depths, err := s.Depths(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case priority < 0:
+		priority = 0
+	case priority >= len(depths):
+		priority = len(depths) - 1
+	}
+	n := 0
+	for p := priority; p < len(depths); p++ {
+		n += depths[p]
+	}
+	return n, nil
+}
+
+// Depths returns the number of queued jobs at each priority level
+func (s *RedisStore) Depths(ctx context.Context) ([]int, error) {
+	cmds := make([]*redis.IntCmd, s.levels)
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for p := range cmds {
+			cmds[p] = pipe.ZCard(ctx, s.pendingKey(p))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	depths := make([]int, s.levels)
+	for p, cmd := range cmds {
+		depths[p] = int(cmd.Val())
+	}
+	return depths, nil
+}
+
+// Len returns the number of queued jobs
+func (s *RedisStore) Len(ctx context.Context) (int, error) {
+	n, err := s.client.Get(ctx, s.key("size")).Int()
+	if stderrors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Maintain renews this replica's lease, returns jobs whose claim was never
+// acknowledged to the queue and drops jobs whose replica has gone. It runs
+// at most three times per visibility timeout.
+func (s *RedisStore) Maintain(ctx context.Context) error {
+	s.mu.Lock()
+	due := time.Since(s.maintainedAt) >= s.visibility/3
+	if due {
+		s.maintainedAt = time.Now()
+	}
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+
+	if err := s.renew(ctx, true); err != nil {
+		return err
+	}
+	if err := s.redeliver(ctx); err != nil {
+		return err
+	}
+	return s.dropAbandoned(ctx)
+}
+
+// renew extends this replica's lease. Unless forced, a lease renewed within
+// the last third of the visibility timeout is left as it is.
+func (s *RedisStore) renew(ctx context.Context, force bool) error {
+	s.mu.Lock()
+	due := force || time.Since(s.renewedAt) >= s.visibility/3
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+
+	now := time.Now()
+	replicas := s.key("replicas")
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, replicas, redis.Z{Score: float64(now.Add(s.visibility).UnixMilli()), Member: s.replica})
+		pipe.ZRemRangeByScore(ctx, replicas, "-inf", "("+strconv.FormatInt(now.UnixMilli(), 10))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.renewedAt = now
+	s.mu.Unlock()
+	return nil
+}
+
+// redeliver returns claimed jobs whose visibility timeout has passed to
+// their place in the queue
+func (s *RedisStore) redeliver(ctx context.Context) error {
+	now := time.Now().UnixMilli()
+	ids, err := s.client.ZRangeByScore(ctx, s.key("processing"), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	records, err := s.records(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		rec, ok := records[id]
+		if !ok {
+			// Acknowledged since the scan
+			s.client.ZRem(ctx, s.key("processing"), id)
+			continue
+		}
+		n, err := redeliverScript.Run(ctx, s.client,
+			[]string{s.pendingKey(rec.Priority), s.levelKey(rec.Priority), s.key("size"), s.key("processing")},
+			id, s.tenantKey(rec.Tenant), rec.Seq, now,
+		).Int()
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			redeliveredTotal.Inc()
+		}
+	}
+	return nil
+}
+
+// dropAbandoned removes queued jobs whose replica no longer holds a lease,
+// and jobs left queued well past their deadline
+func (s *RedisStore) dropAbandoned(ctx context.Context) error {
+	now := time.Now()
+	live, err := s.client.ZRangeByScore(ctx, s.key("replicas"), &redis.ZRangeBy{
+		Min: strconv.FormatInt(now.UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return err
+	}
+	alive := make(map[string]bool, len(live))
+	for _, r := range live {
+		alive[r] = true
+	}
+
+	all, err := s.client.HGetAll(ctx, s.key("jobs")).Result()
+	if err != nil {
+		return err
+	}
+	stale := now.Add(-s.visibility).UnixMilli()
+	for id, data := range all {
+		var rec redisJob
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			s.client.HDel(ctx, s.key("jobs"), id)
+			continue
+		}
+		if alive[rec.Replica] && (rec.Deadline == 0 || rec.Deadline > stale) {
+			continue
+		}
+
+		removed, err := s.Remove(ctx, rec.job())
+		if err != nil {
+			return err
+		}
+		if removed {
+			abandonedTotal.Inc()
+		}
+	}
+	return nil
+}
+
+// Close gives up this replica's lease so that other replicas drop anything
+// it left queued without waiting for the lease to lapse
+func (s *RedisStore) Close(ctx context.Context) error {
+	return s.client.ZRem(ctx, s.key("replicas"), s.replica).Err()
+}
+
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
@@ -0,0 +1,718 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/handlers"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+)
+
+// Router routes dispatched jobs to workers
+type Router interface {
+	RouteRequest(ctx context.Context, req *routing.Request) (worker.Worker, error)
+	RouteFallback(ctx context.Context, req *routing.Request) (worker.Worker, error)
+	ReportResult(req *routing.Request, workerID string, latency time.Duration, err error)
+	Fallbacks(model string) []string
+	Preempt(ctx context.Context, req *routing.Request) bool
+}
+
+// Manager queues requests while every eligible worker is at capacity and
+// dispatches them, highest priority first, as capacity frees up
+type Manager struct {
+	config *config.Config
+	logger *logging.Logger
+	router Router
+
+	store          Store
+	levels         int
+	weights        *weights
+	admission      *admission
+	period         time.Duration
+	maxWait        time.Duration
+	fallbackMargin time.Duration
+	progressEvery  time.Duration
+
+	// rates is owned by the dispatcher goroutine
+	rates *serviceRates
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	started bool
+	stopped bool
+
+	// jobs holds the jobs whose callers are waiting on this gateway
+	jobs map[string]*Job
+}
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// New creates a new queue manager
+func New(opts ...Option) (*Manager, error) {
+	m := &Manager{
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		jobs:  make(map[string]*Job),
+		rates: newServiceRates(),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.config == nil {
+		return nil, fmt.Errorf("queue: config is required")
+	}
+	if m.router == nil {
+		return nil, fmt.Errorf("queue: router is required")
+	}
+
+	cfg := m.config.Queue
+	m.levels = cfg.Levels
+	if m.levels <= 0 {
+		m.levels = 1
+	}
+	if cfg.Fairness.Enabled {
+		w, err := newWeights(cfg.Fairness.DefaultWeight, cfg.Fairness.Weights)
+		if err != nil {
+			return nil, err
+		}
+		m.weights = w
+	}
+	a, err := newAdmission(m.config)
+	if err != nil {
+		return nil, err
+	}
+	m.admission = a
+	if m.store == nil {
+		if cfg.Fairness.Enabled {
+			m.store = NewMemoryStore(NewFairQueue(m.levels, cfg.MaxSize))
+		} else {
+			m.store = NewMemoryStore(NewPriorityQueue(m.levels, cfg.MaxSize))
+		}
+	}
+	m.period = cfg.ProcessingPeriod
+	if m.period <= 0 {
+		m.period = 100 * time.Millisecond
+	}
+	m.maxWait = cfg.MaxWait
+	m.fallbackMargin = cfg.FallbackMargin
+	m.progressEvery = cfg.ProgressInterval
+	if m.progressEvery <= 0 {
+		m.progressEvery = time.Second
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	return m, nil
+}
+
+// WithConfig sets the queue configuration
+func WithConfig(cfg *config.Config) Option {
+	return func(m *Manager) {
+		m.config = cfg
+	}
+}
+
+// WithLogger sets the queue logger
+func WithLogger(logger *logging.Logger) Option {
+	return func(m *Manager) {
+		m.logger = logger
+	}
+}
+
+// WithRouter sets the router used to dispatch jobs
+func WithRouter(router Router) Option {
+	return func(m *Manager) {
+		m.router = router
+	}
+}
+
+// WithStore sets the store that keeps queued jobs, in memory by default
+func WithStore(store Store) Option {
+	return func(m *Manager) {
+		m.store = store
+	}
+}
+
+// Start runs the dispatcher until Stop is called
+func (m *Manager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		return
+	}
+	m.started = true
+	go m.run()
+}
+
+// Stop stops the dispatcher and fails every queued request
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return nil
+	}
+	m.stopped = true
+	started := m.started
+	m.mu.Unlock()
+
+	m.cancel()
+	if !started {
+		m.drain()
+		return m.store.Close(ctx)
+	}
+
+	select {
+	case <-m.done:
+		return m.store.Close(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Submit returns a worker for the request, waiting in the queue while every
+// eligible worker is at capacity. The wait ends at the earlier of the
+// context's deadline and the configured maximum wait. Requests that the
+// queue could not serve in time are rejected with a Rejection telling the
+// client when to retry. While the request
+// waits, its progress is reported to the function set with WithProgress. The
+// worker must be reported to the router once it has answered.
+func (m *Manager) Submit(ctx context.Context, req *routing.Request) (worker.Worker, error) {
+	if m.isStopped() {
+		return worker.Worker{}, ErrStopped
+	}
+
+	// Requests go straight to a worker while nothing of equal or higher
+	// priority is waiting
+	waiting, err := m.store.Waiting(ctx, req.Priority)
+	if err != nil {
+		return worker.Worker{}, m.unavailable(err)
+	}
+	if waiting == 0 {
+		w, err := m.router.RouteRequest(ctx, req)
+		if !stderrors.Is(err, errors.ErrWorkersAtCapacity) {
+			return w, err
+		}
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:         newJobID(),
+		Request:    req,
+		Priority:   m.clamp(req.Priority),
+		EnqueuedAt: now,
+		Tenant:     req.Tenant,
+		Weight:     m.weights.weight(req.Tenant, req.Roles),
+		key:        capacityKey(req),
+		result:     make(chan result, 1),
+	}
+	maxWait := m.maxWait
+	if d, ok := ctx.Value(maxWaitKey{}).(time.Duration); ok {
+		maxWait = d
+	}
+	if maxWait > 0 {
+		job.Deadline = now.Add(maxWait)
+	}
+	if d, ok := ctx.Deadline(); ok && (job.Deadline.IsZero() || d.Before(job.Deadline)) {
+		job.Deadline = d
+	}
+
+	class := m.admission.class(job.Priority)
+	if err := m.admit(ctx, job, class, now); err != nil {
+		return worker.Worker{}, err
+	}
+
+	m.track(job)
+	if err := m.store.Enqueue(ctx, job); err != nil {
+		m.untrack(job)
+		if stderrors.Is(err, ErrQueueFull) {
+			rejectedTotal.WithLabelValues(strconv.Itoa(job.Priority)).Inc()
+			return worker.Worker{}, m.reject(class, "full", ErrQueueFull, m.rates.eta(job.key, 1))
+		}
+		return worker.Worker{}, m.unavailable(err)
+	}
+	m.updateMetrics()
+	m.Notify()
+
+	// The first report follows the dispatcher's first pass over the job
+	var timer *time.Timer
+	var tick <-chan time.Time
+	report := progressFunc(ctx)
+	if report != nil {
+		timer = time.NewTimer(m.period)
+		defer timer.Stop()
+		tick = timer.C
+	}
+
+wait:
+	for {
+		select {
+		case res := <-job.result:
+			m.ack(job)
+			req.QueueWait = time.Since(job.EnqueuedAt)
+			return res.worker, res.err
+		case <-tick:
+			if p, ok := m.progress(job); ok {
+				report(p)
+			}
+			timer.Reset(m.progressEvery)
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	if m.finish(job) {
+		m.remove(job)
+		if stderrors.Is(ctx.Err(), context.DeadlineExceeded) {
+			m.expire(job)
+			return worker.Worker{}, ErrExpired
+		}
+		return worker.Worker{}, ctx.Err()
+	}
+
+	// The dispatcher finished the job as the caller gave up
+	res := <-job.result
+	m.ack(job)
+	if res.err == nil {
+		m.router.ReportResult(req, res.worker.ID, 0, context.Canceled)
+	}
+	if stderrors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return worker.Worker{}, ErrExpired
+	}
+	return worker.Worker{}, ctx.Err()
+}
+
+type maxWaitKey struct{}
+
+// WithMaxWait returns a context whose request may wait in the queue for up to
+// d rather than the configured maximum, for callers that are not holding a
+// connection open
+func WithMaxWait(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxWaitKey{}, d)
+}
+
+// Notify wakes the dispatcher, typically after a worker has freed capacity
+func (m *Manager) Notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Depth returns the number of queued requests
+func (m *Manager) Depth() int {
+	n, err := m.store.Len(m.ctx)
+	if err != nil {
+		m.warn(err, "Failed to read queue depth")
+	}
+	return n
+}
+
+// Progress returns the progress of a request waiting in the queue on this
+// gateway, or false when it is not queued here
+func (m *Manager) Progress(requestID string) (Progress, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, job := range m.jobs {
+		if job.Request.ID == requestID {
+			return job.snapshotProgress(), true
+		}
+	}
+	return Progress{}, false
+}
+
+// Stats describes the current state of the queue
+type Stats struct {
+	Depth        int           `json:"depth"`
+	MaxSize      int           `json:"max_size"`
+	Levels       []LevelStats  `json:"levels"`
+	Tenants      []TenantStats `json:"tenants"`
+	OldestWaitMs float64       `json:"oldest_wait_ms"`
+}
+
+// LevelStats describes one priority level of the queue
+type LevelStats struct {
+	Priority int `json:"priority"`
+	Depth    int `json:"depth"`
+}
+
+// TenantStats describes one tenant's queued requests
+type TenantStats struct {
+	Tenant       string  `json:"tenant"`
+	Depth        int     `json:"depth"`
+	OldestWaitMs float64 `json:"oldest_wait_ms"`
+}
+
+// Stats returns the current state of the queue
+func (m *Manager) Stats() Stats {
+	stats := Stats{MaxSize: m.config.Queue.MaxSize}
+
+	depths, err := m.store.Depths(m.ctx)
+	if err != nil {
+		m.warn(err, "Failed to read queue depths")
+	}
+	for p, depth := range depths {
+		stats.Levels = append(stats.Levels, LevelStats{Priority: p, Depth: depth})
+		stats.Depth += depth
+	}
+
+	jobs, err := m.store.Snapshot(m.ctx)
+	if err != nil {
+		m.warn(err, "Failed to read queue")
+	}
+
+	var oldest time.Duration
+	tenants := make(map[string]*TenantStats)
+	for _, job := range jobs {
+		wait := time.Since(job.EnqueuedAt)
+		if wait > oldest {
+			oldest = wait
+		}
+
+		ts := tenants[job.Tenant]
+		if ts == nil {
+			ts = &TenantStats{Tenant: job.Tenant}
+			tenants[job.Tenant] = ts
+		}
+		ts.Depth++
+		if ms := milliseconds(wait); ms > ts.OldestWaitMs {
+			ts.OldestWaitMs = ms
+		}
+	}
+	stats.OldestWaitMs = milliseconds(oldest)
+
+	for _, ts := range tenants {
+		stats.Tenants = append(stats.Tenants, *ts)
+	}
+	sort.Slice(stats.Tenants, func(i, j int) bool { return stats.Tenants[i].Tenant < stats.Tenants[j].Tenant })
+	return stats
+}
+
+func (m *Manager) isStopped() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopped
+}
+
+// run is the dispatcher loop
+func (m *Manager) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.drain()
+			return
+		case <-m.wake:
+		case <-ticker.C:
+			if err := m.store.Maintain(m.ctx); err != nil {
+				m.warn(err, "Queue maintenance failed")
+			}
+		}
+		m.dispatch()
+	}
+}
+
+// dispatch makes one pass over the queue in priority order, handing a worker
+// to every job waiting on this gateway that can be served
+func (m *Manager) dispatch() {
+	now := time.Now()
+
+	jobs, err := m.store.Snapshot(m.ctx)
+	if err != nil {
+		m.warn(err, "Failed to read queue")
+		return
+	}
+
+	m.rates.observe(now, jobs)
+
+	// Jobs sharing a model and constraints with a job that found no capacity
+	// in this pass are not routed again, so smaller requests cannot take the
+	// token budget a larger one ahead of them is waiting for
+	busy := make(map[string]bool)
+
+	// ahead counts the jobs left waiting for each group of workers, which
+	// gives every job its position
+	ahead := make(map[string]int)
+
+	for _, queued := range jobs {
+		// Jobs queued by other replicas are dispatched by their own gateway
+		job := m.lookup(queued.ID)
+		if job == nil {
+			ahead[queued.key]++
+			continue
+		}
+
+		if job.expired(now) {
+			if m.finish(job) {
+				m.remove(job)
+				m.expire(job)
+				job.result <- result{err: ErrExpired}
+			}
+			continue
+		}
+
+		w, err := worker.Worker{}, error(errors.ErrWorkersAtCapacity)
+		if !busy[job.key] {
+			w, err = m.router.RouteRequest(m.ctx, job.Request)
+		}
+		if stderrors.Is(err, errors.ErrWorkersAtCapacity) {
+			busy[job.key] = true
+			if m.shouldFallback(job, now) {
+				w, err = m.router.RouteFallback(m.ctx, job.Request)
+			}
+			if err != nil {
+				// A job of a higher lane stops a preemptible request to take
+				// its worker, and is served once the worker reports it
+				m.router.Preempt(m.ctx, job.Request)
+				ahead[job.key]++
+				m.setProgress(job, ahead[job.key])
+				continue
+			}
+		}
+
+		m.deliver(job, w, err)
+	}
+
+	m.updateMetrics()
+}
+
+// admit turns a job away before it is queued when the queue is deeper than
+// its priority class allows, or when its predicted wait would pass its
+// deadline or the class's maximum wait
+func (m *Manager) admit(ctx context.Context, job *Job, class config.AdmissionClass, now time.Time) error {
+	if !m.admission.enabled {
+		return nil
+	}
+
+	if m.admission.depthLimited(class) {
+		depth, err := m.store.Len(ctx)
+		if err != nil {
+			return m.unavailable(err)
+		}
+		if depth >= class.MaxDepth {
+			return m.reject(class, "depth", ErrQueueFull, m.rates.eta(job.key, depth-class.MaxDepth+1))
+		}
+	}
+
+	wait := m.rates.predict(job.key, job.Priority)
+	if wait == 0 {
+		return nil
+	}
+	if class.MaxWait > 0 && wait > class.MaxWait {
+		return m.reject(class, "wait", ErrBacklogged, wait-class.MaxWait)
+	}
+	// A job that can fall back to another model is served by the fallback
+	// before its deadline instead
+	canFallback := !job.Request.NoFallback && len(job.Request.Permitted(m.router.Fallbacks(job.Request.Model))) > 0
+	if !job.Deadline.IsZero() && !canFallback {
+		if remaining := job.Deadline.Sub(now); wait > remaining {
+			return m.reject(class, "deadline", ErrBacklogged, wait-remaining)
+		}
+	}
+	return nil
+}
+
+// reject records a request turned away by admission control. retry estimates
+// how long the queue needs to make room for it.
+func (m *Manager) reject(class config.AdmissionClass, reason string, err *errors.Error, retry time.Duration) error {
+	admissionRejectedTotal.WithLabelValues(class.Name, reason).Inc()
+	return &Rejection{Err: err, RetryAfter: m.admission.retryAfter(retry)}
+}
+
+// shouldFallback reports whether a job waiting for capacity is close enough to
+// its deadline to be served by a fallback model instead
+func (m *Manager) shouldFallback(job *Job, now time.Time) bool {
+	if job.Request.NoFallback || job.Deadline.IsZero() {
+		return false
+	}
+	if len(job.Request.Permitted(m.router.Fallbacks(job.Request.Model))) == 0 {
+		return false
+	}
+	return job.Deadline.Sub(now) <= m.fallbackMargin
+}
+
+// deliver hands the routing outcome to the waiting caller, releasing the
+// worker if the caller has already gone
+func (m *Manager) deliver(job *Job, w worker.Worker, err error) {
+	if !m.finish(job) {
+		if err == nil {
+			m.router.ReportResult(job.Request, w.ID, 0, context.Canceled)
+		}
+		return
+	}
+
+	// The caller is served even if the store has lost track of the job; the
+	// store only orders the queue
+	if _, terr := m.store.Take(m.ctx, job); terr != nil {
+		m.warn(terr, "Failed to claim queued request")
+	}
+
+	wait := time.Since(job.EnqueuedAt).Seconds()
+	waitSeconds.WithLabelValues(strconv.Itoa(job.Priority)).Observe(wait)
+	tenantWaitSeconds.WithLabelValues(m.tenantLabel(job.Tenant)).Observe(wait)
+	job.result <- result{worker: w, err: err}
+}
+
+// expire records a job whose deadline passed while it was queued
+func (m *Manager) expire(job *Job) {
+	expiredTotal.WithLabelValues(strconv.Itoa(job.Priority)).Inc()
+	tenantWaitSeconds.WithLabelValues(m.tenantLabel(job.Tenant)).Observe(time.Since(job.EnqueuedAt).Seconds())
+}
+
+// setProgress records a waiting job's position and estimated wait
+func (m *Manager) setProgress(job *Job, position int) {
+	eta := m.rates.eta(job.key, position)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.progress = Progress{Position: position, ETA: eta}
+}
+
+// progress returns a waiting job's progress once the dispatcher has placed it
+func (m *Manager) progress(job *Job) (Progress, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if job.progress.Position == 0 {
+		return Progress{}, false
+	}
+	return job.snapshotProgress(), true
+}
+
+// drain fails every job waiting on this gateway
+func (m *Manager) drain() {
+	m.mu.Lock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	m.mu.Unlock()
+
+	for _, job := range jobs {
+		if m.finish(job) {
+			m.remove(job)
+			job.result <- result{err: ErrStopped}
+		}
+	}
+	m.updateMetrics()
+}
+
+// track records a job whose caller waits on this gateway
+func (m *Manager) track(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[job.ID] = job
+}
+
+func (m *Manager) untrack(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, job.ID)
+}
+
+func (m *Manager) lookup(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+// finish marks a job as answered. Exactly one of the caller and the
+// dispatcher finishes each job, and only it may send the job's result.
+func (m *Manager) finish(job *Job) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.jobs[job.ID]; !ok {
+		return false
+	}
+	delete(m.jobs, job.ID)
+	return true
+}
+
+// remove takes a job that was not dispatched out of the store
+func (m *Manager) remove(job *Job) {
+	if _, err := m.store.Remove(m.ctx, job); err != nil {
+		m.warn(err, "Failed to remove queued request")
+	}
+	m.updateMetrics()
+}
+
+// ack confirms a dispatched job's delivery to the store
+func (m *Manager) ack(job *Job) {
+	if err := m.store.Ack(m.ctx, job); err != nil {
+		m.warn(err, "Failed to acknowledge queued request")
+	}
+}
+
+// clamp limits a priority to the queue's levels
+func (m *Manager) clamp(priority int) int {
+	switch {
+	case priority < 0:
+		return 0
+	case priority >= m.levels:
+		return m.levels - 1
+	default:
+		return priority
+	}
+}
+
+func (m *Manager) updateMetrics() {
+	n, err := m.store.Len(m.ctx)
+	if err != nil {
+		return
+	}
+	handlers.UpdateQueueMetrics(n)
+}
+
+// unavailable logs a store failure and returns the error shown to callers
+func (m *Manager) unavailable(err error) error {
+	m.warn(err, "Request queue is unavailable")
+	return ErrUnavailable
+}
+
+func (m *Manager) warn(err error, msg string) {
+	if m.logger != nil && !stderrors.Is(err, context.Canceled) {
+		m.logger.WithError(err).Warn(msg)
+	}
+}
+
+// newJobID returns a random identifier for a queued job
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// capacityKey groups requests that compete for the same workers. Lanes keep
+// separate reservations of each worker, so their requests are kept apart.
+func capacityKey(req *routing.Request) string {
+	return req.Model + "|" + routing.FormatLabels(req.Constraints.Require) + "|" + strconv.FormatBool(req.Shadow) + "|" + req.Lane
+}
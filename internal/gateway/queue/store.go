@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"context"
+)
+
+// Store keeps the queued jobs in priority order. The in-memory store serves a
+// single gateway; RedisStore shares one queue between gateway replicas.
+type Store interface {
+	// Enqueue adds a job to the queue, returning ErrQueueFull when the queue
+	// is at its maximum size
+	Enqueue(ctx context.Context, job *Job) error
+
+	// Snapshot returns the queued jobs in the order they would be served.
+	// Jobs queued by other replicas are included.
+	Snapshot(ctx context.Context) ([]*Job, error)
+
+	// Take claims a dispatched job, charging it to its tenant's share. The
+	// claim must be acknowledged once the waiting caller has its worker.
+	Take(ctx context.Context, job *Job) (bool, error)
+
+	// Ack confirms that a claimed job was delivered
+	Ack(ctx context.Context, job *Job) error
+
+	// Remove takes a job that was not dispatched out of the queue
+	Remove(ctx context.Context, job *Job) (bool, error)
+
+	// Waiting returns the number of queued jobs at or above a priority
+	Waiting(ctx context.Context, priority int) (int, error)
+
+	// Depths returns the number of queued jobs at each priority level
+	Depths(ctx context.Context) ([]int, error)
+
+	// Len returns the number of queued jobs
+	Len(ctx context.Context) (int, error)
+
+	// Maintain performs periodic housekeeping. The dispatcher calls it on
+	// every tick.
+	Maintain(ctx context.Context) error
+
+	// Close releases the store once the dispatcher has stopped
+	Close(ctx context.Context) error
+}
+
+// memoryStore keeps jobs in a PriorityQueue in the gateway's memory
+type memoryStore struct {
+	q *PriorityQueue
+}
+
+// NewMemoryStore returns a store backed by an in-memory queue
+func NewMemoryStore(q *PriorityQueue) Store {
+	return memoryStore{q: q}
+}
+
+func (s memoryStore) Enqueue(_ context.Context, job *Job) error {
+	return s.q.Enqueue(job)
+}
+
+func (s memoryStore) Snapshot(context.Context) ([]*Job, error) {
+	return s.q.Snapshot(), nil
+}
+
+func (s memoryStore) Take(_ context.Context, job *Job) (bool, error) {
+	return s.q.Take(job), nil
+}
+
+func (s memoryStore) Ack(context.Context, *Job) error {
+	return nil
+}
+
+func (s memoryStore) Remove(_ context.Context, job *Job) (bool, error) {
+	return s.q.Remove(job), nil
+}
+
+func (s memoryStore) Waiting(_ context.Context, priority int) (int, error) {
+	return s.q.Waiting(priority), nil
+}
+
+func (s memoryStore) Depths(context.Context) ([]int, error) {
+	return s.q.Depths(), nil
+}
+
+func (s memoryStore) Len(context.Context) (int, error) {
+	return s.q.Len(), nil
+}
+
+func (s memoryStore) Maintain(context.Context) error {
+	return nil
+}
+
+func (s memoryStore) Close(context.Context) error {
+	return nil
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	registrypb "github.com/ncolesummers/mindgateway/pkg/proto/registry"
+)
+
+// Client is a caching gRPC client for the worker registry service
+type Client struct {
+	client  registrypb.RegistryServiceClient
+	refresh time.Duration
+
+	mu        sync.Mutex
+	workers   []worker.Worker
+	fetchedAt time.Time
+}
+
+// NewClient creates a registry client that refreshes its worker list at most
+// once per refresh interval
+func NewClient(conn grpc.ClientConnInterface, refresh time.Duration) *Client {
+	return &Client{
+		client:  registrypb.NewRegistryServiceClient(conn),
+		refresh: refresh,
+	}
+}
+
+// GetActiveWorkers returns every worker that is not offline
+func (c *Client) GetActiveWorkers(ctx context.Context) ([]worker.Worker, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.workers != nil && time.Since(c.fetchedAt) < c.refresh {
+		return c.workers, nil
+	}
+
+	resp, err := c.client.ListWorkers(ctx, &registrypb.ListWorkersRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workers: %w", err)
+	}
+
+	workers := make([]worker.Worker, 0, len(resp.GetWorkers()))
+	for _, w := range resp.GetWorkers() {
+		switch w.GetStatus() {
+		case registrypb.WorkerStatus_OFFLINE, registrypb.WorkerStatus_UNKNOWN:
+			continue
+		}
+		workers = append(workers, fromProto(w))
+	}
+
+	c.workers = workers
+	c.fetchedAt = time.Now()
+
+	return workers, nil
+}
+
+// fromProto converts a registry worker to the gateway's worker type
+func fromProto(w *registrypb.Worker) worker.Worker {
+	models := make([]string, 0, len(w.GetModels()))
+	for _, m := range w.GetModels() {
+		models = append(models, m.GetName())
+	}
+
+	var loaded []string
+	if lm := w.GetLoadedModels(); lm != nil {
+		loaded = append(make([]string, 0, len(lm.GetNames())), lm.GetNames()...)
+	}
+
+	return worker.Worker{
+		ID:           w.GetId(),
+		Name:         w.GetName(),
+		Endpoint:     w.GetEndpoint(),
+		Models:       models,
+		Load:         float64(w.GetLoad()),
+		Status:       w.GetStatus().String(),
+		Metadata:     w.GetMetadata(),
+		LoadedModels: loaded,
+		Batching:     w.GetCapabilities().GetBatching(),
+		MaxBatchSize: int(w.GetCapabilities().GetMaxBatchSize()),
+	}
+}
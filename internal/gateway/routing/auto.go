@@ -0,0 +1,262 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// Prompt content classes
+const (
+	ContentCode  = "code"
+	ContentProse = "prose"
+)
+
+// Sources of an auto-routing decision
+const (
+	AutoSourceRule        = "rule"
+	AutoSourceRouterModel = "router_model"
+	AutoSourceDefault     = "default"
+)
+
+// Features are the cheap prompt properties auto-routing decides on
+type Features struct {
+	PromptTokens int    `json:"prompt_tokens"`
+	Content      string `json:"content"`
+	Script       string `json:"script"`
+	Tools        bool   `json:"tools"`
+}
+
+// AutoDecision is the concrete model chosen for a request to the auto model
+type AutoDecision struct {
+	Model    string   `json:"model"`
+	Source   string   `json:"source"`
+	Reason   string   `json:"reason"`
+	Features Features `json:"features"`
+}
+
+// Classifier asks a small router model which of the given models should serve
+// a prompt
+type Classifier interface {
+	Classify(ctx context.Context, model, prompt string, choices []string) (string, error)
+}
+
+// scripts recognised by Classify, checked in order
+var scripts = []struct {
+	name   string
+	tables []*unicode.RangeTable
+}{
+	{"latin", []*unicode.RangeTable{unicode.Latin}},
+	{"cyrillic", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"greek", []*unicode.RangeTable{unicode.Greek}},
+	{"arabic", []*unicode.RangeTable{unicode.Arabic}},
+	{"hebrew", []*unicode.RangeTable{unicode.Hebrew}},
+	{"devanagari", []*unicode.RangeTable{unicode.Devanagari}},
+	{"thai", []*unicode.RangeTable{unicode.Thai}},
+	{"hangul", []*unicode.RangeTable{unicode.Hangul}},
+	{"japanese", []*unicode.RangeTable{unicode.Hiragana, unicode.Katakana}},
+	{"han", []*unicode.RangeTable{unicode.Han}},
+}
+
+// codeMarkers are line prefixes and suffixes that suggest source code
+var (
+	codePrefixes = []string{"func ", "def ", "class ", "import ", "from ", "package ", "#include", "public ", "private ", "const ", "let ", "var ", "return ", "SELECT ", "select "}
+	codeSuffixes = []string{";", "{", "}", "):", "=>"}
+)
+
+// EstimateTokens approximates the number of tokens in text at roughly four
+// characters per token
+func EstimateTokens(text string) int {
+	n := len([]rune(text))
+	if n == 0 {
+		return 0
+	}
+	return (n + 3) / 4
+}
+
+// Classify extracts the routing features of a prompt
+func Classify(prompt string, tools bool) Features {
+	return Features{
+		PromptTokens: EstimateTokens(prompt),
+		Content:      contentClass(prompt),
+		Script:       dominantScript(prompt),
+		Tools:        tools,
+	}
+}
+
+func contentClass(prompt string) string {
+	if strings.Contains(prompt, "```") {
+		return ContentCode
+	}
+
+	lines, code := 0, 0
+	for _, line := range strings.Split(prompt, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		lines++
+		if looksLikeCode(line) {
+			code++
+		}
+	}
+	if code >= 2 && code*10 >= lines*3 {
+		return ContentCode
+	}
+	return ContentProse
+}
+
+func looksLikeCode(line string) bool {
+	for _, p := range codePrefixes {
+		if strings.HasPrefix(line, p) {
+			return true
+		}
+	}
+	for _, s := range codeSuffixes {
+		if strings.HasSuffix(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dominantScript returns the writing system most letters of the prompt use
+func dominantScript(prompt string) string {
+	counts := make(map[string]int, len(scripts))
+	for _, r := range prompt {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for _, s := range scripts {
+			if unicode.In(r, s.tables...) {
+				counts[s.name]++
+				break
+			}
+		}
+	}
+
+	best, most := "", 0
+	for _, s := range scripts {
+		if counts[s.name] > most {
+			best, most = s.name, counts[s.name]
+		}
+	}
+	return best
+}
+
+// AutoRouter picks a concrete model for requests to the virtual auto model.
+// Rules are checked in order, then the router model is asked if one is
+// configured, and the default model is used otherwise.
+type AutoRouter struct {
+	enabled     bool
+	model       string
+	def         string
+	routerModel string
+	rules       []config.AutoRule
+	choices     []string
+}
+
+// NewAutoRouter creates an auto router from configuration
+func NewAutoRouter(cfg *config.Config) (*AutoRouter, error) {
+	auto := cfg.Routing.Auto
+	a := &AutoRouter{
+		enabled:     auto.Enabled,
+		model:       auto.Model,
+		def:         auto.Default,
+		routerModel: auto.RouterModel,
+		rules:       auto.Rules,
+	}
+	if !a.enabled {
+		return a, nil
+	}
+
+	if a.model == "" {
+		return nil, fmt.Errorf("auto routing requires a model name")
+	}
+	if a.def == "" {
+		return nil, fmt.Errorf("auto routing requires a default model")
+	}
+
+	seen := map[string]bool{a.def: true}
+	a.choices = []string{a.def}
+	for _, rule := range a.rules {
+		if rule.Model == "" {
+			return nil, fmt.Errorf("auto routing rule %q has no model", rule.Name)
+		}
+		switch rule.Content {
+		case "", ContentCode, ContentProse:
+		default:
+			return nil, fmt.Errorf("auto routing rule %q has unknown content %q", rule.Name, rule.Content)
+		}
+		if !seen[rule.Model] {
+			seen[rule.Model] = true
+			a.choices = append(a.choices, rule.Model)
+		}
+	}
+
+	return a, nil
+}
+
+// IsAuto reports whether a requested model name is the virtual auto model
+func (a *AutoRouter) IsAuto(model string) bool {
+	return a.enabled && model == a.model
+}
+
+// Decide picks the model that serves a prompt with the given features. The
+// classifier is only used when no rule matches and a router model is set.
+func (a *AutoRouter) Decide(ctx context.Context, f Features, prompt string, classifier Classifier) AutoDecision {
+	for i, rule := range a.rules {
+		if ruleMatches(rule, f) {
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return AutoDecision{Model: rule.Model, Source: AutoSourceRule, Reason: "rule " + name, Features: f}
+		}
+	}
+
+	if a.routerModel != "" && classifier != nil {
+		model, err := classifier.Classify(ctx, a.routerModel, prompt, a.choices)
+		switch {
+		case err != nil:
+			return AutoDecision{Model: a.def, Source: AutoSourceDefault, Reason: "router model failed", Features: f}
+		case !contains(a.choices, model):
+			return AutoDecision{Model: a.def, Source: AutoSourceDefault, Reason: "router model gave an unknown answer", Features: f}
+		default:
+			return AutoDecision{Model: model, Source: AutoSourceRouterModel, Reason: "router model " + a.routerModel, Features: f}
+		}
+	}
+
+	return AutoDecision{Model: a.def, Source: AutoSourceDefault, Reason: "no rule matched", Features: f}
+}
+
+func ruleMatches(rule config.AutoRule, f Features) bool {
+	if rule.MinPromptTokens > 0 && f.PromptTokens < rule.MinPromptTokens {
+		return false
+	}
+	if rule.MaxPromptTokens > 0 && f.PromptTokens > rule.MaxPromptTokens {
+		return false
+	}
+	if rule.Content != "" && rule.Content != f.Content {
+		return false
+	}
+	if len(rule.Scripts) > 0 && !contains(rule.Scripts, f.Script) {
+		return false
+	}
+	if rule.Tools != nil && *rule.Tools != f.Tools {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
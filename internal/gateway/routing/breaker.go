@@ -0,0 +1,395 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// BreakerState is the state of a worker circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets all traffic through to the worker
+	BreakerClosed BreakerState = iota
+	// BreakerOpen ejects the worker from routing until its ejection expires
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe requests through
+	BreakerHalfOpen
+)
+
+// String returns the lower case name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Ejection reasons
+const (
+	EjectReasonErrorRate = "error_rate"
+	EjectReasonLatency   = "latency_outlier"
+	EjectReasonProbe     = "probe_failed"
+)
+
+// windowBuckets is the number of buckets the sliding window is divided into
+const windowBuckets = 10
+
+// bucket aggregates outcomes for a slice of the sliding window
+type bucket struct {
+	start    time.Time
+	requests int
+	failures int
+	latency  time.Duration
+}
+
+// BreakerSnapshot is a point-in-time view of a worker's breaker
+type BreakerSnapshot struct {
+	State        string    `json:"state"`
+	Requests     int       `json:"requests"`
+	ErrorRate    float64   `json:"error_rate"`
+	MeanLatency  float64   `json:"mean_latency_ms"`
+	Ejections    int       `json:"ejections"`
+	EjectedUntil time.Time `json:"ejected_until,omitempty"`
+	LastReason   string    `json:"last_reason,omitempty"`
+}
+
+// Breaker tracks outcomes for a single worker over a sliding window
+type Breaker struct {
+	state        BreakerState
+	buckets      [windowBuckets]bucket
+	ejections    int
+	ejectedUntil time.Time
+	probes       int
+	probeSuccess int
+	lastReason   string
+}
+
+// stats returns the request count, error rate and mean latency in the window
+func (b *Breaker) stats(now time.Time, window time.Duration) (int, float64, time.Duration) {
+	var requests, failures int
+	var latency time.Duration
+	for _, bk := range b.buckets {
+		if now.Sub(bk.start) >= window {
+			continue
+		}
+		requests += bk.requests
+		failures += bk.failures
+		latency += bk.latency
+	}
+	if requests == 0 {
+		return 0, 0, 0
+	}
+	return requests, float64(failures) / float64(requests), latency / time.Duration(requests)
+}
+
+// record adds an outcome to the current bucket
+func (b *Breaker) record(now time.Time, window time.Duration, latency time.Duration, failed bool) {
+	width := window / windowBuckets
+	if width <= 0 {
+		width = time.Second
+	}
+	start := now.Truncate(width)
+	idx := int(start.UnixNano()/int64(width)) % windowBuckets
+	bk := &b.buckets[idx]
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+	bk.requests++
+	bk.latency += latency
+	if failed {
+		bk.failures++
+	}
+}
+
+// reset clears the sliding window
+func (b *Breaker) reset() {
+	b.buckets = [windowBuckets]bucket{}
+}
+
+// BreakerSet holds the circuit breakers for all known workers
+type BreakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+
+	enabled            bool
+	window             time.Duration
+	minRequests        int
+	errorRateThreshold float64
+	outlierFactor      float64
+	baseEjection       time.Duration
+	maxEjection        time.Duration
+	maxEjectionPercent int
+	halfOpenRequests   int
+}
+
+// NewBreakerSet creates a breaker set from the circuit breaker configuration
+func NewBreakerSet(cfg *config.Config) *BreakerSet {
+	cb := cfg.Routing.CircuitBreaker
+	bs := &BreakerSet{
+		breakers:           make(map[string]*Breaker),
+		enabled:            cb.Enabled,
+		window:             cb.Window,
+		minRequests:        cb.MinRequests,
+		errorRateThreshold: cb.ErrorRateThreshold,
+		outlierFactor:      cb.LatencyOutlierFactor,
+		baseEjection:       cb.BaseEjectionTime,
+		maxEjection:        cb.MaxEjectionTime,
+		maxEjectionPercent: cb.MaxEjectionPercent,
+		halfOpenRequests:   cb.HalfOpenRequests,
+	}
+	if bs.window <= 0 {
+		bs.window = time.Minute
+	}
+	if bs.halfOpenRequests <= 0 {
+		bs.halfOpenRequests = 1
+	}
+	if bs.maxEjection < bs.baseEjection {
+		bs.maxEjection = bs.baseEjection
+	}
+	return bs
+}
+
+// Allow reports whether a request may be routed to the worker. A half-open
+// breaker admits up to the configured number of probe requests.
+func (bs *BreakerSet) Allow(workerID string) bool {
+	if !bs.enabled {
+		return true
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.get(workerID)
+	bs.advance(workerID, b)
+
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return b.probes < bs.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// Acquire marks a request as routed to the worker. It must be paired with Record.
+func (bs *BreakerSet) Acquire(workerID string) {
+	if !bs.enabled {
+		return
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.get(workerID)
+	if b.state == BreakerHalfOpen {
+		b.probes++
+	}
+}
+
+// Record adds the outcome of a request to the worker's breaker. Requests
+// cancelled by the caller are not held against the worker.
+func (bs *BreakerSet) Record(workerID string, latency time.Duration, err error) {
+	if !bs.enabled {
+		return
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.get(workerID)
+	if errors.Is(err, context.Canceled) {
+		if b.state == BreakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		return
+	}
+
+	now := time.Now()
+	failed := err != nil
+
+	if b.state == BreakerHalfOpen {
+		if failed {
+			bs.eject(workerID, b, now, EjectReasonProbe)
+			return
+		}
+		b.probeSuccess++
+		if b.probeSuccess >= bs.halfOpenRequests {
+			b.state = BreakerClosed
+			b.probes = 0
+			b.probeSuccess = 0
+			b.reset()
+			breakerState.WithLabelValues(workerID).Set(float64(BreakerClosed))
+		}
+		return
+	}
+
+	b.record(now, bs.window, latency, failed)
+	if b.state != BreakerClosed {
+		return
+	}
+
+	requests, errorRate, mean := b.stats(now, bs.window)
+	if requests < bs.minRequests {
+		return
+	}
+	if bs.errorRateThreshold > 0 && errorRate >= bs.errorRateThreshold {
+		bs.eject(workerID, b, now, EjectReasonErrorRate)
+		return
+	}
+	if bs.outlierFactor > 0 {
+		if median, ok := bs.medianLatency(now, workerID); ok && median > 0 &&
+			float64(mean) > bs.outlierFactor*float64(median) {
+			bs.eject(workerID, b, now, EjectReasonLatency)
+		}
+	}
+}
+
+// State returns a snapshot of the worker's breaker
+func (bs *BreakerSet) State(workerID string) BreakerSnapshot {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.get(workerID)
+	bs.advance(workerID, b)
+	return bs.snapshot(b)
+}
+
+// States returns a snapshot of every tracked breaker keyed by worker ID
+func (bs *BreakerSet) States() map[string]BreakerSnapshot {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	states := make(map[string]BreakerSnapshot, len(bs.breakers))
+	for id, b := range bs.breakers {
+		bs.advance(id, b)
+		states[id] = bs.snapshot(b)
+	}
+	return states
+}
+
+// Sync aligns the tracked breakers with the workers known to the registry
+func (bs *BreakerSet) Sync(workerIDs []string) {
+	known := make(map[string]struct{}, len(workerIDs))
+	for _, id := range workerIDs {
+		known[id] = struct{}{}
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	for id := range bs.breakers {
+		if _, ok := known[id]; !ok {
+			delete(bs.breakers, id)
+			breakerState.DeleteLabelValues(id)
+		}
+	}
+	for id := range known {
+		bs.get(id)
+	}
+}
+
+func (bs *BreakerSet) get(workerID string) *Breaker {
+	b, ok := bs.breakers[workerID]
+	if !ok {
+		b = &Breaker{}
+		bs.breakers[workerID] = b
+		breakerState.WithLabelValues(workerID).Set(float64(BreakerClosed))
+	}
+	return b
+}
+
+// advance moves an open breaker to half-open once its ejection has expired
+func (bs *BreakerSet) advance(workerID string, b *Breaker) {
+	if b.state == BreakerOpen && !time.Now().Before(b.ejectedUntil) {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.probeSuccess = 0
+		breakerState.WithLabelValues(workerID).Set(float64(BreakerHalfOpen))
+	}
+}
+
+// eject opens the breaker, backing off exponentially on repeated ejections.
+// Ejections are skipped when they would take out more than the configured
+// share of the fleet, except for failed probes which are already ejected.
+func (bs *BreakerSet) eject(workerID string, b *Breaker, now time.Time, reason string) {
+	if reason != EjectReasonProbe && !bs.canEject() {
+		return
+	}
+
+	duration := bs.baseEjection << uint(min(b.ejections, 16))
+	if duration > bs.maxEjection || duration <= 0 {
+		duration = bs.maxEjection
+	}
+
+	b.state = BreakerOpen
+	b.ejections++
+	b.ejectedUntil = now.Add(duration)
+	b.probes = 0
+	b.probeSuccess = 0
+	b.lastReason = reason
+	b.reset()
+
+	breakerState.WithLabelValues(workerID).Set(float64(BreakerOpen))
+	workerEjections.WithLabelValues(workerID, reason).Inc()
+}
+
+// canEject reports whether one more worker may be ejected
+func (bs *BreakerSet) canEject() bool {
+	if bs.maxEjectionPercent <= 0 {
+		return false
+	}
+	ejected := 0
+	for _, b := range bs.breakers {
+		if b.state != BreakerClosed {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= bs.maxEjectionPercent*len(bs.breakers)
+}
+
+// medianLatency returns the median mean latency of the other closed workers
+// that have enough traffic in the window to be compared against
+func (bs *BreakerSet) medianLatency(now time.Time, exclude string) (time.Duration, bool) {
+	var means []time.Duration
+	for id, b := range bs.breakers {
+		if id == exclude || b.state != BreakerClosed {
+			continue
+		}
+		requests, _, mean := b.stats(now, bs.window)
+		if requests >= bs.minRequests {
+			means = append(means, mean)
+		}
+	}
+	if len(means) == 0 {
+		return 0, false
+	}
+	sort.Slice(means, func(i, j int) bool { return means[i] < means[j] })
+	return means[len(means)/2], true
+}
+
+func (bs *BreakerSet) snapshot(b *Breaker) BreakerSnapshot {
+	requests, errorRate, mean := b.stats(time.Now(), bs.window)
+	s := BreakerSnapshot{
+		State:       b.state.String(),
+		Requests:    requests,
+		ErrorRate:   errorRate,
+		MeanLatency: float64(mean) / float64(time.Millisecond),
+		Ejections:   b.ejections,
+		LastReason:  b.lastReason,
+	}
+	if b.state == BreakerOpen {
+		s.EjectedUntil = b.ejectedUntil
+	}
+	return s
+}
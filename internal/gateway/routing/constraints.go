@@ -0,0 +1,134 @@
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+// Constraints restrict which workers may serve a request based on worker
+// metadata. Every Require label must match exactly, while Prefer labels only
+// raise the score of matching workers.
+type Constraints struct {
+	Require map[string]string `json:"require,omitempty"`
+	Prefer  map[string]string `json:"prefer,omitempty"`
+}
+
+// Matches reports whether worker metadata satisfies every required label
+func (c Constraints) Matches(metadata map[string]string) bool {
+	for k, v := range c.Require {
+		if metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// preference returns the fraction of preferred labels the metadata matches
+func (c Constraints) preference(metadata map[string]string) float64 {
+	if len(c.Prefer) == 0 {
+		return 0
+	}
+	matched := 0
+	for k, v := range c.Prefer {
+		if metadata[k] == v {
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(c.Prefer))
+}
+
+// ParseLabels parses a comma-separated list of key=value labels
+func ParseLabels(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// FormatLabels formats labels as a sorted, comma-separated key=value list
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// constraintPolicy combines tenant policies with the labels clients may set
+type constraintPolicy struct {
+	clientLabels map[string]bool
+	tenants      map[string]Constraints
+}
+
+func newConstraintPolicy(cfg *config.Config) (*constraintPolicy, error) {
+	p := &constraintPolicy{
+		clientLabels: make(map[string]bool),
+		tenants:      make(map[string]Constraints),
+	}
+	for _, label := range cfg.Routing.Constraints.ClientLabels {
+		p.clientLabels[label] = true
+	}
+	for _, t := range cfg.Routing.Constraints.Tenants {
+		if t.Tenant == "" {
+			return nil, fmt.Errorf("tenant constraint policy requires a tenant")
+		}
+		if _, ok := p.tenants[t.Tenant]; ok {
+			return nil, fmt.Errorf("tenant %s has more than one constraint policy", t.Tenant)
+		}
+		p.tenants[t.Tenant] = Constraints{Require: t.Require, Prefer: t.Prefer}
+	}
+	return p, nil
+}
+
+// resolve merges the client's labels with the tenant's policy. Clients may only
+// set allowed labels and can never relax a label the tenant requires.
+func (p *constraintPolicy) resolve(tenant string, require, prefer map[string]string) (Constraints, error) {
+	for _, labels := range []map[string]string{require, prefer} {
+		for k := range labels {
+			if !p.clientLabels[k] {
+				return Constraints{}, errors.New(http.StatusBadRequest, fmt.Sprintf("Routing label %q cannot be set by clients", k))
+			}
+		}
+	}
+
+	policy := p.tenants[tenant]
+	c := Constraints{
+		Require: make(map[string]string, len(policy.Require)+len(require)),
+		Prefer:  make(map[string]string, len(policy.Prefer)+len(prefer)),
+	}
+
+	for k, v := range policy.Require {
+		c.Require[k] = v
+	}
+	for k, v := range require {
+		if tv, ok := policy.Require[k]; ok && tv != v {
+			return Constraints{}, errors.New(http.StatusBadRequest, fmt.Sprintf("Routing label %s=%s conflicts with the tenant policy", k, v))
+		}
+		c.Require[k] = v
+	}
+
+	for k, v := range policy.Prefer {
+		c.Prefer[k] = v
+	}
+	for k, v := range prefer {
+		c.Prefer[k] = v
+	}
+
+	return c, nil
+}
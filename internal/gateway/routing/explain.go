@@ -0,0 +1,207 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+// Reasons a worker is filtered out of routing
+const (
+	RejectStatus      = "status"
+	RejectModel       = "model"
+	RejectContext     = "context"
+	RejectExcluded    = "excluded"
+	RejectConstraints = "constraints"
+	RejectCapacity    = "capacity"
+	RejectBreaker     = "breaker"
+	RejectSaturated   = "saturated"
+	RejectReserved    = "reserved"
+	RejectCold        = "cold"
+)
+
+// Trace is a condensed record of how a request was routed
+type Trace struct {
+	Models     []string
+	Workers    int
+	Candidates int
+	Rejected   map[string]int
+	Worker     string
+	Score      float64
+	Cold       bool
+	Tokens     int
+}
+
+// String formats the trace for a response header
+func (t *Trace) String() string {
+	reasons := make([]string, 0, len(t.Rejected))
+	for reason, n := range t.Rejected {
+		reasons = append(reasons, fmt.Sprintf("%s:%d", reason, n))
+	}
+	sort.Strings(reasons)
+
+	return fmt.Sprintf("models=%s; candidates=%d/%d; rejected=%s; worker=%s; score=%.3f; cold=%t; tokens=%d",
+		strings.Join(t.Models, ","), t.Candidates, t.Workers, strings.Join(reasons, ","), t.Worker, t.Score, t.Cold, t.Tokens)
+}
+
+// ScoreBreakdown lists the components of a worker's routing score
+type ScoreBreakdown struct {
+	Load       float64 `json:"load"`
+	Preference float64 `json:"preference"`
+	Total      float64 `json:"total"`
+}
+
+// WorkerExplanation describes how one worker was evaluated for a request
+type WorkerExplanation struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Status   string            `json:"status"`
+	Load     float64           `json:"load"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Warm     *bool             `json:"warm,omitempty"`
+	Rejected string            `json:"rejected,omitempty"`
+	Score    *ScoreBreakdown   `json:"score,omitempty"`
+	Breaker  BreakerSnapshot   `json:"breaker"`
+	InFlight int               `json:"in_flight"`
+
+	// InFlightTokens is the cost of the worker's in-flight requests, out of
+	// its TokenBudget, which is zero when only requests are counted
+	InFlightTokens int `json:"in_flight_tokens"`
+	TokenBudget    int `json:"token_budget,omitempty"`
+}
+
+// Explanation describes the routing decision for a request
+type Explanation struct {
+	// Models lists the requested model followed by every fallback tried
+	Models []string `json:"models"`
+	// Model is the model that would serve the request
+	Model   string              `json:"model"`
+	Workers []WorkerExplanation `json:"workers"`
+
+	// Tokens is what the request would cost its worker
+	Tokens int `json:"tokens"`
+
+	// Pick is the worker the request would be routed to next. The load
+	// balancer rotates between the workers in PickPool, whose scores are tied.
+	Pick     string   `json:"pick,omitempty"`
+	PickPool []string `json:"pick_pool,omitempty"`
+}
+
+// Explain evaluates the request against every known worker without routing it
+func (r *Router) Explain(ctx context.Context, req *Request) (*Explanation, error) {
+	workers, err := r.source.GetActiveWorkers(ctx)
+	if err != nil {
+		return nil, &errors.Error{
+			Code:    http.StatusServiceUnavailable,
+			Message: "Worker registry unavailable",
+			Err:     err,
+		}
+	}
+
+	ids := make([]string, len(workers))
+	for i, w := range workers {
+		ids[i] = w.ID
+	}
+	r.breakers.Sync(ids)
+
+	models := []string{req.Model}
+	if !req.NoFallback {
+		models = append(models, req.Permitted(r.Fallbacks(req.Model))...)
+	}
+
+	breakers := r.breakers.States()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exp := &Explanation{Tokens: r.tokens.cost(req)}
+	for _, model := range models {
+		attempt := *req
+		attempt.Model = model
+
+		exp.Models = append(exp.Models, model)
+		exp.Model = model
+		exp.Workers = r.explainWorkers(&attempt, workers, breakers)
+		exp.Pick, exp.PickPool = pickPool(exp.Workers)
+		if exp.Pick != "" {
+			break
+		}
+	}
+
+	return exp, nil
+}
+
+// explainWorkers evaluates every worker for the request. The caller must hold r.mu.
+func (r *Router) explainWorkers(req *Request, workers []worker.Worker, breakers map[string]BreakerSnapshot) []WorkerExplanation {
+	out := make([]WorkerExplanation, 0, len(workers))
+	eligible := make([]Candidate, 0, len(workers))
+
+	for _, w := range workers {
+		e := WorkerExplanation{
+			ID:       w.ID,
+			Name:     w.Name,
+			Status:   w.Status,
+			Load:     w.Load,
+			Metadata: w.Metadata,
+			Breaker:  breakers[w.ID],
+			InFlight: r.inflight[w.ID],
+
+			InFlightTokens: r.inflightTokens[w.ID],
+			TokenBudget:    r.tokens.limit(w),
+		}
+		if e.Breaker.State == "" {
+			e.Breaker.State = BreakerClosed.String()
+		}
+		if loaded, known := w.ModelLoaded(req.Model); known {
+			e.Warm = &loaded
+		}
+
+		e.Rejected = r.reject(req, w)
+		if e.Rejected == "" {
+			load := r.scorer.Score(req, w)
+			pref := req.Constraints.preference(w.Metadata)
+			e.Score = &ScoreBreakdown{Load: load, Preference: pref, Total: load + pref}
+			eligible = append(eligible, Candidate{Worker: w, Score: e.Score.Total})
+		}
+		out = append(out, e)
+	}
+
+	warm := make(map[string]bool, len(eligible))
+	for _, c := range preferWarm(req.Model, eligible) {
+		warm[c.Worker.ID] = true
+	}
+	for i := range out {
+		if out[i].Rejected == "" && !warm[out[i].ID] {
+			out[i].Rejected = RejectCold
+		}
+	}
+
+	return out
+}
+
+// pickPool returns the eligible workers tied for the best score, and the
+// first of them
+func pickPool(workers []WorkerExplanation) (string, []string) {
+	best, found := 0.0, false
+	for _, w := range workers {
+		if w.Rejected == "" && (!found || w.Score.Total > best) {
+			best, found = w.Score.Total, true
+		}
+	}
+	if !found {
+		return "", nil
+	}
+
+	var pool []string
+	for _, w := range workers {
+		if w.Rejected == "" && best-w.Score.Total <= scoreTolerance {
+			pool = append(pool, w.ID)
+		}
+	}
+	return pool[0], pool
+}
@@ -0,0 +1,181 @@
+package routing
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// latencySamples is the number of recent latencies kept per model and route
+const latencySamples = 256
+
+// latencyTracker keeps a ring buffer of recent successful request latencies
+type latencyTracker struct {
+	samples [latencySamples]time.Duration
+	next    int
+	count   int
+}
+
+func (t *latencyTracker) observe(latency time.Duration) {
+	t.samples[t.next] = latency
+	t.next = (t.next + 1) % latencySamples
+	if t.count < latencySamples {
+		t.count++
+	}
+}
+
+func (t *latencyTracker) percentile(p float64) time.Duration {
+	if t.count == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, t.count)
+	copy(sorted, t.samples[:t.count])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(p * float64(len(sorted)-1))
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// Hedger decides whether and when a request should be hedged to a second
+// worker, based on the observed latency distribution for its model and route
+type Hedger struct {
+	enabled    bool
+	percentile float64
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	minSamples int
+	maxTokens  int
+	routes     map[string]bool
+	policies   map[string]config.HedgePolicy
+
+	mu       sync.Mutex
+	trackers map[string]*latencyTracker
+}
+
+// NewHedger creates a hedger from the hedging configuration. When hedging is
+// enabled, the percentile and those of the per-model policies must be in
+// (0, 1]; a policy without one uses the global percentile.
+func NewHedger(cfg *config.Config) (*Hedger, error) {
+	hc := cfg.Routing.Hedging
+	if hc.Enabled {
+		if hc.Percentile <= 0 || hc.Percentile > 1 {
+			return nil, fmt.Errorf("hedging percentile %v must be in (0, 1]", hc.Percentile)
+		}
+		for _, p := range hc.Policies {
+			if p.Percentile < 0 || p.Percentile > 1 {
+				return nil, fmt.Errorf("hedging percentile %v of %s must be in (0, 1]", p.Percentile, p.Model)
+			}
+		}
+	}
+
+	h := &Hedger{
+		enabled:    hc.Enabled,
+		percentile: hc.Percentile,
+		minDelay:   hc.MinDelay,
+		maxDelay:   hc.MaxDelay,
+		minSamples: hc.MinSamples,
+		maxTokens:  hc.MaxTokens,
+		routes:     make(map[string]bool),
+		policies:   make(map[string]config.HedgePolicy),
+		trackers:   make(map[string]*latencyTracker),
+	}
+	for _, route := range hc.Routes {
+		h.routes[route] = true
+	}
+	for _, p := range hc.Policies {
+		h.policies[p.Model] = p
+	}
+	if h.maxDelay < h.minDelay {
+		h.maxDelay = h.minDelay
+	}
+	return h, nil
+}
+
+// Delay returns how long to wait for the first attempt before hedging the
+// request, and whether the request may be hedged at all
+func (h *Hedger) Delay(req *Request) (time.Duration, bool) {
+	if !h.enabled {
+		return 0, false
+	}
+	if req.Route != RouteEmbeddings && (req.MaxTokens <= 0 || req.MaxTokens > h.maxTokens) {
+		return 0, false
+	}
+
+	percentile, ok := h.policy(req)
+	if !ok {
+		return 0, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.trackers[req.Model+"|"+req.Route]
+	if !ok || t.count < h.minSamples {
+		return h.maxDelay, true
+	}
+
+	delay := t.percentile(percentile)
+	if delay < h.minDelay {
+		delay = h.minDelay
+	}
+	if delay > h.maxDelay {
+		delay = h.maxDelay
+	}
+	return delay, true
+}
+
+// Observe records the latency of a successful request
+func (h *Hedger) Observe(req *Request, latency time.Duration) {
+	if !h.enabled {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := req.Model + "|" + req.Route
+	t, ok := h.trackers[key]
+	if !ok {
+		t = &latencyTracker{}
+		h.trackers[key] = t
+	}
+	t.observe(latency)
+}
+
+// policy resolves whether hedging applies to the request's model and route,
+// and at which percentile
+func (h *Hedger) policy(req *Request) (float64, bool) {
+	p, ok := h.policies[req.Model]
+	if !ok {
+		return h.percentile, h.routes[req.Route]
+	}
+	if p.Disabled {
+		return 0, false
+	}
+
+	enabled := h.routes[req.Route]
+	if len(p.Routes) > 0 {
+		enabled = false
+		for _, route := range p.Routes {
+			if route == req.Route {
+				enabled = true
+				break
+			}
+		}
+	}
+
+	percentile := h.percentile
+	if p.Percentile > 0 {
+		percentile = p.Percentile
+	}
+	return percentile, enabled
+}
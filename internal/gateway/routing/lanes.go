@@ -0,0 +1,256 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// RouteJobs matches the requests of asynchronous jobs in lane rules
+const RouteJobs = "jobs"
+
+// laneSet assigns requests to lanes and holds each lane's reserved share of
+// worker slots
+type laneSet struct {
+	enabled bool
+	lanes   map[string]config.Lane
+	def     string
+	rules   []config.LaneRule
+
+	// preempts lists, for each lane, whether any preemptible lane ranks
+	// below it
+	preempts map[string]bool
+}
+
+// newLaneSet creates the lane assignment from configuration
+func newLaneSet(cfg *config.Config) (*laneSet, error) {
+	lc := cfg.Routing.Lanes
+	s := &laneSet{
+		enabled:  lc.Enabled,
+		lanes:    make(map[string]config.Lane, len(lc.Lanes)),
+		def:      lc.Default,
+		rules:    lc.Rules,
+		preempts: make(map[string]bool, len(lc.Lanes)),
+	}
+	if !s.enabled {
+		return s, nil
+	}
+
+	total := 0.0
+	for _, lane := range lc.Lanes {
+		if lane.Name == "" {
+			return nil, fmt.Errorf("lane requires a name")
+		}
+		if _, ok := s.lanes[lane.Name]; ok {
+			return nil, fmt.Errorf("duplicate lane %q", lane.Name)
+		}
+		if lane.Share < 0 || lane.Share > 1 {
+			return nil, fmt.Errorf("share of lane %q must be between 0 and 1", lane.Name)
+		}
+		total += lane.Share
+		s.lanes[lane.Name] = lane
+	}
+	if total > 1 {
+		return nil, fmt.Errorf("lane shares add up to more than 1")
+	}
+	if _, ok := s.lanes[s.def]; !ok {
+		return nil, fmt.Errorf("default lane %q is not defined", s.def)
+	}
+	for _, rule := range s.rules {
+		if rule.APIKey == "" && rule.Route == "" {
+			return nil, fmt.Errorf("lane rule for %q must match an API key or a route", rule.Lane)
+		}
+		if _, ok := s.lanes[rule.Lane]; !ok {
+			return nil, fmt.Errorf("lane rule refers to undefined lane %q", rule.Lane)
+		}
+		switch rule.Route {
+		case "", RouteChat, RouteCompletions, RouteEmbeddings, RouteJobs:
+		default:
+			return nil, fmt.Errorf("lane rule refers to unknown route %q", rule.Route)
+		}
+	}
+	for name, lane := range s.lanes {
+		for _, other := range s.lanes {
+			if other.Preemptible && other.Priority < lane.Priority {
+				s.preempts[name] = true
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// assign returns the lane of a request on a route from a caller's API key
+func (s *laneSet) assign(route, apiKey string) (config.Lane, bool) {
+	if !s.enabled {
+		return config.Lane{}, false
+	}
+	for _, rule := range s.rules {
+		if rule.APIKey != "" && rule.APIKey != apiKey {
+			continue
+		}
+		if rule.Route != "" && rule.Route != route {
+			continue
+		}
+		return s.lanes[rule.Lane], true
+	}
+	return s.lanes[s.def], true
+}
+
+// reserved returns the slots of a worker kept for a lane
+func (s *laneSet) reserved(lane string, slots int) int {
+	return int(math.Floor(s.lanes[lane].Share * float64(slots)))
+}
+
+// Lane returns the lane of a request on a route, identified by the caller's
+// API key, and false when lanes are disabled
+func (r *Router) Lane(route, apiKey string) (config.Lane, bool) {
+	lane, ok := r.lanes.assign(route, apiKey)
+	if ok {
+		laneRequests.WithLabelValues(lane.Name, route).Inc()
+	}
+	return lane, ok
+}
+
+// inReserve reports whether serving the request on a worker would take slots
+// other lanes keep in reserve. A lane may always use its own reservation,
+// and a preemptible lane may borrow any free slot, as it gives the slot back
+// when a higher lane needs it. The caller must hold r.mu.
+func (r *Router) inReserve(req *Request, w worker.Worker) bool {
+	if req.Lane == "" || r.slots <= 0 {
+		return false
+	}
+	lane := r.lanes.lanes[req.Lane]
+	used := r.laneInflight[w.ID]
+	if used[req.Lane] < r.lanes.reserved(req.Lane, r.slots) || lane.Preemptible {
+		return false
+	}
+
+	held := 0
+	for name := range r.lanes.lanes {
+		if name == req.Lane {
+			continue
+		}
+		if unused := r.lanes.reserved(name, r.slots) - used[name]; unused > 0 {
+			held += unused
+		}
+	}
+	return r.inflight[w.ID]+1+held > r.slots
+}
+
+// running is an in-flight request that may be preempted
+type running struct {
+	req     *Request
+	started time.Time
+}
+
+// Preempt stops an in-flight request of a lower, preemptible lane on a worker
+// that only lacks capacity to serve req, when req could take its place. It
+// reports whether capacity is on its way, including when an earlier call
+// already preempted a request for req that has not stopped yet.
+func (r *Router) Preempt(ctx context.Context, req *Request) bool {
+	if req.Lane == "" || !r.lanes.preempts[req.Lane] {
+		return false
+	}
+	workers, err := r.source.GetActiveWorkers(ctx)
+	if err != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.claims[req.ID]; ok {
+		return true
+	}
+
+	priority := r.lanes.lanes[req.Lane].Priority
+	var victim *running
+	var victimWorker string
+	for _, w := range workers {
+		if reason := r.reject(req, w); reason != RejectSaturated && reason != RejectReserved {
+			continue
+		}
+		for _, run := range r.running[w.ID] {
+			lane := r.lanes.lanes[run.req.Lane]
+			if !lane.Preemptible || lane.Priority >= priority || !r.fitsWithout(req, w, run.req) {
+				continue
+			}
+			// The lowest lane goes first, and within it the request that
+			// started last, which loses the least work
+			if victim == nil {
+				victim, victimWorker = run, w.ID
+				continue
+			}
+			current := r.lanes.lanes[victim.req.Lane].Priority
+			if lane.Priority < current || (lane.Priority == current && run.started.After(victim.started)) {
+				victim, victimWorker = run, w.ID
+			}
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	delete(r.running[victimWorker], victim.req.ID)
+	r.victims[victimWorker+"/"+victim.req.ID] = req.ID
+	r.claims[req.ID] = struct{}{}
+	close(victim.req.Preempt)
+	preemptionsTotal.WithLabelValues(victim.req.Lane, req.Lane).Inc()
+	return true
+}
+
+// fitsWithout reports whether the worker could serve req once victim has
+// left it. The caller must hold r.mu.
+func (r *Router) fitsWithout(req *Request, w worker.Worker, victim *Request) bool {
+	cost := r.tokens.cost(victim)
+	r.inflight[w.ID]--
+	r.inflightTokens[w.ID] -= cost
+	r.laneInflight[w.ID][victim.Lane]--
+
+	fits := r.reject(req, w) == ""
+
+	r.inflight[w.ID]++
+	r.inflightTokens[w.ID] += cost
+	r.laneInflight[w.ID][victim.Lane]++
+	return fits
+}
+
+// acquireLane records a request routed to a worker. The caller must hold r.mu.
+func (r *Router) acquireLane(req *Request, workerID string) {
+	delete(r.claims, req.ID)
+	if req.Lane == "" {
+		return
+	}
+	if r.laneInflight[workerID] == nil {
+		r.laneInflight[workerID] = make(map[string]int)
+	}
+	r.laneInflight[workerID][req.Lane]++
+	if req.Preempt != nil {
+		if r.running[workerID] == nil {
+			r.running[workerID] = make(map[string]*running)
+		}
+		r.running[workerID][req.ID] = &running{req: req, started: time.Now()}
+	}
+}
+
+// releaseLane records a request that has left its worker. The caller must
+// hold r.mu.
+func (r *Router) releaseLane(req *Request, workerID string) {
+	if req.Lane == "" {
+		return
+	}
+	if used := r.laneInflight[workerID]; used[req.Lane] > 0 {
+		used[req.Lane]--
+	}
+	delete(r.running[workerID], req.ID)
+	key := workerID + "/" + req.ID
+	if beneficiary, ok := r.victims[key]; ok {
+		delete(r.victims, key)
+		delete(r.claims, beneficiary)
+	}
+}
@@ -0,0 +1,44 @@
+package routing
+
+import (
+	"sync/atomic"
+)
+
+// scoreTolerance is how close two scores must be to be considered tied
+const scoreTolerance = 0.05
+
+// LoadBalancer picks one worker from a set of scored candidates
+type LoadBalancer interface {
+	Pick(candidates []Candidate) Candidate
+}
+
+// RoundRobin picks the best scoring candidate, rotating between candidates
+// whose scores are within tolerance of the best
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+// NewRoundRobin creates a new round robin load balancer
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+// Pick returns one of the top scoring candidates. Candidates must not be empty.
+func (rr *RoundRobin) Pick(candidates []Candidate) Candidate {
+	best := candidates[0].Score
+	for _, c := range candidates[1:] {
+		if c.Score > best {
+			best = c.Score
+		}
+	}
+
+	top := make([]Candidate, 0, len(candidates))
+	for _, c := range candidates {
+		if best-c.Score <= scoreTolerance {
+			top = append(top, c)
+		}
+	}
+
+	n := rr.next.Add(1) - 1
+	return top[n%uint64(len(top))]
+}
@@ -0,0 +1,76 @@
+package routing
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Routing metrics
+var (
+	breakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mindgateway_worker_breaker_state",
+			Help: "Circuit breaker state per worker (0=closed, 1=open, 2=half-open)",
+		},
+		[]string{"worker_id"},
+	)
+
+	workerEjections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_worker_ejections_total",
+			Help: "Total number of times a worker was ejected from routing",
+		},
+		[]string{"worker_id", "reason"},
+	)
+
+	fallbacksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_model_fallbacks_total",
+			Help: "Total number of requests served by a fallback model",
+		},
+		[]string{"model", "fallback", "endpoint"},
+	)
+
+	coldStarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_model_cold_starts_total",
+			Help: "Total number of requests routed to a worker without the model loaded",
+		},
+		[]string{"model", "worker_id"},
+	)
+
+	inflightTokens = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mindgateway_worker_inflight_tokens",
+			Help: "Estimated prompt and completion tokens of the requests in flight per worker",
+		},
+		[]string{"worker_id"},
+	)
+
+	laneRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_lane_requests_total",
+			Help: "Total number of requests assigned to each lane by route",
+		},
+		[]string{"lane", "endpoint"},
+	)
+
+	preemptionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_lane_preemptions_total",
+			Help: "Total number of in-flight requests preempted to make room for a higher lane",
+		},
+		[]string{"lane", "for_lane"},
+	)
+
+	autoDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_auto_route_decisions_total",
+			Help: "Total number of auto model requests by chosen model and decision source",
+		},
+		[]string{"model", "source"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(breakerState, workerEjections, fallbacksTotal, coldStarts, inflightTokens, laneRequests, preemptionsTotal, autoDecisions)
+}
@@ -0,0 +1,469 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+)
+
+// Routes served by the gateway
+const (
+	RouteChat        = "chat"
+	RouteCompletions = "completions"
+	RouteEmbeddings  = "embeddings"
+)
+
+// Request describes an inference request for routing purposes
+type Request struct {
+	ID    string
+	Route string
+
+	// LogicalModel is the model name the client asked for, Variant the model
+	// its traffic split assigned and Model the model that will serve the
+	// request, which differs from Variant after a fallback
+	LogicalModel string
+	Variant      string
+	Model        string
+	MaxTokens    int
+
+	// PromptTokens estimates the size of the prompt, or of the inputs to
+	// embed, which with MaxTokens is what the request costs a worker
+	PromptTokens int
+
+	// NoFallback keeps the request on its model even when it has no capacity
+	NoFallback bool
+
+	// Forbidden lists models the request must not fall back to, such as
+	// those its caller may not invoke
+	Forbidden []string
+
+	// Exclude lists worker IDs that must not be picked, such as the worker
+	// already serving the primary attempt of a hedged request
+	Exclude []string
+
+	// Constraints restrict the request to workers with matching metadata
+	Constraints Constraints
+
+	// Shadow marks a mirrored request, which only uses workers with spare
+	// capacity so that it never competes with live traffic
+	Shadow bool
+
+	// Priority orders the request in the queue; higher values are served first
+	Priority int
+
+	// Tenant and Roles identify the caller, whose share of each queue level
+	// is set by the fairness weights
+	Tenant string
+	Roles  []string
+
+	// Lane is the traffic lane of the request, empty when lanes are disabled
+	Lane string
+
+	// Preempt, when set, is closed by the router to stop the request so a
+	// request of a higher lane can take its worker. The caller then requeues
+	// the request with a new channel, and counts the requeue in Preemptions.
+	Preempt     chan struct{}
+	Preemptions int
+
+	// QueueWait is how long the request waited in the queue for capacity
+	QueueWait time.Duration
+
+	// Trace, when set, is filled in with how the request was routed
+	Trace *Trace
+}
+
+// WorkerSource provides the workers currently known to the registry
+type WorkerSource interface {
+	GetActiveWorkers(ctx context.Context) ([]worker.Worker, error)
+}
+
+// Router selects a worker for each request
+type Router struct {
+	config *config.Config
+	logger *logging.Logger
+	source WorkerSource
+
+	scorer    Scorer
+	balancer  LoadBalancer
+	breakers  *BreakerSet
+	hedger    *Hedger
+	splitter  *Splitter
+	fallbacks map[string][]string
+	policy    *constraintPolicy
+	auto      *AutoRouter
+	tokens    *tokenBudget
+	lanes     *laneSet
+
+	// mu guards inflight and inflightTokens, the number of requests routed
+	// to each worker that have not been reported yet and what they cost,
+	// and laneInflight, their number per lane
+	mu             sync.Mutex
+	inflight       map[string]int
+	inflightTokens map[string]int
+	laneInflight   map[string]map[string]int
+	slots          int
+
+	// running holds the preemptible requests on each worker. victims maps a
+	// preempted request that has not stopped yet to the request it makes
+	// room for, whose ID is in claims until it is routed.
+	running map[string]map[string]*running
+	victims map[string]string
+	claims  map[string]struct{}
+}
+
+// Option configures a Router
+type Option func(*Router)
+
+// New creates a new router
+func New(opts ...Option) (*Router, error) {
+	r := &Router{
+		scorer:   LoadScorer{},
+		balancer: NewRoundRobin(),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.config == nil {
+		return nil, fmt.Errorf("routing: config is required")
+	}
+	if r.source == nil {
+		return nil, fmt.Errorf("routing: worker source is required")
+	}
+
+	splitter, err := NewSplitter(r.config)
+	if err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+	policy, err := newConstraintPolicy(r.config)
+	if err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+	auto, err := NewAutoRouter(r.config)
+	if err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+	tokens, err := newTokenBudget(r.config)
+	if err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+	lanes, err := newLaneSet(r.config)
+	if err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+	hedger, err := NewHedger(r.config)
+	if err != nil {
+		return nil, fmt.Errorf("routing: %w", err)
+	}
+
+	r.breakers = NewBreakerSet(r.config)
+	r.hedger = hedger
+	r.splitter = splitter
+	r.fallbacks = make(map[string][]string, len(r.config.Routing.Fallbacks))
+	for _, f := range r.config.Routing.Fallbacks {
+		r.fallbacks[f.Model] = f.Chain
+	}
+	r.policy = policy
+	r.auto = auto
+	r.tokens = tokens
+	r.lanes = lanes
+	r.inflight = make(map[string]int)
+	r.inflightTokens = make(map[string]int)
+	r.laneInflight = make(map[string]map[string]int)
+	r.running = make(map[string]map[string]*running)
+	r.victims = make(map[string]string)
+	r.claims = make(map[string]struct{})
+	r.slots = r.config.Worker.MaxConcurrency
+
+	return r, nil
+}
+
+// WithConfig sets the router configuration
+func WithConfig(cfg *config.Config) Option {
+	return func(r *Router) {
+		r.config = cfg
+	}
+}
+
+// WithLogger sets the router logger
+func WithLogger(logger *logging.Logger) Option {
+	return func(r *Router) {
+		r.logger = logger
+	}
+}
+
+// WithWorkerSource sets where the router discovers workers
+func WithWorkerSource(source WorkerSource) Option {
+	return func(r *Router) {
+		r.source = source
+	}
+}
+
+// RouteRequest picks a worker for the request. When the request's model has no
+// eligible worker its fallback chain is tried in order, and req.Model is set to
+// the model that will serve it. A model whose workers are all busy does not
+// fall back; ErrWorkersAtCapacity is returned so the request can be queued.
+// Every successful call must be followed by ReportResult once the worker has
+// answered.
+func (r *Router) RouteRequest(ctx context.Context, req *Request) (worker.Worker, error) {
+	return r.route(ctx, req, false)
+}
+
+// RouteFallback routes the request to the first model in its fallback chain
+// with a free worker, skipping the request's own model. The queue uses it for
+// requests that would otherwise wait past their deadline.
+func (r *Router) RouteFallback(ctx context.Context, req *Request) (worker.Worker, error) {
+	return r.route(ctx, req, true)
+}
+
+func (r *Router) route(ctx context.Context, req *Request, fallbackOnly bool) (worker.Worker, error) {
+	workers, err := r.source.GetActiveWorkers(ctx)
+	if err != nil {
+		return worker.Worker{}, &errors.Error{
+			Code:    http.StatusServiceUnavailable,
+			Message: "Worker registry unavailable",
+			Err:     err,
+		}
+	}
+
+	ids := make([]string, len(workers))
+	for i, w := range workers {
+		ids[i] = w.ID
+	}
+	r.breakers.Sync(ids)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rejected := make(map[string]int)
+	saturated := false
+	try := func(model string) []Candidate {
+		attempt := *req
+		attempt.Model = model
+		if req.Trace != nil {
+			req.Trace.Models = append(req.Trace.Models, model)
+		}
+		busy := rejected[RejectSaturated] + rejected[RejectReserved]
+		candidates := r.candidates(&attempt, workers, rejected)
+		if rejected[RejectSaturated]+rejected[RejectReserved] > busy {
+			saturated = true
+		}
+		return candidates
+	}
+
+	requested := req.Model
+	var candidates []Candidate
+	if !fallbackOnly {
+		candidates = try(requested)
+	}
+	if len(candidates) == 0 && !req.NoFallback && (fallbackOnly || !saturated) {
+		for _, model := range req.Permitted(r.Fallbacks(requested)) {
+			if candidates = try(model); len(candidates) > 0 {
+				req.Model = model
+				fallbacksTotal.WithLabelValues(requested, model, req.Route).Inc()
+				break
+			}
+		}
+	}
+	if req.Trace != nil {
+		req.Trace.Workers = len(workers)
+		req.Trace.Candidates = len(candidates)
+		req.Trace.Rejected = rejected
+	}
+	if len(candidates) == 0 {
+		if saturated {
+			return worker.Worker{}, errors.ErrWorkersAtCapacity
+		}
+		return worker.Worker{}, errors.ErrNoWorkersAvailable
+	}
+
+	picked := r.balancer.Pick(candidates)
+	r.breakers.Acquire(picked.Worker.ID)
+	r.inflight[picked.Worker.ID]++
+	r.acquireTokens(req, picked.Worker.ID)
+	r.acquireLane(req, picked.Worker.ID)
+
+	loaded, known := picked.Worker.ModelLoaded(req.Model)
+	if known && !loaded {
+		coldStarts.WithLabelValues(req.Model, picked.Worker.ID).Inc()
+	}
+	if req.Trace != nil {
+		req.Trace.Worker = picked.Worker.ID
+		req.Trace.Score = picked.Score
+		req.Trace.Cold = known && !loaded
+		req.Trace.Tokens = r.tokens.cost(req)
+	}
+
+	return picked.Worker, nil
+}
+
+// ReportResult records the outcome of a request routed to a worker
+func (r *Router) ReportResult(req *Request, workerID string, latency time.Duration, err error) {
+	r.mu.Lock()
+	if r.inflight[workerID] > 0 {
+		r.inflight[workerID]--
+		r.releaseTokens(req, workerID)
+		r.releaseLane(req, workerID)
+	}
+	r.mu.Unlock()
+
+	r.breakers.Record(workerID, latency, err)
+	if err == nil {
+		r.hedger.Observe(req, latency)
+	}
+}
+
+// HedgeDelay returns how long to wait on the first attempt before sending a
+// duplicate of the request to a second worker, and whether to hedge at all
+func (r *Router) HedgeDelay(req *Request) (time.Duration, bool) {
+	return r.hedger.Delay(req)
+}
+
+// Permitted returns the models of a fallback chain the request may fall back
+// to
+func (req *Request) Permitted(models []string) []string {
+	if len(req.Forbidden) == 0 {
+		return models
+	}
+	permitted := make([]string, 0, len(models))
+	for _, model := range models {
+		if !slices.Contains(req.Forbidden, model) {
+			permitted = append(permitted, model)
+		}
+	}
+	return permitted
+}
+
+// Fallbacks returns the ordered fallback chain of a model
+func (r *Router) Fallbacks(model string) []string {
+	return r.fallbacks[model]
+}
+
+// ResolveModel returns the model variant that serves a logical model name for
+// the given sticky key, typically the caller's user ID
+func (r *Router) ResolveModel(model, key string) string {
+	return r.splitter.Resolve(model, key)
+}
+
+// Constraints merges the routing labels a client asked for with its tenant's
+// policy. It fails when the client sets a label it is not allowed to or
+// contradicts a label the tenant requires.
+func (r *Router) Constraints(tenant string, require, prefer map[string]string) (Constraints, error) {
+	return r.policy.resolve(tenant, require, prefer)
+}
+
+// IsAuto reports whether a requested model name is the virtual auto model
+func (r *Router) IsAuto(model string) bool {
+	return r.auto.IsAuto(model)
+}
+
+// DecideAuto picks the concrete model serving a request to the auto model
+func (r *Router) DecideAuto(ctx context.Context, f Features, prompt string, classifier Classifier) AutoDecision {
+	d := r.auto.Decide(ctx, f, prompt, classifier)
+	autoDecisions.WithLabelValues(d.Model, d.Source).Inc()
+	return d
+}
+
+// SplitRules returns the traffic split rules keyed by logical model name
+func (r *Router) SplitRules() map[string][]Variant {
+	return r.splitter.Rules()
+}
+
+// SetSplit replaces the variants and weights of a logical model at runtime
+func (r *Router) SetSplit(model string, variants []Variant) error {
+	return r.splitter.Set(model, variants)
+}
+
+// BreakerStates returns the circuit breaker state of every known worker
+func (r *Router) BreakerStates() map[string]BreakerSnapshot {
+	return r.breakers.States()
+}
+
+// candidates returns the scored workers eligible for the request. When
+// rejected is not nil it counts the workers filtered out by reason.
+func (r *Router) candidates(req *Request, workers []worker.Worker, rejected map[string]int) []Candidate {
+	candidates := make([]Candidate, 0, len(workers))
+	for _, w := range workers {
+		if reason := r.reject(req, w); reason != "" {
+			if rejected != nil {
+				rejected[reason]++
+			}
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Worker: w,
+			Score:  r.scorer.Score(req, w) + req.Constraints.preference(w.Metadata),
+		})
+	}
+
+	warm := preferWarm(req.Model, candidates)
+	if rejected != nil && len(warm) < len(candidates) {
+		rejected[RejectCold] += len(candidates) - len(warm)
+	}
+	return warm
+}
+
+// reject returns why a worker cannot serve the request, or an empty string
+// when it is eligible. The caller must hold r.mu.
+func (r *Router) reject(req *Request, w worker.Worker) string {
+	switch {
+	case w.Status != worker.StatusReady && w.Status != worker.StatusBusy:
+		return RejectStatus
+	case !w.HasModel(req.Model):
+		return RejectModel
+	case !r.tokens.fits(req):
+		return RejectContext
+	case excluded(req, w.ID):
+		return RejectExcluded
+	case !req.Constraints.Matches(w.Metadata):
+		return RejectConstraints
+	case req.Shadow && (w.Status != worker.StatusReady || w.Load >= 1):
+		return RejectCapacity
+	case !r.breakers.Allow(w.ID):
+		return RejectBreaker
+	case r.slots > 0 && r.inflight[w.ID] >= r.slots:
+		return RejectSaturated
+	case r.overBudget(req, w):
+		return RejectSaturated
+	case r.inReserve(req, w):
+		return RejectReserved
+	}
+	return ""
+}
+
+// preferWarm narrows the candidates to workers that already have the model
+// loaded while any of them has spare capacity, so a cold load only happens
+// once warm capacity is exhausted
+func preferWarm(model string, candidates []Candidate) []Candidate {
+	var warm []Candidate
+	for _, c := range candidates {
+		if loaded, _ := c.Worker.ModelLoaded(model); !loaded {
+			continue
+		}
+		if c.Worker.Status == worker.StatusReady && c.Worker.Load < 1 {
+			warm = append(warm, c)
+		}
+	}
+	if len(warm) == 0 {
+		return candidates
+	}
+	return warm
+}
+
+func excluded(req *Request, workerID string) bool {
+	for _, id := range req.Exclude {
+		if id == workerID {
+			return true
+		}
+	}
+	return false
+}
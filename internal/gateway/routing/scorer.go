@@ -0,0 +1,31 @@
+package routing
+
+import (
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+)
+
+// Candidate is a worker eligible for a request along with its routing score
+type Candidate struct {
+	Worker worker.Worker
+	Score  float64
+}
+
+// Scorer ranks eligible workers for a request. Higher scores are preferred.
+type Scorer interface {
+	Score(req *Request, w worker.Worker) float64
+}
+
+// LoadScorer prefers workers reporting the least load
+type LoadScorer struct{}
+
+// Score returns the worker's spare capacity in the range [0, 1]
+func (LoadScorer) Score(_ *Request, w worker.Worker) float64 {
+	load := w.Load
+	if load < 0 {
+		load = 0
+	}
+	if load > 1 {
+		load = 1
+	}
+	return 1 - load
+}
@@ -0,0 +1,122 @@
+package routing
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// Variant is a concrete model receiving a weighted share of a logical model's traffic
+type Variant struct {
+	Model  string `json:"model"`
+	Weight int    `json:"weight"`
+}
+
+// Splitter resolves logical model names to weighted model variants. The same
+// sticky key always lands on the same variant while the weights are unchanged.
+type Splitter struct {
+	mu    sync.RWMutex
+	rules map[string][]Variant
+}
+
+// NewSplitter creates a splitter from the configured split rules
+func NewSplitter(cfg *config.Config) (*Splitter, error) {
+	s := &Splitter{rules: make(map[string][]Variant)}
+	for _, rule := range cfg.Routing.Splits {
+		variants := make([]Variant, 0, len(rule.Variants))
+		for _, v := range rule.Variants {
+			variants = append(variants, Variant{Model: v.Model, Weight: v.Weight})
+		}
+		if err := s.Set(rule.Model, variants); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Resolve returns the variant serving the model for the given sticky key. Models
+// without a split rule resolve to themselves.
+func (s *Splitter) Resolve(model, key string) string {
+	s.mu.RLock()
+	variants, ok := s.rules[model]
+	s.mu.RUnlock()
+
+	if !ok {
+		return model
+	}
+
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+
+	var point int
+	if key == "" {
+		point = rand.Intn(total) // #nosec G404 -- traffic splitting does not need a secure source
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(model + "|" + key))
+		point = int(h.Sum32() % uint32(total))
+	}
+
+	for _, v := range variants {
+		if point < v.Weight {
+			return v.Model
+		}
+		point -= v.Weight
+	}
+	return variants[len(variants)-1].Model
+}
+
+// Set replaces the variants of a logical model. An empty list removes the rule.
+func (s *Splitter) Set(model string, variants []Variant) error {
+	if model == "" {
+		return fmt.Errorf("split rule requires a model")
+	}
+
+	if len(variants) > 0 {
+		total := 0
+		seen := make(map[string]bool, len(variants))
+		for _, v := range variants {
+			if v.Model == "" {
+				return fmt.Errorf("split rule for %s has a variant without a model", model)
+			}
+			if seen[v.Model] {
+				return fmt.Errorf("split rule for %s lists %s more than once", model, v.Model)
+			}
+			if v.Weight < 0 {
+				return fmt.Errorf("split rule for %s has a negative weight for %s", model, v.Model)
+			}
+			seen[v.Model] = true
+			total += v.Weight
+		}
+		if total == 0 {
+			return fmt.Errorf("split rule for %s has no weight", model)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(variants) == 0 {
+		delete(s.rules, model)
+		return nil
+	}
+	s.rules[model] = append([]Variant(nil), variants...)
+	return nil
+}
+
+// Rules returns a copy of every split rule keyed by logical model name
+func (s *Splitter) Rules() map[string][]Variant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rules := make(map[string][]Variant, len(s.rules))
+	for model, variants := range s.rules {
+		rules[model] = append([]Variant(nil), variants...)
+	}
+	return rules
+}
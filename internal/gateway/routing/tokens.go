@@ -0,0 +1,123 @@
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+// MetadataTokenBudget is the worker metadata label overriding the configured
+// token budget, for workers with more or less GPU memory than the rest
+const MetadataTokenBudget = "token_budget"
+
+// ErrContextWindowExceeded is returned for requests that cannot fit their
+// model's context window
+var ErrContextWindowExceeded = &errors.Error{Code: http.StatusBadRequest, Message: "Request exceeds the model's context window"}
+
+// tokenBudget estimates what requests cost in tokens and how many tokens each
+// worker may serve at once
+type tokenBudget struct {
+	budget     int
+	defaultMax int
+	windows    map[string]int
+}
+
+// newTokenBudget creates the token accounting from configuration
+func newTokenBudget(cfg *config.Config) (*tokenBudget, error) {
+	b := &tokenBudget{
+		budget:     cfg.Worker.TokenBudget,
+		defaultMax: cfg.Worker.DefaultMaxTokens,
+		windows:    make(map[string]int, len(cfg.Routing.ContextWindows)),
+	}
+	if b.budget < 0 || b.defaultMax < 0 {
+		return nil, fmt.Errorf("worker token budget and default max tokens must not be negative")
+	}
+	for _, w := range cfg.Routing.ContextWindows {
+		if w.Model == "" || w.Tokens <= 0 {
+			return nil, fmt.Errorf("context window for model %q must be positive", w.Model)
+		}
+		if _, ok := b.windows[w.Model]; ok {
+			return nil, fmt.Errorf("duplicate context window for model %q", w.Model)
+		}
+		b.windows[w.Model] = w.Tokens
+	}
+	return b, nil
+}
+
+// cost returns the tokens a request occupies on its worker: its prompt and
+// the completion it may generate. Embeddings generate nothing.
+func (b *tokenBudget) cost(req *Request) int {
+	if req.Route == RouteEmbeddings {
+		return req.PromptTokens
+	}
+	completion := req.MaxTokens
+	if completion <= 0 {
+		completion = b.defaultMax
+	}
+	return req.PromptTokens + completion
+}
+
+// fits reports whether the request's prompt and max_tokens fit the context
+// window of req.Model. Models without a configured window always fit.
+func (b *tokenBudget) fits(req *Request) bool {
+	window, ok := b.windows[req.Model]
+	if !ok {
+		return true
+	}
+	return req.PromptTokens+req.MaxTokens <= window
+}
+
+// limit returns the token budget of a worker, or zero when it is unlimited
+func (b *tokenBudget) limit(w worker.Worker) int {
+	if v, ok := w.Metadata[MetadataTokenBudget]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return b.budget
+}
+
+// CheckContext rejects a request whose prompt and max_tokens do not fit the
+// context window of its model, before it is queued
+func (r *Router) CheckContext(req *Request) error {
+	if r.tokens.fits(req) {
+		return nil
+	}
+	return errors.WithMessage(ErrContextWindowExceeded, fmt.Sprintf(
+		"This model's maximum context length is %d tokens, but the request needs about %d tokens (%d in the prompt, %d for the completion)",
+		r.tokens.windows[req.Model], req.PromptTokens+req.MaxTokens, req.PromptTokens, req.MaxTokens))
+}
+
+// overBudget reports whether routing the request to a worker would take its
+// in-flight tokens past the worker's budget. A worker serving nothing takes
+// any request that fits a context window, so large requests are not starved.
+// The caller must hold r.mu.
+func (r *Router) overBudget(req *Request, w worker.Worker) bool {
+	limit := r.tokens.limit(w)
+	used := r.inflightTokens[w.ID]
+	return limit > 0 && used > 0 && used+r.tokens.cost(req) > limit
+}
+
+// acquireTokens charges a routed request to its worker. The caller must
+// hold r.mu.
+func (r *Router) acquireTokens(req *Request, workerID string) {
+	r.inflightTokens[workerID] += r.tokens.cost(req)
+	inflightTokens.WithLabelValues(workerID).Set(float64(r.inflightTokens[workerID]))
+}
+
+// releaseTokens returns a request's tokens once its worker has answered. The
+// caller must hold r.mu.
+func (r *Router) releaseTokens(req *Request, workerID string) {
+	used := r.inflightTokens[workerID] - r.tokens.cost(req)
+	if used <= 0 {
+		delete(r.inflightTokens, workerID)
+		used = 0
+	} else {
+		r.inflightTokens[workerID] = used
+	}
+	inflightTokens.WithLabelValues(workerID).Set(float64(used))
+}
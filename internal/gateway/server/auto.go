@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+	"github.com/ncolesummers/mindgateway/pkg/api/openai"
+)
+
+// Headers describing an auto-routing decision
+const (
+	HeaderAutoModel  = "X-MindGateway-Auto-Model"
+	HeaderAutoReason = "X-MindGateway-Auto-Reason"
+)
+
+// maxClassifyPrompt bounds how much of a prompt is sent to the router model
+const maxClassifyPrompt = 2000
+
+// resolveAuto returns the model serving a request. Requests for the virtual
+// auto model are routed by prompt features and the decision is reported in
+// response headers; other models are returned unchanged.
+func (s *Server) resolveAuto(c *gin.Context, model, prompt string, tools bool) string {
+	if !s.routingEngine.IsAuto(model) {
+		return model
+	}
+
+	d := s.routingEngine.DecideAuto(c.Request.Context(), routing.Classify(prompt, tools), prompt, routerModel{s})
+	c.Header(HeaderAutoModel, d.Model)
+	c.Header(HeaderAutoReason, d.Reason)
+
+	s.logger.WithField("model", d.Model).
+		WithField("source", d.Source).
+		WithField("reason", d.Reason).
+		Debug("Auto-routed request")
+
+	return d.Model
+}
+
+// chatPrompt joins the content of a conversation for classification
+func chatPrompt(messages []openai.ChatMessage) string {
+	parts := make([]string, 0, len(messages))
+	for _, m := range messages {
+		parts = append(parts, m.Content)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// routerModel classifies prompts by asking a small model on the fleet
+type routerModel struct {
+	s *Server
+}
+
+// Classify asks the router model to pick one of the choices for the prompt
+func (r routerModel) Classify(ctx context.Context, model, prompt string, choices []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.s.config.Routing.Auto.RouterTimeout)
+	defer cancel()
+
+	if runes := []rune(prompt); len(runes) > maxClassifyPrompt {
+		prompt = string(runes[:maxClassifyPrompt])
+	}
+
+	req := &routing.Request{
+		ID:           newRequestID("auto"),
+		Route:        routing.RouteCompletions,
+		LogicalModel: model,
+		Variant:      model,
+		Model:        model,
+		MaxTokens:    32,
+		NoFallback:   true,
+		Priority:     r.s.config.Queue.DefaultPriority,
+	}
+	gen := ollama.GenerateRequest{
+		Model: model,
+		Prompt: fmt.Sprintf("Pick the model best suited to answer the request below. "+
+			"Reply with exactly one of: %s\n\nRequest:\n%s", strings.Join(choices, ", "), prompt),
+		Options: map[string]interface{}{"temperature": 0, "num_predict": req.MaxTokens},
+	}
+	req.PromptTokens = routing.EstimateTokens(gen.Prompt)
+
+	resp, err := dispatch(ctx, r.s, req, func(ctx context.Context, w Worker, id string) (*ollama.GenerateResponse, error) {
+		return r.s.workerClient.Generate(ctx, w, id, gen)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	answer := strings.TrimSpace(resp.Response)
+	if i := strings.IndexByte(answer, '\n'); i >= 0 {
+		answer = answer[:i]
+	}
+	return strings.Trim(answer, " \t\"'`."), nil
+}
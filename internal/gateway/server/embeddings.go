@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/batch"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+)
+
+// embed embeds a request's inputs, merging them with concurrent requests
+// that would be routed the same way when batching is enabled
+func (s *Server) embed(ctx context.Context, req *routing.Request, inputs []string) (*batch.Result, error) {
+	if s.batcher == nil {
+		return s.embedBatch(ctx, req, inputs)
+	}
+	return s.batcher.Embed(ctx, batchKey(req), inputs, func(ctx context.Context, inputs []string) (*batch.Result, error) {
+		breq := *req
+		breq.ID = newRequestID("embd")
+		breq.PromptTokens = inputTokens(inputs)
+		return s.embedBatch(ctx, &breq, inputs)
+	})
+}
+
+// embedBatch routes a set of inputs to one worker and embeds them
+func (s *Server) embedBatch(ctx context.Context, req *routing.Request, inputs []string) (*batch.Result, error) {
+	embeddings, err := dispatch(ctx, s, req, func(ctx context.Context, w Worker, id string) ([][]float64, error) {
+		return s.embedInputs(ctx, w, id, req.Model, inputs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &batch.Result{Embeddings: embeddings, Model: req.Model, QueueWait: req.QueueWait}, nil
+}
+
+// embedInputs sends inputs to a worker, in calls of up to its maximum batch
+// size when it batches and one at a time when it does not
+func (s *Server) embedInputs(ctx context.Context, w Worker, id, model string, inputs []string) ([][]float64, error) {
+	out := make([][]float64, 0, len(inputs))
+	if !w.Batching {
+		for _, input := range inputs {
+			resp, err := s.workerClient.Embeddings(ctx, w, id, ollama.EmbeddingRequest{Model: model, Prompt: input})
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, resp.Embedding)
+		}
+		return out, nil
+	}
+
+	size := w.MaxBatchSize
+	if size <= 0 {
+		size = len(inputs)
+	}
+	for start := 0; start < len(inputs); start += size {
+		end := min(start+size, len(inputs))
+		resp, err := s.workerClient.Embed(ctx, w, id, ollama.EmbedRequest{Model: model, Input: inputs[start:end]})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Embeddings) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(resp.Embeddings))
+		}
+		out = append(out, resp.Embeddings...)
+	}
+	return out, nil
+}
+
+// batchKey groups embedding requests that would be queued and routed the
+// same way, which are the only ones merged into a batch
+func batchKey(req *routing.Request) string {
+	return strings.Join([]string{
+		req.Variant,
+		req.Tenant,
+		strings.Join(req.Roles, ","),
+		strconv.Itoa(req.Priority),
+		req.Lane,
+		strconv.FormatBool(req.NoFallback),
+		routing.FormatLabels(req.Constraints.Require),
+		routing.FormatLabels(req.Constraints.Prefer),
+	}, "|")
+}
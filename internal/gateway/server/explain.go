@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/pkg/api/openai"
+)
+
+// explainRoute evaluates an inference request body against the fleet and
+// returns how it would be routed, without running inference. Routing headers
+// on the explain request apply as they would to the real one.
+func (s *Server) explainRoute(c *gin.Context) {
+	var req struct {
+		Route     string               `json:"route"`
+		Model     string               `json:"model" binding:"required"`
+		Messages  []openai.ChatMessage `json:"messages"`
+		Prompt    string               `json:"prompt"`
+		Tools     []openai.Tool        `json:"tools"`
+		User      string               `json:"user"`
+		MaxTokens int                  `json:"max_tokens"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	route := req.Route
+	if route == "" {
+		route = routing.RouteChat
+		if req.Prompt != "" {
+			route = routing.RouteCompletions
+		}
+	}
+	switch route {
+	case routing.RouteChat, routing.RouteCompletions, routing.RouteEmbeddings:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown route: " + route})
+		return
+	}
+
+	model := req.Model
+	var auto *routing.AutoDecision
+	if s.routingEngine.IsAuto(model) {
+		if route == routing.RouteEmbeddings {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Automatic model selection is not supported for embeddings"})
+			return
+		}
+		prompt := req.Prompt
+		if route == routing.RouteChat {
+			prompt = chatPrompt(req.Messages)
+		}
+		// The router model is not consulted, as that would run inference
+		d := s.routingEngine.DecideAuto(c.Request.Context(), routing.Classify(prompt, len(req.Tools) > 0), prompt, nil)
+		auto = &d
+		model = d.Model
+	}
+
+	tokens := routing.EstimateTokens(req.Prompt)
+	if route == routing.RouteChat {
+		tokens = chatTokens(req.Messages)
+	}
+	rreq, err := s.newRoutingRequest(c, "explain", route, model, req.User, tokens, req.MaxTokens)
+	if err != nil {
+		e := errors.From(err)
+		c.JSON(e.Code, gin.H{"error": e.Message})
+		return
+	}
+
+	exp, err := s.routingEngine.Explain(c.Request.Context(), rreq)
+	if err != nil {
+		e := errors.From(err)
+		c.JSON(e.Code, gin.H{"error": e.Message})
+		return
+	}
+
+	out := gin.H{
+		"request": gin.H{
+			"route":         rreq.Route,
+			"logical_model": rreq.LogicalModel,
+			"variant":       rreq.Variant,
+			"no_fallback":   rreq.NoFallback,
+			"prompt_tokens": rreq.PromptTokens,
+			"lane":          rreq.Lane,
+			"priority":      rreq.Priority,
+			"constraints":   rreq.Constraints,
+		},
+		"routing": exp,
+	}
+	if auto != nil {
+		out["auto"] = auto
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,520 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/handlers"
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/gateway/queue"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+	"github.com/ncolesummers/mindgateway/pkg/api/openai"
+)
+
+// Headers read and set by the gateway
+const (
+	HeaderModelVariant = "X-MindGateway-Model-Variant"
+	HeaderServedModel  = "X-MindGateway-Served-Model"
+	HeaderNoFallback   = "X-MindGateway-No-Fallback"
+	HeaderRequire      = "X-MindGateway-Require"
+	HeaderPrefer       = "X-MindGateway-Prefer"
+	HeaderDebug        = "X-MindGateway-Debug"
+	HeaderRouteTrace   = "X-MindGateway-Route-Trace"
+	HeaderPriority     = "X-MindGateway-Priority"
+	HeaderTimeout      = "X-MindGateway-Timeout-Ms"
+	HeaderQueueWait    = "X-Queue-Wait-Ms"
+)
+
+// newRequestID returns a random request ID with the given prefix
+func newRequestID(prefix string) string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return prefix + "-" + time.Now().Format("20060102150405.000000000")
+	}
+	return prefix + "-" + hex.EncodeToString(b)
+}
+
+// errPreempted reports an attempt stopped to make room for a higher lane
+var errPreempted = stderrors.New("request preempted")
+
+// attempt is the outcome of one attempt at serving a request
+type attempt[T any] struct {
+	id     string
+	worker Worker
+	value  T
+	err    error
+}
+
+// dispatch routes the request to a worker and runs call against it. When the
+// routing engine allows hedging and the first attempt has not answered within
+// the hedge delay, a duplicate is sent to a second worker; the first success
+// wins and the other attempt is cancelled. Every attempt's outcome is reported
+// back to the routing engine. A request preempted for a higher lane is
+// requeued, and stops being preemptible once it has been requeued the
+// configured number of times.
+func dispatch[T any](ctx context.Context, s *Server, req *routing.Request, call func(ctx context.Context, w Worker, attemptID string) (T, error)) (T, error) {
+	for {
+		value, err := dispatchOnce(ctx, s, req, call)
+		if !stderrors.Is(err, errPreempted) {
+			return value, err
+		}
+
+		req.Preemptions++
+		req.Preempt = nil
+		if req.Preemptions < s.config.Routing.Lanes.MaxPreemptions {
+			req.Preempt = make(chan struct{})
+		}
+		s.logger.WithField("request_id", req.ID).WithField("lane", req.Lane).Debug("Request preempted, requeueing")
+	}
+}
+
+// dispatchOnce makes one attempt at serving the request, returning
+// errPreempted when the router stops it for a higher lane
+func dispatchOnce[T any](ctx context.Context, s *Server, req *routing.Request, call func(ctx context.Context, w Worker, attemptID string) (T, error)) (T, error) {
+	var zero T
+
+	primary, err := s.route(ctx, req)
+	if err != nil {
+		return zero, err
+	}
+
+	caller := ctx
+	ctx, cancel := context.WithTimeout(ctx, s.config.Worker.RequestTimeout)
+	defer cancel()
+
+	results := make(chan attempt[T], 2)
+	run := func(w Worker, id string) {
+		start := time.Now()
+		value, err := call(ctx, w, id)
+		s.reportResult(req, w.ID, time.Since(start), workerFault(caller, err))
+		results <- attempt[T]{id: id, worker: w, value: value, err: err}
+	}
+
+	go run(primary, req.ID)
+	pending := 1
+
+	var hedge <-chan time.Time
+	if delay, ok := s.routingEngine.HedgeDelay(req); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	var hedgeID string
+	var failed attempt[T]
+	preempt := req.Preempt
+	preempted := false
+	for pending > 0 {
+		select {
+		case <-preempt:
+			preempt = nil
+			hedge = nil
+			preempted = true
+			cancel()
+		case <-hedge:
+			hedge = nil
+			hedged := *req
+			hedged.NoFallback = true
+			hedged.Exclude = append(append([]string(nil), req.Exclude...), primary.ID)
+			hedged.Trace = nil
+			hedged.Preempt = nil
+			w, err := s.routingEngine.RouteRequest(ctx, &hedged)
+			if err != nil {
+				continue
+			}
+			hedgeID = req.ID + "-hedge"
+			go run(w, hedgeID)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				failed = res
+				hedge = nil
+				continue
+			}
+			if hedgeID != "" {
+				winner := "primary"
+				loser := hedgeID
+				if res.id == hedgeID {
+					winner = "hedge"
+					loser = req.ID
+				}
+				if pending > 0 {
+					s.workerClient.Cancel(loser)
+				}
+				handlers.RecordHedge(req.Model, req.Route, winner)
+			}
+			return res.value, nil
+		}
+	}
+
+	if preempted {
+		return zero, errPreempted
+	}
+	if callerTimedOut(caller) {
+		return zero, errors.ErrTimeout
+	}
+	s.logger.WithWorker(failed.worker.ID).WithError(failed.err).Warn("Worker request failed")
+	return zero, workerError(failed.err)
+}
+
+// callerTimedOut reports whether the deadline the caller set for a request
+// passed, which is no failure of the worker serving it
+func callerTimedOut(caller context.Context) bool {
+	return stderrors.Is(caller.Err(), context.DeadlineExceeded)
+}
+
+// workerError returns the error shown to clients for a failed worker request
+func workerError(err error) error {
+	if stderrors.Is(err, context.DeadlineExceeded) {
+		return errors.ErrWorkerTimeout
+	}
+	return &errors.Error{Code: errors.ErrWorkerFailed.Code, Message: errors.ErrWorkerFailed.Message, Err: err}
+}
+
+// newRoutingRequest builds the routing request for a client request, checking
+// the caller may use the model, resolving the logical model to the variant
+// that will serve it and attaching the worker constraints of the client and
+// its tenant. Requests that cannot fit
+// the model's context window are rejected here, before they are queued. The
+// returned request is always usable for recording metrics, even when an error
+// is returned.
+func (s *Server) newRoutingRequest(c *gin.Context, prefix, route, model, user string, promptTokens, maxTokens int) (*routing.Request, error) {
+	variant := s.routingEngine.ResolveModel(model, stickyKey(c, user))
+	noFallback, _ := strconv.ParseBool(c.GetHeader(HeaderNoFallback))
+
+	req := &routing.Request{
+		ID:           newRequestID(prefix),
+		Route:        route,
+		LogicalModel: model,
+		Variant:      variant,
+		Model:        variant,
+		MaxTokens:    maxTokens,
+		PromptTokens: promptTokens,
+		NoFallback:   noFallback,
+		Priority:     s.config.Queue.DefaultPriority,
+	}
+	if p, ok := principal(c); ok {
+		// Only authenticated callers have a tenant, which is not theirs to
+		// choose
+		req.Tenant = p.Tenant
+		req.Roles = p.Roles
+	}
+	if err := s.authorize(c, auth.ModelResource(model), auth.ActionInvoke); err != nil {
+		return req, err
+	}
+	// Variants and fallbacks serve the request in place of the model, so the
+	// caller must be allowed to invoke them too
+	if variant != model {
+		if err := s.authorize(c, auth.ModelResource(variant), auth.ActionInvoke); err == errors.ErrForbidden {
+			req.Variant, req.Model = model, model
+		} else if err != nil {
+			return req, err
+		}
+	}
+	if s.authClient != nil && !noFallback {
+		for _, fallback := range s.routingEngine.Fallbacks(req.Model) {
+			if err := s.authorize(c, auth.ModelResource(fallback), auth.ActionInvoke); err == errors.ErrForbidden {
+				req.Forbidden = append(req.Forbidden, fallback)
+			} else if err != nil {
+				return req, err
+			}
+		}
+	}
+	lane, laned := s.routingEngine.Lane(laneRoute(c, route), keyFingerprint(c))
+	if laned {
+		req.Lane = lane.Name
+		req.Priority = lane.Priority
+		if lane.Preemptible && s.config.Routing.Lanes.MaxPreemptions > 0 {
+			req.Preempt = make(chan struct{})
+		}
+	}
+	if p := c.GetHeader(HeaderPriority); p != "" {
+		priority, err := strconv.Atoi(p)
+		if err != nil {
+			return req, errors.WithMessage(errors.ErrInvalidInput, "Invalid "+HeaderPriority+" header")
+		}
+		// Clients may lower the priority of their lane or route, but not
+		// raise it
+		if priority < req.Priority {
+			req.Priority = priority
+		}
+	}
+	if debug, _ := strconv.ParseBool(c.GetHeader(HeaderDebug)); debug && s.isAdmin(c) {
+		req.Trace = &routing.Trace{}
+	}
+
+	require, err := routing.ParseLabels(c.GetHeader(HeaderRequire))
+	if err != nil {
+		return req, errors.WithMessage(errors.ErrInvalidInput, "Invalid "+HeaderRequire+" header: "+err.Error())
+	}
+	prefer, err := routing.ParseLabels(c.GetHeader(HeaderPrefer))
+	if err != nil {
+		return req, errors.WithMessage(errors.ErrInvalidInput, "Invalid "+HeaderPrefer+" header: "+err.Error())
+	}
+	req.Constraints, err = s.routingEngine.Constraints(req.Tenant, require, prefer)
+	if err != nil {
+		return req, err
+	}
+	if err := s.routingEngine.CheckContext(req); err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
+
+// messageOverhead approximates the tokens a chat template adds around each
+// message
+const messageOverhead = 4
+
+// chatTokens estimates the prompt tokens of a conversation
+func chatTokens(messages []openai.ChatMessage) int {
+	n := 0
+	for _, m := range messages {
+		n += routing.EstimateTokens(m.Content) + messageOverhead
+	}
+	return n
+}
+
+// inputTokens estimates the tokens of the inputs to an embeddings request
+func inputTokens(inputs []string) int {
+	n := 0
+	for _, input := range inputs {
+		n += routing.EstimateTokens(input)
+	}
+	return n
+}
+
+// laneRoute returns the route lane rules match a request by, which is jobs
+// for every request of an asynchronous job
+func laneRoute(c *gin.Context, route string) string {
+	if _, ok := jobs.FromContext(c.Request.Context()); ok {
+		return routing.RouteJobs
+	}
+	return route
+}
+
+// keyFingerprint identifies the caller's credential without keeping it, as
+// the ID of an API key or the first 16 hex digits of the SHA-256 of any other
+// credential
+func keyFingerprint(c *gin.Context) string {
+	token := credential(c)
+	if token == "" {
+		return ""
+	}
+	if id, ok := auth.KeyID(token); ok {
+		return id
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// stickyKey identifies the caller so that traffic splits assign them to the
+// same variant on every request
+func stickyKey(c *gin.Context, user string) string {
+	if user != "" {
+		return user
+	}
+	if p, ok := principal(c); ok {
+		return p.UserID
+	}
+	if token := c.GetHeader("Authorization"); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	return c.ClientIP()
+}
+
+// tenantLabel returns the metric label for a caller's tenant. Only the tenants
+// the configuration names are labelled by name, so that callers cannot add
+// metric series without bound.
+func (s *Server) tenantLabel(tenant string) string {
+	if tenant == "" || s.config.NamesTenant(tenant) {
+		return tenant
+	}
+	return "other"
+}
+
+// respond writes a successful response and records it
+func (s *Server) respond(c *gin.Context, req *routing.Request, start time.Time, usage openai.Usage, body interface{}) {
+	handlers.RecordRequestMetrics(req.LogicalModel, req.Route, http.StatusOK, start, usage.PromptTokens, usage.CompletionTokens)
+	handlers.RecordVariant(req.LogicalModel, req.Variant, req.Route, http.StatusOK)
+	handlers.RecordTenantUsage(s.tenantLabel(req.Tenant), req.Route, http.StatusOK, usage.PromptTokens, usage.CompletionTokens)
+	setTraceHeader(c, req)
+	setQueueHeader(c, req)
+	c.Header(HeaderModelVariant, req.Variant)
+	c.Header(HeaderServedModel, req.Model)
+	c.JSON(http.StatusOK, body)
+}
+
+// respondError writes the error response for a failed request and records it
+func (s *Server) respondError(c *gin.Context, req *routing.Request, start time.Time, err error) {
+	e := errors.From(err)
+	handlers.RecordRequestMetrics(req.LogicalModel, req.Route, e.Code, start, 0, 0)
+	handlers.RecordVariant(req.LogicalModel, req.Variant, req.Route, e.Code)
+	handlers.RecordTenantUsage(s.tenantLabel(req.Tenant), req.Route, e.Code, 0, 0)
+	setTraceHeader(c, req)
+	setQueueHeader(c, req)
+
+	// Requests turned away by admission control are told when to come back,
+	// in the form OpenAI clients know to retry
+	var rejection *queue.Rejection
+	if stderrors.As(err, &rejection) {
+		c.Header("Retry-After", strconv.Itoa(int(rejection.RetryAfter/time.Second)))
+		c.JSON(e.Code, openai.ErrorResponse{Error: openai.ErrorDetail{
+			Message: e.Message,
+			Type:    "requests",
+			Code:    "rate_limit_exceeded",
+		}})
+		return
+	}
+	c.JSON(e.Code, gin.H{"error": e.Message})
+}
+
+// route picks the worker for a request, waiting in the queue for capacity
+// when a queue manager is configured
+func (s *Server) route(ctx context.Context, req *routing.Request) (Worker, error) {
+	if s.queueManager != nil {
+		return s.queueManager.Submit(ctx, req)
+	}
+	return s.routingEngine.RouteRequest(ctx, req)
+}
+
+// reportResult records the outcome of a request and wakes the queue, as the
+// worker now has capacity for another request
+func (s *Server) reportResult(req *routing.Request, workerID string, latency time.Duration, err error) {
+	s.routingEngine.ReportResult(req, workerID, latency, err)
+	if s.queueManager != nil {
+		s.queueManager.Notify()
+	}
+}
+
+// workerFault returns the error of a failed worker request to hold against
+// the worker. Requests the caller cancelled, or whose deadline the caller set
+// passed, are reported as cancelled, as only the gateway's own worker timeout
+// says anything of the worker.
+func workerFault(caller context.Context, err error) error {
+	if err != nil && caller.Err() != nil {
+		return context.Canceled
+	}
+	return err
+}
+
+// requestContext returns the context for serving a request, bounded by the
+// client's timeout header when one is set
+func requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	ms, err := strconv.Atoi(c.GetHeader(HeaderTimeout))
+	if err != nil || ms <= 0 {
+		return context.WithCancel(c.Request.Context())
+	}
+	return context.WithTimeout(c.Request.Context(), time.Duration(ms)*time.Millisecond)
+}
+
+// setTraceHeader attaches the routing trace of a request being debugged
+func setTraceHeader(c *gin.Context, req *routing.Request) {
+	if req.Trace != nil && len(req.Trace.Models) > 0 {
+		c.Header(HeaderRouteTrace, req.Trace.String())
+	}
+}
+
+// setQueueHeader reports how long a request waited in the queue
+func setQueueHeader(c *gin.Context, req *routing.Request) {
+	c.Header(HeaderQueueWait, strconv.FormatInt(req.QueueWait.Milliseconds(), 10))
+}
+
+// ollamaOptions maps OpenAI sampling parameters onto Ollama options
+func ollamaOptions(temperature, topP float64, maxTokens int, stop []string) map[string]interface{} {
+	opts := make(map[string]interface{})
+	if temperature != 0 {
+		opts["temperature"] = temperature
+	}
+	if topP != 0 {
+		opts["top_p"] = topP
+	}
+	if maxTokens > 0 {
+		opts["num_predict"] = maxTokens
+	}
+	if len(stop) > 0 {
+		opts["stop"] = stop
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return opts
+}
+
+func toOllamaChat(model string, req openai.ChatCompletionRequest) ollama.ChatRequest {
+	messages := make([]ollama.Message, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		messages = append(messages, ollama.Message{Role: m.Role, Content: m.Content})
+	}
+	return ollama.ChatRequest{
+		Model:    model,
+		Messages: messages,
+		Options:  ollamaOptions(req.Temperature, req.TopP, req.MaxTokens, req.Stop),
+	}
+}
+
+func fromOllamaChat(id string, resp *ollama.ChatResponse) openai.ChatCompletionResponse {
+	return openai.ChatCompletionResponse{
+		ID:      id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   resp.Model,
+		Choices: []openai.ChatCompletionChoice{
+			{
+				Message: openai.ChatMessage{
+					Role:    resp.Message.Role,
+					Content: resp.Message.Content,
+				},
+				FinishReason: "stop",
+				Index:        0,
+			},
+		},
+		Usage: openai.Usage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+			TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+		},
+	}
+}
+
+func toOllamaGenerate(model string, req openai.CompletionRequest) ollama.GenerateRequest {
+	return ollama.GenerateRequest{
+		Model:   model,
+		Prompt:  req.Prompt,
+		Options: ollamaOptions(req.Temperature, req.TopP, req.MaxTokens, req.Stop),
+	}
+}
+
+func fromOllamaGenerate(id string, resp *ollama.GenerateResponse) openai.CompletionResponse {
+	return openai.CompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   resp.Model,
+		Choices: []openai.CompletionChoice{
+			{
+				Text:         resp.Response,
+				FinishReason: "stop",
+				Index:        0,
+			},
+		},
+		Usage: openai.Usage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+			TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+// createJob accepts an inference request to be served in the background
+func (s *Server) createJob(c *gin.Context) {
+	if s.jobManager == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Jobs are not enabled"})
+		return
+	}
+
+	var req struct {
+		Endpoint string          `json:"endpoint" binding:"required"`
+		Request  json.RawMessage `json:"request" binding:"required"`
+		Webhook  *struct {
+			URL string `json:"url" binding:"required"`
+		} `json:"webhook"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	// The model a job's request names is authorized now, so that jobs the
+	// caller may not run are rejected up front. The request is authorized
+	// again, as the caller, when it is served.
+	var body struct {
+		Model string `json:"model"`
+	}
+	if json.Unmarshal(req.Request, &body) == nil && body.Model != "" {
+		if err := s.authorize(c, auth.ModelResource(body.Model), auth.ActionInvoke); err != nil {
+			e := errors.From(err)
+			c.JSON(e.Code, gin.H{"error": e.Message})
+			return
+		}
+	}
+
+	job := &jobs.Job{
+		Endpoint: req.Endpoint,
+		Request:  req.Request,
+		Header:   gatewayHeaders(c.Request.Header),
+	}
+	if p, ok := principal(c); ok {
+		job.UserID = p.UserID
+		job.Principal = p
+	}
+	if req.Webhook != nil {
+		job.Webhook = &jobs.Webhook{URL: req.Webhook.URL}
+	}
+
+	if err := s.jobManager.Submit(c.Request.Context(), job); err != nil {
+		e := errors.From(err)
+		c.JSON(e.Code, gin.H{"error": e.Message})
+		return
+	}
+
+	c.Header("Location", "/v1/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// getJob returns a job's status, and its result once it has finished. Jobs
+// are only shown to the caller who submitted them and to admins.
+func (s *Server) getJob(c *gin.Context) {
+	if s.jobManager == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Jobs are not enabled"})
+		return
+	}
+
+	job, err := s.jobManager.Get(c.Request.Context(), c.Param("id"))
+	if err == nil && !s.ownsJob(c, job) {
+		err = jobs.ErrNotFound
+	}
+	if err != nil {
+		e := errors.From(err)
+		c.JSON(e.Code, gin.H{"error": e.Message})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// ownsJob reports whether the caller may see a job
+func (s *Server) ownsJob(c *gin.Context, job *jobs.Job) bool {
+	p, ok := principal(c)
+	if !ok || job.Principal == nil || job.Principal.UserID == p.UserID {
+		return true
+	}
+	return s.isAdmin(c)
+}
+
+// gatewayHeaders returns the gateway's own headers, which steer how a job's
+// request is routed. Credentials are not kept with the job.
+func gatewayHeaders(header http.Header) map[string]string {
+	out := make(map[string]string)
+	for k, v := range header {
+		if len(v) > 0 && strings.HasPrefix(strings.ToLower(k), "x-mindgateway-") {
+			out[k] = v[0]
+		}
+	}
+	return out
+}
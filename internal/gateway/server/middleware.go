@@ -1,10 +1,14 @@
 package server
 
 import (
+	"strings"
 	"time"
 	
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
 	"github.com/ncolesummers/mindgateway/internal/shared/logging"
 )
 
@@ -92,33 +96,112 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
-// AuthMiddleware validates authentication tokens
+// HeaderAPIKey carries an API key for clients that cannot set the
+// Authorization header
+const HeaderAPIKey = "X-API-Key"
+
+// PrincipalKey is the gin context key of the request's authenticated caller
+const PrincipalKey = "principal"
+
+// AuthMiddleware validates the caller's token or API key and attaches the
+// principal it identifies to the request, then audits the request. Requests
+// of asynchronous jobs were authenticated when the job was submitted, and
+// carry the principal who submitted it, whose credential is checked again
+// before the job is served.
 func (s *Server) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		if token == "" {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Authorization token required"})
-			return
-		}
-		
-		// Strip 'Bearer ' prefix if present
-		if len(token) > 7 && token[:7] == "Bearer " {
-			token = token[7:]
-		}
-		
-		// Validate token with auth service
-		valid, err := s.authClient.ValidateToken(c.Request.Context(), token)
-		if err != nil {
-			s.logger.WithError(err).Error("Failed to validate token")
-			c.AbortWithStatusJSON(500, gin.H{"error": "Internal authentication error"})
-			return
+		var p *auth.Principal
+		if _, ok := jobs.FromContext(c.Request.Context()); ok {
+			p, _ = principal(c)
+			if p != nil {
+				if err := s.recheck(c, p); err != nil {
+					e := errors.From(err)
+					c.AbortWithStatusJSON(e.Code, gin.H{"error": e.Message})
+					return
+				}
+			}
+		} else {
+			token := credential(c)
+			if token == "" {
+				c.AbortWithStatusJSON(401, gin.H{"error": "Authorization token required"})
+				return
+			}
+			
+			// Validate token with auth service
+			var err error
+			p, err = s.authClient.ValidateToken(c.Request.Context(), token)
+			if err != nil {
+				s.logger.WithError(err).Error("Failed to validate token")
+				c.AbortWithStatusJSON(500, gin.H{"error": "Internal authentication error"})
+				return
+			}
+			
+			if p == nil {
+				c.AbortWithStatusJSON(401, gin.H{"error": "Invalid authorization token"})
+				return
+			}
 		}
 		
-		if !valid {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid authorization token"})
+		if p == nil {
+			c.Next()
 			return
 		}
+		c.Set(PrincipalKey, p)
+		c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), p))
 		
 		c.Next()
+		
+		s.audit(c, p)
+	}
+}
+
+// recheck checks that the credential the submitter of an asynchronous job
+// presented has neither expired nor been revoked since, and that they may
+// still submit jobs
+func (s *Server) recheck(c *gin.Context, p *auth.Principal) error {
+	if !p.ExpiresAt.IsZero() && !time.Now().Before(p.ExpiresAt) {
+		return errors.ErrUnauthorized
+	}
+	allowed, err := s.authClient.CheckPrincipalPermission(c.Request.Context(), p, auth.ResourceJobs, auth.ActionCreate)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to check job submitter's credential")
+		return errors.ErrServiceUnavailable
+	}
+	if !allowed {
+		return errors.ErrUnauthorized
+	}
+	return nil
+}
+
+// principal returns the authenticated caller of a request, if any
+func principal(c *gin.Context) (*auth.Principal, bool) {
+	return auth.FromContext(c.Request.Context())
+}
+
+// audit logs a request with the caller who made it
+func (s *Server) audit(c *gin.Context, p *auth.Principal) {
+	entry := s.logger.WithUser(p.UserID).WithFields(map[string]interface{}{
+		"component": "audit",
+		"method":    c.Request.Method,
+		"path":      c.Request.URL.Path,
+		"status":    c.Writer.Status(),
+	})
+	if p.Tenant != "" {
+		entry = entry.WithField("tenant", p.Tenant)
+	}
+	if p.KeyID != "" {
+		entry = entry.WithField("key_id", p.KeyID)
+	}
+	if id, ok := jobs.FromContext(c.Request.Context()); ok {
+		entry = entry.WithField("job_id", id)
+	}
+	entry.Info("Request audited")
+}
+
+// credential returns the caller's bearer token or API key
+func credential(c *gin.Context) string {
+	if token := c.GetHeader("Authorization"); token != "" {
+		return strings.TrimPrefix(token, "Bearer ")
 	}
+	return c.GetHeader(HeaderAPIKey)
 }
\ No newline at end of file
@@ -3,24 +3,40 @@ package server
 import (
 	"context"
 	"net/http"
+	"strings"
+	"time"
 	
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/batch"
 	"github.com/ncolesummers/mindgateway/internal/gateway/handlers"
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/gateway/queue"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/shadow"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
 	"github.com/ncolesummers/mindgateway/internal/shared/config"
-	"github.com/sirupsen/logrus"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+	"github.com/ncolesummers/mindgateway/pkg/api/openai"
 )
 
 type Server struct {
 	router *gin.Engine
 	config *config.Config
-	logger *logrus.Logger
+	logger *logging.Logger
 	
 	// Modular components
 	authClient     AuthClient
 	registryClient RegistryClient
 	routingEngine  RoutingEngine
 	queueManager   QueueManager
+	workerClient   WorkerClient
+	shadowMirror   ShadowMirror
+	batcher        EmbeddingBatcher
+	jobManager     JobManager
 }
 
 type Option func(*Server)
@@ -33,6 +49,9 @@ func New(opts ...Option) (*Server, error) {
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.logger == nil {
+		s.logger = logging.NewLogger("info")
+	}
 	
 	s.setupRoutes()
 	s.setupMiddleware()
@@ -48,21 +67,35 @@ func (s *Server) setupRoutes() {
 	// Metrics
 	s.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	
-	// API routes
+	// API routes, which require a token or API key when an auth service
+	// is configured
 	v1 := s.router.Group("/v1")
+	if s.authClient != nil {
+		v1.Use(s.AuthMiddleware())
+	}
 	{
 		// OpenAI compatible endpoints
 		v1.POST("/chat/completions", s.handleChatCompletion)
 		v1.POST("/completions", s.handleCompletion)
 		v1.POST("/embeddings", s.handleEmbeddings)
+		
+		// Asynchronous jobs
+		v1.POST("/jobs", s.requirePermission(auth.ResourceJobs, auth.ActionCreate), s.createJob)
+		v1.GET("/jobs/:id", s.requirePermission(auth.ResourceJobs, auth.ActionRead), s.getJob)
 	}
 	
 	// Admin routes
 	admin := s.router.Group("/admin")
-	admin.Use(s.requireAdmin())
+	if s.authClient != nil {
+		admin.Use(s.AuthMiddleware())
+	}
 	{
-		admin.GET("/workers", s.listWorkers)
-		admin.GET("/queue", s.queueStatus)
+		admin.GET("/workers", s.requirePermission(auth.ResourceAdmin, auth.ActionRead), s.listWorkers)
+		admin.GET("/queue", s.requirePermission(auth.ResourceQueues, auth.ActionRead), s.queueStatus)
+		admin.GET("/splits", s.requirePermission(auth.ResourceAdmin, auth.ActionRead), s.listSplits)
+		admin.PUT("/splits", s.requirePermission(auth.ResourceAdmin, auth.ActionWrite), s.updateSplit)
+		admin.POST("/route/explain", s.requirePermission(auth.ResourceAdmin, auth.ActionRead), s.explainRoute)
+		admin.POST("/revocations", s.requirePermission(auth.ResourceKeys, auth.ActionRevoke), s.revokeAll)
 	}
 }
 
@@ -70,6 +103,11 @@ func (s *Server) Start() error {
 	return s.router.Run(s.config.Server.Address)
 }
 
+// ServeHTTP serves a request through the gateway's routes
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
 	// Graceful shutdown logic
 	return nil
@@ -82,45 +120,352 @@ func WithConfig(cfg *config.Config) Option {
 	}
 }
 
-func WithLogger(logger *logrus.Logger) Option {
+func WithLogger(logger *logging.Logger) Option {
 	return func(s *Server) {
 		s.logger = logger
 	}
 }
 
+// WithAuthClient sets the auth service client callers are authenticated with
+func WithAuthClient(client AuthClient) Option {
+	return func(s *Server) {
+		s.authClient = client
+	}
+}
+
+func WithRegistryClient(client RegistryClient) Option {
+	return func(s *Server) {
+		s.registryClient = client
+	}
+}
+
+func WithRoutingEngine(engine RoutingEngine) Option {
+	return func(s *Server) {
+		s.routingEngine = engine
+	}
+}
+
+func WithWorkerClient(client WorkerClient) Option {
+	return func(s *Server) {
+		s.workerClient = client
+	}
+}
+
+func WithQueueManager(manager QueueManager) Option {
+	return func(s *Server) {
+		s.queueManager = manager
+	}
+}
+
+func WithShadowMirror(mirror ShadowMirror) Option {
+	return func(s *Server) {
+		s.shadowMirror = mirror
+	}
+}
+
+func WithEmbeddingBatcher(batcher EmbeddingBatcher) Option {
+	return func(s *Server) {
+		s.batcher = batcher
+	}
+}
+
+func WithJobManager(manager JobManager) Option {
+	return func(s *Server) {
+		s.jobManager = manager
+	}
+}
+
 // Handler methods
 func (s *Server) handleChatCompletion(c *gin.Context) {
-	// TODO: Implement
-	c.JSON(http.StatusNotImplemented, gin.H{"error": "Not implemented"})
+	start := time.Now()
+	
+	var req openai.ChatCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.Model == "" || len(req.Messages) == 0 {
+		c.JSON(errors.ErrMissingField.Code, gin.H{"error": errors.ErrMissingField.Message})
+		return
+	}
+	
+	model := s.resolveAuto(c, req.Model, chatPrompt(req.Messages), len(req.Tools) > 0)
+	
+	rreq, err := s.newRoutingRequest(c, "chatcmpl", routing.RouteChat, model, req.User, chatTokens(req.Messages), req.MaxTokens)
+	if err != nil {
+		s.respondError(c, rreq, start, err)
+		return
+	}
+	
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	
+	if req.Stream {
+		s.streamChat(ctx, c, rreq, start, req)
+		return
+	}
+	
+	resp, err := dispatch(ctx, s, rreq, func(ctx context.Context, w Worker, id string) (*ollama.ChatResponse, error) {
+		return s.workerClient.Chat(ctx, w, id, toOllamaChat(rreq.Model, req))
+	})
+	if err != nil {
+		s.respondError(c, rreq, start, err)
+		return
+	}
+	
+	out := fromOllamaChat(rreq.ID, resp)
+	s.respond(c, rreq, start, out.Usage, out)
+	
+	s.mirror(rreq, start, chatOutput(out), out.Usage, func(ctx context.Context, w Worker, id, model string) (string, openai.Usage, error) {
+		resp, err := s.workerClient.Chat(ctx, w, id, toOllamaChat(model, req))
+		if err != nil {
+			return "", openai.Usage{}, err
+		}
+		out := fromOllamaChat(id, resp)
+		return chatOutput(out), out.Usage, nil
+	})
 }
 
 func (s *Server) handleCompletion(c *gin.Context) {
-	// TODO: Implement
-	c.JSON(http.StatusNotImplemented, gin.H{"error": "Not implemented"})
+	start := time.Now()
+	
+	var req openai.CompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.Model == "" || req.Prompt == "" {
+		c.JSON(errors.ErrMissingField.Code, gin.H{"error": errors.ErrMissingField.Message})
+		return
+	}
+	
+	model := s.resolveAuto(c, req.Model, req.Prompt, false)
+	
+	rreq, err := s.newRoutingRequest(c, "cmpl", routing.RouteCompletions, model, req.User, routing.EstimateTokens(req.Prompt), req.MaxTokens)
+	if err != nil {
+		s.respondError(c, rreq, start, err)
+		return
+	}
+	
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	
+	if req.Stream {
+		s.streamCompletion(ctx, c, rreq, start, req)
+		return
+	}
+	
+	resp, err := dispatch(ctx, s, rreq, func(ctx context.Context, w Worker, id string) (*ollama.GenerateResponse, error) {
+		return s.workerClient.Generate(ctx, w, id, toOllamaGenerate(rreq.Model, req))
+	})
+	if err != nil {
+		s.respondError(c, rreq, start, err)
+		return
+	}
+	
+	out := fromOllamaGenerate(rreq.ID, resp)
+	s.respond(c, rreq, start, out.Usage, out)
+	
+	s.mirror(rreq, start, completionOutput(out), out.Usage, func(ctx context.Context, w Worker, id, model string) (string, openai.Usage, error) {
+		resp, err := s.workerClient.Generate(ctx, w, id, toOllamaGenerate(model, req))
+		if err != nil {
+			return "", openai.Usage{}, err
+		}
+		out := fromOllamaGenerate(id, resp)
+		return completionOutput(out), out.Usage, nil
+	})
 }
 
 func (s *Server) handleEmbeddings(c *gin.Context) {
-	// TODO: Implement
-	c.JSON(http.StatusNotImplemented, gin.H{"error": "Not implemented"})
+	start := time.Now()
+	
+	var req openai.EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.Model == "" || len(req.Input) == 0 {
+		c.JSON(errors.ErrMissingField.Code, gin.H{"error": errors.ErrMissingField.Message})
+		return
+	}
+	if s.routingEngine.IsAuto(req.Model) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Automatic model selection is not supported for embeddings"})
+		return
+	}
+	
+	rreq, err := s.newRoutingRequest(c, "embd", routing.RouteEmbeddings, req.Model, req.User, inputTokens(req.Input), 0)
+	if err != nil {
+		s.respondError(c, rreq, start, err)
+		return
+	}
+	
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	
+	res, err := s.embed(ctx, rreq, req.Input)
+	if err != nil {
+		s.respondError(c, rreq, start, err)
+		return
+	}
+	rreq.Model = res.Model
+	rreq.QueueWait = res.QueueWait
+	
+	data := make([]openai.Embedding, 0, len(res.Embeddings))
+	for i, embedding := range res.Embeddings {
+		data = append(data, openai.Embedding{Object: "embedding", Embedding: embedding, Index: i})
+	}
+	out := openai.EmbeddingResponse{Object: "list", Data: data, Model: rreq.Model}
+	s.respond(c, rreq, start, out.Usage, out)
 }
 
 func (s *Server) listWorkers(c *gin.Context) {
-	// TODO: Implement
-	c.JSON(http.StatusNotImplemented, gin.H{"error": "Not implemented"})
+	workers, err := s.registryClient.GetActiveWorkers(c.Request.Context())
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list workers")
+		c.JSON(errors.ErrServiceUnavailable.Code, gin.H{"error": errors.ErrServiceUnavailable.Message})
+		return
+	}
+	
+	breakers := s.routingEngine.BreakerStates()
+	
+	out := make([]gin.H, 0, len(workers))
+	for _, w := range workers {
+		breaker, ok := breakers[w.ID]
+		if !ok {
+			breaker = routing.BreakerSnapshot{State: routing.BreakerClosed.String()}
+		}
+		out = append(out, gin.H{
+			"id":            w.ID,
+			"name":          w.Name,
+			"endpoint":      w.Endpoint,
+			"models":        w.Models,
+			"loaded_models": w.LoadedModels,
+			"metadata":      w.Metadata,
+			"load":          w.Load,
+			"status":        w.Status,
+			"breaker":       breaker,
+		})
+	}
+	
+	c.JSON(http.StatusOK, gin.H{
+		"workers": out,
+		"total":   len(out),
+	})
+}
+
+func (s *Server) listSplits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"splits": s.routingEngine.SplitRules()})
+}
+
+func (s *Server) updateSplit(c *gin.Context) {
+	var req struct {
+		Model    string            `json:"model" binding:"required"`
+		Variants []routing.Variant `json:"variants"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	
+	if err := s.routingEngine.SetSplit(req.Model, req.Variants); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	s.logger.WithField("model", req.Model).WithField("variants", req.Variants).Info("Traffic split updated")
+	c.JSON(http.StatusOK, gin.H{"model": req.Model, "variants": req.Variants})
+}
+
+// revokeAll revokes every token and API key of a user or a tenant
+func (s *Server) revokeAll(c *gin.Context) {
+	if s.authClient == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Authentication is not enabled"})
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+		Tenant string `json:"tenant"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if (req.UserID == "") == (req.Tenant == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: exactly one of user_id and tenant is required"})
+		return
+	}
+	
+	keys, err := s.authClient.RevokeAll(c.Request.Context(), credential(c), req.UserID, req.Tenant)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to revoke credentials")
+		c.JSON(errors.ErrServiceUnavailable.Code, gin.H{"error": errors.ErrServiceUnavailable.Message})
+		return
+	}
+	
+	s.logger.WithField("target_user_id", req.UserID).WithField("target_tenant", req.Tenant).Info("Credentials revoked")
+	c.JSON(http.StatusOK, gin.H{"user_id": req.UserID, "tenant": req.Tenant, "revoked_keys": keys})
 }
 
 func (s *Server) queueStatus(c *gin.Context) {
-	// TODO: Implement
-	c.JSON(http.StatusNotImplemented, gin.H{"error": "Not implemented"})
+	if s.queueManager == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Request queue is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, s.queueManager.Stats())
 }
 
-func (s *Server) requireAdmin() gin.HandlerFunc {
+// requirePermission only lets callers allowed an action on a resource through
+func (s *Server) requirePermission(resource, action string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// TODO: Implement admin check
+		if err := s.authorize(c, resource, action); err != nil {
+			e := errors.From(err)
+			c.AbortWithStatusJSON(e.Code, gin.H{"error": e.Message})
+			return
+		}
 		c.Next()
 	}
 }
 
+// authorize checks with the auth service that the caller may take an action
+// on a resource. Without an auth service callers cannot be told apart, so
+// every caller may use models and jobs and none may administer the gateway.
+// The requests of asynchronous jobs are checked as the caller who submitted
+// the job.
+func (s *Server) authorize(c *gin.Context, resource, action string) error {
+	if s.authClient == nil {
+		if resource == auth.ResourceJobs || resource == auth.ResourceModels || strings.HasPrefix(resource, auth.ResourceModels+"/") {
+			return nil
+		}
+		return errors.ErrForbidden
+	}
+	
+	var allowed bool
+	var err error
+	if _, ok := jobs.FromContext(c.Request.Context()); ok {
+		p, ok := principal(c)
+		if !ok {
+			return errors.ErrForbidden
+		}
+		allowed, err = s.authClient.CheckPrincipalPermission(c.Request.Context(), p, resource, action)
+	} else {
+		allowed, err = s.authClient.CheckPermission(c.Request.Context(), credential(c), resource, action)
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to check permission")
+		return errors.ErrServiceUnavailable
+	}
+	if !allowed {
+		return errors.ErrForbidden
+	}
+	return nil
+}
+
+// isAdmin reports whether the caller may read admin endpoints, and so may
+// use debug headers
+func (s *Server) isAdmin(c *gin.Context) bool {
+	return s.authorize(c, auth.ResourceAdmin, auth.ActionRead) == nil
+}
+
 func (s *Server) setupMiddleware() {
 	// Use common middleware
 	s.router.Use(gin.Recovery())
@@ -130,8 +475,11 @@ func (s *Server) setupMiddleware() {
 
 // Interface definitions for modular components
 type AuthClient interface {
-	ValidateToken(ctx context.Context, token string) (bool, error)
+	ValidateToken(ctx context.Context, token string) (*auth.Principal, error)
 	GetUserRoles(ctx context.Context, userID string) ([]string, error)
+	CheckPermission(ctx context.Context, token, resource, action string) (bool, error)
+	CheckPrincipalPermission(ctx context.Context, p *auth.Principal, resource, action string) (bool, error)
+	RevokeAll(ctx context.Context, token, userID, tenant string) (int64, error)
 }
 
 type RegistryClient interface {
@@ -139,19 +487,54 @@ type RegistryClient interface {
 }
 
 type RoutingEngine interface {
-	RouteRequest(ctx context.Context, req interface{}) (Worker, error)
+	RouteRequest(ctx context.Context, req *routing.Request) (Worker, error)
+	ReportResult(req *routing.Request, workerID string, latency time.Duration, err error)
+	HedgeDelay(req *routing.Request) (time.Duration, bool)
+	ResolveModel(model, key string) string
+	Fallbacks(model string) []string
+	SplitRules() map[string][]routing.Variant
+	SetSplit(model string, variants []routing.Variant) error
+	BreakerStates() map[string]routing.BreakerSnapshot
+	Constraints(tenant string, require, prefer map[string]string) (routing.Constraints, error)
+	Explain(ctx context.Context, req *routing.Request) (*routing.Explanation, error)
+	CheckContext(req *routing.Request) error
+	Lane(route, apiKey string) (config.Lane, bool)
+	IsAuto(model string) bool
+	DecideAuto(ctx context.Context, f routing.Features, prompt string, classifier routing.Classifier) routing.AutoDecision
 }
 
+// ShadowMirror samples served requests and mirrors them to shadow models
+type ShadowMirror interface {
+	Sample(model string) (shadow.Target, bool)
+	Go(model, shadowModel string, fn func(ctx context.Context) shadow.Record) bool
+}
+
+// QueueManager holds requests while every eligible worker is at capacity
 type QueueManager interface {
-	Enqueue(ctx context.Context, req interface{}, priority int) (string, error)
-	Dequeue(ctx context.Context) (interface{}, error)
-}
-
-type Worker struct {
-	ID       string
-	Name     string
-	Endpoint string
-	Models   []string
-	Load     float64
-	Status   string
-}
\ No newline at end of file
+	Submit(ctx context.Context, req *routing.Request) (Worker, error)
+	Notify()
+	Stats() queue.Stats
+}
+
+// EmbeddingBatcher merges concurrent embedding requests into batched calls
+type EmbeddingBatcher interface {
+	Embed(ctx context.Context, key string, inputs []string, fn batch.Func) (*batch.Result, error)
+}
+
+// JobManager serves inference requests in the background
+type JobManager interface {
+	Submit(ctx context.Context, job *jobs.Job) error
+	Get(ctx context.Context, id string) (*jobs.Job, error)
+}
+
+type WorkerClient interface {
+	Chat(ctx context.Context, w Worker, requestID string, req ollama.ChatRequest) (*ollama.ChatResponse, error)
+	Generate(ctx context.Context, w Worker, requestID string, req ollama.GenerateRequest) (*ollama.GenerateResponse, error)
+	ChatStream(ctx context.Context, w Worker, requestID string, req ollama.ChatRequest, fn func(*ollama.ChatResponse) error) error
+	GenerateStream(ctx context.Context, w Worker, requestID string, req ollama.GenerateRequest, fn func(*ollama.GenerateResponse) error) error
+	Embeddings(ctx context.Context, w Worker, requestID string, req ollama.EmbeddingRequest) (*ollama.EmbeddingResponse, error)
+	Embed(ctx context.Context, w Worker, requestID string, req ollama.EmbedRequest) (*ollama.EmbedResponse, error)
+	Cancel(requestID string) bool
+}
+
+type Worker = worker.Worker
\ No newline at end of file
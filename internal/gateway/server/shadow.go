@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/shadow"
+	"github.com/ncolesummers/mindgateway/pkg/api/openai"
+)
+
+// shadowCall runs a mirrored request against a worker and returns its output
+type shadowCall func(ctx context.Context, w Worker, id, model string) (string, openai.Usage, error)
+
+// mirror sends a sampled copy of a served request to its shadow model in the
+// background, queued at the lowest priority. It must be called after the
+// primary response has been written.
+func (s *Server) mirror(req *routing.Request, start time.Time, output string, usage openai.Usage, call shadowCall) {
+	if s.shadowMirror == nil {
+		return
+	}
+	target, ok := s.shadowMirror.Sample(req.LogicalModel)
+	if !ok {
+		return
+	}
+
+	// The shadow copy keeps the primary's constraints so that mirroring never
+	// moves a tenant's prompts outside its required placement
+	require := make(map[string]string, len(req.Constraints.Require)+len(target.Require))
+	for k, v := range req.Constraints.Require {
+		require[k] = v
+	}
+	for k, v := range target.Require {
+		if pv, ok := require[k]; ok && pv != v {
+			return
+		}
+		require[k] = v
+	}
+
+	primary := shadow.Result{
+		Model:            req.Model,
+		LatencyMs:        milliseconds(time.Since(start)),
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Output:           output,
+	}
+
+	s.shadowMirror.Go(req.LogicalModel, target.Model, func(ctx context.Context) shadow.Record {
+		sreq := &routing.Request{
+			ID:           req.ID + "-shadow",
+			Route:        req.Route,
+			LogicalModel: target.Model,
+			Variant:      target.Model,
+			Model:        target.Model,
+			MaxTokens:    req.MaxTokens,
+			PromptTokens: req.PromptTokens,
+			NoFallback:   true,
+			Constraints:  routing.Constraints{Require: require, Prefer: req.Constraints.Prefer},
+			Shadow:       true,
+			Priority:     0,
+			Tenant:       req.Tenant,
+			Roles:        req.Roles,
+		}
+		record := shadow.Record{
+			RequestID: req.ID,
+			Route:     req.Route,
+			Primary:   primary,
+			Shadow:    shadow.Result{Model: target.Model},
+		}
+
+		w, err := s.route(ctx, sreq)
+		if err != nil {
+			record.Shadow.Error = err.Error()
+			return record
+		}
+
+		began := time.Now()
+		out, u, err := call(ctx, w, sreq.ID, target.Model)
+		latency := time.Since(began)
+		s.reportResult(sreq, w.ID, latency, err)
+
+		record.Shadow.WorkerID = w.ID
+		record.Shadow.LatencyMs = milliseconds(latency)
+		if err != nil {
+			record.Shadow.Error = err.Error()
+			return record
+		}
+		record.Shadow.PromptTokens = u.PromptTokens
+		record.Shadow.CompletionTokens = u.CompletionTokens
+		record.Shadow.Output = out
+		return record
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func chatOutput(resp openai.ChatCompletionResponse) string {
+	if len(resp.Choices) == 0 {
+		return ""
+	}
+	return resp.Choices[0].Message.Content
+}
+
+func completionOutput(resp openai.CompletionResponse) string {
+	if len(resp.Choices) == 0 {
+		return ""
+	}
+	return resp.Choices[0].Text
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/handlers"
+	"github.com/ncolesummers/mindgateway/internal/gateway/queue"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+	"github.com/ncolesummers/mindgateway/pkg/api/openai"
+)
+
+// eventStream writes a streamed response as server-sent events. The response
+// starts with the first event, after which errors can only be reported as
+// events.
+type eventStream struct {
+	c       *gin.Context
+	req     *routing.Request
+	started bool
+}
+
+// start sends the response headers
+func (e *eventStream) start() {
+	if e.started {
+		return
+	}
+	e.started = true
+
+	h := e.c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set(HeaderModelVariant, e.req.Variant)
+	setTraceHeader(e.c, e.req)
+	e.c.Status(http.StatusOK)
+}
+
+// progress tells a client whose request is queued its position and estimated
+// wait, in a comment that SSE clients ignore
+func (e *eventStream) progress(p queue.Progress) {
+	e.start()
+
+	fields := []string{fmt.Sprintf("position=%d", p.Position)}
+	if p.ETA > 0 {
+		fields = append(fields, fmt.Sprintf("eta_ms=%d", p.ETA.Milliseconds()))
+	}
+	fields = append(fields, fmt.Sprintf("waited_ms=%d", p.Waited.Milliseconds()))
+
+	fmt.Fprintf(e.c.Writer, ": queued %s\n\n", strings.Join(fields, " "))
+	e.c.Writer.Flush()
+}
+
+// send writes an event carrying v as JSON
+func (e *eventStream) send(v interface{}) error {
+	if !e.started {
+		// The wait is only known once the request has left the queue
+		setQueueHeader(e.c, e.req)
+		e.c.Header(HeaderServedModel, e.req.Model)
+		e.start()
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(e.c.Writer, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	e.c.Writer.Flush()
+	return nil
+}
+
+// done ends the stream
+func (e *eventStream) done() {
+	fmt.Fprint(e.c.Writer, "data: [DONE]\n\n")
+	e.c.Writer.Flush()
+}
+
+// stream serves a request whose response is streamed to the client. While the
+// request waits in the queue the client is sent its progress. Streamed
+// requests are neither hedged nor mirrored, as their output goes to the
+// client as it is generated.
+func (s *Server) stream(ctx context.Context, c *gin.Context, req *routing.Request, start time.Time, call func(ctx context.Context, w Worker, events *eventStream) (openai.Usage, error)) {
+	events := &eventStream{c: c, req: req}
+
+	// A stream that has started cannot be requeued
+	req.Preempt = nil
+
+	w, err := s.route(queue.WithProgress(ctx, events.progress), req)
+	if err != nil {
+		s.streamError(events, start, err)
+		return
+	}
+
+	caller := ctx
+	ctx, cancel := context.WithTimeout(ctx, s.config.Worker.RequestTimeout)
+	defer cancel()
+
+	callStart := time.Now()
+	usage, err := call(ctx, w, events)
+	s.reportResult(req, w.ID, time.Since(callStart), workerFault(caller, err))
+	if err != nil && callerTimedOut(caller) {
+		s.streamError(events, start, errors.ErrTimeout)
+		return
+	}
+	if err != nil {
+		s.logger.WithWorker(w.ID).WithError(err).Warn("Worker request failed")
+		s.streamError(events, start, workerError(err))
+		return
+	}
+
+	events.done()
+	handlers.RecordRequestMetrics(req.LogicalModel, req.Route, http.StatusOK, start, usage.PromptTokens, usage.CompletionTokens)
+	handlers.RecordVariant(req.LogicalModel, req.Variant, req.Route, http.StatusOK)
+}
+
+// streamError reports a failed streamed request, as an ordinary error
+// response if the stream has not started
+func (s *Server) streamError(events *eventStream, start time.Time, err error) {
+	if !events.started {
+		s.respondError(events.c, events.req, start, err)
+		return
+	}
+
+	e := errors.From(err)
+	handlers.RecordRequestMetrics(events.req.LogicalModel, events.req.Route, e.Code, start, 0, 0)
+	handlers.RecordVariant(events.req.LogicalModel, events.req.Variant, events.req.Route, e.Code)
+	_ = events.send(gin.H{"error": e.Message})
+}
+
+// streamChat streams a chat completion as chat.completion.chunk events
+func (s *Server) streamChat(ctx context.Context, c *gin.Context, req *routing.Request, start time.Time, body openai.ChatCompletionRequest) {
+	s.stream(ctx, c, req, start, func(ctx context.Context, w Worker, events *eventStream) (openai.Usage, error) {
+		var usage openai.Usage
+		first := true
+		err := s.workerClient.ChatStream(ctx, w, req.ID, toOllamaChat(req.Model, body), func(resp *ollama.ChatResponse) error {
+			chunk := openai.ChatCompletionChunk{
+				ID:      req.ID,
+				Object:  "chat.completion.chunk",
+				Created: time.Now().Unix(),
+				Model:   resp.Model,
+				Choices: []openai.ChatCompletionChunkChoice{{Delta: openai.ChatMessageDelta{Content: resp.Message.Content}}},
+			}
+			if first {
+				chunk.Choices[0].Delta.Role = "assistant"
+				first = false
+			}
+			if resp.Done {
+				usage = streamUsage(resp.PromptEvalCount, resp.EvalCount)
+				chunk.Choices[0].FinishReason = finishReason("stop")
+				chunk.Usage = &usage
+			}
+			return events.send(chunk)
+		})
+		return usage, err
+	})
+}
+
+// streamCompletion streams a completion as text_completion events
+func (s *Server) streamCompletion(ctx context.Context, c *gin.Context, req *routing.Request, start time.Time, body openai.CompletionRequest) {
+	s.stream(ctx, c, req, start, func(ctx context.Context, w Worker, events *eventStream) (openai.Usage, error) {
+		var usage openai.Usage
+		err := s.workerClient.GenerateStream(ctx, w, req.ID, toOllamaGenerate(req.Model, body), func(resp *ollama.GenerateResponse) error {
+			chunk := openai.CompletionChunk{
+				ID:      req.ID,
+				Object:  "text_completion",
+				Created: time.Now().Unix(),
+				Model:   resp.Model,
+				Choices: []openai.CompletionChunkChoice{{Text: resp.Response}},
+			}
+			if resp.Done {
+				usage = streamUsage(resp.PromptEvalCount, resp.EvalCount)
+				chunk.Choices[0].FinishReason = finishReason("stop")
+				chunk.Usage = &usage
+			}
+			return events.send(chunk)
+		})
+		return usage, err
+	})
+}
+
+func streamUsage(prompt, completion int) openai.Usage {
+	return openai.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+}
+
+func finishReason(reason string) *string {
+	return &reason
+}
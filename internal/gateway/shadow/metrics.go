@@ -0,0 +1,36 @@
+package shadow
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Shadow request outcomes
+const (
+	statusOK      = "ok"
+	statusError   = "error"
+	statusDropped = "dropped"
+)
+
+// Shadow metrics
+var (
+	shadowRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mindgateway_shadow_requests_total",
+			Help: "Total number of mirrored requests by outcome",
+		},
+		[]string{"model", "shadow_model", "status"},
+	)
+
+	shadowLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mindgateway_shadow_request_duration_seconds",
+			Help:    "Duration of mirrored requests",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"shadow_model"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shadowRequests, shadowLatency)
+}
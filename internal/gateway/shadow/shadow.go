@@ -0,0 +1,189 @@
+package shadow
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+)
+
+// Target is where a sampled request is mirrored to
+type Target struct {
+	Model string
+
+	// Require restricts the mirrored request to workers with matching
+	// metadata, selecting a dedicated worker pool
+	Require map[string]string
+}
+
+// Result is one side of a mirrored request
+type Result struct {
+	Model            string  `json:"model"`
+	WorkerID         string  `json:"worker_id,omitempty"`
+	LatencyMs        float64 `json:"latency_ms"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Output           string  `json:"output"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// Record pairs the primary and shadow results of a mirrored request for
+// offline comparison
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Route     string    `json:"route"`
+	Primary   Result    `json:"primary"`
+	Shadow    Result    `json:"shadow"`
+}
+
+// Mirror samples live requests and runs their shadow copies in the background.
+// Shadow work is bounded and dropped rather than queued when the mirror is
+// busy, so it never delays the primary path.
+type Mirror struct {
+	config *config.Config
+	logger *logging.Logger
+	sink   Sink
+
+	rules   map[string]config.ShadowRule
+	slots   chan struct{}
+	timeout time.Duration
+	wg      sync.WaitGroup
+}
+
+// Option configures a Mirror
+type Option func(*Mirror)
+
+// New creates a new shadow traffic mirror
+func New(opts ...Option) (*Mirror, error) {
+	m := &Mirror{}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.config == nil {
+		return nil, fmt.Errorf("shadow: config is required")
+	}
+
+	cfg := m.config.Routing.Shadow
+	m.rules = make(map[string]config.ShadowRule, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		if rule.Model == "" || rule.ShadowModel == "" {
+			return nil, fmt.Errorf("shadow: rule requires a model and a shadow model")
+		}
+		if rule.SampleRate < 0 || rule.SampleRate > 1 {
+			return nil, fmt.Errorf("shadow: sample rate for %s must be between 0 and 1", rule.Model)
+		}
+		m.rules[rule.Model] = rule
+	}
+
+	maxInFlight := cfg.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	m.slots = make(chan struct{}, maxInFlight)
+	m.timeout = cfg.Timeout
+
+	if m.sink == nil {
+		sink, err := NewSink(m.config, m.logger)
+		if err != nil {
+			return nil, fmt.Errorf("shadow: %w", err)
+		}
+		m.sink = sink
+	}
+
+	return m, nil
+}
+
+// WithConfig sets the mirror configuration
+func WithConfig(cfg *config.Config) Option {
+	return func(m *Mirror) {
+		m.config = cfg
+	}
+}
+
+// WithLogger sets the mirror logger
+func WithLogger(logger *logging.Logger) Option {
+	return func(m *Mirror) {
+		m.logger = logger
+	}
+}
+
+// WithSink sets where shadow records are written, overriding the configured sink
+func WithSink(sink Sink) Option {
+	return func(m *Mirror) {
+		m.sink = sink
+	}
+}
+
+// Sample decides whether to mirror a request for the model and returns its target
+func (m *Mirror) Sample(model string) (Target, bool) {
+	if !m.config.Routing.Shadow.Enabled {
+		return Target{}, false
+	}
+	rule, ok := m.rules[model]
+	if !ok || rule.SampleRate == 0 {
+		return Target{}, false
+	}
+	if rule.SampleRate < 1 && rand.Float64() >= rule.SampleRate { // #nosec G404 -- sampling does not need a secure source
+		return Target{}, false
+	}
+	return Target{Model: rule.ShadowModel, Require: rule.Require}, true
+}
+
+// Go runs the shadow request in the background and writes the record it
+// returns to the sink. It returns false without running fn when every slot is
+// in use.
+func (m *Mirror) Go(model, shadowModel string, fn func(ctx context.Context) Record) bool {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		shadowRequests.WithLabelValues(model, shadowModel, statusDropped).Inc()
+		return false
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() { <-m.slots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+
+		record := fn(ctx)
+		record.Time = time.Now()
+
+		status := statusOK
+		if record.Shadow.Error != "" {
+			status = statusError
+		}
+		shadowRequests.WithLabelValues(model, shadowModel, status).Inc()
+		shadowLatency.WithLabelValues(shadowModel).Observe(record.Shadow.LatencyMs / 1000)
+
+		if err := m.sink.Write(record); err != nil && m.logger != nil {
+			m.logger.WithError(err).Warn("Failed to write shadow record")
+		}
+	}()
+	return true
+}
+
+// Close waits for in-flight shadow requests and closes the sink
+func (m *Mirror) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return m.sink.Close()
+}
@@ -0,0 +1,93 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+)
+
+// Sink types
+const (
+	SinkLog  = "log"
+	SinkFile = "file"
+)
+
+// Sink stores shadow records for offline comparison
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+// NewSink creates the sink selected by configuration
+func NewSink(cfg *config.Config, logger *logging.Logger) (Sink, error) {
+	sink := cfg.Routing.Shadow.Sink
+	switch sink.Type {
+	case "", SinkLog:
+		if logger == nil {
+			return nil, fmt.Errorf("log sink requires a logger")
+		}
+		return &LogSink{logger: logger}, nil
+	case SinkFile:
+		return NewFileSink(sink.Path)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", sink.Type)
+	}
+}
+
+// LogSink writes shadow records to the gateway log
+type LogSink struct {
+	logger *logging.Logger
+}
+
+// Write logs the record
+func (s *LogSink) Write(record Record) error {
+	s.logger.WithComponent("shadow").
+		WithField("request_id", record.RequestID).
+		WithField("route", record.Route).
+		WithField("primary", record.Primary).
+		WithField("shadow", record.Shadow).
+		Info("Shadow request completed")
+	return nil
+}
+
+// Close is a no-op
+func (s *LogSink) Close() error {
+	return nil
+}
+
+// FileSink appends shadow records to a file as JSON lines
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileSink opens the file at path for appending
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file sink requires a path")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shadow sink: %w", err)
+	}
+	return &FileSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends the record
+func (s *FileSink) Write(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(record)
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
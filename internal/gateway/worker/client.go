@@ -0,0 +1,120 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+)
+
+// Client dispatches inference requests to workers through their Ollama endpoint
+type Client struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	clients  map[string]*ollama.Client
+	inflight map[string]context.CancelFunc
+}
+
+// NewClient creates a new worker client with the given per-request timeout
+func NewClient(timeout time.Duration) *Client {
+	return &Client{
+		timeout:  timeout,
+		clients:  make(map[string]*ollama.Client),
+		inflight: make(map[string]context.CancelFunc),
+	}
+}
+
+// Chat sends a chat request to the worker
+func (c *Client) Chat(ctx context.Context, w Worker, requestID string, req ollama.ChatRequest) (*ollama.ChatResponse, error) {
+	ctx, done := c.track(ctx, requestID)
+	defer done()
+
+	return c.client(w).Chat(ctx, req)
+}
+
+// Generate sends a generate request to the worker
+func (c *Client) Generate(ctx context.Context, w Worker, requestID string, req ollama.GenerateRequest) (*ollama.GenerateResponse, error) {
+	ctx, done := c.track(ctx, requestID)
+	defer done()
+
+	return c.client(w).Generate(ctx, req)
+}
+
+// ChatStream sends a chat request to the worker, calling fn with each chunk
+// of the response as it is generated
+func (c *Client) ChatStream(ctx context.Context, w Worker, requestID string, req ollama.ChatRequest, fn func(*ollama.ChatResponse) error) error {
+	ctx, done := c.track(ctx, requestID)
+	defer done()
+
+	return c.client(w).ChatStream(ctx, req, fn)
+}
+
+// GenerateStream sends a generate request to the worker, calling fn with each
+// chunk of the response as it is generated
+func (c *Client) GenerateStream(ctx context.Context, w Worker, requestID string, req ollama.GenerateRequest, fn func(*ollama.GenerateResponse) error) error {
+	ctx, done := c.track(ctx, requestID)
+	defer done()
+
+	return c.client(w).GenerateStream(ctx, req, fn)
+}
+
+// Embeddings sends an embedding request to the worker
+func (c *Client) Embeddings(ctx context.Context, w Worker, requestID string, req ollama.EmbeddingRequest) (*ollama.EmbeddingResponse, error) {
+	ctx, done := c.track(ctx, requestID)
+	defer done()
+
+	return c.client(w).Embeddings(ctx, req)
+}
+
+// Embed sends a batch of inputs to embed to the worker
+func (c *Client) Embed(ctx context.Context, w Worker, requestID string, req ollama.EmbedRequest) (*ollama.EmbedResponse, error) {
+	ctx, done := c.track(ctx, requestID)
+	defer done()
+
+	return c.client(w).Embed(ctx, req)
+}
+
+// Cancel aborts the in-flight request with the given ID. Closing the
+// connection makes the worker stop generating for that request.
+func (c *Client) Cancel(requestID string) bool {
+	c.mu.Lock()
+	cancel, ok := c.inflight[requestID]
+	delete(c.inflight, requestID)
+	c.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// track registers a cancellable context for an in-flight request
+func (c *Client) track(ctx context.Context, requestID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	c.mu.Lock()
+	c.inflight[requestID] = cancel
+	c.mu.Unlock()
+
+	return ctx, func() {
+		c.mu.Lock()
+		delete(c.inflight, requestID)
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// client returns the cached Ollama client for a worker endpoint
+func (c *Client) client(w Worker) *ollama.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cl, ok := c.clients[w.Endpoint]
+	if !ok {
+		cl = ollama.NewClient(w.Endpoint, c.timeout)
+		c.clients[w.Endpoint] = cl
+	}
+	return cl
+}
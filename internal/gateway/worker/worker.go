@@ -0,0 +1,56 @@
+package worker
+
+// Worker status values as reported by the worker registry
+const (
+	StatusUnknown      = "UNKNOWN"
+	StatusInitializing = "INITIALIZING"
+	StatusReady        = "READY"
+	StatusBusy         = "BUSY"
+	StatusDraining     = "DRAINING"
+	StatusOffline      = "OFFLINE"
+	StatusError        = "ERROR"
+)
+
+// Worker is the gateway's view of a registered inference worker
+type Worker struct {
+	ID       string
+	Name     string
+	Endpoint string
+	Models   []string
+	Load     float64
+	Status   string
+	Metadata map[string]string
+
+	// LoadedModels lists the models resident in the worker's memory. It is
+	// nil when the worker does not report residency.
+	LoadedModels []string
+
+	// Batching reports whether the worker embeds several inputs in one call,
+	// up to MaxBatchSize inputs when that is set
+	Batching     bool
+	MaxBatchSize int
+}
+
+// HasModel reports whether the worker serves the given model
+func (w Worker) HasModel(model string) bool {
+	for _, m := range w.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelLoaded reports whether the model is resident in the worker's memory,
+// and whether the worker reports residency at all
+func (w Worker) ModelLoaded(model string) (loaded bool, known bool) {
+	if w.LoadedModels == nil {
+		return false, false
+	}
+	for _, m := range w.LoadedModels {
+		if m == model {
+			return true, true
+		}
+	}
+	return false, true
+}
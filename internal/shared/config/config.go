@@ -49,10 +49,74 @@ type Config struct {
 	Auth struct {
 		Address   string `mapstructure:"address"`
 		JWTSecret string `mapstructure:"jwt_secret"`
+		
+		// Issuer names the auth service in the tokens it signs, and TokenTTL
+		// is their lifetime when a request does not set one
+		Issuer   string        `mapstructure:"issuer"`
+		TokenTTL time.Duration `mapstructure:"token_ttl"`
+		
+		// MaxTokenTTL is the longest lifetime of a token the service issues.
+		// It defaults to TokenTTL.
+		MaxTokenTTL time.Duration `mapstructure:"max_token_ttl"`
+		
+		// BootstrapToken, when set, is accepted as an admin credential when
+		// issuing tokens and API keys, so that the first admin can be issued
+		// a credential of their own
+		BootstrapToken string `mapstructure:"bootstrap_token"`
+		
+		// ServiceToken is shared by the gateway and the auth service. The
+		// gateway presents it to check the permissions of callers it
+		// identified earlier, such as those who submitted a job.
+		ServiceToken string `mapstructure:"service_token"`
+		
+		// Enabled requires callers of the gateway API to present a token or
+		// API key, and APIKeys lets the auth service issue API keys, which it
+		// stores in the database
+		Enabled bool `mapstructure:"enabled"`
+		APIKeys bool `mapstructure:"api_keys"`
+		
+		// OIDC settings for tokens of external identity providers. Signing
+		// keys are fetched again after JWKSRefresh, ClockSkew is the
+		// tolerance of expiry and not-before checks, and MaxTokenTTL is the
+		// longest lifetime of a provider's token. Revocations of every
+		// credential of a user or tenant are kept for the longest lifetime
+		// of any token.
+		OIDC struct {
+			ClockSkew   time.Duration `mapstructure:"clock_skew"`
+			JWKSRefresh time.Duration `mapstructure:"jwks_refresh"`
+			MaxTokenTTL time.Duration `mapstructure:"max_token_ttl"`
+			Issuers     []OIDCIssuer  `mapstructure:"issuers"`
+		} `mapstructure:"oidc"`
+		
+		// ModelAccess restricts models to some roles or identity provider
+		// groups. Models without a rule are open to every caller allowed to
+		// invoke models.
+		ModelAccess []ModelAccess `mapstructure:"model_access"`
+		
+		// Cache holds validated credentials and permission decisions in the
+		// gateway for up to TTL, never past a token's expiry, and invalid
+		// credentials for NegativeTTL
+		Cache struct {
+			Enabled     bool          `mapstructure:"enabled"`
+			TTL         time.Duration `mapstructure:"ttl"`
+			NegativeTTL time.Duration `mapstructure:"negative_ttl"`
+			MaxEntries  int           `mapstructure:"max_entries"`
+		} `mapstructure:"cache"`
+		
+		// Revocations are kept by Backend: memory keeps them within the auth
+		// service until it restarts, and redis stores them under KeyPrefix
+		// and publishes them on Channel so that gateways evict the
+		// credentials from their caches at once
+		Revocations struct {
+			Backend   string `mapstructure:"backend"`
+			Channel   string `mapstructure:"channel"`
+			KeyPrefix string `mapstructure:"key_prefix"`
+		} `mapstructure:"revocations"`
 	} `mapstructure:"auth"`
 	
 	Registry struct {
-		Address string `mapstructure:"address"`
+		Address         string        `mapstructure:"address"`
+		RefreshInterval time.Duration `mapstructure:"refresh_interval"`
 	} `mapstructure:"registry"`
 	
 	// Worker settings
@@ -60,14 +124,320 @@ type Config struct {
 		ConnectTimeout    time.Duration `mapstructure:"connect_timeout"`
 		RequestTimeout    time.Duration `mapstructure:"request_timeout"`
 		HealthCheckPeriod time.Duration `mapstructure:"health_check_period"`
+		MaxConcurrency    int           `mapstructure:"max_concurrency"`
+		
+		// TokenBudget caps the prompt and completion tokens of the requests
+		// each worker serves at once, so that its concurrency follows the
+		// work it is given. A worker's token_budget metadata label overrides
+		// it, and zero counts requests only.
+		TokenBudget int `mapstructure:"token_budget"`
+		
+		// DefaultMaxTokens is the completion length assumed for requests that
+		// do not set max_tokens
+		DefaultMaxTokens int `mapstructure:"default_max_tokens"`
 	} `mapstructure:"worker"`
 	
 	// Queue settings
 	Queue struct {
 		MaxSize          int           `mapstructure:"max_size"`
+		Levels           int           `mapstructure:"levels"`
 		DefaultPriority  int           `mapstructure:"default_priority"`
 		ProcessingPeriod time.Duration `mapstructure:"processing_period"`
+		MaxWait          time.Duration `mapstructure:"max_wait"`
+		FallbackMargin   time.Duration `mapstructure:"fallback_margin"`
+		
+		// ProgressInterval is how often waiting streams are told their queue
+		// position and estimated wait
+		ProgressInterval time.Duration `mapstructure:"progress_interval"`
+		
+		// Backend is where queued requests are kept: memory, or redis to share
+		// one queue between gateway replicas
+		Backend string `mapstructure:"backend"`
+		
+		Redis struct {
+			KeyPrefix         string        `mapstructure:"key_prefix"`
+			VisibilityTimeout time.Duration `mapstructure:"visibility_timeout"`
+			ScanLimit         int           `mapstructure:"scan_limit"`
+		} `mapstructure:"redis"`
+		
+		// Fairness shares each priority level between tenants by weight
+		Fairness struct {
+			Enabled       bool             `mapstructure:"enabled"`
+			DefaultWeight float64          `mapstructure:"default_weight"`
+			Weights       []FairnessWeight `mapstructure:"weights"`
+		} `mapstructure:"fairness"`
+		
+		// Admission turns requests away with a 429 when the queue is too deep
+		// for their priority class, or when their predicted wait would pass
+		// their deadline
+		Admission struct {
+			Enabled           bool             `mapstructure:"enabled"`
+			DefaultRetryAfter time.Duration    `mapstructure:"default_retry_after"`
+			MaxRetryAfter     time.Duration    `mapstructure:"max_retry_after"`
+			Classes           []AdmissionClass `mapstructure:"classes"`
+		} `mapstructure:"admission"`
 	} `mapstructure:"queue"`
+	
+	// Embedding micro-batching settings
+	Batching struct {
+		Enabled bool `mapstructure:"enabled"`
+		
+		// MaxBatchSize caps the inputs merged into one batch, and MaxLinger
+		// how long a batch waits for more requests before it is sent.
+		// Requests with MaxBatchSize inputs or more are sent on their own.
+		MaxBatchSize int           `mapstructure:"max_batch_size"`
+		MaxLinger    time.Duration `mapstructure:"max_linger"`
+	} `mapstructure:"batching"`
+	
+	// Asynchronous job settings
+	Jobs struct {
+		Enabled bool `mapstructure:"enabled"`
+		
+		// Backend is where jobs are kept: memory, or redis to let any replica
+		// answer for a job and resume it if its replica goes away
+		Backend   string `mapstructure:"backend"`
+		KeyPrefix string `mapstructure:"key_prefix"`
+		
+		// MaxRunning limits the jobs each replica serves at once
+		MaxRunning int `mapstructure:"max_running"`
+		
+		// Timeout is how long a job may take, including time spent queued or
+		// backing off, and Retention how long its result is kept afterwards
+		Timeout   time.Duration `mapstructure:"timeout"`
+		Retention time.Duration `mapstructure:"retention"`
+		
+		// Lease is how long a replica holds a job without renewing it before
+		// another replica takes it over
+		Lease time.Duration `mapstructure:"lease"`
+		
+		// Webhook.AllowedHosts are the only hosts webhooks may call, when
+		// set. Otherwise webhooks may call any host at a public address.
+		Webhook struct {
+			Secret       string        `mapstructure:"secret"`
+			Timeout      time.Duration `mapstructure:"timeout"`
+			MaxAttempts  int           `mapstructure:"max_attempts"`
+			AllowedHosts []string      `mapstructure:"allowed_hosts"`
+		} `mapstructure:"webhook"`
+	} `mapstructure:"jobs"`
+	
+	// Routing settings
+	Routing struct {
+		CircuitBreaker struct {
+			Enabled              bool          `mapstructure:"enabled"`
+			Window               time.Duration `mapstructure:"window"`
+			MinRequests          int           `mapstructure:"min_requests"`
+			ErrorRateThreshold   float64       `mapstructure:"error_rate_threshold"`
+			LatencyOutlierFactor float64       `mapstructure:"latency_outlier_factor"`
+			BaseEjectionTime     time.Duration `mapstructure:"base_ejection_time"`
+			MaxEjectionTime      time.Duration `mapstructure:"max_ejection_time"`
+			MaxEjectionPercent   int           `mapstructure:"max_ejection_percent"`
+			HalfOpenRequests     int           `mapstructure:"half_open_requests"`
+		} `mapstructure:"circuit_breaker"`
+		
+		Hedging struct {
+			Enabled    bool          `mapstructure:"enabled"`
+			Percentile float64       `mapstructure:"percentile"`
+			MinDelay   time.Duration `mapstructure:"min_delay"`
+			MaxDelay   time.Duration `mapstructure:"max_delay"`
+			MinSamples int           `mapstructure:"min_samples"`
+			MaxTokens  int           `mapstructure:"max_tokens"`
+			Routes     []string      `mapstructure:"routes"`
+			Policies   []HedgePolicy `mapstructure:"policies"`
+		} `mapstructure:"hedging"`
+		
+		Splits    []SplitRule     `mapstructure:"splits"`
+		Fallbacks []FallbackChain `mapstructure:"fallbacks"`
+		
+		// ContextWindows rejects requests whose prompt and max_tokens do not
+		// fit the model, rather than queueing them
+		ContextWindows []ContextWindow `mapstructure:"context_windows"`
+		
+		// Lanes separate interactive from bulk traffic. Each lane reserves a
+		// share of every worker's slots and sets the queue priority of its
+		// requests, and requests in preemptible lanes may be stopped and
+		// requeued to make room for a higher lane.
+		Lanes struct {
+			Enabled        bool       `mapstructure:"enabled"`
+			Default        string     `mapstructure:"default"`
+			MaxPreemptions int        `mapstructure:"max_preemptions"`
+			Lanes          []Lane     `mapstructure:"lanes"`
+			Rules          []LaneRule `mapstructure:"rules"`
+		} `mapstructure:"lanes"`
+		
+		Constraints struct {
+			ClientLabels []string            `mapstructure:"client_labels"`
+			Tenants      []TenantConstraints `mapstructure:"tenants"`
+		} `mapstructure:"constraints"`
+		
+		Auto struct {
+			Enabled       bool          `mapstructure:"enabled"`
+			Model         string        `mapstructure:"model"`
+			Default       string        `mapstructure:"default"`
+			RouterModel   string        `mapstructure:"router_model"`
+			RouterTimeout time.Duration `mapstructure:"router_timeout"`
+			Rules         []AutoRule    `mapstructure:"rules"`
+		} `mapstructure:"auto"`
+		
+		Shadow struct {
+			Enabled     bool          `mapstructure:"enabled"`
+			MaxInFlight int           `mapstructure:"max_in_flight"`
+			Timeout     time.Duration `mapstructure:"timeout"`
+			Sink        struct {
+				Type string `mapstructure:"type"`
+				Path string `mapstructure:"path"`
+			} `mapstructure:"sink"`
+			Rules []ShadowRule `mapstructure:"rules"`
+		} `mapstructure:"shadow"`
+	} `mapstructure:"routing"`
+}
+
+// HedgePolicy overrides request hedging for a single model
+type HedgePolicy struct {
+	Model      string   `mapstructure:"model"`
+	Disabled   bool     `mapstructure:"disabled"`
+	Routes     []string `mapstructure:"routes"`
+	Percentile float64  `mapstructure:"percentile"`
+}
+
+// SplitRule divides traffic for a logical model name between model variants
+type SplitRule struct {
+	Model    string         `mapstructure:"model"`
+	Variants []SplitVariant `mapstructure:"variants"`
+}
+
+// SplitVariant is a concrete model receiving a weighted share of traffic
+type SplitVariant struct {
+	Model  string `mapstructure:"model"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// FallbackChain lists the models tried in order when a model has no capacity
+type FallbackChain struct {
+	Model string   `mapstructure:"model"`
+	Chain []string `mapstructure:"chain"`
+}
+
+// Lane is a class of traffic. Share is the fraction of each worker's slots
+// kept for the lane, Priority the queue priority of its requests, which
+// clients may lower but not raise, and Preemptible whether its in-flight
+// requests may be requeued to serve a lane of higher priority.
+type Lane struct {
+	Name        string  `mapstructure:"name"`
+	Share       float64 `mapstructure:"share"`
+	Priority    int     `mapstructure:"priority"`
+	Preemptible bool    `mapstructure:"preemptible"`
+}
+
+// LaneRule assigns requests to a lane by the caller's API key, by route, or
+// by both. MindGateway API keys are matched by their key ID and other
+// credentials by fingerprint, the first 16 hex digits of their SHA-256.
+// Routes are chat, completions, embeddings and jobs, the last covering every
+// request of an asynchronous job. The first matching rule wins.
+type LaneRule struct {
+	APIKey string `mapstructure:"api_key"`
+	Route  string `mapstructure:"route"`
+	Lane   string `mapstructure:"lane"`
+}
+
+// OIDCIssuer is an identity provider whose tokens the auth service accepts,
+// such as a Microsoft Entra ID tenant. Tokens must be issued for one of the
+// audiences. The caller is identified by UserClaim, "sub" by default, and
+// granted DefaultRoles plus the roles of the groups listed in GroupsClaim,
+// "groups" by default. TenantClaim, when set, names the caller's tenant.
+type OIDCIssuer struct {
+	Issuer       string      `mapstructure:"issuer"`
+	Audiences    []string    `mapstructure:"audiences"`
+	UserClaim    string      `mapstructure:"user_claim"`
+	GroupsClaim  string      `mapstructure:"groups_claim"`
+	TenantClaim  string      `mapstructure:"tenant_claim"`
+	DefaultRoles []string    `mapstructure:"default_roles"`
+	GroupRoles   []GroupRole `mapstructure:"group_roles"`
+}
+
+// GroupRole grants roles to the members of an identity provider group
+type GroupRole struct {
+	Group string   `mapstructure:"group"`
+	Roles []string `mapstructure:"roles"`
+}
+
+// ModelAccess restricts a model to callers holding one of Roles or belonging
+// to one of Groups. Admins may use every model.
+type ModelAccess struct {
+	Model  string   `mapstructure:"model"`
+	Roles  []string `mapstructure:"roles"`
+	Groups []string `mapstructure:"groups"`
+}
+
+// ContextWindow is the number of tokens a model can attend to
+type ContextWindow struct {
+	Model  string `mapstructure:"model"`
+	Tokens int    `mapstructure:"tokens"`
+}
+
+// FairnessWeight sets the queue share of a tenant, or of callers holding a
+// role. A tenant weight takes precedence over role weights.
+type FairnessWeight struct {
+	Tenant string  `mapstructure:"tenant"`
+	Role   string  `mapstructure:"role"`
+	Weight float64 `mapstructure:"weight"`
+}
+
+// AdmissionClass sets the admission thresholds for requests of MinPriority
+// and above, up to the next class. MaxDepth rejects requests while the queue
+// holds that many, defaulting to the queue's maximum size, and MaxWait
+// rejects requests whose predicted wait is longer.
+type AdmissionClass struct {
+	Name        string        `mapstructure:"name"`
+	MinPriority int           `mapstructure:"min_priority"`
+	MaxDepth    int           `mapstructure:"max_depth"`
+	MaxWait     time.Duration `mapstructure:"max_wait"`
+}
+
+// TenantConstraints are the worker metadata labels a tenant's requests must
+// match, and those they prefer
+type TenantConstraints struct {
+	Tenant  string            `mapstructure:"tenant"`
+	Require map[string]string `mapstructure:"require"`
+	Prefer  map[string]string `mapstructure:"prefer"`
+}
+
+// NamesTenant reports whether the configuration names a tenant, in its queue
+// fairness weights or routing constraints
+func (c *Config) NamesTenant(tenant string) bool {
+	if c == nil || tenant == "" {
+		return false
+	}
+	for _, w := range c.Queue.Fairness.Weights {
+		if w.Tenant == tenant {
+			return true
+		}
+	}
+	for _, t := range c.Routing.Constraints.Tenants {
+		if t.Tenant == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// AutoRule picks a model for requests to the auto model when every condition
+// it sets matches the prompt
+type AutoRule struct {
+	Name            string   `mapstructure:"name"`
+	Model           string   `mapstructure:"model"`
+	MinPromptTokens int      `mapstructure:"min_prompt_tokens"`
+	MaxPromptTokens int      `mapstructure:"max_prompt_tokens"`
+	Content         string   `mapstructure:"content"`
+	Scripts         []string `mapstructure:"scripts"`
+	Tools           *bool    `mapstructure:"tools"`
+}
+
+// ShadowRule mirrors a sample of a model's traffic to a shadow model
+type ShadowRule struct {
+	Model       string            `mapstructure:"model"`
+	ShadowModel string            `mapstructure:"shadow_model"`
+	SampleRate  float64           `mapstructure:"sample_rate"`
+	Require     map[string]string `mapstructure:"require"`
 }
 
 // Load loads the configuration from file and environment
@@ -139,15 +509,90 @@ func setDefaults() {
 	
 	// Service defaults
 	viper.SetDefault("auth.address", "localhost:9091")
+	viper.SetDefault("auth.issuer", "mindgateway")
+	viper.SetDefault("auth.token_ttl", time.Hour)
+	viper.SetDefault("auth.enabled", false)
+	viper.SetDefault("auth.api_keys", false)
+	viper.SetDefault("auth.oidc.clock_skew", time.Minute)
+	viper.SetDefault("auth.oidc.jwks_refresh", time.Hour)
+	viper.SetDefault("auth.oidc.max_token_ttl", 24*time.Hour)
+	viper.SetDefault("auth.cache.enabled", true)
+	viper.SetDefault("auth.cache.ttl", 5*time.Minute)
+	viper.SetDefault("auth.cache.negative_ttl", 5*time.Second)
+	viper.SetDefault("auth.cache.max_entries", 10000)
+	viper.SetDefault("auth.revocations.backend", "memory")
+	viper.SetDefault("auth.revocations.channel", "mindgateway:auth:revocations")
+	viper.SetDefault("auth.revocations.key_prefix", "{mindgateway:auth:revoked}")
 	viper.SetDefault("registry.address", "localhost:9092")
+	viper.SetDefault("registry.refresh_interval", 2*time.Second)
 	
 	// Worker defaults
 	viper.SetDefault("worker.connect_timeout", 5*time.Second)
 	viper.SetDefault("worker.request_timeout", 60*time.Second)
 	viper.SetDefault("worker.health_check_period", 30*time.Second)
+	viper.SetDefault("worker.max_concurrency", 4)
+	viper.SetDefault("worker.token_budget", 0)
+	viper.SetDefault("worker.default_max_tokens", 512)
+	
+	// Batching defaults
+	viper.SetDefault("batching.enabled", false)
+	viper.SetDefault("batching.max_batch_size", 32)
+	viper.SetDefault("batching.max_linger", 5*time.Millisecond)
 	
 	// Queue defaults
 	viper.SetDefault("queue.max_size", 10000)
+	viper.SetDefault("queue.levels", 10)
 	viper.SetDefault("queue.default_priority", 5)
 	viper.SetDefault("queue.processing_period", 100*time.Millisecond)
+	viper.SetDefault("queue.max_wait", 30*time.Second)
+	viper.SetDefault("queue.fallback_margin", 2*time.Second)
+	viper.SetDefault("queue.progress_interval", time.Second)
+	viper.SetDefault("queue.backend", "memory")
+	viper.SetDefault("queue.redis.key_prefix", "{mindgateway:queue}")
+	viper.SetDefault("queue.redis.visibility_timeout", 30*time.Second)
+	viper.SetDefault("queue.redis.scan_limit", 500)
+	viper.SetDefault("queue.fairness.enabled", true)
+	viper.SetDefault("queue.fairness.default_weight", 1.0)
+	viper.SetDefault("queue.admission.enabled", true)
+	viper.SetDefault("queue.admission.default_retry_after", time.Second)
+	viper.SetDefault("queue.admission.max_retry_after", time.Minute)
+	
+	// Job defaults
+	viper.SetDefault("jobs.enabled", true)
+	viper.SetDefault("jobs.backend", "memory")
+	viper.SetDefault("jobs.key_prefix", "{mindgateway:jobs}")
+	viper.SetDefault("jobs.max_running", 100)
+	viper.SetDefault("jobs.timeout", time.Hour)
+	viper.SetDefault("jobs.retention", 24*time.Hour)
+	viper.SetDefault("jobs.lease", 30*time.Second)
+	viper.SetDefault("jobs.webhook.timeout", 10*time.Second)
+	viper.SetDefault("jobs.webhook.max_attempts", 5)
+	
+	// Routing defaults
+	viper.SetDefault("routing.circuit_breaker.enabled", true)
+	viper.SetDefault("routing.circuit_breaker.window", 60*time.Second)
+	viper.SetDefault("routing.circuit_breaker.min_requests", 20)
+	viper.SetDefault("routing.circuit_breaker.error_rate_threshold", 0.5)
+	viper.SetDefault("routing.circuit_breaker.latency_outlier_factor", 3.0)
+	viper.SetDefault("routing.circuit_breaker.base_ejection_time", 30*time.Second)
+	viper.SetDefault("routing.circuit_breaker.max_ejection_time", 5*time.Minute)
+	viper.SetDefault("routing.circuit_breaker.max_ejection_percent", 50)
+	viper.SetDefault("routing.circuit_breaker.half_open_requests", 3)
+	viper.SetDefault("routing.hedging.enabled", false)
+	viper.SetDefault("routing.hedging.percentile", 0.95)
+	viper.SetDefault("routing.hedging.min_delay", 20*time.Millisecond)
+	viper.SetDefault("routing.hedging.max_delay", 2*time.Second)
+	viper.SetDefault("routing.hedging.min_samples", 50)
+	viper.SetDefault("routing.hedging.max_tokens", 256)
+	viper.SetDefault("routing.hedging.routes", []string{"embeddings"})
+	viper.SetDefault("routing.auto.enabled", false)
+	viper.SetDefault("routing.auto.model", "auto")
+	viper.SetDefault("routing.auto.router_timeout", 2*time.Second)
+	viper.SetDefault("routing.lanes.enabled", false)
+	viper.SetDefault("routing.lanes.default", "standard")
+	viper.SetDefault("routing.lanes.max_preemptions", 2)
+	viper.SetDefault("routing.shadow.enabled", false)
+	viper.SetDefault("routing.shadow.max_in_flight", 4)
+	viper.SetDefault("routing.shadow.timeout", 60*time.Second)
+	viper.SetDefault("routing.shadow.sink.type", "log")
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package errors
 
 import (
+	stderrors "errors"
 	"fmt"
 	"net/http"
 )
@@ -49,8 +50,10 @@ var (
 	
 	// Worker errors
 	ErrNoWorkersAvailable = &Error{Code: http.StatusServiceUnavailable, Message: "No workers available"}
+	ErrWorkersAtCapacity  = &Error{Code: http.StatusServiceUnavailable, Message: "All workers are at capacity"}
 	ErrWorkerNotFound     = &Error{Code: http.StatusNotFound, Message: "Worker not found"}
 	ErrWorkerTimeout      = &Error{Code: http.StatusGatewayTimeout, Message: "Worker request timeout"}
+	ErrWorkerFailed       = &Error{Code: http.StatusBadGateway, Message: "Worker request failed"}
 )
 
 // WithMessage adds context to a standard error
@@ -76,6 +79,15 @@ func WithMessage(err error, message string) *Error {
 	}
 }
 
+// From returns the first Error in err's chain, or ErrInternal if there is none
+func From(err error) *Error {
+	var e *Error
+	if stderrors.As(err, &e) {
+		return e
+	}
+	return ErrInternal
+}
+
 // New creates a new error with the given code and message
 func New(code int, message string) *Error {
 	return &Error{
@@ -0,0 +1,93 @@
+// Package revocation announces revoked credentials from the auth service to
+// gateway replicas over Redis pub/sub.
+package revocation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// resubscribeDelay is how long a subscriber waits before subscribing again
+// after losing its connection
+const resubscribeDelay = time.Second
+
+// Event announces that a token or an API key was revoked, or every
+// credential of a user or a tenant
+type Event struct {
+	TokenID string `json:"token_id,omitempty"`
+	KeyID   string `json:"key_id,omitempty"`
+	UserID  string `json:"user_id,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+}
+
+// Credential identifies a credential an event may revoke
+type Credential struct {
+	TokenID string
+	KeyID   string
+	UserID  string
+	Tenant  string
+}
+
+// Matches reports whether the event revokes a credential
+func (e Event) Matches(c Credential) bool {
+	return matches(e.TokenID, c.TokenID) || matches(e.KeyID, c.KeyID) ||
+		matches(e.UserID, c.UserID) || matches(e.Tenant, c.Tenant)
+}
+
+func matches(revoked, id string) bool {
+	return revoked != "" && revoked == id
+}
+
+// Publish announces an event on a channel
+func Publish(ctx context.Context, client redis.UniversalClient, channel string, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := client.Publish(ctx, channel, data).Err(); err != nil {
+		return fmt.Errorf("failed to publish revocation: %w", err)
+	}
+	return nil
+}
+
+// Subscribe passes the events published on a channel to fn until ctx is
+// done. Events published while the subscription is down are lost, so resync
+// is called each time the subscription is established.
+func Subscribe(ctx context.Context, client redis.UniversalClient, channel string, fn func(Event), resync func()) {
+	for ctx.Err() == nil {
+		receive(ctx, client, channel, fn, resync)
+
+		select {
+		case <-time.After(resubscribeDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// receive serves one subscription until it fails or ctx is done
+func receive(ctx context.Context, client redis.UniversalClient, channel string, fn func(Event), resync func()) {
+	sub := client.Subscribe(ctx, channel)
+	defer sub.Close()
+
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				resync()
+			}
+		case *redis.Message:
+			var e Event
+			if json.Unmarshal([]byte(m.Payload), &e) == nil {
+				fn(e)
+			}
+		}
+	}
+}
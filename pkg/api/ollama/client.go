@@ -91,6 +91,20 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// EmbedRequest represents a request to the Ollama batch embedding endpoint
+type EmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// EmbedResponse represents a response from the Ollama batch embedding
+// endpoint, with one embedding per input in order
+type EmbedResponse struct {
+	Model           string      `json:"model"`
+	Embeddings      [][]float64 `json:"embeddings"`
+	PromptEvalCount int         `json:"prompt_eval_count,omitempty"`
+}
+
 // ModelInfo represents information about an Ollama model
 type ModelInfo struct {
 	Name        string    `json:"name"`
@@ -113,6 +127,22 @@ type ListModelsResponse struct {
 	Models []ModelInfo `json:"models"`
 }
 
+// RunningModel represents a model currently loaded into memory by Ollama
+type RunningModel struct {
+	Name      string       `json:"name"`
+	Model     string       `json:"model"`
+	Size      int64        `json:"size"`
+	Digest    string       `json:"digest"`
+	Details   ModelDetails `json:"details,omitempty"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	SizeVRAM  int64        `json:"size_vram"`
+}
+
+// ListRunningResponse represents a response from the Ollama running models endpoint
+type ListRunningResponse struct {
+	Models []RunningModel `json:"models"`
+}
+
 // Generate sends a generate request to Ollama
 func (c *Client) Generate(ctx context.Context, req GenerateRequest) (*GenerateResponse, error) {
 	url := fmt.Sprintf("%s/api/generate", c.BaseURL)
@@ -183,6 +213,70 @@ func (c *Client) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, erro
 	return &result, nil
 }
 
+// GenerateStream sends a generate request to Ollama and calls fn with each
+// chunk of the response as it is generated. The last chunk has Done set and
+// carries the token counts.
+func (c *Client) GenerateStream(ctx context.Context, req GenerateRequest, fn func(*GenerateResponse) error) error {
+	req.Stream = true
+	return stream(ctx, c, "/api/generate", req, func(chunk *GenerateResponse) (bool, error) {
+		return chunk.Done, fn(chunk)
+	})
+}
+
+// ChatStream sends a chat request to Ollama and calls fn with each chunk of
+// the response as it is generated. The last chunk has Done set and carries
+// the token counts.
+func (c *Client) ChatStream(ctx context.Context, req ChatRequest, fn func(*ChatResponse) error) error {
+	req.Stream = true
+	return stream(ctx, c, "/api/chat", req, func(chunk *ChatResponse) (bool, error) {
+		return chunk.Done, fn(chunk)
+	})
+}
+
+// stream posts a request whose response is a stream of JSON objects and
+// hands each to fn until fn reports the last one
+func stream[T any](ctx context.Context, c *Client, path string, req interface{}, fn func(*T) (bool, error)) error {
+	url := fmt.Sprintf("%s%s", c.BaseURL, path)
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var chunk T
+		if err := dec.Decode(&chunk); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("stream ended before the response was complete")
+			}
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+		done, err := fn(&chunk)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
 // Embeddings sends an embedding request to Ollama
 func (c *Client) Embeddings(ctx context.Context, req EmbeddingRequest) (*EmbeddingResponse, error) {
 	url := fmt.Sprintf("%s/api/embeddings", c.BaseURL)
@@ -218,6 +312,44 @@ func (c *Client) Embeddings(ctx context.Context, req EmbeddingRequest) (*Embeddi
 	return &result, nil
 }
 
+// Embed sends a batch of inputs to the Ollama embed endpoint
+func (c *Client) Embed(ctx context.Context, req EmbedRequest) (*EmbedResponse, error) {
+	url := fmt.Sprintf("%s/api/embed", c.BaseURL)
+	
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	
+	httpReq.Header.Set("Content-Type", "application/json")
+	
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+	
+	var result EmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(result.Embeddings) != len(req.Input) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(req.Input), len(result.Embeddings))
+	}
+	
+	return &result, nil
+}
+
 // ListModels lists available models from Ollama
 func (c *Client) ListModels(ctx context.Context) (*ListModelsResponse, error) {
 	url := fmt.Sprintf("%s/api/tags", c.BaseURL)
@@ -244,4 +376,32 @@ func (c *Client) ListModels(ctx context.Context) (*ListModelsResponse, error) {
 	}
 	
 	return &result, nil
-}
\ No newline at end of file
+}
+
+// ListRunning lists the models currently loaded into memory by Ollama
+func (c *Client) ListRunning(ctx context.Context) (*ListRunningResponse, error) {
+	url := fmt.Sprintf("%s/api/ps", c.BaseURL)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var result ListRunningResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
@@ -13,6 +13,20 @@ type ChatCompletionRequest struct {
 	PresencePenalty  float64       `json:"presence_penalty,omitempty"`
 	FrequencyPenalty float64       `json:"frequency_penalty,omitempty"`
 	User             string        `json:"user,omitempty"`
+	Tools            []Tool        `json:"tools,omitempty"`
+}
+
+// Tool represents a tool the model may call
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction describes a function tool
+type ToolFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
 }
 
 // ChatMessage represents a message in a chat completion request/response
@@ -39,6 +53,30 @@ type ChatCompletionChoice struct {
 	Index        int         `json:"index"`
 }
 
+// ChatCompletionChunk represents one event of a streamed chat completion
+type ChatCompletionChunk struct {
+	ID      string                      `json:"id"`
+	Object  string                      `json:"object"`
+	Created int64                       `json:"created"`
+	Model   string                      `json:"model"`
+	Choices []ChatCompletionChunkChoice `json:"choices"`
+	Usage   *Usage                      `json:"usage,omitempty"`
+}
+
+// ChatCompletionChunkChoice represents a choice in a streamed chat completion.
+// FinishReason is null until the last chunk.
+type ChatCompletionChunkChoice struct {
+	Delta        ChatMessageDelta `json:"delta"`
+	FinishReason *string          `json:"finish_reason"`
+	Index        int              `json:"index"`
+}
+
+// ChatMessageDelta represents the part of a message carried by one chunk
+type ChatMessageDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
 // Usage represents token usage in a completion response
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
@@ -78,6 +116,24 @@ type CompletionChoice struct {
 	Index        int    `json:"index"`
 }
 
+// CompletionChunk represents one event of a streamed completion
+type CompletionChunk struct {
+	ID      string                  `json:"id"`
+	Object  string                  `json:"object"`
+	Created int64                   `json:"created"`
+	Model   string                  `json:"model"`
+	Choices []CompletionChunkChoice `json:"choices"`
+	Usage   *Usage                  `json:"usage,omitempty"`
+}
+
+// CompletionChunkChoice represents a choice in a streamed completion.
+// FinishReason is null until the last chunk.
+type CompletionChunkChoice struct {
+	Text         string  `json:"text"`
+	FinishReason *string `json:"finish_reason"`
+	Index        int     `json:"index"`
+}
+
 // EmbeddingRequest represents an OpenAI-compatible embedding request
 type EmbeddingRequest struct {
 	Model string   `json:"model"`
@@ -98,4 +154,17 @@ type Embedding struct {
 	Object    string    `json:"object"`
 	Embedding []float64 `json:"embedding"`
 	Index     int       `json:"index"`
-}
\ No newline at end of file
+}
+
+// ErrorResponse represents an OpenAI-compatible error response
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes the error in an error response
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
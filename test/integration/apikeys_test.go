@@ -0,0 +1,293 @@
+package integration
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/ncolesummers/mindgateway/internal/auth"
+	gatewayauth "github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/server"
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+// newTestDB connects to the Postgres in TEST_POSTGRES_URI, or to an embedded
+// SQLite stand-in when it is not set
+func newTestDB(t *testing.T) *gorm.DB {
+	gormConfig := &gorm.Config{Logger: logger.Discard}
+	var dialector gorm.Dialector
+	if uri := os.Getenv("TEST_POSTGRES_URI"); uri != "" {
+		dialector = postgres.Open(uri)
+	} else {
+		dialector = sqlite.Open(filepath.Join(t.TempDir(), "auth.db"))
+	}
+	db, err := gorm.Open(dialector, gormConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// testOwner keeps each test's keys apart on a shared database
+func testOwner(t *testing.T) string {
+	return t.Name() + "-" + time.Now().Format("150405.000000000")
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	client, _ := newAuthClient(t, authConfig(), auth.WithDatabase(newTestDB(t)))
+	ctx := context.Background()
+	owner := testOwner(t)
+
+	created, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{
+		OwnerId: owner,
+		Name:    "nightly batch",
+		Scopes:  []string{"models:invoke"},
+		Roles:   []string{auth.RoleUser},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(created.Key, auth.APIKeyPrefix))
+	id, ok := gatewayauth.KeyID(created.Key)
+	require.True(t, ok)
+	assert.Equal(t, created.ApiKey.Id, id)
+	assert.Zero(t, created.ApiKey.ExpiresAt, "keys do not expire by default")
+
+	resp, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: created.Key})
+	require.NoError(t, err)
+	require.True(t, resp.Valid, resp.Error)
+	assert.Equal(t, owner, resp.UserId)
+	assert.Equal(t, id, resp.KeyId)
+	assert.Equal(t, []string{"models:invoke"}, resp.Scopes)
+	assert.Equal(t, []string{auth.RoleUser}, resp.Roles)
+
+	listed, err := client.ListAPIKeys(ctx, &authpb.ListAPIKeysRequest{OwnerId: owner})
+	require.NoError(t, err)
+	require.Len(t, listed.ApiKeys, 1)
+	assert.Equal(t, "nightly batch", listed.ApiKeys[0].Name)
+	assert.NotZero(t, listed.ApiKeys[0].LastUsedAt, "validation records when a key was used")
+
+	// A key with the right ID but another secret is rejected
+	forged := created.Key[:len(created.Key)-4] + "0000"
+	if forged == created.Key {
+		forged = created.Key[:len(created.Key)-4] + "1111"
+	}
+	resp, err = client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: forged})
+	require.NoError(t, err)
+	assert.False(t, resp.Valid)
+
+	revoked, err := client.RevokeAPIKey(ctx, &authpb.RevokeAPIKeyRequest{Id: id})
+	require.NoError(t, err)
+	assert.True(t, revoked.Success, revoked.Error)
+	resp, err = client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: created.Key})
+	require.NoError(t, err)
+	assert.False(t, resp.Valid)
+	assert.Equal(t, auth.ErrTokenRevoked.Error(), resp.Error)
+
+	listed, err = client.ListAPIKeys(ctx, &authpb.ListAPIKeysRequest{OwnerId: owner})
+	require.NoError(t, err)
+	assert.Empty(t, listed.ApiKeys)
+	listed, err = client.ListAPIKeys(ctx, &authpb.ListAPIKeysRequest{OwnerId: owner, IncludeRevoked: true})
+	require.NoError(t, err)
+	require.Len(t, listed.ApiKeys, 1)
+	assert.True(t, listed.ApiKeys[0].Revoked)
+
+	revoked, err = client.RevokeAPIKey(ctx, &authpb.RevokeAPIKeyRequest{Id: "0000000000000000"})
+	require.NoError(t, err)
+	assert.False(t, revoked.Success)
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	db := newTestDB(t)
+	client, _ := newAuthClient(t, authConfig(), auth.WithDatabase(db))
+	ctx := context.Background()
+
+	created, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{
+		OwnerId:           testOwner(t),
+		Name:              "short lived",
+		ExpirationSeconds: 1,
+	})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		resp, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: created.Key})
+		return err == nil && !resp.Valid && resp.Error == auth.ErrTokenExpired.Error()
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// Only a salted hash of the key is stored
+	var stored auth.APIKey
+	require.NoError(t, db.Where("id = ?", created.ApiKey.Id).Take(&stored).Error)
+	assert.NotContains(t, created.Key, stored.Hash)
+	assert.NotEmpty(t, stored.Salt)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	client, _ := newAuthClient(t, authConfig(), auth.WithDatabase(newTestDB(t)))
+	ctx := context.Background()
+
+	key := func(scopes ...string) string {
+		created, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{
+			OwnerId: testOwner(t), Name: "scoped", Scopes: scopes, Roles: []string{auth.RoleUser},
+		})
+		require.NoError(t, err)
+		return created.Key
+	}
+	check := func(token, resource, action string) bool {
+		resp, err := client.CheckPermission(ctx, &authpb.CheckPermissionRequest{Token: token, Resource: resource, Action: action})
+		require.NoError(t, err)
+		return resp.Allowed
+	}
+
+	// Scopes narrow what the key's roles allow
+	scoped := key("models/llama3.1:8b:invoke")
+	assert.True(t, check(scoped, "models/llama3.1:8b", auth.ActionInvoke))
+	assert.False(t, check(scoped, "models/mistral:7b", auth.ActionInvoke))
+	assert.False(t, check(scoped, auth.ResourceJobs, auth.ActionCreate))
+
+	// but never widen them
+	assert.False(t, check(key("*:*"), auth.ResourceAdmin, auth.ActionRead))
+
+	unscoped := key()
+	assert.True(t, check(unscoped, "models/mistral:7b", auth.ActionInvoke))
+	assert.True(t, check(unscoped, auth.ResourceJobs, auth.ActionCreate))
+
+	// Callers identified earlier keep the scopes of their key
+	resp, err := client.CheckPermission(ctx, &authpb.CheckPermissionRequest{
+		Resource: "models/mistral:7b", Action: auth.ActionInvoke,
+		Caller: &authpb.Caller{Roles: []string{auth.RoleUser}, Scopes: []string{"models/llama3.1:8b:invoke"}},
+	})
+	require.NoError(t, err)
+	assert.False(t, resp.Allowed)
+
+	for _, scope := range []string{"models", "models:", ":invoke"} {
+		_, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{OwnerId: testOwner(t), Name: "bad", Scopes: []string{scope}})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), scope)
+	}
+}
+
+func TestManagingAPIKeysRequiresAuthorization(t *testing.T) {
+	client, _ := newAuthClient(t, authConfig(), auth.WithDatabase(newTestDB(t)))
+	ctx := context.Background()
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	alice, olivia := testOwner(t)+"-alice", testOwner(t)+"-olivia"
+	aliceToken := issueToken(t, client, alice, auth.RoleUser)
+	operator := issueToken(t, client, olivia, auth.RoleOperator)
+	aliceKey, err := client.CreateAPIKey(as(aliceToken), &authpb.CreateAPIKeyRequest{OwnerId: alice, Name: "ci", Roles: []string{auth.RoleUser}})
+	require.NoError(t, err)
+	_, err = client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{OwnerId: olivia, Name: "ci"})
+	require.NoError(t, err)
+
+	list := func(ctx context.Context, owner string) error {
+		_, err := client.ListAPIKeys(ctx, &authpb.ListAPIKeysRequest{OwnerId: owner})
+		return err
+	}
+	revoke := func(ctx context.Context, id string) error {
+		_, err := client.RevokeAPIKey(ctx, &authpb.RevokeAPIKeyRequest{Id: id})
+		return err
+	}
+
+	// Callers must present a valid credential
+	assert.Equal(t, codes.Unauthenticated, status.Code(list(as("forged"), alice)))
+	assert.Equal(t, codes.Unauthenticated, status.Code(revoke(as("forged"), aliceKey.ApiKey.Id)))
+
+	// Callers allowed to read keys read only their own, and only admins
+	// revoke keys
+	require.NoError(t, list(as(operator), olivia))
+	assert.Equal(t, codes.PermissionDenied, status.Code(list(as(operator), alice)))
+	assert.Equal(t, codes.PermissionDenied, status.Code(list(as(aliceToken), alice)), "users may not read keys")
+	assert.Equal(t, codes.PermissionDenied, status.Code(revoke(as(operator), aliceKey.ApiKey.Id)))
+	assert.Equal(t, codes.PermissionDenied, status.Code(revoke(as(aliceToken), aliceKey.ApiKey.Id)))
+	assert.True(t, tokenValid(t, client, aliceKey.Key))
+
+	// Admins manage anyone's keys
+	admin := issueToken(t, client, "root", auth.RoleAdmin)
+	listed, err := client.ListAPIKeys(as(admin), &authpb.ListAPIKeysRequest{OwnerId: alice})
+	require.NoError(t, err)
+	assert.Len(t, listed.ApiKeys, 1)
+	require.NoError(t, revoke(as(admin), aliceKey.ApiKey.Id))
+	assert.False(t, tokenValid(t, client, aliceKey.Key))
+}
+
+func TestAPIKeysRequireDatabase(t *testing.T) {
+	client, _ := newAuthClient(t, authConfig())
+	ctx := context.Background()
+
+	_, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{OwnerId: "alice", Name: "key"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	resp, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: "mg-0123456789abcdef-00"})
+	require.NoError(t, err)
+	assert.False(t, resp.Valid)
+}
+
+// fakeAuthClient accepts a fixed set of credentials
+type fakeAuthClient map[string]bool
+
+func (f fakeAuthClient) ValidateToken(ctx context.Context, token string) (*gatewayauth.Principal, error) {
+	if !f[token] {
+		return nil, nil
+	}
+	return &gatewayauth.Principal{UserID: "alice"}, nil
+}
+
+func (f fakeAuthClient) GetUserRoles(ctx context.Context, userID string) ([]string, error) {
+	return nil, nil
+}
+
+func (f fakeAuthClient) CheckPermission(ctx context.Context, token, resource, action string) (bool, error) {
+	return f[token], nil
+}
+
+func (f fakeAuthClient) CheckPrincipalPermission(ctx context.Context, p *gatewayauth.Principal, resource, action string) (bool, error) {
+	return true, nil
+}
+
+func (f fakeAuthClient) RevokeAll(ctx context.Context, token, userID, tenant string) (int64, error) {
+	return 0, nil
+}
+
+func TestGatewayAcceptsTokensAndAPIKeys(t *testing.T) {
+	srv, err := server.New(server.WithAuthClient(fakeAuthClient{"jwt": true, "mg-key-secret": true}))
+	require.NoError(t, err)
+
+	get := func(header, value string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/jobs/job-1", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Authenticated requests reach the handler, which has no jobs to serve
+	assert.Equal(t, http.StatusNotImplemented, get("Authorization", "Bearer jwt"))
+	assert.Equal(t, http.StatusNotImplemented, get("Authorization", "Bearer mg-key-secret"))
+	assert.Equal(t, http.StatusNotImplemented, get(server.HeaderAPIKey, "mg-key-secret"))
+
+	assert.Equal(t, http.StatusUnauthorized, get("", ""))
+	assert.Equal(t, http.StatusUnauthorized, get("Authorization", "Bearer forged"))
+	assert.Equal(t, http.StatusUnauthorized, get(server.HeaderAPIKey, "mg-other-secret"))
+
+	// Health checks stay open
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,242 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/auth"
+	gatewayauth "github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/revocation"
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+// countingBackend counts the calls reaching an auth backend
+type countingBackend struct {
+	gatewayauth.Backend
+	validations atomic.Int32
+	checks      atomic.Int32
+}
+
+func (b *countingBackend) ValidateToken(ctx context.Context, token string) (*gatewayauth.Principal, error) {
+	b.validations.Add(1)
+	return b.Backend.ValidateToken(ctx, token)
+}
+
+func (b *countingBackend) CheckPermission(ctx context.Context, token, resource, action string) (bool, error) {
+	b.checks.Add(1)
+	return b.Backend.CheckPermission(ctx, token, resource, action)
+}
+
+// stubBackend identifies every token as the same principal, or fails
+type stubBackend struct {
+	principal *gatewayauth.Principal
+	err       error
+}
+
+func (b *stubBackend) ValidateToken(ctx context.Context, token string) (*gatewayauth.Principal, error) {
+	return b.principal, b.err
+}
+
+func (b *stubBackend) GetUserRoles(ctx context.Context, userID string) ([]string, error) {
+	return nil, b.err
+}
+
+func (b *stubBackend) CheckPermission(ctx context.Context, token, resource, action string) (bool, error) {
+	return b.principal != nil, b.err
+}
+
+func (b *stubBackend) CheckPrincipalPermission(ctx context.Context, p *gatewayauth.Principal, resource, action string) (bool, error) {
+	return b.principal != nil, b.err
+}
+
+func (b *stubBackend) RevokeAll(ctx context.Context, token, userID, tenant string) (int64, error) {
+	return 0, b.err
+}
+
+func authCacheConfig() *config.Config {
+	cfg := authConfig()
+	cfg.Auth.Cache.Enabled = true
+	cfg.Auth.Cache.TTL = time.Hour
+	cfg.Auth.Cache.NegativeTTL = time.Hour
+	cfg.Auth.Cache.MaxEntries = 100
+	return cfg
+}
+
+func TestAuthCacheAvoidsRoundTrips(t *testing.T) {
+	cfg := authCacheConfig()
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+	backend := &countingBackend{Backend: gatewayauth.NewClient(conn)}
+	cache := gatewayauth.NewCache(backend, cfg)
+	ctx := context.Background()
+
+	token := issueToken(t, client, "alice", auth.RoleUser)
+	for i := 0; i < 3; i++ {
+		p, err := cache.ValidateToken(ctx, token)
+		require.NoError(t, err)
+		require.NotNil(t, p)
+		assert.Equal(t, "alice", p.UserID)
+
+		allowed, err := cache.CheckPermission(ctx, token, gatewayauth.ModelResource("llama3.1:8b"), gatewayauth.ActionInvoke)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+
+		allowed, err = cache.CheckPermission(ctx, token, gatewayauth.ResourceAdmin, gatewayauth.ActionRead)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+	}
+	assert.Equal(t, int32(1), backend.validations.Load())
+	assert.Equal(t, int32(2), backend.checks.Load(), "decisions are cached per permission")
+
+	// Invalid tokens are cached too, and are allowed nothing
+	for i := 0; i < 3; i++ {
+		p, err := cache.ValidateToken(ctx, "forged")
+		require.NoError(t, err)
+		assert.Nil(t, p)
+
+		allowed, err := cache.CheckPermission(ctx, "forged", gatewayauth.ResourceModels, gatewayauth.ActionRead)
+		require.NoError(t, err)
+		assert.False(t, allowed)
+	}
+	assert.Equal(t, int32(2), backend.validations.Load())
+	assert.Equal(t, int32(2), backend.checks.Load())
+
+	// Hits stay well under a millisecond
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		_, err := cache.ValidateToken(ctx, token)
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start)/1000, time.Millisecond)
+}
+
+func TestAuthCacheExpiry(t *testing.T) {
+	cfg := authCacheConfig()
+	cfg.Auth.Cache.NegativeTTL = 50 * time.Millisecond
+	ctx := context.Background()
+
+	// Entries never outlive the credential
+	stub := &stubBackend{principal: &gatewayauth.Principal{UserID: "alice", ExpiresAt: time.Now().Add(50 * time.Millisecond)}}
+	backend := &countingBackend{Backend: stub}
+	cache := gatewayauth.NewCache(backend, cfg)
+	_, err := cache.ValidateToken(ctx, "token")
+	require.NoError(t, err)
+	_, err = cache.ValidateToken(ctx, "token")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), backend.validations.Load())
+	time.Sleep(100 * time.Millisecond)
+	_, err = cache.ValidateToken(ctx, "token")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), backend.validations.Load(), "the token expired")
+
+	// Invalid tokens are remembered for the negative TTL
+	stub.principal = nil
+	_, err = cache.ValidateToken(ctx, "forged")
+	require.NoError(t, err)
+	_, err = cache.ValidateToken(ctx, "forged")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), backend.validations.Load())
+	time.Sleep(100 * time.Millisecond)
+	_, err = cache.ValidateToken(ctx, "forged")
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), backend.validations.Load())
+
+	// Failures are not cached
+	stub.err = errors.New("auth service unavailable")
+	for i := 0; i < 2; i++ {
+		_, err = cache.ValidateToken(ctx, "other")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(6), backend.validations.Load())
+
+	// The cache holds at most its maximum number of entries
+	cfg.Auth.Cache.MaxEntries = 2
+	stub.err = nil
+	stub.principal = &gatewayauth.Principal{UserID: "alice"}
+	backend = &countingBackend{Backend: stub}
+	cache = gatewayauth.NewCache(backend, cfg)
+	for _, token := range []string{"a", "b", "c", "a", "b", "c"} {
+		_, err = cache.ValidateToken(ctx, token)
+		require.NoError(t, err)
+	}
+	assert.Greater(t, backend.validations.Load(), int32(3))
+}
+
+func TestAuthCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cfg := authCacheConfig()
+	cfg.Auth.Cache.MaxEntries = 2
+	backend := &countingBackend{Backend: &stubBackend{principal: &gatewayauth.Principal{UserID: "alice"}}}
+	cache := gatewayauth.NewCache(backend, cfg)
+	ctx := context.Background()
+
+	validate := func(tokens ...string) {
+		for _, token := range tokens {
+			_, err := cache.ValidateToken(ctx, token)
+			require.NoError(t, err)
+		}
+	}
+
+	// "hot" is used again after "cold", so "cold" makes room for "new"
+	validate("hot", "cold", "hot", "new")
+	assert.Equal(t, int32(3), backend.validations.Load())
+	validate("hot", "new")
+	assert.Equal(t, int32(3), backend.validations.Load(), "recently used entries survive eviction")
+	validate("cold")
+	assert.Equal(t, int32(4), backend.validations.Load())
+}
+
+func TestAuthCacheEvictsRevokedCredentials(t *testing.T) {
+	redisClient := newRedisClient(t)
+	cfg := authCacheConfig()
+	cfg.Auth.Revocations.Backend = "redis"
+	cfg.Auth.Revocations.Channel = "test:revocations:" + t.Name()
+
+	_, err := auth.NewService(auth.WithConfig(cfg))
+	assert.Error(t, err, "redis revocations need a client")
+
+	conn, _ := serveAuth(t, cfg, auth.WithDatabase(newTestDB(t)), auth.WithRedis(redisClient))
+	client := authpb.NewAuthServiceClient(conn)
+	cache := gatewayauth.NewCache(gatewayauth.NewClient(conn), cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscribed := make(chan struct{}, 1)
+	go revocation.Subscribe(ctx, redisClient, cfg.Auth.Revocations.Channel, cache.Revoke, func() {
+		cache.Flush()
+		subscribed <- struct{}{}
+	})
+	select {
+	case <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("revocations were not subscribed to")
+	}
+
+	token := issueToken(t, client, "alice", auth.RoleUser)
+	key, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{OwnerId: testOwner(t), Name: "ci", Roles: []string{auth.RoleUser}})
+	require.NoError(t, err)
+	for _, credential := range []string{token, key.Key} {
+		p, err := cache.ValidateToken(ctx, credential)
+		require.NoError(t, err)
+		require.NotNil(t, p)
+	}
+
+	// Cached entries would keep the credentials valid for an hour, so they
+	// are only rejected once the revocations evict them
+	_, err = client.RevokeToken(ctx, &authpb.RevokeTokenRequest{Token: token})
+	require.NoError(t, err)
+	_, err = client.RevokeAPIKey(ctx, &authpb.RevokeAPIKeyRequest{Id: key.ApiKey.Id})
+	require.NoError(t, err)
+	for _, credential := range []string{token, key.Key} {
+		assert.Eventually(t, func() bool {
+			p, err := cache.ValidateToken(ctx, credential)
+			return err == nil && p == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
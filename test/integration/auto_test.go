@@ -0,0 +1,114 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+type fakeClassifier struct {
+	answer string
+	err    error
+	calls  int
+}
+
+func (f *fakeClassifier) Classify(ctx context.Context, model, prompt string, choices []string) (string, error) {
+	f.calls++
+	return f.answer, f.err
+}
+
+func autoConfig() *config.Config {
+	cfg := breakerConfig()
+	tools := true
+	cfg.Routing.Auto.Enabled = true
+	cfg.Routing.Auto.Model = "auto"
+	cfg.Routing.Auto.Default = "llama3.1:8b"
+	cfg.Routing.Auto.Rules = []config.AutoRule{
+		{Name: "tools", Model: "llama3.1:70b", Tools: &tools},
+		{Name: "code", Model: "codellama", Content: routing.ContentCode},
+		{Name: "short", Model: "mistral", MaxPromptTokens: 50, Scripts: []string{"latin"}},
+	}
+	return cfg
+}
+
+func TestClassifyPrompt(t *testing.T) {
+	f := routing.Classify("What is the capital of France?", false)
+	assert.Equal(t, routing.ContentProse, f.Content)
+	assert.Equal(t, "latin", f.Script)
+	assert.Equal(t, 8, f.PromptTokens)
+
+	f = routing.Classify("Fix this:\n```go\nfunc main() {}\n```", true)
+	assert.Equal(t, routing.ContentCode, f.Content)
+	assert.True(t, f.Tools)
+
+	f = routing.Classify("def add(a, b):\n    return a + b\nprint(add(1, 2))", false)
+	assert.Equal(t, routing.ContentCode, f.Content)
+
+	assert.Equal(t, "cyrillic", routing.Classify("Привет, как дела?", false).Script)
+	assert.Equal(t, "japanese", routing.Classify("こんにちは、元気ですか", false).Script)
+}
+
+func TestAutoRoutingRules(t *testing.T) {
+	r := newTestRouter(t, autoConfig())
+	ctx := context.Background()
+
+	assert.True(t, r.IsAuto("auto"))
+	assert.False(t, r.IsAuto("mistral"))
+
+	d := r.DecideAuto(ctx, routing.Features{Tools: true, Content: routing.ContentCode}, "", nil)
+	assert.Equal(t, "llama3.1:70b", d.Model, "rules are checked in order")
+	assert.Equal(t, routing.AutoSourceRule, d.Source)
+	assert.Equal(t, "rule tools", d.Reason)
+
+	d = r.DecideAuto(ctx, routing.Classify("Hi there", false), "Hi there", nil)
+	assert.Equal(t, "mistral", d.Model)
+
+	long := strings.Repeat("Tell me a long story about the sea. ", 20)
+	d = r.DecideAuto(ctx, routing.Classify(long, false), long, nil)
+	assert.Equal(t, "llama3.1:8b", d.Model)
+	assert.Equal(t, routing.AutoSourceDefault, d.Source)
+}
+
+func TestAutoRoutingRouterModel(t *testing.T) {
+	cfg := autoConfig()
+	cfg.Routing.Auto.RouterModel = "qwen2.5:0.5b"
+	r := newTestRouter(t, cfg)
+	ctx := context.Background()
+
+	long := strings.Repeat("Summarise the history of the printing press. ", 20)
+	f := routing.Classify(long, false)
+
+	classifier := &fakeClassifier{answer: "codellama"}
+	d := r.DecideAuto(ctx, f, long, classifier)
+	assert.Equal(t, "codellama", d.Model)
+	assert.Equal(t, routing.AutoSourceRouterModel, d.Source)
+
+	d = r.DecideAuto(ctx, f, long, &fakeClassifier{answer: "gpt-4"})
+	assert.Equal(t, "llama3.1:8b", d.Model, "answers outside the configured models fall back to the default")
+
+	d = r.DecideAuto(ctx, f, long, &fakeClassifier{err: errors.New("no workers")})
+	assert.Equal(t, "llama3.1:8b", d.Model)
+	assert.Equal(t, routing.AutoSourceDefault, d.Source)
+
+	r.DecideAuto(ctx, routing.Classify("Hi", false), "Hi", classifier)
+	assert.Equal(t, 1, classifier.calls, "the router model is skipped when a rule matches")
+}
+
+func TestAutoRoutingConfigValidation(t *testing.T) {
+	cfg := autoConfig()
+	cfg.Routing.Auto.Default = ""
+	_, err := routing.New(routing.WithConfig(cfg), routing.WithWorkerSource(staticWorkers(nil)))
+	require.Error(t, err)
+
+	cfg = autoConfig()
+	cfg.Routing.Auto.Rules[0].Content = "poetry"
+	_, err = routing.New(routing.WithConfig(cfg), routing.WithWorkerSource(staticWorkers(nil)))
+	require.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/batch"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+func newTestBatcher(t *testing.T, maxSize int, linger time.Duration) *batch.Batcher {
+	cfg := &config.Config{}
+	cfg.Batching.Enabled = true
+	cfg.Batching.MaxBatchSize = maxSize
+	cfg.Batching.MaxLinger = linger
+	b, err := batch.New(batch.WithConfig(cfg))
+	require.NoError(t, err)
+	return b
+}
+
+// recordingEmbedder embeds each input as its parsed number, recording the
+// size of every call
+type recordingEmbedder struct {
+	mu    sync.Mutex
+	calls []int
+}
+
+func (e *recordingEmbedder) embed(ctx context.Context, inputs []string) (*batch.Result, error) {
+	e.mu.Lock()
+	e.calls = append(e.calls, len(inputs))
+	e.mu.Unlock()
+
+	out := make([][]float64, len(inputs))
+	for i, input := range inputs {
+		n, err := strconv.Atoi(input)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = []float64{float64(n)}
+	}
+	return &batch.Result{Embeddings: out, Model: "nomic-embed-text", QueueWait: time.Millisecond}, nil
+}
+
+func (e *recordingEmbedder) sizes() []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]int(nil), e.calls...)
+}
+
+func TestBatcherMergesConcurrentRequests(t *testing.T) {
+	b := newTestBatcher(t, 4, 50*time.Millisecond)
+	e := &recordingEmbedder{}
+
+	var wg sync.WaitGroup
+	results := make([]*batch.Result, 6)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inputs := []string{strconv.Itoa(i * 10), strconv.Itoa(i*10 + 1)}
+			res, err := b.Embed(context.Background(), "nomic-embed-text", inputs, e.embed)
+			require.NoError(t, err)
+			results[i] = res
+		}(i)
+	}
+	wg.Wait()
+
+	// Six requests of two inputs fill three batches of four
+	assert.ElementsMatch(t, []int{4, 4, 4}, e.sizes())
+	for i, res := range results {
+		require.NotNil(t, res)
+		assert.Equal(t, [][]float64{{float64(i * 10)}, {float64(i*10 + 1)}}, res.Embeddings)
+		assert.Equal(t, "nomic-embed-text", res.Model)
+		assert.Equal(t, time.Millisecond, res.QueueWait)
+	}
+}
+
+func TestBatcherSendsAfterLinger(t *testing.T) {
+	b := newTestBatcher(t, 8, 20*time.Millisecond)
+	e := &recordingEmbedder{}
+
+	start := time.Now()
+	res, err := b.Embed(context.Background(), "nomic-embed-text", []string{"7"}, e.embed)
+	require.NoError(t, err)
+	assert.Equal(t, [][]float64{{7}}, res.Embeddings)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// Large requests are not held back
+	inputs := make([]string, 8)
+	for i := range inputs {
+		inputs[i] = strconv.Itoa(i)
+	}
+	start = time.Now()
+	res, err = b.Embed(context.Background(), "nomic-embed-text", inputs, e.embed)
+	require.NoError(t, err)
+	assert.Len(t, res.Embeddings, 8)
+	assert.Less(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, []int{1, 8}, e.sizes())
+}
+
+func TestBatcherKeepsKeysApart(t *testing.T) {
+	b := newTestBatcher(t, 4, 20*time.Millisecond)
+	e := &recordingEmbedder{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := b.Embed(context.Background(), fmt.Sprintf("model-%d", i), []string{"1"}, e.embed)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, []int{1, 1}, e.sizes())
+}
+
+func TestBatcherFailuresReachEveryCaller(t *testing.T) {
+	b := newTestBatcher(t, 2, time.Second)
+	e := &recordingEmbedder{}
+
+	errs := make(chan error, 2)
+	for _, input := range []string{"1", "not a number"} {
+		go func(input string) {
+			_, err := b.Embed(context.Background(), "nomic-embed-text", []string{input}, e.embed)
+			errs <- err
+		}(input)
+	}
+	assert.Error(t, <-errs)
+	assert.Error(t, <-errs)
+}
+
+func TestBatcherCancelsOnceEveryCallerLeaves(t *testing.T) {
+	b := newTestBatcher(t, 2, 10*time.Millisecond)
+
+	var cancelled atomic.Bool
+	blocking := func(ctx context.Context, inputs []string) (*batch.Result, error) {
+		<-ctx.Done()
+		cancelled.Store(true)
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err := b.Embed(ctx, "nomic-embed-text", []string{"1"}, blocking)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Eventually(t, cancelled.Load, time.Second, time.Millisecond)
+
+	// A caller leaving does not fail the rest of its batch
+	e := &recordingEmbedder{}
+	leaving, leave := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Embed(leaving, "nomic-embed-text", []string{"1"}, e.embed)
+		done <- err
+	}()
+	time.Sleep(2 * time.Millisecond)
+	leave()
+	res, err := b.Embed(context.Background(), "nomic-embed-text", []string{"2"}, e.embed)
+	require.NoError(t, err)
+	assert.Equal(t, [][]float64{{2}}, res.Embeddings)
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,176 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/server"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+)
+
+type staticWorkers []worker.Worker
+
+func (s staticWorkers) GetActiveWorkers(ctx context.Context) ([]worker.Worker, error) {
+	return s, nil
+}
+
+func breakerConfig() *config.Config {
+	cfg := &config.Config{}
+	cb := &cfg.Routing.CircuitBreaker
+	cb.Enabled = true
+	cb.Window = time.Minute
+	cb.MinRequests = 5
+	cb.ErrorRateThreshold = 0.5
+	cb.LatencyOutlierFactor = 3
+	cb.BaseEjectionTime = 50 * time.Millisecond
+	cb.MaxEjectionTime = time.Second
+	cb.MaxEjectionPercent = 50
+	cb.HalfOpenRequests = 1
+	return cfg
+}
+
+// failWorker routes requests, failing every one that lands on the given worker,
+// until that worker has failed n times
+func failWorker(t *testing.T, r *routing.Router, req *routing.Request, id string, n int) {
+	for failures := 0; failures < n; {
+		w, err := r.RouteRequest(context.Background(), req)
+		require.NoError(t, err)
+		if w.ID == id {
+			r.ReportResult(req, w.ID, 10*time.Millisecond, errors.New("connection refused"))
+			failures++
+			continue
+		}
+		r.ReportResult(req, w.ID, 10*time.Millisecond, nil)
+	}
+}
+
+func newTestRouter(t *testing.T, cfg *config.Config, workers ...worker.Worker) *routing.Router {
+	r, err := routing.New(routing.WithConfig(cfg), routing.WithWorkerSource(staticWorkers(workers)))
+	require.NoError(t, err)
+	return r
+}
+
+func TestCircuitBreakerEjectsFailingWorker(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(),
+		worker.Worker{ID: "w1", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+		worker.Worker{ID: "w2", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+	)
+	req := &routing.Request{Model: "llama3.1:8b"}
+
+	failWorker(t, r, req, "w1", 5)
+	assert.Equal(t, "open", r.BreakerStates()["w1"].State)
+
+	for i := 0; i < 10; i++ {
+		w, err := r.RouteRequest(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "w2", w.ID)
+		r.ReportResult(req, w.ID, 10*time.Millisecond, nil)
+	}
+}
+
+func TestCircuitBreakerHalfOpenRecovery(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(),
+		worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady},
+		worker.Worker{ID: "w2", Models: []string{"mistral"}, Status: worker.StatusReady, Load: 0.9},
+	)
+	req := &routing.Request{Model: "mistral"}
+
+	failWorker(t, r, req, "w1", 5)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, "half-open", r.BreakerStates()["w1"].State)
+
+	w, err := r.RouteRequest(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "w1", w.ID)
+	r.ReportResult(req, w.ID, 10*time.Millisecond, nil)
+
+	assert.Equal(t, "closed", r.BreakerStates()["w1"].State)
+}
+
+func TestCircuitBreakerIgnoresCancelledRequests(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(),
+		worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady},
+		worker.Worker{ID: "w2", Models: []string{"mistral"}, Status: worker.StatusReady},
+	)
+	req := &routing.Request{Model: "mistral"}
+	_, err := r.RouteRequest(context.Background(), req)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		r.ReportResult(req, "w1", time.Millisecond, context.Canceled)
+	}
+	assert.Equal(t, "closed", r.BreakerStates()["w1"].State)
+}
+
+// stalledWorker answers no chat request before it is cancelled
+type stalledWorker struct {
+	server.WorkerClient
+}
+
+func (stalledWorker) Chat(ctx context.Context, w server.Worker, requestID string, req ollama.ChatRequest) (*ollama.ChatResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCircuitBreakerIgnoresClientDeadlines(t *testing.T) {
+	serve := func(workerTimeout time.Duration) (*routing.Router, func(header string) int) {
+		cfg := breakerConfig()
+		cfg.Worker.RequestTimeout = workerTimeout
+		r := newTestRouter(t, cfg,
+			worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady},
+			worker.Worker{ID: "w2", Models: []string{"mistral"}, Status: worker.StatusReady},
+		)
+		srv, err := server.New(
+			server.WithConfig(cfg),
+			server.WithLogger(logging.NewLogger("error")),
+			server.WithRoutingEngine(r),
+			server.WithWorkerClient(stalledWorker{}),
+		)
+		require.NoError(t, err)
+		return r, func(timeout string) int {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+				`{"model":"mistral","messages":[{"role":"user","content":"hi"}]}`))
+			if timeout != "" {
+				req.Header.Set(server.HeaderTimeout, timeout)
+			}
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			return rec.Code
+		}
+	}
+	open := func(r *routing.Router) int {
+		n := 0
+		for _, b := range r.BreakerStates() {
+			if b.State == "open" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// A client's own short deadline says nothing of the workers
+	r, chat := serve(time.Minute)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, http.StatusGatewayTimeout, chat("1"))
+	}
+	assert.Zero(t, open(r))
+
+	// The gateway's worker timeout does
+	r, chat = serve(time.Millisecond)
+	for i := 0; i < 20; i++ {
+		chat("")
+	}
+	assert.Equal(t, 1, open(r))
+}
@@ -0,0 +1,98 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+func constraintsConfig() *config.Config {
+	cfg := breakerConfig()
+	cfg.Routing.Constraints.ClientLabels = []string{"region", "tier"}
+	cfg.Routing.Constraints.Tenants = []config.TenantConstraints{
+		{Tenant: "clinical", Require: map[string]string{"compliance": "hipaa"}},
+	}
+	return cfg
+}
+
+func constrainedWorkers() []worker.Worker {
+	return []worker.Worker{
+		{ID: "us-a100", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady,
+			Metadata: map[string]string{"region": "us", "tier": "a100"}},
+		{ID: "eu-l4", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady,
+			Metadata: map[string]string{"region": "eu", "tier": "l4"}},
+		{ID: "hipaa", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady, Load: 0.9,
+			Metadata: map[string]string{"region": "us", "tier": "l4", "compliance": "hipaa"}},
+	}
+}
+
+func TestConstraintsRequireMatchingWorkers(t *testing.T) {
+	r := newTestRouter(t, constraintsConfig(), constrainedWorkers()...)
+
+	c, err := r.Constraints("", map[string]string{"region": "eu"}, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		w, err := r.RouteRequest(context.Background(), &routing.Request{Model: "llama3.1:8b", Constraints: c})
+		require.NoError(t, err)
+		assert.Equal(t, "eu-l4", w.ID)
+	}
+
+	c, err = r.Constraints("", map[string]string{"region": "apac"}, nil)
+	require.NoError(t, err)
+	_, err = r.RouteRequest(context.Background(), &routing.Request{Model: "llama3.1:8b", Constraints: c})
+	assert.Error(t, err, "hard requirements never fall back to non-matching workers")
+}
+
+func TestConstraintsPreferMatchingWorkers(t *testing.T) {
+	r := newTestRouter(t, constraintsConfig(), constrainedWorkers()...)
+
+	c, err := r.Constraints("", nil, map[string]string{"tier": "a100"})
+	require.NoError(t, err)
+
+	w, err := r.RouteRequest(context.Background(), &routing.Request{Model: "llama3.1:8b", Constraints: c})
+	require.NoError(t, err)
+	assert.Equal(t, "us-a100", w.ID)
+
+	c, err = r.Constraints("", map[string]string{"region": "eu"}, map[string]string{"tier": "a100"})
+	require.NoError(t, err)
+	w, err = r.RouteRequest(context.Background(), &routing.Request{Model: "llama3.1:8b", Constraints: c})
+	require.NoError(t, err)
+	assert.Equal(t, "eu-l4", w.ID, "unmet preferences do not exclude workers")
+}
+
+func TestConstraintsTenantPolicy(t *testing.T) {
+	r := newTestRouter(t, constraintsConfig(), constrainedWorkers()...)
+
+	c, err := r.Constraints("clinical", nil, nil)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		w, err := r.RouteRequest(context.Background(), &routing.Request{Model: "llama3.1:8b", Constraints: c})
+		require.NoError(t, err)
+		assert.Equal(t, "hipaa", w.ID)
+	}
+
+	_, err = r.Constraints("", map[string]string{"compliance": "none"}, nil)
+	assert.Error(t, err, "clients cannot set labels outside their scope")
+
+	c, err = r.Constraints("clinical", map[string]string{"region": "eu"}, nil)
+	require.NoError(t, err)
+	_, err = r.RouteRequest(context.Background(), &routing.Request{Model: "llama3.1:8b", Constraints: c})
+	assert.Error(t, err, "client labels narrow the tenant policy rather than replacing it")
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := routing.ParseLabels(" region=eu, tier=a100 ")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"region": "eu", "tier": "a100"}, labels)
+	assert.Equal(t, "region=eu,tier=a100", routing.FormatLabels(labels))
+
+	_, err = routing.ParseLabels("region")
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+)
+
+func explainWorkers() []worker.Worker {
+	return []worker.Worker{
+		{ID: "idle", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady, Load: 0.1},
+		{ID: "busy", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady, Load: 0.7},
+		{ID: "draining", Models: []string{"llama3.1:8b"}, Status: worker.StatusDraining},
+		{ID: "other", Models: []string{"mistral"}, Status: worker.StatusReady},
+	}
+}
+
+func TestExplainListsEveryWorker(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(), explainWorkers()...)
+
+	exp, err := r.Explain(context.Background(), &routing.Request{Model: "llama3.1:8b"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "llama3.1:8b", exp.Model)
+	assert.Equal(t, "idle", exp.Pick)
+	assert.Equal(t, []string{"idle"}, exp.PickPool)
+
+	byID := make(map[string]routing.WorkerExplanation)
+	for _, w := range exp.Workers {
+		byID[w.ID] = w
+	}
+	require.Len(t, byID, 4)
+
+	assert.Empty(t, byID["idle"].Rejected)
+	require.NotNil(t, byID["idle"].Score)
+	assert.InDelta(t, 0.9, byID["idle"].Score.Total, 1e-9)
+	assert.Equal(t, "closed", byID["idle"].Breaker.State)
+	assert.Empty(t, byID["busy"].Rejected)
+	assert.Equal(t, routing.RejectStatus, byID["draining"].Rejected)
+	assert.Equal(t, routing.RejectModel, byID["other"].Rejected)
+	assert.Nil(t, byID["other"].Score)
+}
+
+func TestExplainFollowsFallbacks(t *testing.T) {
+	r := newTestRouter(t, fallbackConfig(), explainWorkers()...)
+
+	exp, err := r.Explain(context.Background(), &routing.Request{Model: "llama3.1:70b"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"llama3.1:70b", "llama3.1:8b"}, exp.Models)
+	assert.Equal(t, "llama3.1:8b", exp.Model)
+	assert.Equal(t, "idle", exp.Pick)
+
+	exp, err = r.Explain(context.Background(), &routing.Request{Model: "llama3.1:70b", NoFallback: true})
+	require.NoError(t, err)
+	assert.Empty(t, exp.Pick)
+}
+
+func TestRouteTrace(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(), explainWorkers()...)
+
+	req := &routing.Request{Model: "llama3.1:8b", Trace: &routing.Trace{}}
+	w, err := r.RouteRequest(context.Background(), req)
+	require.NoError(t, err)
+
+	assert.Equal(t, w.ID, req.Trace.Worker)
+	assert.Equal(t, 2, req.Trace.Candidates)
+	assert.Equal(t, 4, req.Trace.Workers)
+	assert.Equal(t,
+		"models=llama3.1:8b; candidates=2/4; rejected=model:1,status:1; worker=idle; score=0.900; cold=false; tokens=0",
+		req.Trace.String())
+}
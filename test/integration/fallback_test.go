@@ -0,0 +1,47 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+func fallbackConfig() *config.Config {
+	cfg := breakerConfig()
+	cfg.Routing.Fallbacks = []config.FallbackChain{
+		{Model: "llama3.1:70b", Chain: []string{"llama3.1:8b", "mistral"}},
+	}
+	return cfg
+}
+
+func TestFallbackChainIsTriedInOrder(t *testing.T) {
+	r := newTestRouter(t, fallbackConfig(),
+		worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady},
+		worker.Worker{ID: "w2", Models: []string{"llama3.1:70b"}, Status: worker.StatusOffline},
+	)
+
+	req := &routing.Request{LogicalModel: "llama3.1:70b", Variant: "llama3.1:70b", Model: "llama3.1:70b"}
+	w, err := r.RouteRequest(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "w1", w.ID)
+	assert.Equal(t, "mistral", req.Model)
+	assert.Equal(t, "llama3.1:70b", req.Variant)
+}
+
+func TestFallbackOptOut(t *testing.T) {
+	r := newTestRouter(t, fallbackConfig(),
+		worker.Worker{ID: "w1", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+	)
+
+	req := &routing.Request{Model: "llama3.1:70b", NoFallback: true}
+	_, err := r.RouteRequest(context.Background(), req)
+	assert.Equal(t, errors.ErrNoWorkersAvailable, err)
+	assert.Equal(t, "llama3.1:70b", req.Model)
+}
@@ -0,0 +1,114 @@
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+func hedgingConfig() *config.Config {
+	cfg := breakerConfig()
+	h := &cfg.Routing.Hedging
+	h.Enabled = true
+	h.Percentile = 0.9
+	h.MinDelay = 5 * time.Millisecond
+	h.MaxDelay = time.Second
+	h.MinSamples = 10
+	h.MaxTokens = 128
+	h.Routes = []string{routing.RouteEmbeddings}
+	h.Policies = []config.HedgePolicy{
+		{Model: "llama3.1:8b", Routes: []string{routing.RouteCompletions}},
+		{Model: "bge-large", Disabled: true},
+	}
+	return cfg
+}
+
+func TestHedgeDelayFollowsObservedLatency(t *testing.T) {
+	r := newTestRouter(t, hedgingConfig(),
+		worker.Worker{ID: "w1", Models: []string{"nomic-embed-text"}, Status: worker.StatusReady},
+	)
+	req := &routing.Request{Model: "nomic-embed-text", Route: routing.RouteEmbeddings}
+
+	delay, ok := r.HedgeDelay(req)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, delay, "without enough samples the maximum delay is used")
+
+	for i := 1; i <= 100; i++ {
+		r.ReportResult(req, "w1", time.Duration(i)*time.Millisecond, nil)
+	}
+	delay, ok = r.HedgeDelay(req)
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Millisecond, delay)
+}
+
+func TestHedgePolicies(t *testing.T) {
+	r := newTestRouter(t, hedgingConfig())
+
+	_, ok := r.HedgeDelay(&routing.Request{Model: "llama3.1:8b", Route: routing.RouteCompletions, MaxTokens: 64})
+	assert.True(t, ok, "short completions are hedged for models with a policy")
+
+	_, ok = r.HedgeDelay(&routing.Request{Model: "llama3.1:8b", Route: routing.RouteCompletions, MaxTokens: 1024})
+	assert.False(t, ok, "long completions are never hedged")
+
+	_, ok = r.HedgeDelay(&routing.Request{Model: "llama3.1:8b", Route: routing.RouteEmbeddings})
+	assert.False(t, ok, "policy routes replace the default routes")
+
+	_, ok = r.HedgeDelay(&routing.Request{Model: "bge-large", Route: routing.RouteEmbeddings})
+	assert.False(t, ok, "disabled policies turn hedging off")
+
+	_, ok = r.HedgeDelay(&routing.Request{Model: "mistral", Route: routing.RouteChat, MaxTokens: 64})
+	assert.False(t, ok, "routes outside the defaults are not hedged")
+}
+
+func TestHedgeExcludesPrimaryWorker(t *testing.T) {
+	r := newTestRouter(t, hedgingConfig(),
+		worker.Worker{ID: "w1", Models: []string{"nomic-embed-text"}, Status: worker.StatusReady},
+		worker.Worker{ID: "w2", Models: []string{"nomic-embed-text"}, Status: worker.StatusReady, Load: 0.8},
+	)
+
+	w, err := r.RouteRequest(context.Background(), &routing.Request{
+		Model:   "nomic-embed-text",
+		Route:   routing.RouteEmbeddings,
+		Exclude: []string{"w1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "w2", w.ID)
+}
+
+func TestHedgePercentileMustBeAFraction(t *testing.T) {
+	for _, percentile := range []float64{0, -0.5, 1.5, 95} {
+		cfg := hedgingConfig()
+		cfg.Routing.Hedging.Percentile = percentile
+		_, err := routing.New(routing.WithConfig(cfg), routing.WithWorkerSource(staticWorkers(nil)))
+		assert.Error(t, err, percentile)
+
+		cfg = hedgingConfig()
+		cfg.Routing.Hedging.Policies[0].Percentile = percentile
+		_, err = routing.New(routing.WithConfig(cfg), routing.WithWorkerSource(staticWorkers(nil)))
+		if percentile == 0 {
+			assert.NoError(t, err, "policies without a percentile use the global one")
+		} else {
+			assert.Error(t, err, percentile)
+		}
+	}
+
+	cfg := hedgingConfig()
+	cfg.Routing.Hedging.Percentile = 1
+	r := newTestRouter(t, cfg,
+		worker.Worker{ID: "w1", Models: []string{"nomic-embed-text"}, Status: worker.StatusReady},
+	)
+	req := &routing.Request{Model: "nomic-embed-text", Route: routing.RouteEmbeddings}
+	for i := 1; i <= 20; i++ {
+		r.ReportResult(req, "w1", time.Duration(i)*10*time.Millisecond, nil)
+	}
+	delay, ok := r.HedgeDelay(req)
+	require.True(t, ok)
+	assert.Equal(t, 200*time.Millisecond, delay, "the 100th percentile is the slowest request")
+}
@@ -0,0 +1,276 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+func jobsConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Jobs.Enabled = true
+	cfg.Jobs.MaxRunning = 4
+	cfg.Jobs.Timeout = 10 * time.Second
+	cfg.Jobs.Retention = time.Minute
+	cfg.Jobs.Lease = 90 * time.Millisecond
+	cfg.Jobs.Webhook.Secret = "test-secret"
+	cfg.Jobs.Webhook.Timeout = time.Second
+	cfg.Jobs.Webhook.MaxAttempts = 3
+	return cfg
+}
+
+func newTestJobs(t *testing.T, cfg *config.Config, handler http.Handler, opts ...jobs.Option) *jobs.Manager {
+	opts = append([]jobs.Option{jobs.WithConfig(cfg), jobs.WithHandler(handler)}, opts...)
+	m, err := jobs.New(opts...)
+	require.NoError(t, err)
+	m.Start()
+	t.Cleanup(func() { _ = m.Stop(context.Background()) })
+	return m
+}
+
+// completionHandler stands in for the gateway, answering every request with
+// a completion naming the tenant header it was sent with
+func completionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"object":"chat.completion","tenant":%q}`, r.Header.Get("X-MindGateway-Tenant"))
+	})
+}
+
+// waitForJob waits until a job has finished
+func waitForJob(t *testing.T, m *jobs.Manager, id string) *jobs.Job {
+	var job *jobs.Job
+	require.Eventually(t, func() bool {
+		var err error
+		job, err = m.Get(context.Background(), id)
+		require.NoError(t, err)
+		return job.Status.Finished()
+	}, 5*time.Second, 5*time.Millisecond)
+	return job
+}
+
+func TestJobCompletesAndCallsSignedWebhook(t *testing.T) {
+	cfg := jobsConfig()
+
+	delivered := make(chan *jobs.Job, 1)
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, jobs.Verify(cfg.Jobs.Webhook.Secret, r.Header, body, time.Minute))
+
+		// The first delivery fails, and is retried
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var job jobs.Job
+		require.NoError(t, json.Unmarshal(body, &job))
+		delivered <- &job
+	}))
+	defer receiver.Close()
+
+	// The receiver listens on loopback, which webhooks only reach when it is
+	// allowed explicitly
+	u, err := url.Parse(receiver.URL)
+	require.NoError(t, err)
+	cfg.Jobs.Webhook.AllowedHosts = []string{u.Hostname()}
+
+	m := newTestJobs(t, cfg, completionHandler())
+	job := &jobs.Job{
+		Endpoint: "/v1/chat/completions",
+		Request:  json.RawMessage(`{"model":"mistral","messages":[{"role":"user","content":"hi"}]}`),
+		Header:   map[string]string{"X-MindGateway-Tenant": "research"},
+		Webhook:  &jobs.Webhook{URL: receiver.URL},
+	}
+	require.NoError(t, m.Submit(context.Background(), job))
+	assert.NotEmpty(t, job.ID)
+	assert.Equal(t, jobs.StatusQueued, job.Status)
+
+	select {
+	case got := <-delivered:
+		assert.Equal(t, job.ID, got.ID)
+		assert.Equal(t, jobs.StatusCompleted, got.Status)
+		assert.JSONEq(t, `{"object":"chat.completion","tenant":"research"}`, string(got.Result))
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	require.Eventually(t, func() bool {
+		got, err := m.Get(context.Background(), job.ID)
+		require.NoError(t, err)
+		return got.Webhook.DeliveredAt != nil
+	}, time.Second, 5*time.Millisecond)
+	got, err := m.Get(context.Background(), job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.Webhook.Attempts)
+	assert.Equal(t, 1, got.Attempts)
+	assert.NotNil(t, got.CompletedAt)
+}
+
+func TestWebhooksRefuseInternalAddresses(t *testing.T) {
+	cfg := jobsConfig()
+	cfg.Jobs.Webhook.MaxAttempts = 1
+	m := newTestJobs(t, cfg, completionHandler())
+	ctx := context.Background()
+	body := json.RawMessage(`{"model":"mistral","prompt":"hi"}`)
+
+	for _, hook := range []string{
+		"http://127.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.8/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://100.100.100.200/latest/meta-data/",
+	} {
+		assert.Error(t, m.Submit(ctx, &jobs.Job{Endpoint: "/v1/completions", Request: body, Webhook: &jobs.Webhook{URL: hook}}), hook)
+	}
+
+	// Names are checked by the addresses they resolve to
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+	u, err := url.Parse(receiver.URL)
+	require.NoError(t, err)
+
+	job := &jobs.Job{Endpoint: "/v1/completions", Request: body, Webhook: &jobs.Webhook{URL: "http://localhost:" + u.Port() + "/hook"}}
+	require.NoError(t, m.Submit(ctx, job))
+	require.Eventually(t, func() bool {
+		got, err := m.Get(ctx, job.ID)
+		require.NoError(t, err)
+		return got.Webhook.Attempts == 1 && got.Webhook.LastError != ""
+	}, 5*time.Second, 5*time.Millisecond)
+	got, err := m.Get(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Contains(t, got.Webhook.LastError, "not allowed")
+	assert.Nil(t, got.Webhook.DeliveredAt)
+	assert.Zero(t, calls.Load())
+}
+
+func TestWebhookSignatureRejectsTampering(t *testing.T) {
+	body := []byte(`{"id":"job-1"}`)
+	now := time.Now().Unix()
+	header := http.Header{}
+	header.Set(jobs.HeaderTimestamp, fmt.Sprint(now))
+	header.Set(jobs.HeaderSignature, jobs.Sign("secret", now, body))
+
+	assert.NoError(t, jobs.Verify("secret", header, body, time.Minute))
+	assert.Error(t, jobs.Verify("other", header, body, time.Minute))
+	assert.Error(t, jobs.Verify("secret", header, []byte(`{"id":"job-2"}`), time.Minute))
+
+	old := now - 600
+	header.Set(jobs.HeaderTimestamp, fmt.Sprint(old))
+	header.Set(jobs.HeaderSignature, jobs.Sign("secret", old, body))
+	assert.Error(t, jobs.Verify("secret", header, body, time.Minute), "stale webhooks are rejected")
+}
+
+func TestJobBacksOffWhileQueueRejects(t *testing.T) {
+	var calls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"Request queue is full","type":"requests","code":"rate_limit_exceeded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"object":"list"}`)
+	})
+	m := newTestJobs(t, jobsConfig(), handler)
+
+	job := &jobs.Job{Endpoint: "/v1/embeddings", Request: json.RawMessage(`{"model":"nomic","input":["a"]}`)}
+	require.NoError(t, m.Submit(context.Background(), job))
+
+	got := waitForJob(t, m, job.ID)
+	assert.Equal(t, jobs.StatusCompleted, got.Status)
+	assert.Equal(t, 3, got.Attempts)
+	assert.Nil(t, got.Queue)
+}
+
+func TestJobRecordsFailures(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, `{"error":"Worker request failed"}`)
+	})
+	m := newTestJobs(t, jobsConfig(), handler)
+
+	job := &jobs.Job{Endpoint: "/v1/completions", Request: json.RawMessage(`{"model":"mistral","prompt":"hi"}`)}
+	require.NoError(t, m.Submit(context.Background(), job))
+
+	got := waitForJob(t, m, job.ID)
+	assert.Equal(t, jobs.StatusFailed, got.Status)
+	require.NotNil(t, got.Error)
+	assert.Equal(t, http.StatusBadGateway, got.Error.Code)
+	assert.Equal(t, "Worker request failed", got.Error.Message)
+}
+
+func TestJobSubmissionIsValidated(t *testing.T) {
+	cfg := jobsConfig()
+	cfg.Jobs.Webhook.AllowedHosts = []string{"hooks.example.com"}
+	m := newTestJobs(t, cfg, completionHandler())
+	ctx := context.Background()
+
+	body := json.RawMessage(`{"model":"mistral","prompt":"hi"}`)
+	assert.Error(t, m.Submit(ctx, &jobs.Job{Endpoint: "/admin/queue", Request: body}))
+	assert.Error(t, m.Submit(ctx, &jobs.Job{Endpoint: "/v1/completions", Request: json.RawMessage(`{"model":"mistral","prompt":"hi","stream":true}`)}))
+	assert.Error(t, m.Submit(ctx, &jobs.Job{Endpoint: "/v1/completions", Request: json.RawMessage(`"text"`)}))
+	assert.Error(t, m.Submit(ctx, &jobs.Job{Endpoint: "/v1/completions", Request: body, Webhook: &jobs.Webhook{URL: "https://elsewhere.example.com/hook"}}))
+	assert.Error(t, m.Submit(ctx, &jobs.Job{Endpoint: "/v1/completions", Request: body, Webhook: &jobs.Webhook{URL: "/relative"}}))
+	assert.NoError(t, m.Submit(ctx, &jobs.Job{Endpoint: "/v1/completions", Request: body, Webhook: &jobs.Webhook{URL: "https://hooks.example.com/hook"}}))
+
+	_, err := m.Get(ctx, "job-missing")
+	assert.ErrorIs(t, err, jobs.ErrNotFound)
+}
+
+func TestRedisJobResumedAfterReplicaLeaves(t *testing.T) {
+	ctx := context.Background()
+	cfg := jobsConfig()
+	cfg.Jobs.KeyPrefix = fmt.Sprintf("{test:%s:%d}", url.PathEscape(t.Name()), time.Now().UnixNano())
+	store, err := jobs.NewRedisStore(newRedisClient(t), cfg)
+	require.NoError(t, err)
+
+	// A replica took the job on and went away without finishing it
+	now := time.Now()
+	job := &jobs.Job{
+		ID:        "job-orphan",
+		Object:    "job",
+		Endpoint:  "/v1/chat/completions",
+		Status:    jobs.StatusQueued,
+		Request:   json.RawMessage(`{"model":"mistral","messages":[]}`),
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Minute),
+	}
+	require.NoError(t, store.Create(ctx, job))
+	claimed, err := store.Claim(ctx, job.ID, "gone", now.Add(cfg.Jobs.Lease))
+	require.NoError(t, err)
+	require.NotNil(t, claimed)
+	claimed.Status = jobs.StatusInProgress
+	require.NoError(t, store.Save(ctx, claimed, "gone"))
+
+	again, err := store.Claim(ctx, job.ID, "other", now.Add(cfg.Jobs.Lease))
+	require.NoError(t, err)
+	assert.Nil(t, again, "a held job cannot be claimed")
+	assert.ErrorIs(t, store.Save(ctx, claimed, "other"), jobs.ErrLeaseLost)
+
+	// Another replica takes the job over once the lease lapses
+	m := newTestJobs(t, cfg, completionHandler(), jobs.WithStore(store))
+	got := waitForJob(t, m, job.ID)
+	assert.Equal(t, jobs.StatusCompleted, got.Status)
+
+	ok, err := store.Renew(ctx, job.ID, "gone", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, ok, "the departed replica no longer holds the job")
+	assert.ErrorIs(t, store.Save(ctx, claimed, "gone"), jobs.ErrLeaseLost, "an unfinished job cannot overwrite a finished one")
+}
@@ -0,0 +1,189 @@
+package integration
+
+import (
+	"context"
+	stderrors "errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+func laneConfig() *config.Config {
+	cfg := queueConfig()
+	cfg.Worker.MaxConcurrency = 4
+	lanes := &cfg.Routing.Lanes
+	lanes.Enabled = true
+	lanes.Default = "standard"
+	lanes.MaxPreemptions = 2
+	lanes.Lanes = []config.Lane{
+		{Name: "interactive", Share: 0.5, Priority: 8},
+		{Name: "standard", Share: 0.25, Priority: 5},
+		{Name: "batch", Priority: 1, Preemptible: true},
+	}
+	lanes.Rules = []config.LaneRule{
+		{APIKey: "0123456789abcdef", Lane: "batch"},
+		{Route: routing.RouteJobs, Lane: "batch"},
+		{Route: routing.RouteChat, Lane: "interactive"},
+	}
+	return cfg
+}
+
+// laneRequest returns a request in a lane, preemptible when the lane is
+func laneRequest(id, lane string) *routing.Request {
+	req := &routing.Request{ID: id, Model: "llama3.1:8b", Lane: lane}
+	if lane == "batch" {
+		req.Preempt = make(chan struct{})
+	}
+	return req
+}
+
+func TestLaneAssignment(t *testing.T) {
+	r := newTestRouter(t, laneConfig())
+
+	lane, ok := r.Lane(routing.RouteChat, "")
+	require.True(t, ok)
+	assert.Equal(t, "interactive", lane.Name)
+	assert.Equal(t, 8, lane.Priority)
+
+	lane, _ = r.Lane(routing.RouteChat, "0123456789abcdef")
+	assert.Equal(t, "batch", lane.Name, "an API key rule listed first wins")
+	lane, _ = r.Lane(routing.RouteJobs, "")
+	assert.Equal(t, "batch", lane.Name)
+	lane, _ = r.Lane(routing.RouteEmbeddings, "")
+	assert.Equal(t, "standard", lane.Name)
+
+	_, ok = newTestRouter(t, queueConfig()).Lane(routing.RouteChat, "")
+	assert.False(t, ok, "lanes are disabled by default")
+
+	cfg := laneConfig()
+	cfg.Routing.Lanes.Lanes[2].Share = 0.5
+	_, err := routing.New(routing.WithConfig(cfg), routing.WithWorkerSource(staticWorkers(nil)))
+	assert.Error(t, err, "shares may not add up to more than 1")
+
+	cfg = laneConfig()
+	cfg.Routing.Lanes.Rules = append(cfg.Routing.Lanes.Rules, config.LaneRule{Route: "chat", Lane: "bulk"})
+	_, err = routing.New(routing.WithConfig(cfg), routing.WithWorkerSource(staticWorkers(nil)))
+	assert.Error(t, err, "rules must name a defined lane")
+}
+
+func TestLanesReserveCapacity(t *testing.T) {
+	r := newTestRouter(t, laneConfig(),
+		worker.Worker{ID: "w1", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+	)
+	ctx := context.Background()
+
+	// Standard traffic keeps out of the two slots reserved for interactive
+	for i := 0; i < 2; i++ {
+		_, err := r.RouteRequest(ctx, laneRequest("std", "standard"))
+		require.NoError(t, err)
+	}
+	req := laneRequest("std", "standard")
+	req.Trace = &routing.Trace{}
+	_, err := r.RouteRequest(ctx, req)
+	assert.True(t, stderrors.Is(err, errors.ErrWorkersAtCapacity))
+	assert.Equal(t, 1, req.Trace.Rejected[routing.RejectReserved])
+
+	for i := 0; i < 2; i++ {
+		_, err := r.RouteRequest(ctx, laneRequest("chat", "interactive"))
+		require.NoError(t, err, "interactive traffic uses its reservation")
+	}
+	_, err = r.RouteRequest(ctx, laneRequest("chat", "interactive"))
+	assert.True(t, stderrors.Is(err, errors.ErrWorkersAtCapacity))
+}
+
+func TestPreemptibleLaneBorrowsIdleReservations(t *testing.T) {
+	r := newTestRouter(t, laneConfig(),
+		worker.Worker{ID: "w1", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+	)
+	ctx := context.Background()
+
+	std := laneRequest("std-a", "standard")
+	_, err := r.RouteRequest(ctx, std)
+	require.NoError(t, err)
+	batch := make([]*routing.Request, 3)
+	for i := range batch {
+		batch[i] = laneRequest("batch-"+string(rune('a'+i)), "batch")
+		_, err := r.RouteRequest(ctx, batch[i])
+		require.NoError(t, err, "batch work borrows reserved slots")
+		time.Sleep(time.Millisecond)
+	}
+
+	// A second standard request could not use a freed slot, which is
+	// reserved for interactive traffic, so nothing is preempted for it
+	assert.False(t, r.Preempt(ctx, laneRequest("std-b", "standard")))
+
+	chat := laneRequest("chat", "interactive")
+	_, err = r.RouteRequest(ctx, chat)
+	require.True(t, stderrors.Is(err, errors.ErrWorkersAtCapacity))
+
+	// The batch request that started last makes room
+	require.True(t, r.Preempt(ctx, chat))
+	select {
+	case <-batch[2].Preempt:
+	default:
+		t.Fatal("the latest batch request was not preempted")
+	}
+	assert.True(t, r.Preempt(ctx, chat), "capacity is already on its way")
+	for _, req := range batch[:2] {
+		select {
+		case <-req.Preempt:
+			t.Fatal("more requests than needed were preempted")
+		default:
+		}
+	}
+
+	r.ReportResult(batch[2], "w1", 0, context.Canceled)
+	_, err = r.RouteRequest(ctx, chat)
+	assert.NoError(t, err)
+}
+
+func TestQueuedInteractiveRequestPreemptsBatchWork(t *testing.T) {
+	cfg := laneConfig()
+	r := newTestRouter(t, cfg,
+		worker.Worker{ID: "w1", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+	)
+	m := newTestQueue(t, cfg, r)
+	ctx := context.Background()
+
+	// Batch work fills the worker, each request giving its slot back when
+	// it is preempted, as the server does before requeueing it
+	for i := 0; i < 4; i++ {
+		req := laneRequest("batch-"+string(rune('a'+i)), "batch")
+		req.Priority = 1
+		_, err := m.Submit(ctx, req)
+		require.NoError(t, err)
+		go func() {
+			<-req.Preempt
+			r.ReportResult(req, "w1", 0, context.Canceled)
+			m.Notify()
+		}()
+	}
+
+	chat := laneRequest("chat", "interactive")
+	chat.Priority = 8
+	w, err := m.Submit(ctx, chat)
+	require.NoError(t, err)
+	assert.Equal(t, "w1", w.ID)
+
+	// A requeued batch request waits behind the interactive one
+	requeued := laneRequest("batch-a", "batch")
+	requeued.Priority = 1
+	done := submit(m, ctx, requeued)
+	waitForDepth(t, m, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("requeued batch request was served while the worker is full: %v", err)
+	default:
+	}
+
+	r.ReportResult(chat, "w1", 0, nil)
+	m.Notify()
+	assert.NoError(t, <-done)
+}
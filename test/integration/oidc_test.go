@@ -0,0 +1,365 @@
+package integration
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/auth"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+// mockIssuer is an OpenID Connect provider serving discovery and JWKS
+// documents for keys it signs tokens with
+type mockIssuer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	keys map[string]crypto.Signer
+	// stall holds JWKS requests until it is closed, when it is set
+	stall chan struct{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	m := &mockIssuer{keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   m.URL,
+			"jwks_uri": m.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		m.fetches.Add(1)
+		m.mu.Lock()
+		stall := m.stall
+		m.mu.Unlock()
+		if stall != nil {
+			<-stall
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": m.jwks()})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// addRSAKey adds an RSA signing key
+func (m *mockIssuer) addRSAKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[kid] = key
+}
+
+// addECKey adds a P-256 signing key
+func (m *mockIssuer) addECKey(t *testing.T, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[kid] = key
+}
+
+// removeKey stops publishing a key
+func (m *mockIssuer) removeKey(kid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, kid)
+}
+
+func (m *mockIssuer) jwks() []map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	enc := base64.RawURLEncoding
+	var keys []map[string]string
+	for kid, key := range m.keys {
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": enc.EncodeToString(k.N.Bytes()),
+				"e": enc.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		case *ecdsa.PrivateKey:
+			keys = append(keys, map[string]string{
+				"kty": "EC", "kid": kid, "use": "sig", "crv": "P-256",
+				"x": enc.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+				"y": enc.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	return keys
+}
+
+// sign returns a token carrying claims signed with a key
+func (m *mockIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	m.mu.Lock()
+	key := m.keys[kid]
+	m.mu.Unlock()
+	require.NotNil(t, key)
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// claims returns the claims of a valid token for the test client
+func (m *mockIssuer) claims(overrides map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":    m.URL,
+		"aud":    "mindgateway-api",
+		"sub":    "pairwise-subject",
+		"oid":    "00000000-0000-0000-0000-00000000a11c",
+		"email":  "alice@example.com",
+		"groups": []string{"gpu-admins", "unmapped"},
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    now.Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		claims[k] = v
+	}
+	return claims
+}
+
+func oidcConfig(issuer string) *config.Config {
+	cfg := authConfig()
+	cfg.Auth.OIDC.ClockSkew = time.Minute
+	cfg.Auth.OIDC.JWKSRefresh = time.Hour
+	cfg.Auth.OIDC.MaxTokenTTL = 2 * time.Hour
+	cfg.Auth.OIDC.Issuers = []config.OIDCIssuer{{
+		Issuer:       issuer,
+		Audiences:    []string{"api://mindgateway", "mindgateway-api"},
+		UserClaim:    "oid",
+		DefaultRoles: []string{auth.RoleUser},
+		GroupRoles: []config.GroupRole{
+			{Group: "gpu-admins", Roles: []string{auth.RoleAdmin}},
+		},
+	}}
+	return cfg
+}
+
+func TestOIDCTokenValidation(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	issuer.addECKey(t, "ec-1")
+	client, _ := newAuthClient(t, oidcConfig(issuer.URL))
+	ctx := context.Background()
+
+	validate := func(token string) *authpb.ValidateTokenResponse {
+		resp, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: token})
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := validate(issuer.sign(t, "rsa-1", issuer.claims(nil)))
+	require.True(t, resp.Valid, resp.Error)
+	assert.Equal(t, "00000000-0000-0000-0000-00000000a11c", resp.UserId)
+	assert.Equal(t, []string{auth.RoleUser, auth.RoleAdmin}, resp.Roles)
+	assert.Equal(t, "alice@example.com", resp.Claims["email"])
+
+	roles, err := client.GetUserRoles(ctx, &authpb.GetUserRolesRequest{UserId: resp.UserId})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{auth.RoleUser, auth.RoleAdmin}, roles.Roles)
+
+	resp = validate(issuer.sign(t, "ec-1", issuer.claims(map[string]interface{}{
+		"aud":    []string{"other-app", "api://mindgateway"},
+		"groups": nil,
+	})))
+	require.True(t, resp.Valid, resp.Error)
+	assert.Equal(t, []string{auth.RoleUser}, resp.Roles)
+
+	// Tokens within the clock skew are accepted
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{
+		"exp": time.Now().Add(-30 * time.Second).Unix(),
+		"nbf": time.Now().Add(30 * time.Second).Unix(),
+	})))
+	assert.True(t, resp.Valid, resp.Error)
+
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{
+		"exp": time.Now().Add(-2 * time.Minute).Unix(),
+	})))
+	assert.False(t, resp.Valid)
+	assert.Equal(t, auth.ErrTokenExpired.Error(), resp.Error)
+
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{
+		"nbf": time.Now().Add(5 * time.Minute).Unix(),
+	})))
+	assert.False(t, resp.Valid, "tokens not valid yet are rejected")
+
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"aud": "another-app"})))
+	assert.False(t, resp.Valid, "tokens for other audiences are rejected")
+
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"oid": nil})))
+	assert.False(t, resp.Valid, "tokens without the user claim are rejected")
+
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"iat": nil})))
+	assert.False(t, resp.Valid, "tokens without an issue time are rejected")
+
+	// Providers' tokens may outlive the service's own, up to their limit
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{
+		"exp": time.Now().Add(90 * time.Minute).Unix(),
+	})))
+	assert.True(t, resp.Valid, resp.Error)
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{
+		"exp": time.Now().Add(3 * time.Hour).Unix(),
+	})))
+	assert.False(t, resp.Valid, "tokens living longer than the maximum OIDC token TTL are rejected")
+
+	// Tokens of an issuer that is not configured are not trusted
+	resp = validate(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"iss": "https://evil.example.com"})))
+	assert.False(t, resp.Valid)
+
+	token := issuer.sign(t, "rsa-1", issuer.claims(nil))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(issuer.claims(map[string]interface{}{"groups": []string{"gpu-admins", "more"}}))
+	resp = validate(parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2])
+	assert.False(t, resp.Valid, "claims must match the signature")
+
+	assert.Equal(t, int32(1), issuer.fetches.Load(), "signing keys are cached")
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "2024-01")
+	cfg := oidcConfig(issuer.URL)
+	cfg.Auth.OIDC.JWKSRefresh = 200 * time.Millisecond
+	client, _ := newAuthClient(t, cfg)
+	ctx := context.Background()
+
+	valid := func(token string) bool {
+		resp, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: token})
+		require.NoError(t, err)
+		return resp.Valid
+	}
+
+	old := issuer.sign(t, "2024-01", issuer.claims(nil))
+	require.True(t, valid(old))
+
+	// The provider rotates to a new key and retires the old one
+	issuer.addRSAKey(t, "2024-02")
+	issuer.removeKey("2024-01")
+	rotated := issuer.sign(t, "2024-02", issuer.claims(nil))
+	assert.Eventually(t, func() bool { return valid(rotated) }, 2*time.Second, 20*time.Millisecond)
+	assert.False(t, valid(old), "tokens of a retired key are rejected")
+
+	// Unknown keys do not make every request fetch the keys again
+	fetches := issuer.fetches.Load()
+	unknown := issuer.sign(t, "2024-02", issuer.claims(nil))
+	unknown = strings.Replace(unknown, strings.Split(unknown, ".")[0],
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"missing"}`)), 1)
+	for i := 0; i < 5; i++ {
+		assert.False(t, valid(unknown))
+	}
+	assert.LessOrEqual(t, issuer.fetches.Load()-fetches, int32(1))
+}
+
+func TestOIDCServesCachedKeysWhileFetching(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	cfg := oidcConfig(issuer.URL)
+	cfg.Auth.OIDC.JWKSRefresh = 50 * time.Millisecond
+	client, _ := newAuthClient(t, cfg)
+	ctx := context.Background()
+
+	valid := func(token string) bool {
+		resp, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: token})
+		require.NoError(t, err)
+		return resp.Valid
+	}
+	token := issuer.sign(t, "rsa-1", issuer.claims(nil))
+	require.True(t, valid(token))
+
+	// The keys are stale and their provider is slow to answer
+	stall := make(chan struct{})
+	var release sync.Once
+	t.Cleanup(func() { release.Do(func() { close(stall) }) })
+	issuer.mu.Lock()
+	issuer.stall = stall
+	issuer.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	fetches := issuer.fetches.Load()
+
+	refreshed := make(chan bool, 1)
+	go func() {
+		resp, err := client.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: token})
+		refreshed <- err == nil && resp.Valid
+	}()
+	require.Eventually(t, func() bool { return issuer.fetches.Load() > fetches }, time.Second, time.Millisecond)
+
+	// Other tokens of the cached key are validated meanwhile
+	meanwhile, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		resp, err := client.ValidateToken(meanwhile, &authpb.ValidateTokenRequest{Token: issuer.sign(t, "rsa-1", issuer.claims(nil))})
+		require.NoError(t, err)
+		assert.True(t, resp.Valid)
+	}
+	assert.Equal(t, fetches+1, issuer.fetches.Load(), "one fetch runs at a time")
+
+	release.Do(func() { close(stall) })
+	select {
+	case ok := <-refreshed:
+		assert.True(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fetch did not finish")
+	}
+}
+
+func TestOIDCIssuerUnavailable(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	token := issuer.sign(t, "rsa-1", issuer.claims(nil))
+	client, _ := newAuthClient(t, oidcConfig(issuer.URL))
+	issuer.Close()
+
+	_, err := client.ValidateToken(context.Background(), &authpb.ValidateTokenRequest{Token: token})
+	assert.Error(t, err, "an unreachable provider is an error rather than an invalid token")
+
+	cfg := oidcConfig(issuer.URL)
+	cfg.Auth.OIDC.Issuers[0].Audiences = nil
+	_, err = auth.NewService(auth.WithConfig(cfg))
+	assert.Error(t, err, "issuers require an audience")
+}
@@ -0,0 +1,251 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/auth"
+	gatewayauth "github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/gateway/server"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+// logBuffer collects log output written from many goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries returns the logged entries with a message
+func (b *logBuffer) entries(message string) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []map[string]interface{}
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["message"] == message {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+func TestValidationReturnsPrincipal(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	cfg := oidcConfig(issuer.URL)
+	cfg.Auth.OIDC.Issuers[0].TenantClaim = "tid"
+	conn, _ := serveAuth(t, cfg, auth.WithDatabase(newTestDB(t)))
+	client := authpb.NewAuthServiceClient(conn)
+	gateway := gatewayauth.NewClient(conn)
+	ctx := context.Background()
+
+	created, err := client.CreateToken(ctx, &authpb.CreateTokenRequest{
+		UserId: "alice",
+		Roles:  []string{auth.RoleUser},
+		Claims: map[string]string{auth.TenantClaim: "research"},
+	})
+	require.NoError(t, err)
+	p, err := gateway.ValidateToken(ctx, created.Token)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.NotEmpty(t, p.TokenID)
+	assert.Equal(t, time.Unix(created.ExpiresAt, 0), p.ExpiresAt)
+	assert.False(t, p.IssuedAt.IsZero())
+	assert.Equal(t, &gatewayauth.Principal{
+		UserID: "alice", Tenant: "research", Roles: []string{auth.RoleUser},
+		TokenID: p.TokenID, IssuedAt: p.IssuedAt, ExpiresAt: p.ExpiresAt,
+	}, p)
+
+	key, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{
+		OwnerId: "bob", Name: "ci", Tenant: "platform",
+		Scopes: []string{"models:invoke"}, Roles: []string{auth.RoleUser},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "platform", key.ApiKey.Tenant)
+	p, err = gateway.ValidateToken(ctx, key.Key)
+	require.NoError(t, err)
+	assert.Equal(t, &gatewayauth.Principal{
+		UserID: "bob", Tenant: "platform", Roles: []string{auth.RoleUser},
+		Scopes: []string{"models:invoke"}, KeyID: key.ApiKey.Id,
+	}, p)
+
+	p, err = gateway.ValidateToken(ctx, issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"tid": "contoso"})))
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Equal(t, "contoso", p.Tenant)
+	assert.Equal(t, []string{"gpu-admins", "unmapped"}, p.Groups)
+
+	p, err = gateway.ValidateToken(ctx, "forged")
+	require.NoError(t, err)
+	assert.Nil(t, p, "invalid tokens identify no one")
+}
+
+func TestGatewayCarriesPrincipal(t *testing.T) {
+	cfg := constraintsConfig()
+	cfg.Auth = authConfig().Auth
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+
+	logs := &logBuffer{}
+	logger := logging.NewLogger("info")
+	logger.SetOutput(logs)
+
+	var srv *server.Server
+	manager := newTestJobs(t, jobsConfig(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.ServeHTTP(w, r)
+	}))
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logger),
+		server.WithAuthClient(gatewayauth.NewClient(conn)),
+		server.WithRoutingEngine(newTestRouter(t, cfg, constrainedWorkers()...)),
+		server.WithJobManager(manager),
+	)
+	require.NoError(t, err)
+
+	token := func(user, role, tenant string) string {
+		resp, err := client.CreateToken(context.Background(), &authpb.CreateTokenRequest{
+			UserId: user, Roles: []string{role}, Claims: map[string]string{auth.TenantClaim: tenant},
+		})
+		require.NoError(t, err)
+		return resp.Token
+	}
+	do := func(method, path, token, tenant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if tenant != "" {
+			req.Header.Set("X-MindGateway-Tenant", tenant)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The caller's tenant sets their routing constraints, and the tenant
+	// header is ignored
+	explain := func(token, tenant string) map[string]string {
+		rec := do(http.MethodPost, "/admin/route/explain", token, tenant,
+			`{"model":"llama3.1:8b","messages":[{"role":"user","content":"hi"}]}`)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var out struct {
+			Request struct {
+				Constraints struct {
+					Require map[string]string `json:"require"`
+				} `json:"constraints"`
+			} `json:"request"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out.Request.Constraints.Require
+	}
+	hipaa := map[string]string{"compliance": "hipaa"}
+	assert.Equal(t, hipaa, explain(token("carol", auth.RoleAdmin, "clinical"), ""))
+	assert.Empty(t, explain(token("dave", auth.RoleAdmin, "research"), "clinical"))
+	assert.Empty(t, explain(token("erin", auth.RoleAdmin, ""), "clinical"))
+
+	// Jobs are served as the caller who submitted them, and only shown to
+	// them and to admins. No worker serves the job's model, so it fails once
+	// it is routed.
+	alice := token("alice", auth.RoleUser, "research")
+	rec := do(http.MethodPost, "/v1/jobs", alice, "",
+		`{"endpoint":"/v1/chat/completions","request":{"model":"mistral:7b","messages":[{"role":"user","content":"hi"}]}}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var job jobs.Job
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.Equal(t, "alice", job.UserID)
+	assert.NotContains(t, rec.Body.String(), "principal", "the caller's credentials are not shown")
+
+	assert.Eventually(t, func() bool {
+		job, err := manager.Get(context.Background(), job.ID)
+		return err == nil && job.Status.Finished()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/v1/jobs/"+job.ID, alice, "", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/v1/jobs/"+job.ID, token("root", auth.RoleAdmin, ""), "", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/v1/jobs/"+job.ID, token("bob", auth.RoleUser, "research"), "", "").Code)
+
+	// Requests are audited with their caller, including those of jobs
+	var served bool
+	for _, entry := range logs.entries("Request audited") {
+		if entry["job_id"] == job.ID {
+			served = true
+			assert.Equal(t, "alice", entry["user_id"])
+			assert.Equal(t, "research", entry["tenant"])
+		}
+	}
+	assert.True(t, served, "the job's request is audited")
+}
+
+func TestTenantMetricsAreBounded(t *testing.T) {
+	cfg := constraintsConfig()
+	cfg.Auth = authConfig().Auth
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+
+	authed, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithAuthClient(gatewayauth.NewClient(conn)),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+	)
+	require.NoError(t, err)
+	open, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+	)
+	require.NoError(t, err)
+
+	chat := func(srv *server.Server, token, tenant string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+			`{"model":"llama3.1:8b","messages":[{"role":"user","content":"hi"}]}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set("X-MindGateway-Tenant", tenant)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	}
+	token := func(tenant string) string {
+		resp, err := client.CreateToken(context.Background(), &authpb.CreateTokenRequest{
+			UserId: "alice", Roles: []string{auth.RoleUser}, Claims: map[string]string{auth.TenantClaim: tenant},
+		})
+		require.NoError(t, err)
+		return resp.Token
+	}
+
+	// Only configured tenants are labelled by name, and the tenant header
+	// labels nothing
+	unlisted := testOwner(t)
+	chat(authed, token("clinical"), unlisted+"-header")
+	chat(authed, token(unlisted), unlisted+"-header")
+	chat(open, "", unlisted+"-open")
+
+	rec := httptest.NewRecorder()
+	open.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	metrics := rec.Body.String()
+	assert.Contains(t, metrics, `tenant="clinical"`)
+	assert.Contains(t, metrics, `tenant="other"`)
+	assert.NotContains(t, metrics, unlisted)
+}
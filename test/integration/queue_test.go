@@ -0,0 +1,505 @@
+package integration
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/queue"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/server"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+)
+
+func queueConfig() *config.Config {
+	cfg := fallbackConfig()
+	cfg.Worker.MaxConcurrency = 1
+	cfg.Queue.MaxSize = 10
+	cfg.Queue.Levels = 10
+	cfg.Queue.DefaultPriority = 5
+	cfg.Queue.ProcessingPeriod = 10 * time.Millisecond
+	cfg.Queue.MaxWait = 5 * time.Second
+	return cfg
+}
+
+func newTestQueue(t *testing.T, cfg *config.Config, r *routing.Router) *queue.Manager {
+	m, err := queue.New(queue.WithConfig(cfg), queue.WithRouter(r))
+	require.NoError(t, err)
+	m.Start()
+	t.Cleanup(func() { _ = m.Stop(context.Background()) })
+	return m
+}
+
+// submit queues a request in the background and returns the channel its
+// outcome is delivered on
+func submit(m *queue.Manager, ctx context.Context, req *routing.Request) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Submit(ctx, req)
+		done <- err
+	}()
+	return done
+}
+
+// waitForDepth waits until the queue holds n requests
+func waitForDepth(t *testing.T, m *queue.Manager, n int) {
+	require.Eventually(t, func() bool { return m.Stats().Depth == n }, time.Second, time.Millisecond)
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	q := queue.NewPriorityQueue(3, 0)
+
+	low := &queue.Job{ID: "low", Priority: 0}
+	first := &queue.Job{ID: "first", Priority: 2}
+	second := &queue.Job{ID: "second", Priority: 7}
+	removed := &queue.Job{ID: "removed", Priority: 1}
+	for _, j := range []*queue.Job{low, first, second, removed} {
+		require.NoError(t, q.Enqueue(j))
+	}
+	assert.Equal(t, 2, second.Priority, "priorities are clamped to the top level")
+	assert.True(t, q.Remove(removed))
+	assert.False(t, q.Remove(removed))
+
+	assert.Equal(t, 3, q.Len())
+	assert.Equal(t, 2, q.Waiting(2))
+	assert.Equal(t, "first", q.Dequeue().ID)
+	assert.Equal(t, "second", q.Dequeue().ID)
+	assert.Equal(t, "low", q.Dequeue().ID)
+	assert.Nil(t, q.Dequeue())
+
+	full := queue.NewPriorityQueue(1, 1)
+	require.NoError(t, full.Enqueue(&queue.Job{}))
+	assert.ErrorIs(t, full.Enqueue(&queue.Job{}), queue.ErrQueueFull)
+}
+
+func TestQueueDispatchesByPriority(t *testing.T) {
+	cfg := queueConfig()
+	r := newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})
+	m := newTestQueue(t, cfg, r)
+	ctx := context.Background()
+
+	busy := &routing.Request{ID: "busy", Model: "mistral", Priority: 5}
+	w, err := m.Submit(ctx, busy)
+	require.NoError(t, err)
+
+	low := &routing.Request{ID: "low", Model: "mistral", Priority: 1}
+	lowDone := submit(m, ctx, low)
+	waitForDepth(t, m, 1)
+	high := &routing.Request{ID: "high", Model: "mistral", Priority: 9}
+	highDone := submit(m, ctx, high)
+	waitForDepth(t, m, 2)
+
+	r.ReportResult(busy, w.ID, time.Millisecond, nil)
+	m.Notify()
+	select {
+	case err := <-highDone:
+		require.NoError(t, err)
+	case <-lowDone:
+		t.Fatal("low priority request was dispatched first")
+	case <-time.After(time.Second):
+		t.Fatal("high priority request was not dispatched")
+	}
+
+	r.ReportResult(high, w.ID, time.Millisecond, nil)
+	m.Notify()
+	require.NoError(t, <-lowDone)
+	assert.Equal(t, 0, m.Stats().Depth)
+}
+
+// priorityRecorder records the priority of the requests submitted to it,
+// turning them all away
+type priorityRecorder struct {
+	priorities []int
+}
+
+func (r *priorityRecorder) Submit(ctx context.Context, req *routing.Request) (server.Worker, error) {
+	r.priorities = append(r.priorities, req.Priority)
+	return server.Worker{}, errors.ErrServiceUnavailable
+}
+
+func (r *priorityRecorder) Notify() {}
+
+func (r *priorityRecorder) Stats() queue.Stats { return queue.Stats{} }
+
+func TestPriorityHeaderOnlyLowersPriority(t *testing.T) {
+	cfg := queueConfig()
+	recorder := &priorityRecorder{}
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+		server.WithQueueManager(recorder),
+	)
+	require.NoError(t, err)
+
+	for _, priority := range []string{"9", "5", "2", "0"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+			`{"model":"llama3.1:8b","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set(server.HeaderPriority, priority)
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, []int{5, 5, 2, 0}, recorder.priorities, "clients may not raise the default priority")
+}
+
+func TestTimeoutHeaderIsNotAWorkerFailure(t *testing.T) {
+	cfg := queueConfig()
+	cfg.Worker.RequestTimeout = time.Minute
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithRoutingEngine(newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})),
+		server.WithWorkerClient(stalledWorker{}),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+		`{"model":"mistral","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set(server.HeaderTimeout, "20")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	assert.Equal(t, errors.ErrTimeout.Code, rec.Code)
+	assert.Contains(t, rec.Body.String(), errors.ErrTimeout.Message)
+	assert.NotContains(t, rec.Body.String(), errors.ErrWorkerTimeout.Message)
+}
+
+func TestQueueHonoursDeadlines(t *testing.T) {
+	cfg := queueConfig()
+	r := newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})
+	m := newTestQueue(t, cfg, r)
+
+	_, err := m.Submit(context.Background(), &routing.Request{Model: "mistral"})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = m.Submit(ctx, &routing.Request{Model: "mistral"})
+	assert.ErrorIs(t, err, queue.ErrExpired)
+	assert.Equal(t, 0, m.Stats().Depth)
+}
+
+func TestQueueFallsBackBeforeDeadline(t *testing.T) {
+	cfg := queueConfig()
+	cfg.Queue.MaxWait = 300 * time.Millisecond
+	cfg.Queue.FallbackMargin = 200 * time.Millisecond
+	r := newTestRouter(t, cfg,
+		worker.Worker{ID: "big", Models: []string{"llama3.1:70b"}, Status: worker.StatusReady},
+		worker.Worker{ID: "small", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+	)
+	m := newTestQueue(t, cfg, r)
+	ctx := context.Background()
+
+	_, err := m.Submit(ctx, &routing.Request{Model: "llama3.1:70b"})
+	require.NoError(t, err)
+
+	req := &routing.Request{Model: "llama3.1:70b"}
+	start := time.Now()
+	w, err := m.Submit(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "small", w.ID)
+	assert.Equal(t, "llama3.1:8b", req.Model)
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond, "the request waits for capacity before falling back")
+
+	_, err = m.Submit(ctx, &routing.Request{Model: "llama3.1:70b", NoFallback: true})
+	assert.ErrorIs(t, err, queue.ErrExpired)
+}
+
+func TestRouterReportsCapacity(t *testing.T) {
+	cfg := queueConfig()
+	r := newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})
+
+	req := &routing.Request{Model: "mistral"}
+	_, err := r.RouteRequest(context.Background(), req)
+	require.NoError(t, err)
+
+	_, err = r.RouteRequest(context.Background(), &routing.Request{Model: "mistral"})
+	assert.ErrorIs(t, err, errors.ErrWorkersAtCapacity)
+	_, err = r.RouteRequest(context.Background(), &routing.Request{Model: "phi3"})
+	assert.ErrorIs(t, err, errors.ErrNoWorkersAvailable)
+
+	r.ReportResult(req, "w1", time.Millisecond, nil)
+	_, err = r.RouteRequest(context.Background(), &routing.Request{Model: "mistral"})
+	assert.NoError(t, err)
+}
+
+// tenants returns the tenants of the jobs in order
+func tenants(jobs []*queue.Job) []string {
+	out := make([]string, len(jobs))
+	for i, j := range jobs {
+		out[i] = j.Tenant
+	}
+	return out
+}
+
+func TestFairQueueSharesLevelsByWeight(t *testing.T) {
+	q := queue.NewFairQueue(1, 0)
+	for i := 0; i < 8; i++ {
+		require.NoError(t, q.Enqueue(&queue.Job{Tenant: "batch", Weight: 1}))
+	}
+	for i := 0; i < 8; i++ {
+		require.NoError(t, q.Enqueue(&queue.Job{Tenant: "interactive", Weight: 4}))
+	}
+
+	snapshot := tenants(q.Snapshot())
+	var served []*queue.Job
+	for i := 0; i < 10; i++ {
+		served = append(served, q.Dequeue())
+	}
+	assert.Equal(t, []string{
+		"interactive", "interactive", "interactive", "batch", "interactive",
+		"interactive", "interactive", "interactive", "batch", "interactive",
+	}, tenants(served))
+	assert.Equal(t, snapshot[:10], tenants(served), "snapshots list jobs in the order they are served")
+}
+
+func TestFairQueueDoesNotBankIdleShare(t *testing.T) {
+	q := queue.NewFairQueue(1, 0)
+	for i := 0; i < 8; i++ {
+		require.NoError(t, q.Enqueue(&queue.Job{Tenant: "batch", Weight: 1}))
+	}
+	for i := 0; i < 4; i++ {
+		require.Equal(t, "batch", q.Dequeue().Tenant)
+	}
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, q.Enqueue(&queue.Job{Tenant: "late", Weight: 1}))
+	}
+	var served []*queue.Job
+	for i := 0; i < 4; i++ {
+		served = append(served, q.Dequeue())
+	}
+	assert.Equal(t, []string{"late", "batch", "late", "batch"}, tenants(served))
+}
+
+func TestFairQueueRemoveDoesNotCharge(t *testing.T) {
+	q := queue.NewFairQueue(1, 0)
+	a1 := &queue.Job{Tenant: "a", Weight: 1}
+	a2 := &queue.Job{Tenant: "a", Weight: 1}
+	b1 := &queue.Job{Tenant: "b", Weight: 1}
+	for _, j := range []*queue.Job{a1, a2, b1} {
+		require.NoError(t, q.Enqueue(j))
+	}
+
+	assert.True(t, q.Remove(a1))
+	assert.Same(t, a2, q.Dequeue(), "a cancelled job does not use up its tenant's share")
+	assert.True(t, q.Take(b1))
+	assert.False(t, q.Take(b1))
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestQueueDispatchesTenantsFairly(t *testing.T) {
+	cfg := queueConfig()
+	cfg.Queue.Fairness.Enabled = true
+	cfg.Queue.Fairness.DefaultWeight = 1
+	r := newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})
+	m := newTestQueue(t, cfg, r)
+	ctx := context.Background()
+
+	busy := &routing.Request{Model: "mistral"}
+	_, err := m.Submit(ctx, busy)
+	require.NoError(t, err)
+
+	var reqs []*routing.Request
+	var done []<-chan error
+	for i, tenant := range []string{"batch", "batch", "batch", "interactive"} {
+		req := &routing.Request{ID: tenant + strconv.Itoa(i), Model: "mistral", Tenant: tenant}
+		reqs = append(reqs, req)
+		done = append(done, submit(m, ctx, req))
+		waitForDepth(t, m, i+1)
+	}
+
+	stats := m.Stats()
+	require.Len(t, stats.Tenants, 2)
+	assert.Equal(t, "batch", stats.Tenants[0].Tenant)
+	assert.Equal(t, 3, stats.Tenants[0].Depth)
+	assert.Equal(t, 1, stats.Tenants[1].Depth)
+
+	// Each release serves one queued request; the interactive tenant's
+	// request is second rather than behind the whole batch
+	var order []string
+	current := busy
+	for range reqs {
+		r.ReportResult(current, "w1", time.Millisecond, nil)
+		m.Notify()
+
+		cases := make([]reflect.SelectCase, 0, len(done)+1)
+		for _, ch := range done {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(time.Second))})
+		i, v, _ := reflect.Select(cases)
+		require.Less(t, i, len(done), "no queued request was dispatched")
+		require.Nil(t, v.Interface())
+
+		current = reqs[i]
+		order = append(order, current.Tenant)
+		done[i] = nil
+	}
+	assert.Equal(t, []string{"batch", "interactive", "batch", "batch"}, order)
+}
+
+func TestQueueReportsProgress(t *testing.T) {
+	cfg := queueConfig()
+	cfg.Queue.ProgressInterval = 20 * time.Millisecond
+	r := newTestRouter(t, cfg,
+		worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady},
+		worker.Worker{ID: "w2", Models: []string{"phi3"}, Status: worker.StatusReady},
+	)
+	m := newTestQueue(t, cfg, r)
+	ctx := context.Background()
+
+	busy := &routing.Request{ID: "busy", Model: "mistral"}
+	_, err := m.Submit(ctx, busy)
+	require.NoError(t, err)
+	_, err = m.Submit(ctx, &routing.Request{ID: "other", Model: "phi3"})
+	require.NoError(t, err)
+
+	first := &routing.Request{ID: "first", Model: "mistral"}
+	firstDone := submit(m, ctx, first)
+	waitForDepth(t, m, 1)
+	_ = submit(m, ctx, &routing.Request{ID: "unrelated", Model: "phi3"})
+	waitForDepth(t, m, 2)
+
+	reports := make(chan queue.Progress, 100)
+	second := &routing.Request{ID: "second", Model: "mistral"}
+	secondDone := submit(m, queue.WithProgress(ctx, func(p queue.Progress) { reports <- p }), second)
+
+	// Only requests for the same workers count towards the position, and no
+	// estimate is given before any request has been served
+	var p queue.Progress
+	select {
+	case p = <-reports:
+	case <-time.After(time.Second):
+		t.Fatal("no progress was reported")
+	}
+	assert.Equal(t, 2, p.Position)
+	assert.Zero(t, p.ETA)
+	assert.Greater(t, p.Waited, time.Duration(0))
+
+	progress, ok := m.Progress("second")
+	require.True(t, ok)
+	assert.Equal(t, 2, progress.Position)
+	_, ok = m.Progress("busy")
+	assert.False(t, ok, "requests that were not queued have no progress")
+
+	time.Sleep(100 * time.Millisecond)
+	r.ReportResult(busy, "w1", time.Millisecond, nil)
+	m.Notify()
+	require.NoError(t, <-firstDone)
+	assert.GreaterOrEqual(t, first.QueueWait, 100*time.Millisecond)
+
+	// One request left after roughly 100ms, so the next is expected then
+	require.Eventually(t, func() bool {
+		p, ok := m.Progress("second")
+		return ok && p.Position == 1 && p.ETA > 0
+	}, time.Second, time.Millisecond)
+	progress, _ = m.Progress("second")
+	assert.InDelta(t, 100*time.Millisecond, progress.ETA, float64(80*time.Millisecond))
+
+	r.ReportResult(first, "w1", time.Millisecond, nil)
+	m.Notify()
+	require.NoError(t, <-secondDone)
+	_, ok = m.Progress("second")
+	assert.False(t, ok)
+}
+
+func TestAdmissionRejectsByPriorityClass(t *testing.T) {
+	cfg := queueConfig()
+	cfg.Queue.MaxSize = 3
+	cfg.Queue.Admission.Enabled = true
+	cfg.Queue.Admission.DefaultRetryAfter = 1500 * time.Millisecond
+	cfg.Queue.Admission.MaxRetryAfter = time.Minute
+	cfg.Queue.Admission.Classes = []config.AdmissionClass{
+		{Name: "batch", MinPriority: 0, MaxDepth: 1},
+		{Name: "interactive", MinPriority: 8},
+	}
+	r := newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})
+	m := newTestQueue(t, cfg, r)
+	ctx := context.Background()
+
+	_, err := m.Submit(ctx, &routing.Request{Model: "mistral", Priority: 9})
+	require.NoError(t, err)
+	_ = submit(m, ctx, &routing.Request{Model: "mistral", Priority: 1})
+	waitForDepth(t, m, 1)
+
+	// Batch requests are turned away once one is queued, and are told to
+	// retry after the default rounded up to whole seconds
+	_, err = m.Submit(ctx, &routing.Request{Model: "mistral", Priority: 2})
+	var rejection *queue.Rejection
+	require.ErrorAs(t, err, &rejection)
+	assert.ErrorIs(t, err, queue.ErrQueueFull)
+	assert.Equal(t, http.StatusTooManyRequests, errors.From(err).Code)
+	assert.Equal(t, 2*time.Second, rejection.RetryAfter)
+
+	// Interactive requests may use the rest of the queue
+	_ = submit(m, ctx, &routing.Request{Model: "mistral", Priority: 9})
+	_ = submit(m, ctx, &routing.Request{Model: "mistral", Priority: 9})
+	waitForDepth(t, m, 3)
+	_, err = m.Submit(ctx, &routing.Request{Model: "mistral", Priority: 9})
+	require.ErrorAs(t, err, &rejection)
+	assert.ErrorIs(t, err, queue.ErrQueueFull)
+}
+
+func TestAdmissionRejectsRequestsThatWouldMissTheirDeadline(t *testing.T) {
+	cfg := queueConfig()
+	cfg.Queue.Admission.Enabled = true
+	cfg.Queue.Admission.DefaultRetryAfter = time.Second
+	cfg.Queue.Admission.MaxRetryAfter = time.Minute
+	r := newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})
+	m := newTestQueue(t, cfg, r)
+	ctx := context.Background()
+
+	busy := &routing.Request{Model: "mistral"}
+	_, err := m.Submit(ctx, busy)
+	require.NoError(t, err)
+
+	// Without an observed service rate there is nothing to predict from
+	short, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	first := &routing.Request{Model: "mistral"}
+	firstDone := submit(m, short, first)
+	waitForDepth(t, m, 1)
+	second := &routing.Request{Model: "mistral"}
+	secondDone := submit(m, ctx, second)
+	waitForDepth(t, m, 2)
+
+	time.Sleep(200 * time.Millisecond)
+	r.ReportResult(busy, "w1", time.Millisecond, nil)
+	m.Notify()
+	require.NoError(t, <-firstDone)
+	waitForDepth(t, m, 1)
+	require.Eventually(t, func() bool {
+		p, ok := m.Progress(second.ID)
+		return ok && p.ETA > 0
+	}, time.Second, time.Millisecond)
+
+	// A request served every ~200ms cannot wait behind one other in 100ms
+	tight, cancelTight := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelTight()
+	_, err = m.Submit(tight, &routing.Request{Model: "mistral", NoFallback: true})
+	var rejection *queue.Rejection
+	require.ErrorAs(t, err, &rejection)
+	assert.ErrorIs(t, err, queue.ErrBacklogged)
+	assert.Equal(t, time.Second, rejection.RetryAfter)
+
+	third := &routing.Request{Model: "mistral"}
+	thirdDone := submit(m, ctx, third)
+	waitForDepth(t, m, 2)
+
+	r.ReportResult(first, "w1", time.Millisecond, nil)
+	m.Notify()
+	require.NoError(t, <-secondDone)
+	r.ReportResult(second, "w1", time.Millisecond, nil)
+	m.Notify()
+	require.NoError(t, <-thirdDone)
+}
@@ -0,0 +1,442 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/ncolesummers/mindgateway/internal/auth"
+	gatewayauth "github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/jobs"
+	"github.com/ncolesummers/mindgateway/internal/gateway/server"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	"github.com/ncolesummers/mindgateway/pkg/api/ollama"
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+const restrictedModel = "llama3.1:405b"
+
+// rbacConfig restricts a model to operators and a research group
+func rbacConfig(issuer string) *config.Config {
+	cfg := oidcConfig(issuer)
+	cfg.Auth.OIDC.Issuers[0].GroupRoles = nil
+	cfg.Auth.ModelAccess = []config.ModelAccess{
+		{Model: restrictedModel, Roles: []string{auth.RoleOperator}, Groups: []string{"gpu-research"}},
+	}
+	return cfg
+}
+
+// issueToken signs a token for a user with a role
+func issueToken(t *testing.T, client authpb.AuthServiceClient, user, role string) string {
+	resp, err := client.CreateToken(context.Background(), &authpb.CreateTokenRequest{UserId: user, Roles: []string{role}})
+	require.NoError(t, err)
+	return resp.Token
+}
+
+func TestRolePermissions(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	client, _ := newAuthClient(t, rbacConfig(issuer.URL))
+	ctx := context.Background()
+
+	tokens := map[string]string{}
+	for _, role := range []string{auth.RoleAdmin, auth.RoleOperator, auth.RoleUser, auth.RoleViewer} {
+		tokens[role] = issueToken(t, client, role+"-1", role)
+	}
+	tokens["member"] = issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"groups": []string{"gpu-research"}}))
+
+	check := func(token, resource, action string) bool {
+		resp, err := client.CheckPermission(ctx, &authpb.CheckPermissionRequest{Token: token, Resource: resource, Action: action})
+		require.NoError(t, err)
+		return resp.Allowed
+	}
+	cases := []struct {
+		resource, action string
+		allowed          []string
+	}{
+		{"admin", "read", []string{"admin", "operator"}},
+		{"admin", "write", []string{"admin", "operator"}},
+		{"keys", "revoke", []string{"admin"}},
+		{"queues", "read", []string{"admin", "operator", "viewer"}},
+		{"models", "read", []string{"admin", "operator", "user", "viewer", "member"}},
+		{"models/llama3.1:8b", "invoke", []string{"admin", "operator", "user", "member"}},
+		{"models/" + restrictedModel, "invoke", []string{"admin", "operator", "member"}},
+		{"jobs", "create", []string{"admin", "operator", "user", "member"}},
+	}
+	for _, tc := range cases {
+		for caller, token := range tokens {
+			want := false
+			for _, a := range tc.allowed {
+				want = want || a == caller
+			}
+			assert.Equal(t, want, check(token, tc.resource, tc.action), "%s %s:%s", caller, tc.resource, tc.action)
+		}
+	}
+
+	assert.False(t, check("forged", "models", "read"), "invalid tokens are allowed nothing")
+
+	// Users are checked by their latest roles and groups
+	resp, err := client.CheckPermission(ctx, &authpb.CheckPermissionRequest{
+		UserId: "00000000-0000-0000-0000-00000000a11c", Resource: "models/" + restrictedModel, Action: "invoke",
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.Allowed)
+
+	cfg := rbacConfig(issuer.URL)
+	cfg.Auth.ModelAccess[0].Groups = nil
+	cfg.Auth.ModelAccess[0].Roles = nil
+	_, err = auth.NewService(auth.WithConfig(cfg))
+	assert.Error(t, err, "model access rules need roles or groups")
+}
+
+func TestCheckingOtherCallersRequiresTheGateway(t *testing.T) {
+	cfg := authConfig()
+	cfg.Auth.ServiceToken = "test-service-token-of-at-least-32-bytes"
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	user := issueToken(t, client, "alice", auth.RoleUser)
+	admin := issueToken(t, client, "root", auth.RoleAdmin)
+
+	claimed := &authpb.CheckPermissionRequest{
+		UserId: "alice", Resource: "admin", Action: "write", Caller: &authpb.Caller{Roles: []string{auth.RoleAdmin}},
+	}
+	_, err := client.CheckPermission(as("forged"), claimed)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.CheckPermission(as(user), claimed)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "callers may not claim roles")
+	_, err = client.CheckPermission(as(user), &authpb.CheckPermissionRequest{UserId: "root", Resource: "admin", Action: "write"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "callers may not ask as other users")
+
+	// Callers presenting their own token need nothing more
+	resp, err := client.CheckPermission(as(user), &authpb.CheckPermissionRequest{Token: user, Resource: "models", Action: "invoke"})
+	require.NoError(t, err)
+	assert.True(t, resp.Allowed)
+
+	// The gateway and admins may
+	for _, token := range []string{cfg.Auth.ServiceToken, admin} {
+		resp, err := client.CheckPermission(as(token), claimed)
+		require.NoError(t, err)
+		assert.True(t, resp.Allowed)
+	}
+	allowed, err := gatewayauth.NewClient(conn, gatewayauth.WithServiceToken(cfg.Auth.ServiceToken)).CheckPrincipalPermission(
+		context.Background(), &gatewayauth.Principal{UserID: "alice", Roles: []string{auth.RoleUser}}, "models", "invoke")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	cfg.Auth.ServiceToken = "short"
+	_, err = auth.NewService(auth.WithConfig(cfg))
+	assert.Error(t, err)
+}
+
+func TestAdminRoutesAreClosedWithoutAuth(t *testing.T) {
+	cfg := fallbackConfig()
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+	)
+	require.NoError(t, err)
+
+	for _, route := range []struct{ method, path, body string }{
+		{http.MethodGet, "/admin/workers", ""},
+		{http.MethodGet, "/admin/queue", ""},
+		{http.MethodGet, "/admin/splits", ""},
+		{http.MethodPut, "/admin/splits", `{"model":"llama3.1:8b","variants":[{"model":"llama3.1:70b","weight":100}]}`},
+		{http.MethodPost, "/admin/route/explain", `{"model":"llama3.1:8b"}`},
+		{http.MethodPost, "/admin/revocations", `{"user_id":"root"}`},
+	} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(route.method, route.path, strings.NewReader(route.body)))
+		assert.Equal(t, http.StatusForbidden, rec.Code, "%s %s", route.method, route.path)
+	}
+}
+
+func TestRolesAreSharedBetweenReplicas(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	cfg := rbacConfig(issuer.URL)
+	db := newTestDB(t)
+	first, _ := newAuthClient(t, cfg, auth.WithDatabase(db))
+	second, _ := newAuthClient(t, cfg, auth.WithDatabase(db))
+	ctx := context.Background()
+
+	check := func(client authpb.AuthServiceClient, user, resource string) bool {
+		resp, err := client.CheckPermission(ctx, &authpb.CheckPermissionRequest{UserId: user, Resource: resource, Action: "invoke"})
+		require.NoError(t, err)
+		return resp.Allowed
+	}
+
+	// The roles an identity provider's token grants are known to every
+	// replica, and follow the latest token
+	alice := testOwner(t) + "-alice"
+	member := issuer.claims(map[string]interface{}{"oid": alice, "groups": []string{"gpu-research"}})
+	require.True(t, tokenValid(t, first, issuer.sign(t, "rsa-1", member)))
+	assert.True(t, check(second, alice, "models/"+restrictedModel))
+	member["groups"] = nil
+	require.True(t, tokenValid(t, second, issuer.sign(t, "rsa-1", member)))
+	assert.False(t, check(first, alice, "models/"+restrictedModel))
+
+	// So are the roles of the tokens the service issues
+	carol := testOwner(t) + "-carol"
+	_, err := first.CreateToken(ctx, &authpb.CreateTokenRequest{UserId: carol, Roles: []string{auth.RoleOperator}})
+	require.NoError(t, err)
+	roles, err := second.GetUserRoles(ctx, &authpb.GetUserRolesRequest{UserId: carol})
+	require.NoError(t, err)
+	assert.Equal(t, []string{auth.RoleOperator}, roles.Roles)
+	assert.True(t, check(second, carol, "models/"+restrictedModel))
+}
+
+func TestGatewayEnforcesPermissions(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	cfg := rbacConfig(issuer.URL)
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithAuthClient(gatewayauth.NewClient(conn)),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+		server.WithJobManager(newTestJobs(t, jobsConfig(), completionHandler())),
+	)
+	require.NoError(t, err)
+
+	admin := issueToken(t, client, "root", auth.RoleAdmin)
+	operator := issueToken(t, client, "ops", auth.RoleOperator)
+	user := issueToken(t, client, "alice", auth.RoleUser)
+	viewer := issueToken(t, client, "victor", auth.RoleViewer)
+	member := issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"groups": []string{"gpu-research"}}))
+
+	do := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Admin endpoints
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/splits", "", ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/splits", user, ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/splits", viewer, ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/splits", operator, ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/splits", admin, ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/admin/splits", viewer, "{}"))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/admin/splits", operator, "{}"))
+	assert.Equal(t, http.StatusNotImplemented, do(http.MethodGet, "/admin/queue", viewer, ""), "viewers may read the queue")
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/queue", user, ""))
+
+	// Models. Allowed requests get as far as routing, which has no workers.
+	chat := func(model, token string) int {
+		return do(http.MethodPost, "/v1/chat/completions", token,
+			`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, chat("llama3.1:8b", user))
+	assert.Equal(t, http.StatusForbidden, chat("llama3.1:8b", viewer), "viewers may not invoke models")
+	assert.Equal(t, http.StatusForbidden, chat(restrictedModel, user))
+	assert.Equal(t, http.StatusServiceUnavailable, chat(restrictedModel, member))
+	assert.Equal(t, http.StatusServiceUnavailable, chat(restrictedModel, operator))
+	assert.Equal(t, http.StatusServiceUnavailable, chat(restrictedModel, admin))
+
+	// Jobs are authorized for their model when they are submitted
+	job := func(model, token string) int {
+		return do(http.MethodPost, "/v1/jobs", token,
+			`{"endpoint":"/v1/chat/completions","request":{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}}`)
+	}
+	assert.Equal(t, http.StatusForbidden, job(restrictedModel, user))
+	assert.Equal(t, http.StatusForbidden, job("llama3.1:8b", viewer))
+	assert.Equal(t, http.StatusAccepted, job(restrictedModel, member))
+}
+
+func TestJobsAreAuthorizedAsTheirSubmitter(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.addRSAKey(t, "rsa-1")
+	cfg := rbacConfig(issuer.URL)
+	cfg.Routing.Auto.Enabled = true
+	cfg.Routing.Auto.Model = "auto"
+	cfg.Routing.Auto.Default = restrictedModel
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+
+	var srv *server.Server
+	manager := newTestJobs(t, jobsConfig(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.ServeHTTP(w, r)
+	}))
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithAuthClient(gatewayauth.NewClient(conn)),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+		server.WithJobManager(manager),
+	)
+	require.NoError(t, err)
+
+	// The auto model is open to users, but resolves to the restricted model,
+	// which the job's request is checked against as it is served
+	job := func(token string) *jobs.Job {
+		req := httptest.NewRequest(http.MethodPost, "/v1/jobs", strings.NewReader(
+			`{"endpoint":"/v1/chat/completions","request":{"model":"auto","messages":[{"role":"user","content":"hi"}]}}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+		var job jobs.Job
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return waitForJob(t, manager, job.ID)
+	}
+
+	denied := job(issueToken(t, client, "alice", auth.RoleUser))
+	assert.Equal(t, jobs.StatusFailed, denied.Status)
+	require.NotNil(t, denied.Error)
+	assert.Equal(t, http.StatusForbidden, denied.Error.Code)
+
+	// Members of the model's group get as far as routing, which has no
+	// workers
+	member := job(issuer.sign(t, "rsa-1", issuer.claims(map[string]interface{}{"groups": []string{"gpu-research"}})))
+	require.NotNil(t, member.Error)
+	assert.Equal(t, http.StatusServiceUnavailable, member.Error.Code)
+}
+
+func TestJobsFailWhenTheirSubmittersCredentialLapses(t *testing.T) {
+	issuer := newMockIssuer(t)
+	cfg := rbacConfig(issuer.URL)
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+
+	// Jobs are held until the test lets them run
+	var srv *server.Server
+	hold := make(chan struct{})
+	manager := newTestJobs(t, jobsConfig(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hold
+		srv.ServeHTTP(w, r)
+	}))
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithAuthClient(gatewayauth.NewClient(conn)),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+		server.WithJobManager(manager),
+	)
+	require.NoError(t, err)
+
+	submit := func(token string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/jobs", strings.NewReader(
+			`{"endpoint":"/v1/chat/completions","request":{"model":"llama3.1:8b","messages":[{"role":"user","content":"hi"}]}}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+		var job jobs.Job
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return job.ID
+	}
+
+	kept := submit(issueToken(t, client, "alice", auth.RoleUser))
+	revoked := issueToken(t, client, "bob", auth.RoleUser)
+	revokedJob := submit(revoked)
+	short, err := client.CreateToken(context.Background(), &authpb.CreateTokenRequest{
+		UserId: "carol", Roles: []string{auth.RoleUser}, ExpirationSeconds: 1,
+	})
+	require.NoError(t, err)
+	expiredJob := submit(short.Token)
+
+	resp, err := client.RevokeToken(context.Background(), &authpb.RevokeTokenRequest{Token: revoked})
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+	time.Sleep(time.Until(time.Unix(short.ExpiresAt, 0)))
+	close(hold)
+
+	// The job of a valid submitter gets as far as routing, which has no
+	// workers
+	job := waitForJob(t, manager, kept)
+	require.NotNil(t, job.Error)
+	assert.Equal(t, http.StatusServiceUnavailable, job.Error.Code)
+
+	for _, id := range []string{revokedJob, expiredJob} {
+		job := waitForJob(t, manager, id)
+		assert.Equal(t, jobs.StatusFailed, job.Status)
+		require.NotNil(t, job.Error)
+		assert.Equal(t, http.StatusUnauthorized, job.Error.Code)
+	}
+}
+
+// modelRecorder answers chat requests, recording the models they were served
+// by
+type modelRecorder struct {
+	server.WorkerClient
+	models []string
+}
+
+func (r *modelRecorder) Chat(ctx context.Context, w server.Worker, requestID string, req ollama.ChatRequest) (*ollama.ChatResponse, error) {
+	r.models = append(r.models, req.Model)
+	return &ollama.ChatResponse{Model: req.Model, Message: ollama.Message{Role: "assistant", Content: "hi"}, Done: true}, nil
+}
+
+func TestFallbacksAndVariantsAreAuthorized(t *testing.T) {
+	issuer := newMockIssuer(t)
+	cfg := rbacConfig(issuer.URL)
+	cfg.Routing.Fallbacks = []config.FallbackChain{
+		{Model: "llama3.1:70b", Chain: []string{restrictedModel}},
+	}
+	cfg.Routing.Splits = []config.SplitRule{
+		{Model: "llama3.1:8b", Variants: []config.SplitVariant{{Model: restrictedModel, Weight: 100}}},
+	}
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+
+	workers := &modelRecorder{}
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithAuthClient(gatewayauth.NewClient(conn)),
+		server.WithRoutingEngine(newTestRouter(t, cfg,
+			worker.Worker{ID: "w1", Models: []string{"llama3.1:8b", restrictedModel}, Status: worker.StatusReady},
+		)),
+		server.WithWorkerClient(workers),
+	)
+	require.NoError(t, err)
+
+	user := issueToken(t, client, "alice", auth.RoleUser)
+	operator := issueToken(t, client, "bob", auth.RoleOperator)
+	chat := func(model, token string) int {
+		workers.models = nil
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(
+			`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The open model has no workers, and users may not fall back to the
+	// restricted one
+	assert.Equal(t, http.StatusServiceUnavailable, chat("llama3.1:70b", user))
+	assert.Empty(t, workers.models)
+	assert.Equal(t, http.StatusOK, chat("llama3.1:70b", operator))
+	assert.Equal(t, []string{restrictedModel}, workers.models)
+
+	// Users are served the model they asked for rather than its restricted
+	// variant
+	assert.Equal(t, http.StatusOK, chat("llama3.1:8b", user))
+	assert.Equal(t, []string{"llama3.1:8b"}, workers.models)
+	assert.Equal(t, http.StatusOK, chat("llama3.1:8b", operator))
+	assert.Equal(t, []string{restrictedModel}, workers.models)
+}
@@ -0,0 +1,200 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/queue"
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+// newRedisClient connects to the Redis in TEST_REDIS_URI, or to an embedded
+// stand-in when it is not set
+func newRedisClient(t *testing.T) redis.UniversalClient {
+	var client *redis.Client
+	if uri := os.Getenv("TEST_REDIS_URI"); uri != "" {
+		opts, err := redis.ParseURL(uri)
+		require.NoError(t, err)
+		client = redis.NewClient(opts)
+	} else {
+		client = redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// redisQueueConfig keeps each test's keys apart on a shared Redis
+func redisQueueConfig(t *testing.T) *config.Config {
+	cfg := queueConfig()
+	cfg.Queue.Backend = "redis"
+	cfg.Queue.Redis.KeyPrefix = fmt.Sprintf("{test:%s:%d}", t.Name(), time.Now().UnixNano())
+	cfg.Queue.Redis.VisibilityTimeout = 90 * time.Millisecond
+	cfg.Queue.Redis.ScanLimit = 100
+	cfg.Queue.Fairness.Enabled = true
+	cfg.Queue.Fairness.DefaultWeight = 1
+	return cfg
+}
+
+func newRedisStore(t *testing.T, client redis.UniversalClient, cfg *config.Config) *queue.RedisStore {
+	store, err := queue.NewRedisStore(client, cfg)
+	require.NoError(t, err)
+	return store
+}
+
+func TestRedisStoreMatchesMemoryOrder(t *testing.T) {
+	ctx := context.Background()
+	cfg := redisQueueConfig(t)
+	store := newRedisStore(t, newRedisClient(t), cfg)
+	mem := queue.NewMemoryStore(queue.NewFairQueue(cfg.Queue.Levels, 0))
+
+	jobs := []*queue.Job{
+		{ID: "b1", Priority: 5, Tenant: "batch", Weight: 1},
+		{ID: "b2", Priority: 5, Tenant: "batch", Weight: 1},
+		{ID: "b3", Priority: 5, Tenant: "batch", Weight: 1},
+		{ID: "i1", Priority: 5, Tenant: "interactive", Weight: 4},
+		{ID: "i2", Priority: 5, Tenant: "interactive", Weight: 4},
+		{ID: "low", Priority: 1, Tenant: "batch", Weight: 1},
+		{ID: "high", Priority: 8, Tenant: "batch", Weight: 1},
+	}
+	for _, j := range jobs {
+		j.EnqueuedAt = time.Now()
+		require.NoError(t, store.Enqueue(ctx, j))
+		copied := *j
+		require.NoError(t, mem.Enqueue(ctx, &copied))
+	}
+
+	ids := func(s queue.Store) []string {
+		snapshot, err := s.Snapshot(ctx)
+		require.NoError(t, err)
+		out := make([]string, len(snapshot))
+		for i, j := range snapshot {
+			out[i] = j.ID
+		}
+		return out
+	}
+	assert.Equal(t, []string{"high", "i1", "i2", "b1", "b2", "b3", "low"}, ids(store))
+	assert.Equal(t, ids(mem), ids(store))
+
+	// Serving the first batch job charges the batch tenant in both stores
+	for _, s := range []queue.Store{store, mem} {
+		snapshot, err := s.Snapshot(ctx)
+		require.NoError(t, err)
+		taken, err := s.Take(ctx, snapshot[3])
+		require.NoError(t, err)
+		assert.True(t, taken)
+		removed, err := s.Remove(ctx, snapshot[0])
+		require.NoError(t, err)
+		assert.True(t, removed)
+	}
+	assert.Equal(t, ids(mem), ids(store))
+
+	n, err := store.Len(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	waiting, err := store.Waiting(ctx, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 4, waiting)
+}
+
+func TestRedisStoreRedeliversUnacknowledgedClaims(t *testing.T) {
+	ctx := context.Background()
+	cfg := redisQueueConfig(t)
+	store := newRedisStore(t, newRedisClient(t), cfg)
+
+	claimed := &queue.Job{ID: "claimed", Priority: 5, Weight: 1, EnqueuedAt: time.Now()}
+	acked := &queue.Job{ID: "acked", Priority: 5, Weight: 1, EnqueuedAt: time.Now()}
+	for _, j := range []*queue.Job{claimed, acked} {
+		require.NoError(t, store.Enqueue(ctx, j))
+		taken, err := store.Take(ctx, j)
+		require.NoError(t, err)
+		require.True(t, taken)
+	}
+	require.NoError(t, store.Ack(ctx, acked))
+
+	n, err := store.Len(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	time.Sleep(cfg.Queue.Redis.VisibilityTimeout + 10*time.Millisecond)
+	require.NoError(t, store.Maintain(ctx))
+
+	snapshot, err := store.Snapshot(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, "claimed", snapshot[0].ID)
+}
+
+func TestRedisStoreDropsJobsOfDepartedReplicas(t *testing.T) {
+	ctx := context.Background()
+	cfg := redisQueueConfig(t)
+	client := newRedisClient(t)
+	gone := newRedisStore(t, client, cfg)
+	live := newRedisStore(t, client, cfg)
+	require.NotEqual(t, gone.Replica(), live.Replica())
+
+	require.NoError(t, gone.Enqueue(ctx, &queue.Job{ID: "orphan", Priority: 5, Weight: 1, EnqueuedAt: time.Now()}))
+	require.NoError(t, live.Enqueue(ctx, &queue.Job{ID: "kept", Priority: 5, Weight: 1, EnqueuedAt: time.Now()}))
+
+	require.NoError(t, live.Maintain(ctx))
+	n, err := live.Len(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n, "jobs of a replica holding its lease are kept")
+
+	require.NoError(t, gone.Close(ctx))
+	time.Sleep(cfg.Queue.Redis.VisibilityTimeout / 2)
+	require.NoError(t, live.Maintain(ctx))
+
+	snapshot, err := live.Snapshot(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, "kept", snapshot[0].ID)
+}
+
+func TestRedisQueueSharedBetweenReplicas(t *testing.T) {
+	ctx := context.Background()
+	cfg := redisQueueConfig(t)
+	cfg.Queue.MaxSize = 1
+	client := newRedisClient(t)
+
+	replica := func() (*queue.Manager, *routing.Router) {
+		r := newTestRouter(t, cfg, worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady})
+		m, err := queue.New(queue.WithConfig(cfg), queue.WithRouter(r), queue.WithStore(newRedisStore(t, client, cfg)))
+		require.NoError(t, err)
+		m.Start()
+		t.Cleanup(func() { _ = m.Stop(context.Background()) })
+		return m, r
+	}
+	a, ra := replica()
+	b, _ := replica()
+
+	busy := &routing.Request{Model: "mistral"}
+	_, err := a.Submit(ctx, busy)
+	require.NoError(t, err)
+
+	done := submit(a, ctx, &routing.Request{Model: "mistral", Tenant: "research"})
+	waitForDepth(t, a, 1)
+
+	// The other replica sees the request queued on the first
+	stats := b.Stats()
+	assert.Equal(t, 1, stats.Depth)
+	require.Len(t, stats.Tenants, 1)
+	assert.Equal(t, "research", stats.Tenants[0].Tenant)
+
+	_, err = b.Submit(ctx, &routing.Request{Model: "mistral"})
+	assert.ErrorIs(t, err, queue.ErrQueueFull, "the size limit applies across replicas")
+
+	ra.ReportResult(busy, "w1", time.Millisecond, nil)
+	a.Notify()
+	require.NoError(t, <-done)
+	waitForDepth(t, b, 0)
+}
@@ -0,0 +1,48 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+)
+
+func TestRoutingPrefersWarmWorkers(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(),
+		worker.Worker{ID: "cold", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady, LoadedModels: []string{}},
+		worker.Worker{ID: "warm", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady, Load: 0.8, LoadedModels: []string{"llama3.1:8b"}},
+	)
+	req := &routing.Request{Model: "llama3.1:8b"}
+
+	for i := 0; i < 10; i++ {
+		w, err := r.RouteRequest(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, "warm", w.ID, "a busier warm worker beats an idle cold one")
+	}
+}
+
+func TestRoutingLoadsColdWhenWarmCapacityExhausted(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(),
+		worker.Worker{ID: "cold", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady, LoadedModels: []string{"mistral"}},
+		worker.Worker{ID: "warm", Models: []string{"llama3.1:8b"}, Status: worker.StatusBusy, Load: 1, LoadedModels: []string{"llama3.1:8b"}},
+	)
+
+	w, err := r.RouteRequest(context.Background(), &routing.Request{Model: "llama3.1:8b"})
+	require.NoError(t, err)
+	assert.Equal(t, "cold", w.ID)
+}
+
+func TestRoutingIgnoresResidencyWhenUnreported(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(),
+		worker.Worker{ID: "w1", Models: []string{"mistral"}, Status: worker.StatusReady, Load: 0.9},
+		worker.Worker{ID: "w2", Models: []string{"mistral"}, Status: worker.StatusReady},
+	)
+
+	w, err := r.RouteRequest(context.Background(), &routing.Request{Model: "mistral"})
+	require.NoError(t, err)
+	assert.Equal(t, "w2", w.ID, "load scoring applies when no worker reports loaded models")
+}
@@ -0,0 +1,220 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/ncolesummers/mindgateway/internal/auth"
+	gatewayauth "github.com/ncolesummers/mindgateway/internal/gateway/auth"
+	"github.com/ncolesummers/mindgateway/internal/gateway/server"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/logging"
+	authpb "github.com/ncolesummers/mindgateway/pkg/proto/auth"
+)
+
+// redisRevocationsConfig keeps each test's revocations apart on a shared
+// Redis
+func redisRevocationsConfig(t *testing.T) *config.Config {
+	cfg := authCacheConfig()
+	cfg.Auth.Revocations.Backend = "redis"
+	cfg.Auth.Revocations.KeyPrefix = fmt.Sprintf("{test:%s:%d}", t.Name(), time.Now().UnixNano())
+	cfg.Auth.Revocations.Channel = cfg.Auth.Revocations.KeyPrefix + ":events"
+	return cfg
+}
+
+// waitNextSecond waits until tokens are issued in a later second than now,
+// since tokens record when they were issued to the second
+func waitNextSecond() {
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+}
+
+// tokenValid reports whether the auth service accepts a credential
+func tokenValid(t *testing.T, client authpb.AuthServiceClient, token string) bool {
+	resp, err := client.ValidateToken(context.Background(), &authpb.ValidateTokenRequest{Token: token})
+	require.NoError(t, err)
+	return resp.Valid
+}
+
+func TestRevocationsSurviveRestarts(t *testing.T) {
+	redisClient := newRedisClient(t)
+	cfg := redisRevocationsConfig(t)
+	cfg.Auth.MaxTokenTTL = 2 * cfg.Auth.TokenTTL
+	db := newTestDB(t)
+	client, _ := newAuthClient(t, cfg, auth.WithRedis(redisClient), auth.WithDatabase(db))
+	ctx := context.Background()
+
+	token := issueToken(t, client, "alice", auth.RoleUser)
+	kept := issueToken(t, client, "bob", auth.RoleUser)
+	researcher, err := client.CreateToken(ctx, &authpb.CreateTokenRequest{
+		UserId: "carol", Claims: map[string]string{auth.TenantClaim: "research"},
+	})
+	require.NoError(t, err)
+	resp, err := client.RevokeToken(ctx, &authpb.RevokeTokenRequest{Token: token})
+	require.NoError(t, err)
+	require.True(t, resp.Success, resp.Error)
+
+	// Revoked tokens are kept until they would have expired
+	keys, err := redisClient.Keys(ctx, cfg.Auth.Revocations.KeyPrefix+":token:*").Result()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	ttl, err := redisClient.TTL(ctx, keys[0]).Result()
+	require.NoError(t, err)
+	assert.Greater(t, ttl, time.Duration(0))
+	assert.LessOrEqual(t, ttl, cfg.Auth.TokenTTL)
+
+	// Revoked API keys that never expire are kept for the maximum token TTL
+	key, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{OwnerId: "dave", Name: "key"})
+	require.NoError(t, err)
+	revoked, err := client.RevokeAPIKey(ctx, &authpb.RevokeAPIKeyRequest{Id: key.ApiKey.Id})
+	require.NoError(t, err)
+	require.True(t, revoked.Success, revoked.Error)
+	ttl, err = redisClient.TTL(ctx, cfg.Auth.Revocations.KeyPrefix+":key:"+key.ApiKey.Id).Result()
+	require.NoError(t, err)
+	assert.Greater(t, ttl, cfg.Auth.TokenTTL)
+	assert.LessOrEqual(t, ttl, cfg.Auth.MaxTokenTTL)
+
+	// Revocations of every credential of a tenant are kept for as long as
+	// the tokens they revoke may be accepted
+	_, err = client.RevokeAll(ctx, &authpb.RevokeAllRequest{Tenant: "research"})
+	require.NoError(t, err)
+	keys, err = redisClient.Keys(ctx, cfg.Auth.Revocations.KeyPrefix+":tenant:*").Result()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	ttl, err = redisClient.TTL(ctx, keys[0]).Result()
+	require.NoError(t, err)
+	assert.Greater(t, ttl, cfg.Auth.TokenTTL)
+	assert.LessOrEqual(t, ttl, cfg.Auth.MaxTokenTTL+cfg.Auth.OIDC.ClockSkew)
+
+	// Another instance of the service sharing the Redis knows of them
+	restarted, _ := newAuthClient(t, cfg, auth.WithRedis(redisClient), auth.WithDatabase(db))
+	assert.False(t, tokenValid(t, restarted, token))
+	assert.False(t, tokenValid(t, restarted, researcher.Token))
+	assert.True(t, tokenValid(t, restarted, kept))
+
+	// Without Redis, the service cannot tell whether tokens were revoked
+	broken := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { broken.Close() })
+	unavailable, _ := newAuthClient(t, cfg, auth.WithRedis(broken))
+	_, err = unavailable.ValidateToken(ctx, &authpb.ValidateTokenRequest{Token: kept})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestRevokeAll(t *testing.T) {
+	for _, backend := range []string{"memory", "redis"} {
+		t.Run(backend, func(t *testing.T) {
+			cfg := redisRevocationsConfig(t)
+			opts := []auth.Option{auth.WithDatabase(newTestDB(t))}
+			if backend == "redis" {
+				opts = append(opts, auth.WithRedis(newRedisClient(t)))
+			} else {
+				cfg.Auth.Revocations.Backend = backend
+			}
+			client, _ := newAuthClient(t, cfg, opts...)
+			ctx := context.Background()
+
+			token := func(user, tenant string) string {
+				resp, err := client.CreateToken(ctx, &authpb.CreateTokenRequest{
+					UserId: user, Roles: []string{auth.RoleUser}, Claims: map[string]string{auth.TenantClaim: tenant},
+				})
+				require.NoError(t, err)
+				return resp.Token
+			}
+			key := func(owner, tenant string) string {
+				resp, err := client.CreateAPIKey(ctx, &authpb.CreateAPIKeyRequest{OwnerId: owner, Name: "key", Tenant: tenant})
+				require.NoError(t, err)
+				return resp.Key
+			}
+			alice, bob := testOwner(t)+"-alice", testOwner(t)+"-bob"
+			research := testOwner(t) + "-research"
+			aliceToken, aliceKey := token(alice, research), key(alice, "")
+			bobToken, bobKey := token(bob, research), key(bob, research)
+			carolToken := token("carol", "platform")
+
+			resp, err := client.RevokeAll(ctx, &authpb.RevokeAllRequest{UserId: alice})
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), resp.RevokedKeys)
+			assert.False(t, tokenValid(t, client, aliceToken))
+			assert.False(t, tokenValid(t, client, aliceKey))
+			assert.True(t, tokenValid(t, client, bobToken))
+			assert.True(t, tokenValid(t, client, bobKey))
+
+			// Credentials issued afterwards are valid
+			waitNextSecond()
+			assert.True(t, tokenValid(t, client, token(alice, research)))
+
+			resp, err = client.RevokeAll(ctx, &authpb.RevokeAllRequest{Tenant: research})
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), resp.RevokedKeys)
+			assert.False(t, tokenValid(t, client, bobToken))
+			assert.False(t, tokenValid(t, client, bobKey))
+			assert.True(t, tokenValid(t, client, carolToken))
+
+			// Only admins may revoke every credential of a user or tenant
+			as := func(token string) context.Context {
+				return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+			}
+			operator := issueToken(t, client, "ops", auth.RoleOperator)
+			for token, code := range map[string]codes.Code{
+				"forged":   codes.Unauthenticated,
+				carolToken: codes.PermissionDenied,
+				operator:   codes.PermissionDenied,
+			} {
+				_, err := client.RevokeAll(as(token), &authpb.RevokeAllRequest{Tenant: "platform"})
+				assert.Equal(t, code, status.Code(err))
+			}
+			assert.True(t, tokenValid(t, client, carolToken))
+
+			for _, req := range []*authpb.RevokeAllRequest{{}, {UserId: alice, Tenant: research}} {
+				_, err := client.RevokeAll(ctx, req)
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			}
+		})
+	}
+}
+
+func TestGatewayRevokesAll(t *testing.T) {
+	cfg := rbacConfig(newMockIssuer(t).URL)
+	conn, _ := serveAuth(t, cfg)
+	client := authpb.NewAuthServiceClient(conn)
+
+	srv, err := server.New(
+		server.WithConfig(cfg),
+		server.WithLogger(logging.NewLogger("error")),
+		server.WithAuthClient(gatewayauth.NewCache(gatewayauth.NewClient(conn), authCacheConfig())),
+		server.WithRoutingEngine(newTestRouter(t, cfg)),
+	)
+	require.NoError(t, err)
+
+	admin := issueToken(t, client, "root", auth.RoleAdmin)
+	operator := issueToken(t, client, "ops", auth.RoleOperator)
+	do := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/splits", operator, ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/admin/revocations", operator, `{"user_id":"root"}`),
+		"only admins may revoke credentials")
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/admin/revocations", admin, `{}`))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/admin/revocations", admin, `{"user_id":"ops","tenant":"research"}`))
+
+	// The operator's token was cached, and is rejected at once
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/revocations", admin, `{"user_id":"ops"}`))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/splits", operator, ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/splits", admin, ""))
+}
@@ -0,0 +1,98 @@
+package integration
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/shadow"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	records []shadow.Record
+}
+
+func (s *memorySink) Write(record shadow.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+func shadowConfig() *config.Config {
+	cfg := breakerConfig()
+	cfg.Routing.Shadow.Enabled = true
+	cfg.Routing.Shadow.MaxInFlight = 1
+	cfg.Routing.Shadow.Timeout = time.Second
+	cfg.Routing.Shadow.Rules = []config.ShadowRule{
+		{Model: "llama3.1:8b", ShadowModel: "qwen2.5:7b", SampleRate: 1},
+		{Model: "mistral", ShadowModel: "qwen2.5:7b", SampleRate: 0},
+	}
+	return cfg
+}
+
+func TestShadowSampling(t *testing.T) {
+	m, err := shadow.New(shadow.WithConfig(shadowConfig()), shadow.WithSink(&memorySink{}))
+	require.NoError(t, err)
+
+	target, ok := m.Sample("llama3.1:8b")
+	assert.True(t, ok)
+	assert.Equal(t, "qwen2.5:7b", target.Model)
+
+	_, ok = m.Sample("mistral")
+	assert.False(t, ok)
+	_, ok = m.Sample("phi3")
+	assert.False(t, ok)
+
+	cfg := shadowConfig()
+	cfg.Routing.Shadow.Rules[0].SampleRate = 1.5
+	_, err = shadow.New(shadow.WithConfig(cfg), shadow.WithSink(&memorySink{}))
+	assert.Error(t, err)
+}
+
+func TestShadowDropsWhenBusy(t *testing.T) {
+	sink := &memorySink{}
+	m, err := shadow.New(shadow.WithConfig(shadowConfig()), shadow.WithSink(sink))
+	require.NoError(t, err)
+
+	release := make(chan struct{})
+	started := m.Go("llama3.1:8b", "qwen2.5:7b", func(ctx context.Context) shadow.Record {
+		<-release
+		return shadow.Record{RequestID: "first"}
+	})
+	require.True(t, started)
+
+	dropped := m.Go("llama3.1:8b", "qwen2.5:7b", func(ctx context.Context) shadow.Record {
+		return shadow.Record{RequestID: "second"}
+	})
+	assert.False(t, dropped, "shadow work is dropped rather than queued")
+
+	close(release)
+	require.NoError(t, m.Close(context.Background()))
+	require.Len(t, sink.records, 1)
+	assert.Equal(t, "first", sink.records[0].RequestID)
+}
+
+func TestShadowRequestsAvoidBusyWorkers(t *testing.T) {
+	r := newTestRouter(t, breakerConfig(),
+		worker.Worker{ID: "busy", Models: []string{"qwen2.5:7b"}, Status: worker.StatusBusy, Load: 0.2},
+		worker.Worker{ID: "full", Models: []string{"qwen2.5:7b"}, Status: worker.StatusReady, Load: 1},
+	)
+
+	_, err := r.RouteRequest(context.Background(), &routing.Request{Model: "qwen2.5:7b", Shadow: true})
+	assert.Error(t, err)
+
+	w, err := r.RouteRequest(context.Background(), &routing.Request{Model: "qwen2.5:7b"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, w.ID)
+}
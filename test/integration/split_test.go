@@ -0,0 +1,68 @@
+package integration
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+)
+
+func splitConfig() *config.Config {
+	cfg := breakerConfig()
+	cfg.Routing.Splits = []config.SplitRule{
+		{
+			Model: "llama3.1:8b",
+			Variants: []config.SplitVariant{
+				{Model: "llama3.1:8b", Weight: 95},
+				{Model: "llama3.1:8b-q5", Weight: 5},
+			},
+		},
+	}
+	return cfg
+}
+
+func TestTrafficSplitIsStickyPerUser(t *testing.T) {
+	r := newTestRouter(t, splitConfig())
+
+	for i := 0; i < 50; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		first := r.ResolveModel("llama3.1:8b", user)
+		for j := 0; j < 5; j++ {
+			assert.Equal(t, first, r.ResolveModel("llama3.1:8b", user))
+		}
+	}
+}
+
+func TestTrafficSplitFollowsWeights(t *testing.T) {
+	r := newTestRouter(t, splitConfig())
+
+	canary := 0
+	for i := 0; i < 10000; i++ {
+		if r.ResolveModel("llama3.1:8b", fmt.Sprintf("user-%d", i)) == "llama3.1:8b-q5" {
+			canary++
+		}
+	}
+	assert.InDelta(t, 500, canary, 150)
+
+	assert.Equal(t, "mistral", r.ResolveModel("mistral", "user-1"), "models without a rule resolve to themselves")
+}
+
+func TestTrafficSplitRuntimeUpdate(t *testing.T) {
+	r := newTestRouter(t, splitConfig())
+
+	require.NoError(t, r.SetSplit("llama3.1:8b", []routing.Variant{
+		{Model: "llama3.1:8b", Weight: 0},
+		{Model: "llama3.1:8b-q5", Weight: 100},
+	}))
+	assert.Equal(t, "llama3.1:8b-q5", r.ResolveModel("llama3.1:8b", "user-1"))
+
+	assert.Error(t, r.SetSplit("llama3.1:8b", []routing.Variant{{Model: "llama3.1:8b", Weight: 0}}))
+	assert.Error(t, r.SetSplit("llama3.1:8b", []routing.Variant{{Model: "a", Weight: 1}, {Model: "a", Weight: 1}}))
+
+	require.NoError(t, r.SetSplit("llama3.1:8b", nil))
+	assert.Empty(t, r.SplitRules())
+}
@@ -0,0 +1,113 @@
+package integration
+
+import (
+	"context"
+	stderrors "errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncolesummers/mindgateway/internal/gateway/routing"
+	"github.com/ncolesummers/mindgateway/internal/gateway/worker"
+	"github.com/ncolesummers/mindgateway/internal/shared/config"
+	"github.com/ncolesummers/mindgateway/internal/shared/errors"
+)
+
+func tokenConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Worker.MaxConcurrency = 8
+	cfg.Worker.TokenBudget = 10000
+	cfg.Worker.DefaultMaxTokens = 500
+	cfg.Routing.ContextWindows = []config.ContextWindow{
+		{Model: "llama3.1:8b", Tokens: 8000},
+		{Model: "mistral", Tokens: 4000},
+	}
+	cfg.Routing.Fallbacks = []config.FallbackChain{{Model: "llama3.1:8b", Chain: []string{"mistral"}}}
+	return cfg
+}
+
+func TestTokenBudgetLimitsConcurrency(t *testing.T) {
+	r := newTestRouter(t, tokenConfig(),
+		worker.Worker{ID: "w1", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+	)
+	ctx := context.Background()
+
+	// Small requests share the worker up to its budget
+	small := &routing.Request{Route: routing.RouteChat, Model: "llama3.1:8b", PromptTokens: 1500, MaxTokens: 900}
+	for i := 0; i < 4; i++ {
+		_, err := r.RouteRequest(ctx, small)
+		require.NoError(t, err)
+	}
+	_, err := r.RouteRequest(ctx, small)
+	assert.True(t, stderrors.Is(err, errors.ErrWorkersAtCapacity), "the fifth request exceeds the budget")
+
+	// A large request waits for the worker to drain
+	large := &routing.Request{Route: routing.RouteCompletions, Model: "llama3.1:8b", PromptTokens: 7600}
+	for i := 0; i < 4; i++ {
+		r.ReportResult(small, "w1", 0, nil)
+	}
+	exp, err := r.Explain(ctx, large)
+	require.NoError(t, err)
+	assert.Equal(t, 8100, exp.Tokens, "requests without max_tokens are charged the default")
+	assert.Zero(t, exp.Workers[0].InFlightTokens)
+
+	_, err = r.RouteRequest(ctx, large)
+	require.NoError(t, err)
+	_, err = r.RouteRequest(ctx, small)
+	assert.True(t, stderrors.Is(err, errors.ErrWorkersAtCapacity))
+
+	r.ReportResult(large, "w1", 0, nil)
+	_, err = r.RouteRequest(ctx, small)
+	assert.NoError(t, err)
+}
+
+func TestWorkerTokenBudgetOverride(t *testing.T) {
+	r := newTestRouter(t, tokenConfig(),
+		worker.Worker{ID: "big", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady,
+			Metadata: map[string]string{routing.MetadataTokenBudget: "40000"}},
+	)
+
+	req := &routing.Request{Route: routing.RouteChat, Model: "llama3.1:8b", PromptTokens: 4000, MaxTokens: 1000}
+	for i := 0; i < 8; i++ {
+		_, err := r.RouteRequest(context.Background(), req)
+		require.NoError(t, err, "request %d fits the worker's own budget", i)
+	}
+
+	exp, err := r.Explain(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 40000, exp.Workers[0].InFlightTokens)
+	assert.Equal(t, 40000, exp.Workers[0].TokenBudget)
+}
+
+func TestContextWindowRejectsOversizedRequests(t *testing.T) {
+	r := newTestRouter(t, tokenConfig(),
+		worker.Worker{ID: "w1", Models: []string{"llama3.1:8b"}, Status: worker.StatusReady},
+		worker.Worker{ID: "w2", Models: []string{"mistral"}, Status: worker.StatusReady},
+	)
+
+	req := &routing.Request{Route: routing.RouteChat, Model: "llama3.1:8b", PromptTokens: 7000, MaxTokens: 2000}
+	err := r.CheckContext(req)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, errors.From(err).Code)
+	assert.Contains(t, errors.From(err).Message, "8000 tokens")
+
+	// Models without a configured window accept any request
+	assert.NoError(t, r.CheckContext(&routing.Request{Model: "qwen2.5:7b", PromptTokens: 1 << 20}))
+
+	// A fallback with a smaller window is skipped
+	req = &routing.Request{Route: routing.RouteChat, Model: "llama3.1:8b", PromptTokens: 5000, MaxTokens: 1000, Trace: &routing.Trace{}}
+	require.NoError(t, r.CheckContext(req))
+	w, err := r.RouteRequest(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "w1", w.ID)
+	r.ReportResult(req, w.ID, 0, nil)
+
+	r2 := newTestRouter(t, tokenConfig(),
+		worker.Worker{ID: "w2", Models: []string{"mistral"}, Status: worker.StatusReady},
+	)
+	_, err = r2.RouteRequest(context.Background(), req)
+	assert.True(t, stderrors.Is(err, errors.ErrNoWorkersAvailable))
+	assert.Equal(t, 1, req.Trace.Rejected[routing.RejectContext])
+}